@@ -1,17 +1,22 @@
 package main
 
 import (
-	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"syscall"
 	"time"
 
 	"vibepn/config"
 	"vibepn/control"
 	"vibepn/crypto"
+	"vibepn/dns"
 	"vibepn/forward"
 	"vibepn/iface"
 	"vibepn/log"
@@ -19,6 +24,8 @@ import (
 	"vibepn/netgraph"
 	"vibepn/peer"
 	"vibepn/quic"
+
+	gquic "github.com/quic-go/quic-go"
 )
 
 func main() {
@@ -32,8 +39,23 @@ func main() {
 	if err != nil {
 		logger.Fatalf("Failed to load config: %v", err)
 	}
+	if err := cfg.MergeJoinedPeers(); err != nil {
+		logger.Warnf("Failed to load peers admitted with invites: %v", err)
+	}
 
 	quic.SetOwnFingerprint(cfg.Identity.Fingerprint)
+	if cfg.Identity.KnownPeers != "" {
+		crypto.SetTOFUPath(cfg.Identity.KnownPeers)
+	}
+	if cfg.Identity.PassphraseFile != "" {
+		crypto.SetKeyPassphraseFile(cfg.Identity.PassphraseFile)
+	}
+	if cfg.Identity.CA != "" {
+		if err := crypto.SetTrustedCA(cfg.Identity.CA); err != nil {
+			logger.Fatalf("Failed to load mesh CA: %v", err)
+		}
+		logger.Infof("CA mode: peers must present certificates issued by %s", cfg.Identity.CA)
+	}
 
 	tlsConf, err := crypto.LoadTLS(
 		cfg.Identity.Cert,
@@ -46,33 +68,68 @@ func main() {
 
 	tlsConf.ClientAuth = tls.RequireAnyClientCert
 
+	if cfg.Revocation != nil {
+		// Revocations this node signs itself are always trusted locally
+		signers := append([]string{crypto.LocalFingerprint()}, cfg.Revocation.Signers...)
+		if err := crypto.ConfigureRevocation(cfg.Revocation.File, signers); err != nil {
+			logger.Fatalf("Failed to load revocation list: %v", err)
+		}
+		if rl := crypto.CurrentRevocationList(); rl != nil {
+			logger.Infof("Revocation list v%d in force (%d keys, %d serials)", rl.Version, len(rl.Fingerprints), len(rl.Serials))
+		}
+	}
+
+	secrets, err := config.LoadNetworkSecrets(cfg.Networks)
+	if err != nil {
+		logger.Fatalf("Failed to load network secrets: %v", err)
+	}
+	crypto.SetNetworkSecrets(secrets)
+	for name, netCfg := range cfg.Networks {
+		if err := netCfg.CheckRoutes(); err != nil {
+			logger.Fatalf("Network %s: %v", name, err)
+		}
+		if err := netCfg.CheckLease(); err != nil {
+			logger.Fatalf("Network %s: %v", name, err)
+		}
+		if err := netCfg.CheckMode(); err != nil {
+			logger.Fatalf("Network %s: %v", name, err)
+		}
+		if err := netCfg.CheckMulticast(); err != nil {
+			logger.Fatalf("Network %s: %v", name, err)
+		}
+	}
+
 	routeTable := netgraph.NewRouteTable()
-	tracker := peer.NewLivenessTracker(30 * time.Second)
-	tracker.StartWatcher(routeTable)
+	registry := peer.NewRegistry(cfg.Identity, cfg.Peers, cfg.Networks)
+	registry.StartWatcher(peer.DefaultLivenessTimeout)
+	registry.WatchLocalAddresses()
+	if cfg.Relay != nil && cfg.Relay.Enabled {
+		registry.EnableRelay(cfg.Relay.MaxBytesPerSec)
+		logger.Infof("Relaying for peers enabled (cap %d bytes/s, 0 = unlimited)", cfg.Relay.MaxBytesPerSec)
+	}
 
-	registry := peer.NewRegistry(cfg.Identity, cfg.Networks)
+	if cfg.Discovery != nil && cfg.Discovery.Enabled {
+		if err := registry.EnableGossip(*cfg.Discovery); err != nil {
+			logger.Fatalf("Failed to enable peer discovery: %v", err)
+		}
+		logger.Infof("Peer discovery enabled (allow %v)", cfg.Discovery.Allow)
+	}
 
+	registry.SetOnConnect(func(peerID string, conn gquic.Connection) {
+		control.PublishEvent("peer_connected", map[string]interface{}{
+			"peer":    peerID,
+			"address": conn.RemoteAddr().String(),
+		})
+	})
 	registry.SetOnDisconnect(func(peerID string) {
 		routeTable.RemoveByPeer(peerID)
+		control.PublishEvent("peer_disconnected", map[string]interface{}{"peer": peerID})
 	})
 
 	// Register control handlers
-	control.Register(routeTable, tracker, func(peerID, network string, route netgraph.Route) {
-		conn := registry.Get(peerID)
-		if conn != nil {
-			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-			stream, err := conn.OpenStreamSync(ctx)
-			cancel()
-			if err != nil {
-				logger.Warnf("Failed to open stream to send route-announce: %v", err)
-				return
-			}
-			defer stream.Close()
-
-			err = control.SendRouteAnnounce(stream, network, []string{route.Prefix})
-			if err != nil {
-				logger.Warnf("Failed to send route-announce: %v", err)
-			}
+	control.Register(routeTable, registry, func(peerID, network string, route netgraph.Route) {
+		if err := registry.AnnounceRoute(peerID, network, []string{route.Prefix}); err != nil {
+			logger.Warnf("Failed to send route-announce: %v", err)
 		}
 	})
 	control.RegisterNetConfig(cfg.Networks)
@@ -81,8 +138,30 @@ func main() {
 	control.RegisterGoodbyeCallback(func() {
 		registry.DisconnectAll()
 	})
+	control.RegisterPeerToggle(func(peerID string, enabled bool) error {
+		registry.SetEnabled(peerID, enabled)
+		return nil
+	})
+	control.RegisterRevocationReload(registry.ReloadRevocations)
+	control.RegisterKeyRotation(func(certPath, keyPath string, grace time.Duration) (string, error) {
+		fp, err := registry.RotateIdentity(certPath, keyPath, grace)
+		if err == nil {
+			quic.SetOwnFingerprint(fp)
+		}
+		return fp, err
+	})
 
-	ifaceMgr, err := iface.Init(cfg.Networks, cfg.Identity.Fingerprint)
+	addrStatePath := cfg.AddressState
+	if addrStatePath == "" {
+		addrStatePath = config.DefaultAddressStatePath
+	}
+	addrState, err := config.LoadAddressState(addrStatePath)
+	if err != nil {
+		logger.Warnf("Ignoring address state: %v", err)
+		addrState = config.AddressState{}
+	}
+
+	ifaceMgr, err := iface.Init(cfg.Networks, cfg.Identity.Fingerprint, addrState)
 	if err != nil {
 		logger.Fatalf("Interface setup failed: %v", err)
 	}
@@ -90,22 +169,173 @@ func main() {
 		logger.Fatalf("No network interfaces were initialized from config")
 	}
 
+	// 🚪 Exit nodes, offered to peers and used for our own default traffic
+	var masqueraded []string
+	if cfg.ExitNode != nil && cfg.ExitNode.Advertise {
+		registry.OfferExit(*cfg.ExitNode)
+		for _, netName := range registry.ExitNetworks() {
+			dev := ifaceMgr.Devices[netName]
+			if dev == nil {
+				continue
+			}
+			if err := iface.EnableMasquerade(cfg.Networks[netName].Prefix, dev.Name(), cfg.ExitNode.Interface); err != nil {
+				logger.Errorf("Failed to set up exit on %s: %v", netName, err)
+				continue
+			}
+			masqueraded = append(masqueraded, netName)
+		}
+		logger.Infof("Offering exit to %v on %v", cfg.ExitNode.Allow, masqueraded)
+	}
+	registry.SetOnExit(func(network string, enable bool) error {
+		dev := ifaceMgr.Devices[network]
+		if dev == nil {
+			return fmt.Errorf("no interface for network %s", network)
+		}
+		if enable {
+			return iface.EnableExitRouting(dev.Name())
+		}
+		return iface.DisableExitRouting(dev.Name())
+	})
+	control.RegisterExitNodes(registry)
+
+	// 🏢 Subnets we route for peers, and those peers route for us
+	var subnetRouted []string
+	for netName, netCfg := range cfg.Networks {
+		dev := ifaceMgr.Devices[netName]
+		if len(netCfg.Routes) == 0 || dev == nil {
+			continue
+		}
+		if err := iface.EnableSubnetRouter(netCfg.Prefix, dev.Name(), netCfg.Routes, netCfg.SNAT); err != nil {
+			logger.Errorf("Failed to route subnets on %s: %v", netName, err)
+			continue
+		}
+		subnetRouted = append(subnetRouted, netName)
+	}
+	registry.SetOnSubnetRoute(func(network, prefix string, add bool) error {
+		dev := ifaceMgr.Devices[network]
+		if dev == nil {
+			return fmt.Errorf("no interface for network %s", network)
+		}
+		if add {
+			return iface.AddRoute(prefix, dev.Name())
+		}
+		return iface.DelRoute(prefix, dev.Name())
+	})
+	if cfg.ExitNode != nil && cfg.ExitNode.Use != "" {
+		if err := registry.UseExit(cfg.ExitNode.Use, cfg.ExitNode.Network); err != nil {
+			logger.Errorf("Ignoring configured exit node: %v", err)
+		}
+	}
+
+	peer.SetLocalNode(crypto.NodeName(), cfg.Identity.Fingerprint, ifaceMgr.Addresses)
+
+	// 📇 Overlay DNS for <peer>.<network>.vibepn on every network address
+	var resolverLinks []string
+	var serveDNS func(netName, addr string)
+	dnsConns := make(map[string]net.PacketConn) // network → resolver socket
+	if cfg.DNS != nil && cfg.DNS.Enabled {
+		var own []net.IP
+		for _, addr := range ifaceMgr.Addresses {
+			own = append(own, net.ParseIP(addr))
+		}
+		upstream := cfg.DNS.Upstream
+		if len(upstream) == 0 {
+			upstream = dns.SystemUpstreams(own)
+		}
+		server := dns.NewServer(registry, upstream)
+		port := cfg.DNS.ListenPort()
+		// Called at startup and then only from the readdress hook, which
+		// the registry serializes; "" stops the network's resolver
+		serveDNS = func(netName, addr string) {
+			if old := dnsConns[netName]; old != nil {
+				old.Close()
+				delete(dnsConns, netName)
+			}
+			if addr == "" {
+				return
+			}
+			listen := net.JoinHostPort(addr, strconv.Itoa(port))
+			conn, err := net.ListenPacket("udp", listen)
+			if err != nil {
+				logger.Errorf("DNS resolver on %s failed: %v", listen, err)
+				return
+			}
+			dnsConns[netName] = conn
+			go func() {
+				if err := server.Serve(conn); err != nil && !errors.Is(err, net.ErrClosed) {
+					logger.Errorf("DNS resolver on %s failed: %v", listen, err)
+				}
+			}()
+			if cfg.DNS.Configure == "" {
+				return
+			}
+			dev := ifaceMgr.Devices[netName].Name()
+			if err := iface.ConfigureResolver(cfg.DNS.Configure, dev, net.ParseIP(addr), port, netName+"."+dns.Domain); err != nil {
+				logger.Errorf("Failed to configure host resolver for %s: %v", netName, err)
+				return
+			}
+			if !slices.Contains(resolverLinks, dev) {
+				resolverLinks = append(resolverLinks, dev)
+			}
+		}
+		for netName, addr := range ifaceMgr.Addresses {
+			serveDNS(netName, addr)
+		}
+		logger.Infof("Overlay DNS enabled (upstream %v)", upstream)
+	}
+
+	// 🔢 Move off auto addresses that turn out to be taken, and take or
+	// drop leased ones
+	registry.SetAddressing(addrState, addrStatePath, func(network, addr string) error {
+		if err := ifaceMgr.Readdress(network, addr); err != nil {
+			return err
+		}
+		if serveDNS != nil {
+			serveDNS(network, addr)
+		}
+		return nil
+	})
+	if err := registry.ServeLeases(); err != nil {
+		logger.Fatalf("Failed to start address leasing: %v", err)
+	}
+	control.RegisterLeaseServer(registry)
+	control.RegisterProber(peer.NewProber(registry))
+
 	dispatcher := forward.NewDispatcher(routeTable, ifaceMgr.Devices, registry)
 	for netName, d := range ifaceMgr.Devices {
 		dispatcher.Start(netName, d)
 	}
 
-	inbound := forward.NewInbound(ifaceMgr.Devices)
+	inbound := forward.NewInbound(ifaceMgr.Devices, registry, routeTable)
 
+	metrics.RegisterPeerSource(registry.ListPeers)
 	go metrics.Serve(":9000")
 	go control.StartUDS("/var/run/vibepn.sock")
 
+	if cfg.Management != nil && cfg.Management.Listen != "" {
+		token, err := cfg.Management.BearerToken()
+		if err != nil {
+			logger.Fatalf("Invalid management config: %v", err)
+		}
+		go func() {
+			if err := control.StartHTTP(cfg.Management.Listen, token); err != nil {
+				logger.Errorf("Management API failed: %v", err)
+			}
+		}()
+	}
+
 	ln, err := quic.Listen(":51820", tlsConf)
 	if err != nil {
 		logger.Fatalf("Failed to start QUIC listener: %v", err)
 	}
 
-	go quic.AcceptLoop(*ln, tracker, routeTable, registry, inbound)
+	go quic.AcceptLoop(*ln, routeTable, registry, inbound)
+
+	relayLn, err := quic.ListenRelay(tlsConf, registry)
+	if err != nil {
+		logger.Fatalf("Failed to start relay listener: %v", err)
+	}
+	go quic.AcceptLoop(*relayLn, routeTable, registry, inbound)
 
 	peer.ConnectToPeers(cfg.Peers, cfg.Identity, routeTable, cfg.Networks, registry)
 
@@ -117,6 +347,17 @@ func main() {
 
 		logger.Infof("Shutting down...")
 		registry.DisconnectAll()
+		registry.UseExit("", "")
+		for _, dev := range resolverLinks {
+			iface.RevertResolver(cfg.DNS.Configure, dev)
+		}
+		for _, netName := range subnetRouted {
+			netCfg := cfg.Networks[netName]
+			iface.DisableSubnetRouter(netCfg.Prefix, ifaceMgr.Devices[netName].Name(), netCfg.Routes, netCfg.SNAT)
+		}
+		for _, netName := range masqueraded {
+			iface.DisableMasquerade(cfg.Networks[netName].Prefix, ifaceMgr.Devices[netName].Name(), cfg.ExitNode.Interface)
+		}
 		os.Exit(0)
 	}()
 
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"vibepn/config"
+	vpncrypto "vibepn/crypto"
+)
+
+const defaultCADir = "/etc/vibepn/ca"
+
+func runCA(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: %s ca <init|sign> [options]", os.Args[0])
+	}
+	switch args[0] {
+	case "init":
+		return runCAInit(args[1:])
+	case "sign":
+		return runCASign(args[1:])
+	default:
+		return fmt.Errorf("unknown ca command %q (want init or sign)", args[0])
+	}
+}
+
+func runCAInit(args []string) error {
+	fs := flag.NewFlagSet("ca init", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	dir := fs.String("dir", defaultCADir, "Directory to write ca.crt and ca.key to")
+	name := fs.String("name", "VibePN mesh CA", "CA certificate common name")
+	days := fs.Int("days", 3650, "CA certificate validity in days")
+	force := fs.Bool("force", false, "Overwrite an existing CA")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ca init [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if *days < 1 {
+		return errors.New("--days must be at least 1")
+	}
+
+	certPath, keyPath := filepath.Join(*dir, "ca.crt"), filepath.Join(*dir, "ca.key")
+	if !*force && (pathExists(certPath) || pathExists(keyPath)) {
+		return fmt.Errorf("CA already exists in %s (use --force to overwrite)", *dir)
+	}
+
+	certDER, key, err := vpncrypto.NewCA(*name, time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("marshal CA key: %w", err)
+	}
+
+	if err := writeStrictFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	if err := writeStrictFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created mesh CA %s\nCertificate: %s (copy to every node)\nKey:         %s (keep offline)\n", *name, certPath, keyPath)
+	return nil
+}
+
+func runCASign(args []string) error {
+	fs := flag.NewFlagSet("ca sign", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	dir := fs.String("dir", defaultCADir, "Directory holding ca.crt and ca.key")
+	name := fs.String("name", "", "Node name (certificate common name)")
+	networks := fs.String("networks", "", "Comma-separated networks the node may join")
+	certPath := fs.String("cert", defaultCertPath, "Path to node certificate to write")
+	keyPath := fs.String("key", defaultKeyPath, "Path to node private key (reused if it exists)")
+	days := fs.Int("days", 365, "Node certificate validity in days")
+	configPath := fs.String("config", "", "Optional node config to point at the new certificate and CA")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ca sign [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if *name == "" {
+		return errors.New("--name is required")
+	}
+	nodeNetworks := splitCSV(*networks)
+	if len(nodeNetworks) == 0 {
+		return errors.New("--networks is required")
+	}
+	if *days < 1 {
+		return errors.New("--days must be at least 1")
+	}
+
+	caCertPath := filepath.Join(*dir, "ca.crt")
+	caCert, caKey, err := vpncrypto.LoadCA(caCertPath, filepath.Join(*dir, "ca.key"))
+	if err != nil {
+		return err
+	}
+
+	var cfg *config.Config
+	if *configPath != "" {
+		if cfg, err = config.Load(*configPath); err != nil {
+			return fmt.Errorf("load config %q: %w", *configPath, err)
+		}
+		if cfg.Identity.PassphraseFile != "" {
+			vpncrypto.SetKeyPassphraseFile(cfg.Identity.PassphraseFile)
+		}
+	}
+
+	key, reused, err := loadOrGenerateKey(*keyPath)
+	if err != nil {
+		return err
+	}
+
+	certDER, err := vpncrypto.IssueNodeCert(caCert, caKey, key.Public(), *name, nodeNetworks, time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	if err := writeStrictFile(*certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600); err != nil {
+		return err
+	}
+	fp := vpncrypto.Fingerprint(certDER)
+
+	if cfg != nil {
+		cfg.Identity.Cert = *certPath
+		cfg.Identity.Key = *keyPath
+		cfg.Identity.Fingerprint = fp
+		cfg.Identity.CA = caCertPath
+		if err := config.Save(*configPath, cfg); err != nil {
+			return err
+		}
+	}
+
+	if reused {
+		fmt.Printf("Reused existing key %s\n", *keyPath)
+	}
+	fmt.Printf("Issued %s for %s (networks: %s)\nFingerprint: %s\n", *certPath, *name, strings.Join(nodeNetworks, ","), fp)
+	return nil
+}
+
+// loadOrGenerateKey reads a PEM private key, unlocking it if it is
+// encrypted, or creates an ECDSA key at path if there is none, so
+// re-issuing a certificate keeps the node's key.
+func loadOrGenerateKey(path string) (crypto.Signer, bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, false, fmt.Errorf("generate private key: %w", err)
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, false, fmt.Errorf("marshal private key: %w", err)
+		}
+		if err := writeStrictFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+			return nil, false, err
+		}
+		return key, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("read private key: %w", err)
+	}
+
+	if vpncrypto.IsEncryptedKey(data) {
+		pass, err := vpncrypto.KeyPassphrase()
+		if err != nil {
+			return nil, false, err
+		}
+		if data, err = vpncrypto.DecryptKeyPEM(data, pass); err != nil {
+			return nil, false, fmt.Errorf("decrypt private key %s: %w", path, err)
+		}
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, false, fmt.Errorf("no PEM private key in %s", path)
+	}
+	var parsed interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("parse private key %s: %w", path, err)
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, false, fmt.Errorf("private key %s cannot sign", path)
+	}
+	return signer, true, nil
+}
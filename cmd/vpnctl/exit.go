@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"vibepn/config"
+)
+
+// runExitNode picks the exit node the daemon routes default traffic
+// through, and by default records the choice in the config so it holds
+// across restarts.
+func runExitNode(args []string, jsonMode bool) error {
+	fs := flag.NewFlagSet("exit-node", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	network := fs.String("network", "", "Network to reach the exit on (default: the only one it offers)")
+	save := fs.Bool("save", true, "Record the choice in the config file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s exit-node [options] use <peer-name|fingerprint> | off | list\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	req := map[string]string{"action": fs.Arg(0)}
+	switch {
+	case fs.NArg() == 0 || (fs.Arg(0) == "list" && fs.NArg() == 1):
+		req["action"] = "list"
+	case fs.Arg(0) == "use" && fs.NArg() == 2:
+		req["peer"], req["network"] = fs.Arg(1), *network
+	case fs.Arg(0) == "off" && fs.NArg() == 1:
+	default:
+		fs.Usage()
+		return errors.New("expected use <peer>, off or list")
+	}
+
+	output, err := daemonRequest("exit-node", req)
+	if err != nil {
+		return err
+	}
+	if req["action"] != "list" && *save {
+		if err := saveExitChoice(*configPath, req["peer"], req["network"]); err != nil {
+			return fmt.Errorf("daemon switched, but the choice was not saved: %w", err)
+		}
+	}
+	if jsonMode {
+		return printJSON(output)
+	}
+	printExitStatus(output)
+	return nil
+}
+
+func saveExitChoice(path, peer, network string) error {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return fmt.Errorf("load config %q: %w", path, err)
+	}
+	if cfg.ExitNode == nil {
+		if peer == "" {
+			return nil
+		}
+		cfg.ExitNode = &config.ExitNode{}
+	}
+	cfg.ExitNode.Use, cfg.ExitNode.Network = peer, network
+	return config.Save(path, cfg)
+}
+
+func printExitStatus(output interface{}) {
+	m, _ := output.(map[string]interface{})
+	if offering, _ := m["offering"].([]interface{}); len(offering) > 0 {
+		fmt.Printf("Offering exit on %v\n", offering)
+	}
+	switch via, _ := m["via"].(string); {
+	case via != "":
+		fmt.Printf("Routing default traffic through %s on %s\n", via, m["via_net"])
+	case m["use"] != "":
+		fmt.Printf("Exit %s chosen, waiting for it to offer\n", m["use"])
+	default:
+		fmt.Println("Not using an exit node")
+	}
+	offers, _ := m["offers"].([]interface{})
+	for _, item := range offers {
+		o, _ := item.(map[string]interface{})
+		name, _ := o["name"].(string)
+		id, _ := o["peer"].(string)
+		fmt.Printf("Exit: %s on %v\n", displayName(name, id), o["networks"])
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"vibepn/config"
+	vpncrypto "vibepn/crypto"
+)
+
+// newKeyPassphraseEnv holds the new passphrase for key change-passphrase.
+const newKeyPassphraseEnv = "VIBEPN_NEW_KEY_PASSPHRASE"
+
+// runKey encrypts, decrypts or re-encrypts the identity key on disk. The
+// daemon only reads the key at startup, so it keeps running either way.
+func runKey(args []string) error {
+	fs := flag.NewFlagSet("key", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file (for identity.key)")
+	keyPath := fs.String("key", "", "Path to the private key (overrides the config)")
+	passFile := fs.String("passphrase-file", "", "File holding the passphrase (default: identity.passphrase_file, $"+vpncrypto.KeyPassphraseEnv+" or stdin)")
+	newPassFile := fs.String("new-passphrase-file", "", "File holding the new passphrase for change-passphrase (default: $"+newKeyPassphraseEnv+" or stdin)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s key [options] <command>\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Commands:")
+		fmt.Fprintln(fs.Output(), "  encrypt             Encrypt the private key with a passphrase")
+		fmt.Fprintln(fs.Output(), "  decrypt             Store the private key unencrypted again")
+		fmt.Fprintln(fs.Output(), "  change-passphrase   Re-encrypt the private key with a new passphrase")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("exactly one key command is required")
+	}
+
+	path := *keyPath
+	cfgPassFile := ""
+	if cfg, err := config.Load(*configPath); err == nil {
+		if path == "" {
+			path = cfg.Identity.Key
+		}
+		cfgPassFile = cfg.Identity.PassphraseFile
+	} else if path == "" {
+		return fmt.Errorf("load config %q: %w", *configPath, err)
+	}
+	if *passFile == "" {
+		*passFile = cfgPassFile
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read key: %w", err)
+	}
+	encrypted := vpncrypto.IsEncryptedKey(data)
+
+	var out []byte
+	switch sub := fs.Arg(0); sub {
+	case "encrypt":
+		if encrypted {
+			return fmt.Errorf("%s is already encrypted", path)
+		}
+		pass, err := readPassphrase(*passFile, vpncrypto.KeyPassphraseEnv)
+		if err != nil {
+			return err
+		}
+		if out, err = vpncrypto.EncryptKeyPEM(data, pass); err != nil {
+			return err
+		}
+
+	case "decrypt", "change-passphrase":
+		if !encrypted {
+			return fmt.Errorf("%s is not encrypted", path)
+		}
+		pass, err := readPassphrase(*passFile, vpncrypto.KeyPassphraseEnv)
+		if err != nil {
+			return err
+		}
+		if out, err = vpncrypto.DecryptKeyPEM(data, pass); err != nil {
+			return err
+		}
+		if sub == "change-passphrase" {
+			newPass, err := readPassphrase(*newPassFile, newKeyPassphraseEnv)
+			if err != nil {
+				return err
+			}
+			if out, err = vpncrypto.EncryptKeyPEM(out, newPass); err != nil {
+				return err
+			}
+		}
+
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown key command %q", sub)
+	}
+
+	if err := replaceKeyFile(path, out); err != nil {
+		return err
+	}
+	switch fs.Arg(0) {
+	case "encrypt":
+		fmt.Printf("Encrypted %s\nThe daemon needs identity.passphrase_file, the %s systemd credential or $%s to start\n",
+			path, vpncrypto.KeyPassphraseCredential, vpncrypto.KeyPassphraseEnv)
+	case "decrypt":
+		fmt.Printf("Decrypted %s\n", path)
+	default:
+		fmt.Printf("Changed the passphrase of %s\nUpdate wherever the daemon reads it from before it restarts\n", path)
+	}
+	return nil
+}
+
+// readPassphrase takes the passphrase from file, then the environment
+// variable env, then one line of stdin when it is not a terminal (nothing
+// would hide the typed passphrase).
+func readPassphrase(file, env string) ([]byte, error) {
+	var pass string
+	switch {
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read passphrase file: %w", err)
+		}
+		pass = string(data)
+	case os.Getenv(env) != "":
+		pass = os.Getenv(env)
+	default:
+		if st, err := os.Stdin.Stat(); err != nil || st.Mode()&os.ModeCharDevice != 0 {
+			return nil, fmt.Errorf("no passphrase: use a passphrase file, $%s or pipe it on stdin", env)
+		}
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("read passphrase from stdin: %w", err)
+		}
+		pass = line
+	}
+
+	pass = strings.TrimRight(pass, "\r\n")
+	if pass == "" {
+		return nil, errors.New("passphrase is empty")
+	}
+	return []byte(pass), nil
+}
+
+// replaceKeyFile swaps in the new key file atomically, so an interruption
+// cannot leave the node without a usable key.
+func replaceKeyFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("create temp key file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write key: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write key: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replace key: %w", err)
+	}
+	return nil
+}
+
+// loadIdentity loads the node key pair from cfg, unlocking an encrypted
+// key the same way the daemon does.
+func loadIdentity(cfg *config.Config) (tls.Certificate, error) {
+	if cfg.Identity.PassphraseFile != "" {
+		vpncrypto.SetKeyPassphraseFile(cfg.Identity.PassphraseFile)
+	}
+	cert, err := vpncrypto.LoadKeyPair(cfg.Identity.Cert, cfg.Identity.Key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("load identity: %w", err)
+	}
+	return cert, nil
+}
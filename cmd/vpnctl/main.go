@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
@@ -17,14 +18,15 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/BurntSushi/toml"
-
 	"vibepn/config"
 	vpncrypto "vibepn/crypto"
+	"vibepn/peer"
+	"vibepn/qr"
 )
 
 const (
@@ -35,7 +37,8 @@ const (
 )
 
 type CommandRequest struct {
-	Cmd string `json:"cmd"`
+	Cmd  string          `json:"cmd"`
+	Args json.RawMessage `json:"args,omitempty"`
 }
 
 type CommandResponse struct {
@@ -49,6 +52,9 @@ type InvitePayload struct {
 	Network string     `json:"network"`
 	Prefix  string     `json:"prefix"`
 	Inviter InvitePeer `json:"inviter"`
+	// Version 2: signed single-use token redeemed with the inviter on join
+	Expires *time.Time `json:"expires,omitempty"`
+	Token   []byte     `json:"token,omitempty"`
 }
 
 type InvitePeer struct {
@@ -72,8 +78,16 @@ func main() {
 
 	var err error
 	switch cmd {
-	case "status", "routes", "peers", "reload", "goodbye":
-		err = runDaemonCommand(cmd, *jsonMode)
+	case "status", "routes", "peers", "leases", "reload", "goodbye":
+		err = runDaemonCommand(cmd, nil, *jsonMode)
+	case "peer-enable", "peer-disable":
+		err = runPeerToggle(cmd, args, *jsonMode)
+	case "ping":
+		err = runPing(args, *jsonMode)
+	case "traceroute":
+		err = runTraceroute(args, *jsonMode)
+	case "exit-node":
+		err = runExitNode(args, *jsonMode)
 	case "init":
 		err = runInit(args)
 	case "invite":
@@ -84,6 +98,16 @@ func main() {
 		err = runAddPeer(args)
 	case "doctor":
 		err = runDoctor(args)
+	case "trust":
+		err = runTrust(args, *jsonMode)
+	case "ca":
+		err = runCA(args)
+	case "revoke":
+		err = runRevoke(args, *jsonMode)
+	case "rotate-key":
+		err = runRotateKey(args)
+	case "key":
+		err = runKey(args)
 	default:
 		flag.Usage()
 		err = fmt.Errorf("unknown command %q", cmd)
@@ -97,49 +121,85 @@ func main() {
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s [--json] <command> [options]\n\n", os.Args[0])
 	fmt.Fprintln(os.Stderr, "Daemon control commands:")
-	fmt.Fprintln(os.Stderr, "  status | routes | peers | reload | goodbye")
+	fmt.Fprintln(os.Stderr, "  status | routes | peers | leases | reload | goodbye")
+	fmt.Fprintln(os.Stderr, "  peer-enable <fingerprint> | peer-disable <fingerprint>")
+	fmt.Fprintln(os.Stderr, "  ping <peer> | traceroute <overlay-ip>")
+	fmt.Fprintln(os.Stderr, "  exit-node use <peer> | exit-node off | exit-node list")
 	fmt.Fprintln(os.Stderr)
 	fmt.Fprintln(os.Stderr, "Onboarding commands:")
 	fmt.Fprintln(os.Stderr, "  init      Generate cert/key/fingerprint and write config TOML")
-	fmt.Fprintln(os.Stderr, "  invite    Emit JSON invite payload for an exported network")
-	fmt.Fprintln(os.Stderr, "  join      Parse invite payload, generate cert/key, and write config")
+	fmt.Fprintln(os.Stderr, "  invite    Emit a signed, expiring, single-use invite for an exported network")
+	fmt.Fprintln(os.Stderr, "  join      Redeem an invite with the inviter, generate cert/key, and write config")
 	fmt.Fprintln(os.Stderr, "  add-peer  Append a peer entry to an existing config")
 	fmt.Fprintln(os.Stderr, "  doctor    Validate config and identity/peer/network consistency")
+	fmt.Fprintln(os.Stderr, "  trust     List, pin, forget or re-key TOFU-pinned peers")
+	fmt.Fprintln(os.Stderr, "  ca        Create a mesh CA (ca init) and issue node certificates (ca sign)")
+	fmt.Fprintln(os.Stderr, "  revoke    Revoke a peer key and distribute the signed revocation list")
+	fmt.Fprintln(os.Stderr, "  rotate-key  Switch the running daemon to a new identity key without downtime")
+	fmt.Fprintln(os.Stderr, "  key       Encrypt or decrypt the identity key, or change its passphrase")
 	fmt.Fprintln(os.Stderr)
 	fmt.Fprintln(os.Stderr, "Use '<command> -h' for command-specific flags.")
 	flag.PrintDefaults()
 }
 
-func runDaemonCommand(cmd string, jsonMode bool) error {
+func runDaemonCommand(cmd string, args interface{}, jsonMode bool) error {
+	output, err := daemonRequest(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	if jsonMode {
+		return printJSON(output)
+	}
+
+	printOutput(cmd, output)
+	return nil
+}
+
+// daemonRequest sends one command over the control socket and returns its
+// output, turning error responses into Go errors.
+func daemonRequest(cmd string, args interface{}) (interface{}, error) {
 	req := CommandRequest{Cmd: cmd}
+	if args != nil {
+		raw, err := json.Marshal(args)
+		if err != nil {
+			return nil, fmt.Errorf("encode args: %w", err)
+		}
+		req.Args = raw
+	}
 
 	conn, err := net.Dial("unix", socketPath)
 	if err != nil {
-		return fmt.Errorf("failed to connect to socket: %w", err)
+		return nil, fmt.Errorf("failed to connect to socket: %w", err)
 	}
 	defer conn.Close()
 
 	if err := json.NewEncoder(conn).Encode(req); err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 
 	var resp CommandResponse
 	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
-		return fmt.Errorf("failed to read response: %w", err)
+		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
 	if resp.Status != "ok" {
-		return errors.New(resp.Error)
+		return nil, errors.New(resp.Error)
 	}
+	return resp.Output, nil
+}
 
-	if jsonMode {
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetIndent("", "  ")
-		return enc.Encode(resp.Output)
-	}
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
 
-	printOutput(cmd, resp.Output)
-	return nil
+func runPeerToggle(cmd string, args []string, jsonMode bool) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s %s <fingerprint>", os.Args[0], cmd)
+	}
+	return runDaemonCommand(cmd, map[string]string{"peer": args[0]}, jsonMode)
 }
 
 func runInit(args []string) error {
@@ -209,7 +269,7 @@ func runInit(args []string) error {
 		},
 	}
 
-	if err := writeConfig(*configPath, cfg); err != nil {
+	if err := config.Save(*configPath, cfg); err != nil {
 		return err
 	}
 
@@ -224,7 +284,10 @@ func runInvite(args []string) error {
 	networkName := fs.String("network", "", "Exported network name to include in invite")
 	address := fs.String("address", "", "Inviter reachable address (host:port)")
 	name := fs.String("name", defaultNodeName(), "Inviter name in invite payload")
+	expires := fs.Duration("expires", 24*time.Hour, "How long the invite can be redeemed")
+	invitee := fs.String("for", "", "Only let a node with this name redeem the invite")
 	outPath := fs.String("out", "-", "Output file for invite payload ('-' for stdout)")
+	format := fs.String("format", "json", "Invite format: json, url (vibepn://...), qr or qr-ascii")
 	fs.Usage = func() {
 		fmt.Fprintf(fs.Output(), "Usage: %s invite [options]\n", os.Args[0])
 		fs.PrintDefaults()
@@ -247,6 +310,12 @@ func runInvite(args []string) error {
 	if err := validateHostPort(*address); err != nil {
 		return fmt.Errorf("invalid --address: %w", err)
 	}
+	if *expires <= 0 {
+		return errors.New("--expires must be positive")
+	}
+	if !slices.Contains([]string{"json", "url", "qr", "qr-ascii"}, *format) {
+		return fmt.Errorf("unknown --format %q (want json, url, qr or qr-ascii)", *format)
+	}
 
 	cfg, err := config.Load(*configPath)
 	if err != nil {
@@ -255,6 +324,13 @@ func runInvite(args []string) error {
 	if strings.TrimSpace(cfg.Identity.Fingerprint) == "" {
 		return errors.New("config identity fingerprint is empty")
 	}
+	cert, err := loadIdentity(cfg)
+	if err != nil {
+		return err
+	}
+	if fp := vpncrypto.Fingerprint(cert.Certificate[0]); fp != cfg.Identity.Fingerprint {
+		return fmt.Errorf("identity certificate fingerprint %s does not match config fingerprint %s", fp, cfg.Identity.Fingerprint)
+	}
 
 	netCfg, ok := cfg.Networks[*networkName]
 	if !ok {
@@ -267,8 +343,30 @@ func runInvite(args []string) error {
 		return fmt.Errorf("network %q has empty prefix", *networkName)
 	}
 
+	tok := &vpncrypto.InviteToken{
+		Network: *networkName,
+		Prefix:  netCfg.Prefix,
+		Inviter: *name,
+		Address: *address,
+		Invitee: *invitee,
+		Expires: time.Now().Add(*expires).Truncate(time.Second),
+	}
+	if err := vpncrypto.SignInvite(tok, cert); err != nil {
+		return err
+	}
+	raw, err := tok.Marshal()
+	if err != nil {
+		return err
+	}
+	compact := *tok
+	compact.Signer = nil
+	compactRaw, err := compact.Marshal()
+	if err != nil {
+		return err
+	}
+
 	payload := InvitePayload{
-		Version: 1,
+		Version: 2,
 		Network: *networkName,
 		Prefix:  netCfg.Prefix,
 		Inviter: InvitePeer{
@@ -276,13 +374,31 @@ func runInvite(args []string) error {
 			Address:     *address,
 			Fingerprint: cfg.Identity.Fingerprint,
 		},
+		Expires: &tok.Expires,
+		Token:   raw,
 	}
 
-	data, err := json.MarshalIndent(payload, "", "  ")
-	if err != nil {
-		return fmt.Errorf("encode invite payload: %w", err)
+	var data []byte
+	switch *format {
+	case "json":
+		data, err = json.MarshalIndent(payload, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encode invite payload: %w", err)
+		}
+		data = append(data, '\n')
+	case "url":
+		data = []byte(inviteURL(compactRaw) + "\n")
+	case "qr", "qr-ascii":
+		code, err := qr.Encode([]byte(inviteURL(compactRaw)), qr.L)
+		if err != nil {
+			return fmt.Errorf("encode invite QR code: %w", err)
+		}
+		text := code.UTF8()
+		if *format == "qr-ascii" {
+			text = code.ASCII()
+		}
+		data = []byte(text + inviteURL(compactRaw) + "\n")
 	}
-	data = append(data, '\n')
 
 	if *outPath == "-" {
 		_, err := os.Stdout.Write(data)
@@ -303,11 +419,13 @@ func runJoin(args []string) error {
 	certPath := fs.String("cert", defaultCertPath, "Path to node certificate to write")
 	keyPath := fs.String("key", defaultKeyPath, "Path to node private key to write")
 	name := fs.String("name", defaultNodeName(), "Node name / certificate common name")
-	inviteJSON := fs.String("invite", "", "Invite payload JSON string")
-	inviteFile := fs.String("invite-file", "", "Path to file containing invite payload JSON")
+	inviteJSON := fs.String("invite", "", "Invite payload: JSON string or vibepn:// URL")
+	inviteFile := fs.String("invite-file", "", "Path to file containing invite payload JSON or URL")
 	address := fs.String("address", "auto", "Local address for invited network (or 'auto')")
 	exportNet := fs.Bool("export", true, "Whether to export invited network")
 	force := fs.Bool("force", false, "Overwrite existing config/cert/key files")
+	advertise := fs.String("advertise", "", "Address (host:port) the inviter can dial this node on")
+	offline := fs.Bool("offline", false, "Write the config without redeeming the invite with the inviter")
 	fs.Usage = func() {
 		fmt.Fprintf(fs.Output(), "Usage: %s join [options]\n", os.Args[0])
 		fs.PrintDefaults()
@@ -326,6 +444,15 @@ func runJoin(args []string) error {
 	if err != nil {
 		return err
 	}
+	if *advertise != "" {
+		if err := validateHostPort(*advertise); err != nil {
+			return fmt.Errorf("invalid --advertise: %w", err)
+		}
+	}
+	tok, err := inviteToken(payload, time.Now())
+	if err != nil {
+		return err
+	}
 	if !*force {
 		if pathExists(*configPath) {
 			return fmt.Errorf("config %q already exists (use --force to overwrite)", *configPath)
@@ -343,6 +470,20 @@ func runJoin(args []string) error {
 		return err
 	}
 
+	// 🤝 Redeem the token so the inviter pins us and adds us as a peer
+	switch {
+	case tok == nil:
+		fmt.Printf("Invite has no token; on the inviter run:\n  vpnctl add-peer --name %s --fingerprint %s --networks %s --address <this node's host:port>\n", *name, fp, payload.Network)
+	case *offline:
+		fmt.Println("Not redeeming the invite (--offline); the inviter will not know this node until it is added there")
+	default:
+		if err := peer.Join(tok, *name, *advertise, *certPath, *keyPath, 15*time.Second); err != nil {
+			os.Remove(*certPath)
+			os.Remove(*keyPath)
+			return fmt.Errorf("join %s at %s: %w", payload.Inviter.Name, payload.Inviter.Address, err)
+		}
+	}
+
 	cfg := &config.Config{
 		Identity: config.Identity{
 			Cert:        *certPath,
@@ -366,7 +507,7 @@ func runJoin(args []string) error {
 		},
 	}
 
-	if err := writeConfig(*configPath, cfg); err != nil {
+	if err := config.Save(*configPath, cfg); err != nil {
 		return err
 	}
 
@@ -435,7 +576,7 @@ func runAddPeer(args []string) error {
 		Networks:    peerNetworks,
 	})
 
-	if err := writeConfig(*configPath, cfg); err != nil {
+	if err := config.Save(*configPath, cfg); err != nil {
 		return err
 	}
 
@@ -531,7 +672,7 @@ func runDoctor(args []string) error {
 		invalidAddresses := make([]string, 0)
 		for name, netCfg := range cfg.Networks {
 			address := strings.TrimSpace(netCfg.Address)
-			if address == "auto" {
+			if address == "auto" || address == "lease" {
 				continue
 			}
 			if address == "" {
@@ -545,7 +686,7 @@ func runDoctor(args []string) error {
 		if len(invalidAddresses) > 0 {
 			report("FAIL", "5) network address format", strings.Join(invalidAddresses, "; "))
 		} else {
-			report("PASS", "5) network address format", "all network addresses are 'auto' or valid IPs")
+			report("PASS", "5) network address format", "all network addresses are 'auto', 'lease' or valid IPs")
 		}
 	}
 
@@ -558,7 +699,7 @@ func runDoctor(args []string) error {
 			if strings.TrimSpace(peer.Name) == "" {
 				missing = append(missing, "name")
 			}
-			if strings.TrimSpace(peer.Address) == "" {
+			if len(peer.Candidates()) == 0 {
 				missing = append(missing, "address")
 			}
 			if len(missing) > 0 {
@@ -574,15 +715,16 @@ func runDoctor(args []string) error {
 
 	invalidPeerAddresses := make([]string, 0)
 	for i, peer := range cfg.Peers {
-		address := strings.TrimSpace(peer.Address)
-		host, port, err := net.SplitHostPort(address)
-		if err != nil || strings.TrimSpace(host) == "" || strings.TrimSpace(port) == "" {
-			invalidPeerAddresses = append(invalidPeerAddresses, fmt.Sprintf("peer[%d]=%q", i, peer.Address))
-			continue
-		}
-		portNum, err := strconv.Atoi(port)
-		if err != nil || portNum < 1 || portNum > 65535 {
-			invalidPeerAddresses = append(invalidPeerAddresses, fmt.Sprintf("peer[%d]=%q", i, peer.Address))
+		for _, address := range peer.Candidates() {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil || strings.TrimSpace(host) == "" || strings.TrimSpace(port) == "" {
+				invalidPeerAddresses = append(invalidPeerAddresses, fmt.Sprintf("peer[%d]=%q", i, address))
+				continue
+			}
+			portNum, err := strconv.Atoi(port)
+			if err != nil || portNum < 1 || portNum > 65535 {
+				invalidPeerAddresses = append(invalidPeerAddresses, fmt.Sprintf("peer[%d]=%q", i, address))
+			}
 		}
 	}
 	if len(invalidPeerAddresses) > 0 {
@@ -634,6 +776,54 @@ func runDoctor(args []string) error {
 		report("PASS", "9) peer network references", "all peer network references exist")
 	}
 
+	invalidRoutes := make([]string, 0)
+	for name, netCfg := range cfg.Networks {
+		if err := netCfg.CheckRoutes(); err != nil {
+			invalidRoutes = append(invalidRoutes, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(invalidRoutes) > 0 {
+		report("FAIL", "10) subnet routes", strings.Join(invalidRoutes, "; "))
+	} else {
+		report("PASS", "10) subnet routes", "all routes and accept_routes entries are valid")
+	}
+
+	invalidLeases := make([]string, 0)
+	for name, netCfg := range cfg.Networks {
+		if err := netCfg.CheckLease(); err != nil {
+			invalidLeases = append(invalidLeases, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(invalidLeases) > 0 {
+		report("FAIL", "11) address leases", strings.Join(invalidLeases, "; "))
+	} else {
+		report("PASS", "11) address leases", "lease coordinators and leased networks are configured")
+	}
+
+	invalidModes := make([]string, 0)
+	for name, netCfg := range cfg.Networks {
+		if err := netCfg.CheckMode(); err != nil {
+			invalidModes = append(invalidModes, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(invalidModes) > 0 {
+		report("FAIL", "12) network modes", strings.Join(invalidModes, "; "))
+	} else {
+		report("PASS", "12) network modes", "all networks use mode tun or tap")
+	}
+
+	invalidMulticast := make([]string, 0)
+	for name, netCfg := range cfg.Networks {
+		if err := netCfg.CheckMulticast(); err != nil {
+			invalidMulticast = append(invalidMulticast, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(invalidMulticast) > 0 {
+		report("FAIL", "13) multicast", strings.Join(invalidMulticast, "; "))
+	} else {
+		report("PASS", "13) multicast", "multicast settings are valid")
+	}
+
 	fmt.Printf("Summary: PASS=%d WARN=%d FAIL=%d\n", passCount, warnCount, failCount)
 	if failCount > 0 {
 		return fmt.Errorf("doctor detected %d failing checks", failCount)
@@ -661,7 +851,11 @@ func loadInvitePayload(inviteJSON, inviteFile string) (InvitePayload, error) {
 	}
 
 	var payload InvitePayload
-	if err := json.Unmarshal(raw, &payload); err != nil {
+	if url := strings.TrimSpace(string(raw)); strings.HasPrefix(url, inviteScheme) {
+		if payload, err = parseInviteURL(url); err != nil {
+			return InvitePayload{}, err
+		}
+	} else if err := json.Unmarshal(raw, &payload); err != nil {
 		return InvitePayload{}, fmt.Errorf("parse invite payload: %w", err)
 	}
 	if payload.Network == "" {
@@ -691,6 +885,71 @@ func loadInvitePayload(inviteJSON, inviteFile string) (InvitePayload, error) {
 	return payload, nil
 }
 
+const inviteScheme = "vibepn://"
+
+// inviteURL is the compact invite form: the signed token without the
+// inviter certificate, base64url encoded. Everything the JSON payload holds
+// is in the token.
+func inviteURL(token []byte) string {
+	return inviteScheme + base64.RawURLEncoding.EncodeToString(token)
+}
+
+// parseInviteURL rebuilds the version 2 payload from a vibepn:// invite.
+// The token is checked later by inviteToken like any other.
+func parseInviteURL(url string) (InvitePayload, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(url, inviteScheme))
+	if err != nil {
+		return InvitePayload{}, fmt.Errorf("decode invite URL: %w", err)
+	}
+	tok, err := vpncrypto.ParseInviteToken(raw)
+	if err != nil {
+		return InvitePayload{}, fmt.Errorf("parse invite token: %w", err)
+	}
+	return InvitePayload{
+		Version: 2,
+		Network: tok.Network,
+		Prefix:  tok.Prefix,
+		Inviter: InvitePeer{
+			Name:        tok.Inviter,
+			Address:     tok.Address,
+			Fingerprint: tok.SignerFingerprint,
+		},
+		Expires: &tok.Expires,
+		Token:   raw,
+	}, nil
+}
+
+// inviteToken checks the signed token of a version 2 invite and returns it
+// with the payload made to match it. Invites without a token return nil.
+func inviteToken(payload InvitePayload, now time.Time) (*vpncrypto.InviteToken, error) {
+	if len(payload.Token) == 0 {
+		if payload.Version >= 2 {
+			return nil, errors.New("invite payload missing token")
+		}
+		return nil, nil
+	}
+	tok, err := vpncrypto.ParseInviteToken(payload.Token)
+	if err != nil {
+		return nil, fmt.Errorf("parse invite token: %w", err)
+	}
+	if tok.SignerFingerprint != payload.Inviter.Fingerprint {
+		return nil, errors.New("invite token is not signed by the inviter")
+	}
+	// Compact invites carry no certificate; their signature is checked
+	// once the inviter has proved its key on connect
+	if tok.Signer != nil {
+		if err := tok.Verify(now); err != nil {
+			return nil, err
+		}
+	} else if now.After(tok.Expires) {
+		return nil, fmt.Errorf("invite expired at %s", tok.Expires.Format(time.RFC3339))
+	}
+	if tok.Network != payload.Network || tok.Prefix != payload.Prefix || tok.Address != payload.Inviter.Address || tok.Inviter != payload.Inviter.Name {
+		return nil, errors.New("invite payload does not match its signed token")
+	}
+	return tok, nil
+}
+
 func generateIdentity(certPath, keyPath, commonName string) (string, error) {
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
@@ -740,26 +999,6 @@ func generateIdentity(certPath, keyPath, commonName string) (string, error) {
 	return hex.EncodeToString(hash[:]), nil
 }
 
-func writeConfig(path string, cfg *config.Config) error {
-	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
-		return fmt.Errorf("create config directory: %w", err)
-	}
-
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
-	if err != nil {
-		return fmt.Errorf("open config %q: %w", path, err)
-	}
-	defer f.Close()
-
-	if err := toml.NewEncoder(f).Encode(cfg); err != nil {
-		return fmt.Errorf("encode config TOML: %w", err)
-	}
-	if err := os.Chmod(path, 0600); err != nil {
-		return fmt.Errorf("set config permissions: %w", err)
-	}
-	return nil
-}
-
 func writeStrictFile(path string, data []byte, mode os.FileMode) error {
 	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
 		return fmt.Errorf("create directory for %q: %w", path, err)
@@ -822,6 +1061,26 @@ func isValidFingerprint(fingerprint string) bool {
 	return err == nil
 }
 
+// formatBytes renders a JSON number of bytes with a binary unit suffix.
+func formatBytes(v interface{}) string {
+	n, _ := v.(float64)
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// orDash renders empty or missing JSON strings as "-".
+func orDash(v interface{}) string {
+	if s, _ := v.(string); s != "" {
+		return s
+	}
+	return "-"
+}
+
 func printOutput(cmd string, output interface{}) {
 	switch cmd {
 	case "status":
@@ -831,9 +1090,46 @@ func printOutput(cmd string, output interface{}) {
 		fmt.Printf("Routes: %v\n", m["routes"])
 	case "peers":
 		peers, _ := output.([]interface{})
+		names := make(map[string]string, len(peers))
+		for _, item := range peers {
+			p, _ := item.(map[string]interface{})
+			id, _ := p["id"].(string)
+			names[id], _ = p["name"].(string)
+		}
 		for _, item := range peers {
 			p := item.(map[string]interface{})
-			fmt.Printf("Peer: %s (last seen: %s)\n", p["id"], p["last_seen"])
+			name, _ := p["name"].(string)
+			id, _ := p["id"].(string)
+			fmt.Printf("Peer: %s %s %s\n", displayName(name, id), p["state"], orDash(p["direction"]))
+			fmt.Printf("  address %s  remote %s  connected since %s  last seen %s\n",
+				orDash(p["address"]), orDash(p["remote"]), orDash(p["connected_since"]), p["last_seen"])
+			if endpoint, _ := p["endpoint"].(string); endpoint != "" {
+				fmt.Printf("  dialed via %s\n", endpoint)
+			}
+			if via, _ := p["relay_via"].(string); via != "" {
+				fmt.Printf("  relayed via %s\n", displayName(names[via], via))
+			}
+			if discovered, _ := p["discovered"].(bool); discovered {
+				fmt.Printf("  discovered through gossip\n")
+			}
+			if observed, _ := p["observed_as"].(string); observed != "" {
+				fmt.Printf("  seen by peer as %s\n", observed)
+			}
+			if nets, _ := p["networks"].([]interface{}); len(nets) > 0 {
+				fmt.Printf("  authorized networks %v\n", nets)
+			}
+			if subnets, _ := p["subnets"].([]interface{}); len(subnets) > 0 {
+				fmt.Printf("  routes subnets %v\n", subnets)
+			}
+			if exits, _ := p["exit_networks"].([]interface{}); len(exits) > 0 {
+				fmt.Printf("  exit node on %v\n", exits)
+			}
+			if caps, _ := p["capabilities"].([]interface{}); len(caps) > 0 {
+				fmt.Printf("  capabilities %v\n", caps)
+			}
+			fmt.Printf("  rtt %.2f ms  jitter %.2f ms  quic rtt %.2f ms  loss %.2f%%  tx %s/s  rx %s/s\n",
+				p["rtt_ms"], p["jitter_ms"], p["quic_rtt_ms"], p["loss_pct"],
+				formatBytes(p["tx_bps"]), formatBytes(p["rx_bps"]))
 		}
 	case "routes":
 		routes, _ := output.([]interface{})
@@ -842,7 +1138,24 @@ func printOutput(cmd string, output interface{}) {
 			fmt.Printf("Net: %-10s Prefix: %-18s Peer: %-16s Metric: %v Expires: %s\n",
 				r["network"], r["prefix"], r["peer"], r["metric"], r["expires"])
 		}
+	case "leases":
+		leases, _ := output.([]interface{})
+		for _, item := range leases {
+			l := item.(map[string]interface{})
+			name, _ := l["name"].(string)
+			peerID, _ := l["peer"].(string)
+			state, _ := l["state"].(string)
+			if connected, _ := l["connected"].(bool); connected {
+				state += ", connected"
+			}
+			fmt.Printf("Net: %-10s Address: %-15s Peer: %-16s Expires: %s (%s)\n",
+				l["network"], l["address"], displayName(name, peerID), l["expires"], state)
+		}
 	default:
+		if m, ok := output.(map[string]interface{}); ok && m["message"] != nil {
+			fmt.Println(m["message"])
+			return
+		}
 		fmt.Println("OK")
 	}
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
@@ -10,8 +11,10 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"vibepn/config"
+	vpncrypto "vibepn/crypto"
 )
 
 func TestSplitCSV(t *testing.T) {
@@ -118,6 +121,139 @@ func TestLoadInvitePayloadInvalidJSONAndFilePath(t *testing.T) {
 	}
 }
 
+// signedTestInvite returns a token for network corp signed by a fresh
+// identity, and that identity's fingerprint.
+func signedTestInvite(t *testing.T, expires time.Time) ([]byte, string) {
+	t.Helper()
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key")
+	fp, err := generateIdentity(certPath, keyPath, "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok := &vpncrypto.InviteToken{Network: "corp", Prefix: "10.42.0.0/24", Inviter: "node-a", Address: "127.0.0.1:3000", Expires: expires}
+	if err := vpncrypto.SignInvite(tok, cert); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := tok.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw, fp
+}
+
+func TestInviteTokenMustMatchPayload(t *testing.T) {
+	now := time.Now()
+	raw, fp := signedTestInvite(t, now.Add(time.Hour))
+	payload := InvitePayload{
+		Version: 2,
+		Network: "corp",
+		Prefix:  "10.42.0.0/24",
+		Inviter: InvitePeer{Name: "node-a", Address: "127.0.0.1:3000", Fingerprint: fp},
+		Token:   raw,
+	}
+
+	if _, err := inviteToken(payload, now); err != nil {
+		t.Fatalf("valid invite rejected: %v", err)
+	}
+	if _, err := inviteToken(payload, now.Add(2*time.Hour)); err == nil {
+		t.Fatal("expected expired invite to be rejected")
+	}
+
+	edited := payload
+	edited.Inviter.Address = "198.51.100.7:3000"
+	if _, err := inviteToken(edited, now); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("expected edited payload to be rejected, got: %v", err)
+	}
+
+	edited = payload
+	edited.Inviter.Fingerprint = strings.Repeat("0", 64)
+	if _, err := inviteToken(edited, now); err == nil || !strings.Contains(err.Error(), "not signed by the inviter") {
+		t.Fatalf("expected foreign signer to be rejected, got: %v", err)
+	}
+}
+
+func TestLoadInvitePayloadURL(t *testing.T) {
+	now := time.Now()
+	raw, fp := signedTestInvite(t, now.Add(time.Hour))
+	tok, err := vpncrypto.ParseInviteToken(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok.Signer = nil
+	if raw, err = tok.Marshal(); err != nil {
+		t.Fatal(err)
+	}
+
+	url := inviteURL(raw)
+	if len(url) > 300 {
+		t.Fatalf("invite URL is %d bytes, too long for a comfortable QR code", len(url))
+	}
+	payload, err := loadInvitePayload(url+"\n", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Network != "corp" || payload.Inviter.Address != "127.0.0.1:3000" || payload.Inviter.Fingerprint != fp {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+	if _, err := inviteToken(payload, now); err != nil {
+		t.Fatalf("invite from URL rejected: %v", err)
+	}
+	if _, err := inviteToken(payload, now.Add(2*time.Hour)); err == nil {
+		t.Fatal("expected expired invite URL to be rejected")
+	}
+
+	if _, err := loadInvitePayload(inviteScheme+"!!", ""); err == nil || !strings.Contains(err.Error(), "decode invite URL") {
+		t.Fatalf("expected decode error, got: %v", err)
+	}
+}
+
+func TestRunKeyEncryptAndDecrypt(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key")
+	if _, err := generateIdentity(certPath, keyPath, "node-a"); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passPath := filepath.Join(dir, "pass")
+	if err := os.WriteFile(passPath, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.toml")
+
+	if err := runKey([]string{"-config", missing, "-key", keyPath, "-passphrase-file", passPath, "encrypt"}); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !vpncrypto.IsEncryptedKey(sealed) {
+		t.Fatal("key not encrypted")
+	}
+	if info, err := os.Stat(keyPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("encrypted key mode = %v, %v", info.Mode().Perm(), err)
+	}
+	if err := runKey([]string{"-config", missing, "-key", keyPath, "-passphrase-file", passPath, "encrypt"}); err == nil {
+		t.Fatal("expected encrypting twice to fail")
+	}
+
+	if err := runKey([]string{"-config", missing, "-key", keyPath, "-passphrase-file", passPath, "decrypt"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(keyPath); string(got) != string(plain) {
+		t.Fatal("decrypted key differs from the original")
+	}
+}
+
 func TestGenerateIdentityWritesFilesAndFingerprint(t *testing.T) {
 	certPath := filepath.Join(t.TempDir(), "certs", "node.crt")
 	keyPath := filepath.Join(filepath.Dir(certPath), "node.key")
@@ -186,7 +322,7 @@ func TestRunDoctorInvalidAndValidConfigs(t *testing.T) {
 		},
 	}
 	validConfigPath := filepath.Join(dir, "valid.toml")
-	if err := writeConfig(validConfigPath, validCfg); err != nil {
+	if err := config.Save(validConfigPath, validCfg); err != nil {
 		t.Fatalf("write valid config: %v", err)
 	}
 
@@ -194,3 +330,51 @@ func TestRunDoctorInvalidAndValidConfigs(t *testing.T) {
 		t.Fatalf("runDoctor returned error for valid config: %v", err)
 	}
 }
+
+func TestSummarizeProbes(t *testing.T) {
+	got := summarizeProbes([]probeResult{
+		{Seq: 1, RTTMS: 10},
+		{Seq: 2, Error: "timeout"},
+		{Seq: 3, RTTMS: 30},
+		{Seq: 4, RTTMS: 20},
+	})
+	want := probeSummary{Sent: 4, Received: 3, LossPct: 25, MinMS: 10, AvgMS: 20, MaxMS: 30}
+	if got != want {
+		t.Fatalf("summarizeProbes = %+v, want %+v", got, want)
+	}
+
+	if empty := summarizeProbes(nil); empty != (probeSummary{}) {
+		t.Fatalf("summarizeProbes(nil) = %+v, want zero value", empty)
+	}
+}
+
+func TestRunCASignWithEncryptedKey(t *testing.T) {
+	dir := t.TempDir()
+	caDir := filepath.Join(dir, "ca")
+	if err := runCAInit([]string{"-dir", caDir}); err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key")
+	if _, err := generateIdentity(certPath, keyPath, "node-a"); err != nil {
+		t.Fatal(err)
+	}
+	passPath := filepath.Join(dir, "pass")
+	if err := os.WriteFile(passPath, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := runKey([]string{"-config", filepath.Join(dir, "missing.toml"), "-key", keyPath, "-passphrase-file", passPath, "encrypt"}); err != nil {
+		t.Fatal(err)
+	}
+	vpncrypto.SetKeyPassphraseFile(passPath)
+	t.Cleanup(func() { vpncrypto.SetKeyPassphraseFile("") })
+
+	if err := runCASign([]string{"-dir", caDir, "-name", "node-a", "-networks", "corp", "-cert", certPath, "-key", keyPath}); err != nil {
+		t.Fatalf("ca sign with an encrypted key: %v", err)
+	}
+	if sealed, _ := os.ReadFile(keyPath); !vpncrypto.IsEncryptedKey(sealed) {
+		t.Fatal("ca sign left the key decrypted")
+	}
+	if _, err := vpncrypto.LoadKeyPair(certPath, keyPath); err != nil {
+		t.Fatalf("issued certificate does not match the key: %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+type probeResult struct {
+	Seq   int     `json:"seq"`
+	Name  string  `json:"name,omitempty"`
+	Peer  string  `json:"peer,omitempty"`
+	RTTMS float64 `json:"rtt_ms,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+type probeSummary struct {
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	LossPct  float64 `json:"loss_pct"`
+	MinMS    float64 `json:"min_ms"`
+	AvgMS    float64 `json:"avg_ms"`
+	MaxMS    float64 `json:"max_ms"`
+}
+
+type traceHop struct {
+	TTL     int           `json:"ttl"`
+	Name    string        `json:"name,omitempty"`
+	Peer    string        `json:"peer,omitempty"`
+	Probes  []probeResult `json:"probes"`
+	Reached bool          `json:"reached"`
+}
+
+func runPing(args []string, jsonMode bool) error {
+	fs := flag.NewFlagSet("ping", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	count := fs.Int("count", 4, "Number of echo requests to send")
+	interval := fs.Duration("interval", time.Second, "Delay between echo requests")
+	timeout := fs.Duration("timeout", time.Second, "Per-request timeout (max 1.5s)")
+	jsonOut := fs.Bool("json", jsonMode, "Output results as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ping [options] <peer-name|fingerprint>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("exactly one peer is required")
+	}
+	if *count < 1 {
+		return errors.New("--count must be at least 1")
+	}
+	peer := fs.Arg(0)
+
+	results := make([]probeResult, 0, *count)
+	for seq := 1; seq <= *count; seq++ {
+		if seq > 1 {
+			time.Sleep(*interval)
+		}
+
+		res := probeResult{Seq: seq}
+		out, err := daemonRequest("ping", map[string]interface{}{
+			"peer":       peer,
+			"timeout_ms": timeout.Milliseconds(),
+		})
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			fillProbeResult(&res, out)
+		}
+		results = append(results, res)
+
+		if !*jsonOut {
+			if res.Error != "" {
+				fmt.Printf("seq=%d %s\n", seq, res.Error)
+			} else {
+				fmt.Printf("Reply from %s: seq=%d time=%.2f ms\n", displayName(res.Name, res.Peer), seq, res.RTTMS)
+			}
+		}
+	}
+
+	summary := summarizeProbes(results)
+	if *jsonOut {
+		return printJSON(map[string]interface{}{
+			"peer":    peer,
+			"probes":  results,
+			"summary": summary,
+		})
+	}
+
+	fmt.Printf("--- %s ping statistics ---\n", peer)
+	fmt.Printf("%d sent, %d received, %.1f%% loss", summary.Sent, summary.Received, summary.LossPct)
+	if summary.Received > 0 {
+		fmt.Printf(", rtt min/avg/max = %.2f/%.2f/%.2f ms", summary.MinMS, summary.AvgMS, summary.MaxMS)
+	}
+	fmt.Println()
+	return nil
+}
+
+func runTraceroute(args []string, jsonMode bool) error {
+	fs := flag.NewFlagSet("traceroute", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	network := fs.String("network", "", "Overlay network to trace in (default: first with a route)")
+	maxHops := fs.Int("max-hops", 16, "Maximum number of hops")
+	count := fs.Int("count", 3, "Probes per hop")
+	interval := fs.Duration("interval", 0, "Delay between probes")
+	timeout := fs.Duration("timeout", time.Second, "Per-probe timeout (max 1.5s)")
+	jsonOut := fs.Bool("json", jsonMode, "Output results as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s traceroute [options] <overlay-ip>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("exactly one overlay address is required")
+	}
+	target := fs.Arg(0)
+	if net.ParseIP(target) == nil {
+		return fmt.Errorf("invalid overlay address %q", target)
+	}
+	if *count < 1 {
+		return errors.New("--count must be at least 1")
+	}
+	if *maxHops < 1 || *maxHops > 255 {
+		return errors.New("--max-hops must be 1-255")
+	}
+
+	hops := make([]traceHop, 0, *maxHops)
+	for ttl := 1; ttl <= *maxHops; ttl++ {
+		hop := traceHop{TTL: ttl}
+		unreachable := false
+
+		for seq := 1; seq <= *count; seq++ {
+			if seq > 1 {
+				time.Sleep(*interval)
+			}
+
+			res := probeResult{Seq: seq}
+			out, err := daemonRequest("trace", map[string]interface{}{
+				"network":    *network,
+				"target":     target,
+				"ttl":        ttl,
+				"timeout_ms": timeout.Milliseconds(),
+			})
+			if err != nil {
+				res.Error = err.Error()
+			} else {
+				fillProbeResult(&res, out)
+				m, _ := out.(map[string]interface{})
+				if reached, _ := m["reached"].(bool); reached {
+					hop.Reached = true
+				}
+				if u, _ := m["unreachable"].(bool); u {
+					unreachable = true
+				}
+				if hop.Name == "" {
+					hop.Name, hop.Peer = res.Name, res.Peer
+				}
+			}
+			hop.Probes = append(hop.Probes, res)
+		}
+		hops = append(hops, hop)
+
+		if !*jsonOut {
+			printTraceHop(hop)
+		}
+		if hop.Reached || unreachable {
+			break
+		}
+	}
+
+	if *jsonOut {
+		return printJSON(map[string]interface{}{
+			"target": target,
+			"hops":   hops,
+		})
+	}
+	return nil
+}
+
+func fillProbeResult(res *probeResult, out interface{}) {
+	m, _ := out.(map[string]interface{})
+	res.Name, _ = m["name"].(string)
+	res.Peer, _ = m["peer"].(string)
+	res.RTTMS, _ = m["rtt_ms"].(float64)
+}
+
+func printTraceHop(hop traceHop) {
+	parts := make([]string, 0, len(hop.Probes))
+	for _, p := range hop.Probes {
+		if p.Error != "" {
+			parts = append(parts, "*")
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%.2f ms", p.RTTMS))
+	}
+
+	who := "*"
+	if hop.Name != "" || hop.Peer != "" {
+		who = displayName(hop.Name, hop.Peer)
+	}
+	fmt.Printf("%2d  %-24s %s\n", hop.TTL, who, strings.Join(parts, "  "))
+}
+
+func displayName(name, fingerprint string) string {
+	short := fingerprint
+	if len(short) > 12 {
+		short = short[:12]
+	}
+	switch {
+	case name != "" && short != "":
+		return fmt.Sprintf("%s (%s)", name, short)
+	case name != "":
+		return name
+	default:
+		return short
+	}
+}
+
+func summarizeProbes(results []probeResult) probeSummary {
+	s := probeSummary{Sent: len(results)}
+	var total float64
+	for _, r := range results {
+		if r.Error != "" {
+			continue
+		}
+		if s.Received == 0 || r.RTTMS < s.MinMS {
+			s.MinMS = r.RTTMS
+		}
+		if r.RTTMS > s.MaxMS {
+			s.MaxMS = r.RTTMS
+		}
+		total += r.RTTMS
+		s.Received++
+	}
+	if s.Received > 0 {
+		s.AvgMS = total / float64(s.Received)
+	}
+	if s.Sent > 0 {
+		s.LossPct = 100 * float64(s.Sent-s.Received) / float64(s.Sent)
+	}
+	return s
+}
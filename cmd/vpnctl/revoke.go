@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"vibepn/config"
+	vpncrypto "vibepn/crypto"
+)
+
+// runRevoke adds keys to the signed revocation list, bumps its version and
+// asks the local daemon to load it; the daemon passes it on to its peers.
+func runRevoke(args []string, jsonMode bool) error {
+	fs := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file (for revocation.file and identity)")
+	listPath := fs.String("file", "", "Path to the revocation list (overrides the config)")
+	serial := fs.Bool("serial", false, "Arguments are mesh CA serial numbers (hex) instead of fingerprints")
+	caDir := fs.String("ca-dir", "", "Sign with the mesh CA key in this directory instead of the node identity")
+	list := fs.Bool("list", false, "Show the current revocation list and exit")
+	jsonOut := fs.Bool("json", jsonMode, "Output as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s revoke [options] <fingerprint|serial>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	var cfg *config.Config
+	if *listPath == "" || (*caDir == "" && !*list) {
+		var err error
+		if cfg, err = config.Load(*configPath); err != nil {
+			return fmt.Errorf("load config %q: %w", *configPath, err)
+		}
+	}
+	path := *listPath
+	if path == "" {
+		if cfg.Revocation == nil || cfg.Revocation.File == "" {
+			return errors.New("no revocation.file in config (or pass --file)")
+		}
+		path = cfg.Revocation.File
+	}
+
+	current, err := vpncrypto.ReadRevocationFile(path)
+	if err != nil {
+		return err
+	}
+	if *list {
+		return printRevocations(path, current, *jsonOut)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("at least one fingerprint or serial is required")
+	}
+
+	next := &vpncrypto.RevocationList{Version: 1, Issued: time.Now()}
+	if current != nil {
+		next.Version = current.Version + 1
+		next.Fingerprints = slices.Clone(current.Fingerprints)
+		next.Serials = slices.Clone(current.Serials)
+	}
+	for _, arg := range fs.Args() {
+		if *serial {
+			n, ok := new(big.Int).SetString(strings.TrimPrefix(strings.ToLower(arg), "0x"), 16)
+			if !ok || n.Sign() <= 0 {
+				return fmt.Errorf("invalid serial %q: must be hex", arg)
+			}
+			if s := n.Text(16); !slices.Contains(next.Serials, s) {
+				next.Serials = append(next.Serials, s)
+			}
+			continue
+		}
+		fp := strings.ToLower(strings.TrimSpace(arg))
+		if !isValidFingerprint(fp) {
+			return fmt.Errorf("invalid fingerprint %q: must be 64 hex chars", arg)
+		}
+		if !slices.Contains(next.Fingerprints, fp) {
+			next.Fingerprints = append(next.Fingerprints, fp)
+		}
+	}
+
+	signer, err := revocationSigner(cfg, *caDir)
+	if err != nil {
+		return err
+	}
+	if err := vpncrypto.SignRevocationList(next, signer); err != nil {
+		return err
+	}
+	if err := vpncrypto.WriteRevocationFile(path, next); err != nil {
+		return err
+	}
+	fmt.Printf("Revocation list v%d written to %s (%d keys, %d serials)\n", next.Version, path, len(next.Fingerprints), len(next.Serials))
+
+	if _, err := daemonRequest("revocation-reload", nil); err != nil {
+		fmt.Printf("Daemon not updated (%v); it loads the list on start\n", err)
+		return nil
+	}
+	fmt.Println("Daemon reloaded the list and is passing it to its peers")
+	return nil
+}
+
+// revocationSigner returns the mesh CA from caDir, or the node identity.
+// Peers only accept the list from a signer they trust.
+func revocationSigner(cfg *config.Config, caDir string) (tls.Certificate, error) {
+	if caDir != "" {
+		caCert, caKey, err := vpncrypto.LoadCA(filepath.Join(caDir, "ca.crt"), filepath.Join(caDir, "ca.key"))
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.Certificate{Certificate: [][]byte{caCert.Raw}, PrivateKey: caKey}, nil
+	}
+	return loadIdentity(cfg)
+}
+
+func printRevocations(path string, rl *vpncrypto.RevocationList, jsonOut bool) error {
+	if jsonOut {
+		out := map[string]interface{}{"file": path}
+		if rl != nil {
+			out["version"] = rl.Version
+			out["issued"] = rl.Issued.Format(time.RFC3339)
+			out["signer"] = vpncrypto.Fingerprint(rl.Signer)
+			out["fingerprints"] = rl.Fingerprints
+			out["serials"] = rl.Serials
+		}
+		return printJSON(out)
+	}
+	if rl == nil {
+		fmt.Printf("No revocation list at %s\n", path)
+		return nil
+	}
+	fmt.Printf("Revocation list v%d issued %s, signed by %s\n", rl.Version, formatSeen(rl.Issued), vpncrypto.Fingerprint(rl.Signer))
+	for _, fp := range rl.Fingerprints {
+		fmt.Printf("  key    %s\n", fp)
+	}
+	for _, s := range rl.Serials {
+		fmt.Printf("  serial %s\n", s)
+	}
+	return nil
+}
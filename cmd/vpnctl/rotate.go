@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"vibepn/config"
+	vpncrypto "vibepn/crypto"
+)
+
+// runRotateKey generates a new identity next to the current one and hands
+// it to the running daemon, which announces it to peers signed by both
+// keys. Only once the daemon has switched are the files and the config
+// replaced, so a failed rotation leaves everything as it was.
+func runRotateKey(args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	grace := fs.Duration("grace", 24*time.Hour, "How long peers keep accepting the old key")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rotate-key [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if *grace < time.Minute {
+		return errors.New("--grace must be at least 1m")
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return fmt.Errorf("load config %q: %w", *configPath, err)
+	}
+	if cfg.Identity.CA != "" {
+		return errors.New("in CA mode, issue a new certificate with vpnctl ca sign instead")
+	}
+	name, err := certCommonName(cfg.Identity.Cert)
+	if err != nil {
+		return err
+	}
+
+	nextCert, nextKey := cfg.Identity.Cert+".next", cfg.Identity.Key+".next"
+	fp, err := generateIdentity(nextCert, nextKey, name)
+	if err != nil {
+		return err
+	}
+	cleanup := func() {
+		os.Remove(nextCert)
+		os.Remove(nextKey)
+	}
+
+	// 🔒 Keep the key encrypted if the current one is, with the same
+	// passphrase, so the daemon can unlock it
+	if current, err := os.ReadFile(cfg.Identity.Key); err == nil && vpncrypto.IsEncryptedKey(current) {
+		if err := encryptKeyFile(cfg, nextKey); err != nil {
+			cleanup()
+			return err
+		}
+	}
+
+	output, err := daemonRequest("rotate-key", map[string]interface{}{
+		"cert":          nextCert,
+		"key":           nextKey,
+		"grace_seconds": int(grace.Seconds()),
+	})
+	if err != nil {
+		cleanup()
+		return fmt.Errorf("daemon did not rotate (it must be running to announce the new key): %w", err)
+	}
+
+	if err := os.Rename(nextKey, cfg.Identity.Key); err != nil {
+		return fmt.Errorf("install new key: %w", err)
+	}
+	if err := os.Rename(nextCert, cfg.Identity.Cert); err != nil {
+		return fmt.Errorf("install new certificate: %w", err)
+	}
+	cfg.Identity.Fingerprint = fp
+	if err := config.Save(*configPath, cfg); err != nil {
+		return err
+	}
+
+	retires := "-"
+	if out, ok := output.(map[string]interface{}); ok {
+		retires = orDash(out["retires_at"])
+	}
+	fmt.Printf("Rotated identity to %s\nPeers accept the old key until %s\n", fp, retires)
+	return nil
+}
+
+// certCommonName reads the node name from a PEM certificate.
+func certCommonName(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read certificate: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("no certificate in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("parse certificate: %w", err)
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// encryptKeyFile encrypts the key at path with the passphrase of the
+// node's current key.
+func encryptKeyFile(cfg *config.Config, path string) error {
+	if cfg.Identity.PassphraseFile != "" {
+		vpncrypto.SetKeyPassphraseFile(cfg.Identity.PassphraseFile)
+	}
+	pass, err := vpncrypto.KeyPassphrase()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read new key: %w", err)
+	}
+	sealed, err := vpncrypto.EncryptKeyPEM(data, pass)
+	if err != nil {
+		return err
+	}
+	return replaceKeyFile(path, sealed)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"vibepn/config"
+	vpncrypto "vibepn/crypto"
+)
+
+// runTrust manages the TOFU store directly on disk. The daemon re-reads
+// the store on every handshake, so changes apply to the next connection.
+func runTrust(args []string, jsonMode bool) error {
+	fs := flag.NewFlagSet("trust", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file (for identity.known_peers)")
+	storePath := fs.String("file", "", "Path to the TOFU store (overrides the config)")
+	jsonOut := fs.Bool("json", jsonMode, "Output as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s trust [options] <command>\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Commands:")
+		fmt.Fprintln(fs.Output(), "  list                                  Show pinned peer keys")
+		fmt.Fprintln(fs.Output(), "  forget <name|fingerprint>             Remove a pin; the next key is trusted on first use")
+		fmt.Fprintln(fs.Output(), "  pin <name> <fingerprint> [address]    Pin a peer to a known key")
+		fmt.Fprintln(fs.Output(), "  accept-new <name>                     Accept the next key the peer presents")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return errors.New("a trust command is required")
+	}
+
+	path, err := trustStorePath(*storePath, *configPath)
+	if err != nil {
+		return err
+	}
+	vpncrypto.SetTOFUPath(path)
+
+	sub, rest := fs.Arg(0), fs.Args()[1:]
+	switch sub {
+	case "list":
+		if len(rest) != 0 {
+			return fmt.Errorf("usage: %s trust list", os.Args[0])
+		}
+		peers, err := vpncrypto.KnownPeers()
+		if err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(peers)
+		}
+		if len(peers) == 0 {
+			fmt.Printf("No pinned peers in %s\n", path)
+			return nil
+		}
+		for _, p := range peers {
+			fmt.Printf("%s %s\n", p.Name, p.Fingerprint)
+			fmt.Printf("  address %s  first seen %s  last seen %s\n",
+				orDash(p.Address), formatSeen(p.FirstSeen), formatSeen(p.LastSeen))
+			if p.RetireAt != nil {
+				fmt.Printf("  old key after rotation, accepted until %s\n", formatSeen(*p.RetireAt))
+			}
+			if p.AcceptNew {
+				fmt.Println("  will accept a new key on next connection")
+			}
+		}
+		return nil
+
+	case "forget":
+		if len(rest) != 1 {
+			return fmt.Errorf("usage: %s trust forget <name|fingerprint>", os.Args[0])
+		}
+		n, err := vpncrypto.ForgetPeer(rest[0])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("no pinned key matches %q", rest[0])
+		}
+		fmt.Printf("Forgot %d pinned key(s) for %s\n", n, rest[0])
+		return nil
+
+	case "pin":
+		if len(rest) < 2 || len(rest) > 3 {
+			return fmt.Errorf("usage: %s trust pin <name> <fingerprint> [address]", os.Args[0])
+		}
+		name, fp := rest[0], strings.ToLower(strings.TrimSpace(rest[1]))
+		if !isValidFingerprint(fp) {
+			return fmt.Errorf("invalid fingerprint %q: must be 64 hex chars", rest[1])
+		}
+		address := ""
+		if len(rest) == 3 {
+			address = rest[2]
+			if err := validateHostPort(address); err != nil {
+				return fmt.Errorf("invalid address: %w", err)
+			}
+		}
+		if err := vpncrypto.PinPeer(name, fp, address); err != nil {
+			return err
+		}
+		fmt.Printf("Pinned %s to %s\n", name, fp)
+		return nil
+
+	case "accept-new":
+		if len(rest) != 1 {
+			return fmt.Errorf("usage: %s trust accept-new <name>", os.Args[0])
+		}
+		if err := vpncrypto.AcceptNewKey(rest[0]); err != nil {
+			return err
+		}
+		fmt.Printf("The next key presented by %s will replace its pin\n", rest[0])
+		return nil
+
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown trust command %q", sub)
+	}
+}
+
+// trustStorePath picks the store the daemon uses: an explicit path, then
+// identity.known_peers from the config, then the default location.
+func trustStorePath(explicit, configPath string) (string, error) {
+	if explicit != "" {
+		return explicit, nil
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return vpncrypto.DefaultTOFUPath(), nil
+		}
+		return "", fmt.Errorf("load config %q: %w", configPath, err)
+	}
+	if cfg.Identity.KnownPeers != "" {
+		return cfg.Identity.KnownPeers, nil
+	}
+	return vpncrypto.DefaultTOFUPath(), nil
+}
+
+// formatSeen renders a timestamp, or "-" for entries migrated without one.
+func formatSeen(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
@@ -6,12 +6,24 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 )
 
 func ResolveAddressForNetwork(
 	network string,
 	nodeID string,
 	networks map[string]NetworkConfig,
+) (string, error) {
+	return ResolveAddressAttempt(network, nodeID, networks, 0)
+}
+
+// ResolveAddressAttempt resolves the address like ResolveAddressForNetwork,
+// with an auto address rehashed attempt times after conflicts.
+func ResolveAddressAttempt(
+	network string,
+	nodeID string,
+	networks map[string]NetworkConfig,
+	attempt int,
 ) (string, error) {
 	cfg, ok := networks[network]
 	if !ok {
@@ -22,11 +34,15 @@ func ResolveAddressForNetwork(
 		return "", fmt.Errorf("network %q has no address assigned", network)
 	}
 
+	if cfg.Address == "lease" {
+		return "", fmt.Errorf("network %q leases its address from %s", network, cfg.Coordinator)
+	}
+
 	if cfg.Address == "auto" {
 		if nodeID == "" {
 			return "", fmt.Errorf("cannot derive auto address: nodeID is empty")
 		}
-		return deriveAutoAddress(network, nodeID, cfg.Prefix)
+		return deriveAutoAddress(network, nodeID, cfg.Prefix, attempt)
 	}
 
 	ip := net.ParseIP(cfg.Address)
@@ -37,7 +53,13 @@ func ResolveAddressForNetwork(
 	return cfg.Address, nil
 }
 
-func deriveAutoAddress(network, nodeID, prefix string) (string, error) {
+// AutoAddress returns the auto address nodeID starts out with on a
+// network with prefix, before any conflict moved it.
+func AutoAddress(network, nodeID, prefix string) (string, error) {
+	return deriveAutoAddress(network, nodeID, prefix, 0)
+}
+
+func deriveAutoAddress(network, nodeID, prefix string, attempt int) (string, error) {
 	_, ipnet, err := net.ParseCIDR(prefix)
 	if err != nil {
 		return "", fmt.Errorf("invalid CIDR prefix for %s: %v", network, err)
@@ -49,7 +71,12 @@ func deriveAutoAddress(network, nodeID, prefix string) (string, error) {
 	}
 
 	// Hash of network + nodeID ensures unique IP per network per node
-	h := sha256.Sum256([]byte(network + ":" + nodeID))
+	// Attempt 0 keeps the original input, so existing addresses stay put
+	seed := network + ":" + nodeID
+	if attempt > 0 {
+		seed += ":" + strconv.Itoa(attempt)
+	}
+	h := sha256.Sum256([]byte(seed))
 	hostOffset := binary.BigEndian.Uint32(h[:4]) & ((1 << (32 - ones)) - 2) // exclude network/broadcast
 
 	base := ipnet.IP.To4()
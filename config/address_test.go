@@ -2,6 +2,7 @@ package config
 
 import (
 	"net"
+	"path/filepath"
 	"testing"
 )
 
@@ -61,3 +62,50 @@ func TestResolveAddressForNetworkMissingNetwork(t *testing.T) {
 		t.Fatalf("expected error for missing network")
 	}
 }
+
+func TestResolveAddressAttempt(t *testing.T) {
+	networks := map[string]NetworkConfig{
+		"corp": {Address: "auto", Prefix: "10.42.0.0/24"},
+	}
+
+	legacy, err := ResolveAddressForNetwork("corp", "node-a", networks)
+	if err != nil {
+		t.Fatalf("ResolveAddressForNetwork returned error: %v", err)
+	}
+	first, err := ResolveAddressAttempt("corp", "node-a", networks, 0)
+	if err != nil {
+		t.Fatalf("attempt 0 failed: %v", err)
+	}
+	if first != legacy {
+		t.Fatalf("attempt 0 should keep the original address: %q != %q", first, legacy)
+	}
+
+	next, err := ResolveAddressAttempt("corp", "node-a", networks, 1)
+	if err != nil {
+		t.Fatalf("attempt 1 failed: %v", err)
+	}
+	if next == first {
+		t.Fatalf("attempt 1 should rehash, got the same address %q", next)
+	}
+}
+
+func TestAddressStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "addresses.json")
+
+	state, err := LoadAddressState(path)
+	if err != nil || len(state) != 0 {
+		t.Fatalf("missing state should load empty, got %v, %v", state, err)
+	}
+
+	state["corp"] = 2
+	if err := state.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	loaded, err := LoadAddressState(path)
+	if err != nil {
+		t.Fatalf("LoadAddressState failed: %v", err)
+	}
+	if loaded["corp"] != 2 {
+		t.Fatalf("unexpected attempt after reload: %v", loaded)
+	}
+}
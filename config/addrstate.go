@@ -0,0 +1,63 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DefaultAddressStatePath is used when address_state is not configured.
+const DefaultAddressStatePath = "/var/lib/vibepn/addresses.json"
+
+// AddressState records, per network, how many times this node rehashed
+// its auto address after conflicts, so it keeps the address it settled on
+// across restarts.
+type AddressState map[string]int
+
+// LoadAddressState reads the state at path; a missing file is empty.
+func LoadAddressState(path string) (AddressState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return AddressState{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read address state: %w", err)
+	}
+	state := AddressState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parse address state %q: %w", path, err)
+	}
+	return state, nil
+}
+
+// Save writes the state to path, replacing the file atomically.
+func (s AddressState) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode address state: %w", err)
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create address state directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("create temp address state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write address state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write address state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replace address state %q: %w", path, err)
+	}
+	return nil
+}
@@ -1,34 +1,416 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
-	Identity Identity                 `toml:"identity"`
-	Peers    []Peer                   `toml:"peers"`
-	Networks map[string]NetworkConfig `toml:"networks"`
+	Identity   Identity                 `toml:"identity"`
+	Peers      []Peer                   `toml:"peers"`
+	Networks   map[string]NetworkConfig `toml:"networks"`
+	Management *Management              `toml:"management,omitempty"`
+	Relay      *Relay                   `toml:"relay,omitempty"`
+	Discovery  *Discovery               `toml:"discovery,omitempty"`
+	Revocation *Revocation              `toml:"revocation,omitempty"`
+	ExitNode   *ExitNode                `toml:"exit_node,omitempty"`
+	DNS        *DNS                     `toml:"dns,omitempty"`
+	// AddressState keeps auto addresses moved after conflicts, default
+	// DefaultAddressStatePath
+	AddressState string `toml:"address_state,omitempty"`
+	// JoinedPeers keeps peers admitted with an invite, default
+	// DefaultJoinedPeersPath
+	JoinedPeers string `toml:"joined_peers,omitempty"`
 }
 
 type Identity struct {
 	Cert        string `toml:"cert"`
 	Key         string `toml:"key"`
-	Fingerprint string `toml:"fingerprint"` // optional if using TOFU
+	Fingerprint string `toml:"fingerprint"`           // optional if using TOFU
+	KnownPeers  string `toml:"known_peers,omitempty"` // TOFU store, default $HOME/.vibepn/known_peers.json
+	CA          string `toml:"ca,omitempty"`          // mesh CA certificate; enables CA mode instead of TOFU
+	// PassphraseFile unlocks an encrypted key; without it the systemd
+	// credential vibepn-key-passphrase or $VIBEPN_KEY_PASSPHRASE is used
+	PassphraseFile string `toml:"passphrase_file,omitempty"`
 }
 
 type Peer struct {
 	Name        string   `toml:"name"`
 	Address     string   `toml:"address"`
-	Fingerprint string   `toml:"fingerprint"` // optional if using TOFU
+	Addresses   []string `toml:"addresses,omitempty"` // further host:port candidates, DNS names allowed
+	Fingerprint string   `toml:"fingerprint"`         // optional if using TOFU
 	Networks    []string `toml:"networks"`
 }
 
+// Candidates returns every configured dial address of the peer, address
+// first, without duplicates.
+func (p Peer) Candidates() []string {
+	out := make([]string, 0, 1+len(p.Addresses))
+	for _, a := range append([]string{p.Address}, p.Addresses...) {
+		a = strings.TrimSpace(a)
+		if a != "" && !slices.Contains(out, a) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
 type NetworkConfig struct {
-	Address string `toml:"address"` // "auto" or static IP
-	Prefix  string `toml:"prefix"`  // required if address is "auto"
+	Address string `toml:"address"` // "auto", "lease" or static IP
+	Prefix  string `toml:"prefix"`  // required if address is "auto" or "lease"
 	Export  bool   `toml:"export"`  // whether to announce to peers
+	// Mode is "tun" (default) to forward IP packets or "tap" to switch
+	// Ethernet frames between members, broadcasts included
+	Mode string `toml:"mode,omitempty"`
+	// SecretFile holds a pre-shared secret peers must prove they know
+	// before routes or packets for the network are exchanged with them
+	SecretFile string `toml:"secret_file,omitempty"`
+	// Routes are further prefixes reached through this node, such as the
+	// LAN it sits on, announced with the network's prefix
+	Routes []string `toml:"routes,omitempty"`
+	SNAT   bool     `toml:"snat,omitempty"` // masquerade overlay traffic forwarded to routes
+	// AcceptRoutes limits the prefixes beyond the network's own that we
+	// take from peers: a route is installed if one of them contains it,
+	// "*" accepts any, empty none
+	AcceptRoutes []string `toml:"accept_routes,omitempty"`
+	// Coordinator is the peer, by name or fingerprint, that leases us our
+	// address when address is "lease"
+	Coordinator string `toml:"coordinator,omitempty"`
+	// Leases makes this node the network's coordinator, leasing addresses
+	// to members that use address = "lease"
+	Leases *Leases `toml:"leases,omitempty"`
+	// Multicast forwards multicast and broadcast packets of a tun network
+	// to its members; off by default
+	Multicast *Multicast `toml:"multicast,omitempty"`
+}
+
+// CheckRoutes validates routes and accept_routes. Routes must be IPv4,
+// the only family the overlay forwards.
+func (n NetworkConfig) CheckRoutes() error {
+	for _, r := range n.Routes {
+		p, err := netip.ParsePrefix(r)
+		if err != nil {
+			return fmt.Errorf("invalid route %q: %w", r, err)
+		}
+		if !p.Addr().Is4() {
+			return fmt.Errorf("route %q is not IPv4", r)
+		}
+	}
+	for _, r := range n.AcceptRoutes {
+		if r == "*" {
+			continue
+		}
+		if _, err := netip.ParsePrefix(r); err != nil {
+			return fmt.Errorf("invalid accept_routes entry %q: %w", r, err)
+		}
+	}
+	return nil
+}
+
+// TAP reports whether the network forwards Ethernet frames.
+func (n NetworkConfig) TAP() bool {
+	return n.Mode == "tap"
+}
+
+// CheckMode validates mode. Subnet routes are IP routing, so they need a
+// tun network.
+func (n NetworkConfig) CheckMode() error {
+	switch n.Mode {
+	case "", "tun":
+		return nil
+	case "tap":
+		if len(n.Routes) > 0 {
+			return errors.New("routes are not supported with mode \"tap\"")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %q, want \"tun\" or \"tap\"", n.Mode)
+	}
+}
+
+// ForwardsMulticast reports whether multicast and broadcast packets are
+// forwarded on the network. Tap networks flood them as frames instead.
+func (n NetworkConfig) ForwardsMulticast() bool {
+	return n.Multicast != nil && n.Multicast.Enabled && !n.TAP()
+}
+
+// CheckMulticast validates the multicast settings.
+func (n NetworkConfig) CheckMulticast() error {
+	m := n.Multicast
+	if m == nil {
+		return nil
+	}
+	if n.TAP() && m.Enabled {
+		return errors.New("multicast is not supported with mode \"tap\", which floods broadcasts already")
+	}
+	if m.Rate < 0 || m.Burst < 0 {
+		return errors.New("multicast rate and burst must not be negative")
+	}
+	return nil
+}
+
+// CheckLease validates address = "lease" and the coordinator settings.
+func (n NetworkConfig) CheckLease() error {
+	if n.Address == "lease" {
+		if n.Coordinator == "" {
+			return errors.New(`address "lease" requires a coordinator`)
+		}
+		if n.Leases != nil {
+			return errors.New("a coordinator cannot lease its own address")
+		}
+	}
+	if n.Leases == nil {
+		return nil
+	}
+	p, err := netip.ParsePrefix(n.Prefix)
+	if err != nil || !p.Addr().Is4() || p.Bits() >= 31 {
+		return fmt.Errorf("leases need an IPv4 prefix shorter than /31, got %q", n.Prefix)
+	}
+	if _, err := n.Leases.LeaseDuration(); err != nil {
+		return err
+	}
+	for _, r := range n.Leases.Reserved {
+		if _, err := netip.ParsePrefix(r); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(r); err != nil {
+			return fmt.Errorf("invalid reserved address %q", r)
+		}
+	}
+	return nil
+}
+
+// AcceptsRoute reports whether a peer's announcement of prefix on the
+// network may be installed: it lies inside the network's prefix or is
+// allowed by accept_routes.
+func (n NetworkConfig) AcceptsRoute(prefix string) bool {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return false
+	}
+	if own, err := netip.ParsePrefix(n.Prefix); err == nil && prefixContains(own, p) {
+		return true
+	}
+	for _, a := range n.AcceptRoutes {
+		if a == "*" {
+			return true
+		}
+		if allowed, err := netip.ParsePrefix(a); err == nil && prefixContains(allowed, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func prefixContains(outer, inner netip.Prefix) bool {
+	return outer.Bits() <= inner.Bits() && outer.Contains(inner.Addr())
+}
+
+// minSecretLen keeps network secrets out of brute-force range.
+const minSecretLen = 16
+
+// LoadNetworkSecrets reads the secret_file of every network that has one.
+func LoadNetworkSecrets(networks map[string]NetworkConfig) (map[string][]byte, error) {
+	secrets := make(map[string][]byte)
+	for name, n := range networks {
+		if n.SecretFile == "" {
+			continue
+		}
+		data, err := os.ReadFile(n.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("read secret for network %s: %w", name, err)
+		}
+		secret := strings.TrimSpace(string(data))
+		if len(secret) < minSecretLen {
+			return nil, fmt.Errorf("secret for network %s is shorter than %d characters", name, minSecretLen)
+		}
+		secrets[name] = []byte(secret)
+	}
+	return secrets, nil
+}
+
+// Management configures the optional HTTP/JSON management API.
+type Management struct {
+	Listen    string `toml:"listen"`               // loopback "127.0.0.1:9100" or "unix:/var/run/vibepn-api.sock"
+	Token     string `toml:"token,omitempty"`      // bearer token (prefer token_file)
+	TokenFile string `toml:"token_file,omitempty"` // file containing the bearer token
+}
+
+// Relay opts this node into forwarding traffic between peers that cannot
+// reach each other directly.
+type Relay struct {
+	Enabled        bool  `toml:"enabled"`
+	MaxBytesPerSec int64 `toml:"max_bytes_per_sec,omitempty"` // cap across all relayed streams, 0 = unlimited
+}
+
+// Discovery opts this node into peer exchange: it shares a record of
+// itself signed with its identity key and learns other members from its
+// peers. Only members on the allow list are dialed.
+type Discovery struct {
+	Enabled   bool     `toml:"enabled"`
+	Advertise []string `toml:"advertise,omitempty"` // addresses others should dial us on
+	Networks  []string `toml:"networks,omitempty"`  // only dial members of these networks, empty = all local networks
+	Allow     []string `toml:"allow,omitempty"`     // fingerprints to dial, "*" = any member
+}
+
+// Revocation configures the signed list of revoked peer keys. The newest
+// list seen, from the file or from peers, is enforced and passed on.
+type Revocation struct {
+	File    string   `toml:"file"`              // where the list is loaded from and saved to
+	Signers []string `toml:"signers,omitempty"` // fingerprints allowed to sign lists; the mesh CA always is
+}
+
+// ExitNode configures default-route forwarding. A node can offer itself as
+// an exit (advertise) and route its own default traffic through another
+// node's exit (use).
+type ExitNode struct {
+	Advertise bool     `toml:"advertise,omitempty"` // announce 0.0.0.0/0 and ::/0 and masquerade tunnel traffic
+	Networks  []string `toml:"networks,omitempty"`  // networks to offer the exit on, empty = all exported ones
+	Allow     []string `toml:"allow,omitempty"`     // peer names or fingerprints that may use it, "*" = any member
+	Interface string   `toml:"interface,omitempty"` // egress interface for masquerading, empty = any
+	Use       string   `toml:"use,omitempty"`       // peer whose exit to route through, set by vpnctl exit-node use
+	Network   string   `toml:"network,omitempty"`   // network to reach that exit on, if it offers several
+}
+
+// Multicast configures multicast and broadcast forwarding. Each packet is
+// sent to every member, or with snooping to the members whose hosts joined
+// its group; link-local groups and broadcasts always go to every member.
+type Multicast struct {
+	Enabled  bool `toml:"enabled"`
+	Snooping bool `toml:"snooping,omitempty"` // learn groups from IGMP/MLD reports on the TUN
+	Rate     int  `toml:"rate,omitempty"`     // packets per second sent, and accepted per peer; default 100
+	Burst    int  `toml:"burst,omitempty"`    // packets above rate allowed at once; default rate
+}
+
+// DefaultMulticastRate is used when rate is not configured.
+const DefaultMulticastRate = 100
+
+// Limits returns the packet rate and burst.
+func (m Multicast) Limits() (rate float64, burst int) {
+	r := m.Rate
+	if r == 0 {
+		r = DefaultMulticastRate
+	}
+	b := m.Burst
+	if b == 0 {
+		b = r
+	}
+	return float64(r), b
+}
+
+// DNS runs a resolver on each network's address that answers
+// <peer>.<network>.vibepn and forwards other names upstream.
+type DNS struct {
+	Enabled   bool     `toml:"enabled"`
+	Port      int      `toml:"port,omitempty"`      // default 53
+	Upstream  []string `toml:"upstream,omitempty"`  // "ip" or "ip:port", default the nameservers in /etc/resolv.conf
+	Configure string   `toml:"configure,omitempty"` // "resolved" or "resolvconf" to point the host resolver at us
+}
+
+// Leases configures the address pool a coordinator leases from: every
+// host address in the network's prefix except its own and the reserved
+// ones.
+type Leases struct {
+	File     string   `toml:"file,omitempty"`     // where leases are kept, default DefaultLeaseFile(network)
+	Duration string   `toml:"duration,omitempty"` // lease time, default 1h; members renew halfway
+	Reserved []string `toml:"reserved,omitempty"` // addresses or prefixes never leased, e.g. static members
+}
+
+// DefaultLeaseDuration is used when duration is not configured.
+const DefaultLeaseDuration = time.Hour
+
+// minLeaseDuration keeps renewals from flooding the coordinator.
+const minLeaseDuration = time.Minute
+
+// LeaseDuration returns how long a lease is valid.
+func (l Leases) LeaseDuration() (time.Duration, error) {
+	if l.Duration == "" {
+		return DefaultLeaseDuration, nil
+	}
+	d, err := time.ParseDuration(l.Duration)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lease duration %q: %w", l.Duration, err)
+	}
+	if d < minLeaseDuration {
+		return 0, fmt.Errorf("lease duration %s is shorter than %s", d, minLeaseDuration)
+	}
+	return d, nil
+}
+
+// Path returns the lease file for network.
+func (l Leases) Path(network string) string {
+	if l.File != "" {
+		return l.File
+	}
+	return DefaultLeaseFile(network)
+}
+
+// DefaultLeaseFile is where a coordinator keeps network's leases unless
+// configured otherwise.
+func DefaultLeaseFile(network string) string {
+	return filepath.Join("/var/lib/vibepn", "leases-"+network+".json")
+}
+
+// ListenPort returns the port the resolver listens on.
+func (d DNS) ListenPort() int {
+	if d.Port == 0 {
+		return 53
+	}
+	return d.Port
+}
+
+// BearerToken returns the configured API token, reading token_file if set.
+func (m *Management) BearerToken() (string, error) {
+	if m.TokenFile != "" {
+		data, err := os.ReadFile(m.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("read token file: %w", err)
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("token file %q is empty", m.TokenFile)
+		}
+		return token, nil
+	}
+	if strings.TrimSpace(m.Token) == "" {
+		return "", errors.New("management API requires token or token_file")
+	}
+	return strings.TrimSpace(m.Token), nil
+}
+
+// Save writes cfg to path as TOML, replacing the file atomically so the
+// daemon never reads a half-written config.
+func Save(path string, cfg *Config) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create config directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("create temp config: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := toml.NewEncoder(tmp).Encode(cfg); err != nil {
+		tmp.Close()
+		return fmt.Errorf("encode config TOML: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write config %q: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replace config %q: %w", path, err)
+	}
+	return nil
 }
 
 // Load reads and parses the config file
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAcceptsRoute(t *testing.T) {
+	n := NetworkConfig{Prefix: "10.42.0.0/24", AcceptRoutes: []string{"192.168.0.0/16"}}
+
+	cases := []struct {
+		prefix string
+		want   bool
+	}{
+		{"10.42.0.0/24", true},    // the network's own prefix
+		{"10.42.0.128/25", true},  // inside it
+		{"10.42.0.0/16", false},   // wider than it
+		{"192.168.10.0/24", true}, // allowed by accept_routes
+		{"192.168.0.0/15", false}, // wider than the allowed prefix
+		{"172.16.0.0/12", false},  // not allowed
+		{"not-a-prefix", false},
+	}
+	for _, c := range cases {
+		if got := n.AcceptsRoute(c.prefix); got != c.want {
+			t.Errorf("AcceptsRoute(%s) = %v, want %v", c.prefix, got, c.want)
+		}
+	}
+
+	n.AcceptRoutes = []string{"*"}
+	if !n.AcceptsRoute("172.16.0.0/12") {
+		t.Error("\"*\" did not accept any route")
+	}
+
+	if err := (NetworkConfig{Routes: []string{"fd00::/64"}}).CheckRoutes(); err == nil {
+		t.Error("expected IPv6 route to be rejected")
+	}
+	if err := (NetworkConfig{Routes: []string{"192.168.10.0/24"}, AcceptRoutes: []string{"*", "10.0.0.0/8"}}).CheckRoutes(); err != nil {
+		t.Errorf("valid routes rejected: %v", err)
+	}
+}
+
+func TestCheckLease(t *testing.T) {
+	cases := []struct {
+		name string
+		n    NetworkConfig
+		ok   bool
+	}{
+		{"static", NetworkConfig{Address: "10.42.0.1", Prefix: "10.42.0.0/24"}, true},
+		{"leased", NetworkConfig{Address: "lease", Prefix: "10.42.0.0/24", Coordinator: "node1"}, true},
+		{"no coordinator", NetworkConfig{Address: "lease", Prefix: "10.42.0.0/24"}, false},
+		{"coordinator leasing itself", NetworkConfig{Address: "lease", Prefix: "10.42.0.0/24", Coordinator: "node1", Leases: &Leases{}}, false},
+		{"coordinator", NetworkConfig{Address: "10.42.0.1", Prefix: "10.42.0.0/24", Leases: &Leases{Duration: "2h", Reserved: []string{"10.42.0.2", "10.42.0.128/25"}}}, true},
+		{"short duration", NetworkConfig{Address: "10.42.0.1", Prefix: "10.42.0.0/24", Leases: &Leases{Duration: "10s"}}, false},
+		{"bad reserved", NetworkConfig{Address: "10.42.0.1", Prefix: "10.42.0.0/24", Leases: &Leases{Reserved: []string{"node2"}}}, false},
+		{"IPv6 pool", NetworkConfig{Address: "fd00::1", Prefix: "fd00::/64", Leases: &Leases{}}, false},
+	}
+	for _, c := range cases {
+		if err := c.n.CheckLease(); (err == nil) != c.ok {
+			t.Errorf("%s: CheckLease() = %v", c.name, err)
+		}
+	}
+}
+
+func TestCheckMode(t *testing.T) {
+	for _, n := range []NetworkConfig{{}, {Mode: "tun", Routes: []string{"192.168.10.0/24"}}, {Mode: "tap"}} {
+		if err := n.CheckMode(); err != nil {
+			t.Errorf("CheckMode(%+v) = %v", n, err)
+		}
+	}
+	for _, n := range []NetworkConfig{{Mode: "bridge"}, {Mode: "tap", Routes: []string{"192.168.10.0/24"}}} {
+		if err := n.CheckMode(); err == nil {
+			t.Errorf("CheckMode(%+v) accepted an invalid mode", n)
+		}
+	}
+}
+
+func TestCheckMulticast(t *testing.T) {
+	on := &Multicast{Enabled: true}
+	if err := (NetworkConfig{Multicast: on}).CheckMulticast(); err != nil {
+		t.Errorf("tun multicast rejected: %v", err)
+	}
+	if err := (NetworkConfig{Mode: "tap", Multicast: on}).CheckMulticast(); err == nil {
+		t.Error("tap multicast accepted")
+	}
+	if err := (NetworkConfig{Multicast: &Multicast{Enabled: true, Rate: -1}}).CheckMulticast(); err == nil {
+		t.Error("negative rate accepted")
+	}
+
+	if rate, burst := on.Limits(); rate != DefaultMulticastRate || burst != DefaultMulticastRate {
+		t.Errorf("default limits = %v, %d", rate, burst)
+	}
+	if rate, burst := (Multicast{Rate: 10, Burst: 50}).Limits(); rate != 10 || burst != 50 {
+		t.Errorf("limits = %v, %d, want 10, 50", rate, burst)
+	}
+}
+
+func TestMergeJoinedPeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "joined-peers.toml")
+	joined := []Peer{
+		{Name: "node3", Address: "203.0.113.3:51820", Fingerprint: "fp-3", Networks: []string{"corp"}},
+		{Name: "node2", Fingerprint: "fp-other", Networks: []string{"corp"}},
+	}
+	if err := SaveJoinedPeers(path, joined); err != nil {
+		t.Fatalf("SaveJoinedPeers failed: %v", err)
+	}
+
+	cfg := &Config{JoinedPeers: path, Peers: []Peer{{Name: "node2", Fingerprint: "fp-2"}}}
+	if err := cfg.MergeJoinedPeers(); err != nil {
+		t.Fatalf("MergeJoinedPeers failed: %v", err)
+	}
+	if len(cfg.Peers) != 2 || cfg.Peers[0].Fingerprint != "fp-2" || cfg.Peers[1].Name != "node3" || cfg.Peers[1].Networks[0] != "corp" {
+		t.Fatalf("merged peers = %+v, want node2 from the config and node3 joined", cfg.Peers)
+	}
+
+	missing := &Config{JoinedPeers: filepath.Join(t.TempDir(), "none.toml")}
+	if err := missing.MergeJoinedPeers(); err != nil || len(missing.Peers) != 0 {
+		t.Fatalf("missing joined peers file: %v, %+v", err, missing.Peers)
+	}
+}
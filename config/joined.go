@@ -0,0 +1,91 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+)
+
+// DefaultJoinedPeersPath is used when joined_peers is not configured. It
+// lives in the daemon's state directory, which it can write, unlike the
+// config file.
+const DefaultJoinedPeersPath = "/var/lib/vibepn/joined-peers.toml"
+
+type joinedFile struct {
+	Peers []Peer `toml:"peers"`
+}
+
+// JoinedPeersPath returns where peers admitted with an invite are kept.
+func (c *Config) JoinedPeersPath() string {
+	if c.JoinedPeers != "" {
+		return c.JoinedPeers
+	}
+	return DefaultJoinedPeersPath
+}
+
+// LoadJoinedPeers reads the peers at path; a missing file is empty.
+func LoadJoinedPeers(path string) ([]Peer, error) {
+	var f joinedFile
+	_, err := toml.DecodeFile(path, &f)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read joined peers %q: %w", path, err)
+	}
+	return f.Peers, nil
+}
+
+// SaveJoinedPeers writes peers to path, replacing the file atomically.
+func SaveJoinedPeers(path string, peers []Peer) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create joined peers directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("create temp joined peers: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := toml.NewEncoder(tmp).Encode(joinedFile{Peers: peers}); err != nil {
+		tmp.Close()
+		return fmt.Errorf("encode joined peers: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write joined peers: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replace joined peers %q: %w", path, err)
+	}
+	return nil
+}
+
+// MergeJoinedPeers adds the peers kept at JoinedPeersPath to c.Peers. A
+// peer in the config file wins over a joined one with the same name or
+// fingerprint.
+func (c *Config) MergeJoinedPeers() error {
+	joined, err := LoadJoinedPeers(c.JoinedPeersPath())
+	if err != nil {
+		return err
+	}
+	for _, p := range joined {
+		if !c.hasPeer(p) {
+			c.Peers = append(c.Peers, p)
+		}
+	}
+	return nil
+}
+
+func (c *Config) hasPeer(p Peer) bool {
+	for _, existing := range c.Peers {
+		if existing.Name == p.Name || (p.Fingerprint != "" && existing.Fingerprint == p.Fingerprint) {
+			return true
+		}
+	}
+	return false
+}
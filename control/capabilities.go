@@ -0,0 +1,74 @@
+package control
+
+import "sync/atomic"
+
+// Capability bits advertised in Hello. An optional feature is only used
+// with a peer when both sides advertise it; peers that send a bare 8-byte
+// Hello negotiate none.
+const (
+	CapKeepaliveAck uint32 = 1 << iota
+	CapEcho
+	CapNATPunch
+	CapRelay // service bit: the sender forwards traffic for other peers
+	CapGossip
+	CapRevocation
+	CapRotation
+	CapNetworkSecret
+	CapAddress
+	CapLease // service bit: the sender leases addresses on some network
+	CapMulticast
+)
+
+// Service bits describe something the peer offers rather than a protocol
+// feature, so they are kept as advertised instead of intersected.
+const serviceCapabilities = CapRelay | CapLease
+
+var localCaps atomic.Uint32
+
+func init() {
+	localCaps.Store(CapKeepaliveAck | CapEcho | CapNATPunch | CapRevocation | CapRotation | CapNetworkSecret | CapAddress | CapMulticast)
+}
+
+// LocalCapabilities is the set this node advertises.
+func LocalCapabilities() uint32 {
+	return localCaps.Load()
+}
+
+// EnableCapability adds bit to what this node advertises in future Hellos.
+func EnableCapability(bit uint32) {
+	localCaps.Store(localCaps.Load() | bit)
+}
+
+// NegotiateCapabilities returns the capabilities in effect with a peer
+// that advertised peerCaps.
+func NegotiateCapabilities(peerCaps uint32) uint32 {
+	return LocalCapabilities()&peerCaps&^serviceCapabilities | peerCaps&serviceCapabilities
+}
+
+var capabilityNames = map[uint32]string{
+	CapKeepaliveAck:  "keepalive-ack",
+	CapEcho:          "echo",
+	CapNATPunch:      "nat-punch",
+	CapRelay:         "relay",
+	CapGossip:        "gossip",
+	CapRevocation:    "revocation",
+	CapRotation:      "rotation",
+	CapNetworkSecret: "network-secret",
+	CapAddress:       "address",
+	CapLease:         "lease",
+	CapMulticast:     "multicast",
+}
+
+// CapabilityNames lists the names of the bits set in caps.
+func CapabilityNames(caps uint32) []string {
+	names := make([]string, 0, len(capabilityNames))
+	for bit := uint32(1); bit != 0; bit <<= 1 {
+		if caps&bit == 0 {
+			continue
+		}
+		if name, ok := capabilityNames[bit]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
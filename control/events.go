@@ -0,0 +1,62 @@
+package control
+
+import (
+	"sync"
+	"time"
+)
+
+const eventBufferSize = 64
+
+type Event struct {
+	Type string                 `json:"type"`
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+var events struct {
+	sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func init() {
+	events.subs = make(map[chan Event]struct{})
+}
+
+// PublishEvent fans an event out to all subscribers. Slow subscribers
+// miss events rather than blocking the publisher.
+func PublishEvent(eventType string, data map[string]interface{}) {
+	ev := Event{
+		Type: eventType,
+		Time: time.Now().UTC(),
+		Data: data,
+	}
+
+	events.Lock()
+	defer events.Unlock()
+	for ch := range events.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// SubscribeEvents returns a channel of future events and a function that
+// must be called to release it.
+func SubscribeEvents() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+
+	events.Lock()
+	events.subs[ch] = struct{}{}
+	events.Unlock()
+
+	cancel := func() {
+		events.Lock()
+		defer events.Unlock()
+		if _, ok := events.subs[ch]; ok {
+			delete(events.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
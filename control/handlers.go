@@ -6,12 +6,88 @@ import (
 	"time"
 
 	"vibepn/config"
+	"vibepn/crypto"
 	"vibepn/log"
 	"vibepn/netgraph"
+	"vibepn/shared"
 )
 
 type CommandRequest struct {
-	Cmd string `json:"cmd"`
+	Cmd  string          `json:"cmd"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type peerArgs struct {
+	Peer string `json:"peer"`
+}
+
+type rotateArgs struct {
+	Cert         string `json:"cert"`
+	Key          string `json:"key"`
+	GraceSeconds int    `json:"grace_seconds,omitempty"`
+}
+
+// defaultRotationGrace is how long peers keep accepting a rotated-out key.
+const defaultRotationGrace = 24 * time.Hour
+
+type probeArgs struct {
+	Peer      string `json:"peer,omitempty"`
+	Network   string `json:"network,omitempty"`
+	Target    string `json:"target,omitempty"`
+	TTL       int    `json:"ttl,omitempty"`
+	TimeoutMS int    `json:"timeout_ms,omitempty"`
+}
+
+type exitArgs struct {
+	Action  string `json:"action"` // use, off or list
+	Peer    string `json:"peer,omitempty"`
+	Network string `json:"network,omitempty"`
+}
+
+// maxProbeTimeout keeps a single probe inside the control socket deadline.
+const maxProbeTimeout = 1500 * time.Millisecond
+
+func (a probeArgs) timeout() time.Duration {
+	d := time.Duration(a.TimeoutMS) * time.Millisecond
+	if d <= 0 || d > maxProbeTimeout {
+		return maxProbeTimeout
+	}
+	return d
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func peerStateName(p shared.PeerState) string {
+	switch {
+	case p.Disabled:
+		return "disabled"
+	case p.Connected:
+		return "connected"
+	default:
+		return "disconnected"
+	}
+}
+
+func connectedPeers() int {
+	n := 0
+	for _, p := range GetPeerTracker().ListPeers() {
+		if p.Connected {
+			n++
+		}
+	}
+	return n
+}
+
+func hopOutput(hop TraceHop, rtt time.Duration) map[string]interface{} {
+	return map[string]interface{}{
+		"peer":        hop.Peer,
+		"name":        hop.Name,
+		"rtt_ms":      durationMS(rtt),
+		"reached":     hop.Reached,
+		"unreachable": hop.Unreachable,
+	}
 }
 
 type CommandResponse struct {
@@ -20,7 +96,7 @@ type CommandResponse struct {
 	Error  string      `json:"error,omitempty"`
 }
 
-func Handle(cmd string, _ json.RawMessage, logger *log.Logger) CommandResponse {
+func Handle(cmd string, args json.RawMessage, logger *log.Logger) CommandResponse {
 	switch cmd {
 	case "routes":
 		var output []map[string]interface{}
@@ -38,17 +114,44 @@ func Handle(cmd string, _ json.RawMessage, logger *log.Logger) CommandResponse {
 	case "peers":
 		var output []map[string]interface{}
 		for _, p := range GetPeerTracker().ListPeers() {
-			output = append(output, map[string]interface{}{
-				"id":        p.ID,
-				"last_seen": p.LastSeen.Format(time.RFC3339),
-			})
+			entry := map[string]interface{}{
+				"id":             p.ID,
+				"name":           p.Name,
+				"address":        p.Address,
+				"endpoint":       p.Endpoint,
+				"remote":         p.Remote,
+				"observed_as":    p.ObservedAddr,
+				"relay_via":      p.RelayVia,
+				"direction":      p.Direction,
+				"discovered":     p.Discovered,
+				"state":          peerStateName(p),
+				"capabilities":   CapabilityNames(p.Capabilities),
+				"networks":       p.Networks,
+				"exit_networks":  p.ExitNetworks,
+				"subnets":        p.Subnets,
+				"last_seen":      p.LastSeen.Format(time.RFC3339),
+				"rtt_ms":         durationMS(p.RTT),
+				"jitter_ms":      durationMS(p.Jitter),
+				"quic_rtt_ms":    durationMS(p.QUICRTT),
+				"cwnd":           p.CongestionWindow,
+				"packets_lost":   p.PacketsLost,
+				"loss_pct":       100 * p.LossRatio(),
+				"bytes_sent":     p.BytesSent,
+				"bytes_received": p.BytesReceived,
+				"tx_bps":         p.TxRate,
+				"rx_bps":         p.RxRate,
+			}
+			if p.Connected {
+				entry["connected_since"] = p.ConnectedAt.Format(time.RFC3339)
+			}
+			output = append(output, entry)
 		}
 		return CommandResponse{Status: "ok", Output: output}
 
 	case "status":
 		resp := map[string]interface{}{
 			"uptime": Uptime(),
-			"peers":  len(GetPeerTracker().ListPeers()),
+			"peers":  connectedPeers(),
 			"routes": len(GetRouteTable().AllRoutes()),
 		}
 		return CommandResponse{Status: "ok", Output: resp}
@@ -61,6 +164,12 @@ func Handle(cmd string, _ json.RawMessage, logger *log.Logger) CommandResponse {
 				Error:  "failed to reload config: " + err.Error(),
 			}
 		}
+		if err := cfg.MergeJoinedPeers(); err != nil {
+			return CommandResponse{
+				Status: "error",
+				Error:  "failed to reload joined peers: " + err.Error(),
+			}
+		}
 
 		// 🔍 Static validation
 		seenNames := make(map[string]bool)
@@ -87,6 +196,33 @@ func Handle(cmd string, _ json.RawMessage, logger *log.Logger) CommandResponse {
 					Error:  "invalid prefix for network " + name + ": " + err.Error(),
 				}
 			}
+
+			if err := net.CheckMode(); err != nil {
+				return CommandResponse{
+					Status: "error",
+					Error:  "network " + name + ": " + err.Error(),
+				}
+			}
+			if err := net.CheckMulticast(); err != nil {
+				return CommandResponse{
+					Status: "error",
+					Error:  "network " + name + ": " + err.Error(),
+				}
+			}
+
+			if err := net.CheckLease(); err != nil {
+				return CommandResponse{
+					Status: "error",
+					Error:  "network " + name + ": " + err.Error(),
+				}
+			}
+
+			if err := net.CheckRoutes(); err != nil {
+				return CommandResponse{
+					Status: "error",
+					Error:  "network " + name + ": " + err.Error(),
+				}
+			}
 		}
 
 		if cfg.Identity.Fingerprint == "" || cfg.Identity.Cert == "" || cfg.Identity.Key == "" {
@@ -96,24 +232,40 @@ func Handle(cmd string, _ json.RawMessage, logger *log.Logger) CommandResponse {
 			}
 		}
 
+		secrets, err := config.LoadNetworkSecrets(cfg.Networks)
+		if err != nil {
+			return CommandResponse{
+				Status: "error",
+				Error:  err.Error(),
+			}
+		}
+
 		// 🧠 If passed, apply
 		RegisterNetConfig(cfg.Networks)
+		crypto.SetNetworkSecrets(secrets)
 		routeTable := GetRouteTable()
 		peerTracker := GetPeerTracker()
 		routeTable.RemoveByPeer(cfg.Identity.Fingerprint)
 
 		for name, net := range cfg.Networks {
-			route := netgraph.Route{
-				Prefix: net.Prefix,
-				PeerID: cfg.Identity.Fingerprint,
-				Metric: 1,
-			}
+			for _, prefix := range append([]string{net.Prefix}, net.Routes...) {
+				route := netgraph.Route{
+					Prefix: prefix,
+					PeerID: cfg.Identity.Fingerprint,
+					Metric: 1,
+				}
 
-			for _, p := range peerTracker.ListPeers() {
-				SendRouteToPeer(p.ID, name, route)
+				for _, p := range peerTracker.ListPeers() {
+					if !p.Connected {
+						continue
+					}
+					SendRouteToPeer(p.ID, name, route)
+				}
 			}
 		}
 
+		PublishEvent("reload", nil)
+
 		return CommandResponse{
 			Status: "ok",
 			Output: map[string]interface{}{
@@ -121,6 +273,146 @@ func Handle(cmd string, _ json.RawMessage, logger *log.Logger) CommandResponse {
 			},
 		}
 
+	case "peer-enable", "peer-disable":
+		var a peerArgs
+		if len(args) > 0 {
+			if err := json.Unmarshal(args, &a); err != nil {
+				return CommandResponse{Status: "error", Error: "invalid args: " + err.Error()}
+			}
+		}
+		if a.Peer == "" {
+			return CommandResponse{Status: "error", Error: "missing peer"}
+		}
+
+		enabled := cmd == "peer-enable"
+		if err := SetPeerEnabled(a.Peer, enabled); err != nil {
+			return CommandResponse{Status: "error", Error: err.Error()}
+		}
+
+		state := "disabled"
+		if enabled {
+			state = "enabled"
+		}
+		PublishEvent("peer_"+state, map[string]interface{}{"peer": a.Peer})
+
+		return CommandResponse{
+			Status: "ok",
+			Output: map[string]interface{}{
+				"message": "peer " + a.Peer + " " + state,
+			},
+		}
+
+	case "revocation-reload":
+		version, err := ReloadRevocations()
+		if err != nil {
+			return CommandResponse{Status: "error", Error: err.Error()}
+		}
+		return CommandResponse{
+			Status: "ok",
+			Output: map[string]interface{}{
+				"message": "revocation list reloaded",
+				"version": version,
+			},
+		}
+
+	case "rotate-key":
+		var a rotateArgs
+		if len(args) > 0 {
+			if err := json.Unmarshal(args, &a); err != nil {
+				return CommandResponse{Status: "error", Error: "invalid args: " + err.Error()}
+			}
+		}
+		if a.Cert == "" || a.Key == "" {
+			return CommandResponse{Status: "error", Error: "rotate-key requires cert and key"}
+		}
+		grace := time.Duration(a.GraceSeconds) * time.Second
+		if grace <= 0 {
+			grace = defaultRotationGrace
+		}
+		fp, err := RotateKey(a.Cert, a.Key, grace)
+		if err != nil {
+			return CommandResponse{Status: "error", Error: err.Error()}
+		}
+		PublishEvent("key_rotated", map[string]interface{}{"fingerprint": fp})
+		return CommandResponse{
+			Status: "ok",
+			Output: map[string]interface{}{
+				"message":     "identity rotated",
+				"fingerprint": fp,
+				"retires_at":  time.Now().Add(grace).Format(time.RFC3339),
+			},
+		}
+
+	case "ping", "trace":
+		if GetProber() == nil {
+			return CommandResponse{Status: "error", Error: "probing not available"}
+		}
+		var a probeArgs
+		if len(args) > 0 {
+			if err := json.Unmarshal(args, &a); err != nil {
+				return CommandResponse{Status: "error", Error: "invalid args: " + err.Error()}
+			}
+		}
+
+		var (
+			hop TraceHop
+			rtt time.Duration
+			err error
+		)
+		if cmd == "ping" {
+			if a.Peer == "" {
+				return CommandResponse{Status: "error", Error: "missing peer"}
+			}
+			hop, rtt, err = GetProber().Ping(a.Peer, a.timeout())
+		} else {
+			if a.Target == "" || a.TTL < 1 || a.TTL > 255 {
+				return CommandResponse{Status: "error", Error: "trace requires target and ttl 1-255"}
+			}
+			hop, rtt, err = GetProber().Trace(a.Network, a.Target, a.TTL, a.timeout())
+		}
+		if err != nil {
+			return CommandResponse{Status: "error", Error: err.Error()}
+		}
+		return CommandResponse{Status: "ok", Output: hopOutput(hop, rtt)}
+
+	case "exit-node":
+		if GetExitNodes() == nil {
+			return CommandResponse{Status: "error", Error: "exit nodes not available"}
+		}
+		var a exitArgs
+		if len(args) > 0 {
+			if err := json.Unmarshal(args, &a); err != nil {
+				return CommandResponse{Status: "error", Error: "invalid args: " + err.Error()}
+			}
+		}
+		switch a.Action {
+		case "use":
+			if a.Peer == "" {
+				return CommandResponse{Status: "error", Error: "missing peer"}
+			}
+		case "off":
+			a.Peer, a.Network = "", ""
+		case "list", "":
+			return CommandResponse{Status: "ok", Output: GetExitNodes().ExitStatus()}
+		default:
+			return CommandResponse{Status: "error", Error: "unknown exit-node action: " + a.Action}
+		}
+		if err := GetExitNodes().UseExit(a.Peer, a.Network); err != nil {
+			return CommandResponse{Status: "error", Error: err.Error()}
+		}
+		PublishEvent("exit_node_selected", map[string]interface{}{"peer": a.Peer, "network": a.Network})
+		return CommandResponse{Status: "ok", Output: GetExitNodes().ExitStatus()}
+
+	case "leases":
+		if GetLeaseServer() == nil {
+			return CommandResponse{Status: "error", Error: "leases not available"}
+		}
+		output, err := GetLeaseServer().LeaseStatus()
+		if err != nil {
+			return CommandResponse{Status: "error", Error: err.Error()}
+		}
+		return CommandResponse{Status: "ok", Output: output}
+
 	case "goodbye":
 		TriggerGoodbye()
 		return CommandResponse{
@@ -0,0 +1,157 @@
+package control
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"vibepn/log"
+)
+
+// StartHTTP serves the management API on addr, which is either a loopback
+// TCP address ("127.0.0.1:9100") or a unix socket ("unix:/path/to.sock").
+// Every request must carry "Authorization: Bearer <token>".
+func StartHTTP(addr, token string) error {
+	logger := log.New("control/http")
+
+	if token == "" {
+		return errors.New("management API requires a bearer token")
+	}
+
+	var (
+		l   net.Listener
+		err error
+	)
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		_ = os.Remove(path)
+		l, err = net.Listen("unix", path)
+		if err == nil {
+			if err := os.Chmod(path, 0o600); err != nil {
+				logger.Warnf("Failed to set socket permissions: %v", err)
+			}
+		}
+	} else {
+		if err := loopbackAddr(addr); err != nil {
+			return err
+		}
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("management listen: %w", err)
+	}
+
+	logger.Infof("Serving management API on %s", addr)
+	return http.Serve(l, newHTTPHandler(token, logger))
+}
+
+// loopbackAddr checks that a TCP management address only listens on
+// this host: the API can reload the config and toggle peers.
+func loopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("management listen %q: %w", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("management listen %q: only loopback addresses or a unix socket are allowed", addr)
+	}
+	return nil
+}
+
+func newHTTPHandler(token string, logger *log.Logger) http.Handler {
+	mux := http.NewServeMux()
+
+	command := func(cmd string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			writeCommandResponse(w, Handle(cmd, nil, logger))
+		}
+	}
+	peerCommand := func(cmd string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			args, _ := json.Marshal(peerArgs{Peer: r.PathValue("id")})
+			writeCommandResponse(w, Handle(cmd, args, logger))
+		}
+	}
+
+	mux.HandleFunc("GET /v1/status", command("status"))
+	mux.HandleFunc("GET /v1/peers", command("peers"))
+	mux.HandleFunc("GET /v1/routes", command("routes"))
+	mux.HandleFunc("POST /v1/reload", command("reload"))
+	mux.HandleFunc("POST /v1/revocations/reload", command("revocation-reload"))
+	mux.HandleFunc("POST /v1/peers/{id}/enable", peerCommand("peer-enable"))
+	mux.HandleFunc("POST /v1/peers/{id}/disable", peerCommand("peer-disable"))
+	mux.HandleFunc("GET /v1/events", serveEvents)
+
+	return requireToken(token, mux)
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vibepn"`)
+			writeJSON(w, http.StatusUnauthorized, CommandResponse{Status: "error", Error: "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeCommandResponse(w http.ResponseWriter, resp CommandResponse) {
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp CommandResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// serveEvents streams control events as server-sent events until the
+// client goes away.
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, CommandResponse{Status: "error", Error: "streaming unsupported"})
+		return
+	}
+
+	ch, cancel := SubscribeEvents()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
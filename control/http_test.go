@@ -0,0 +1,94 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vibepn/log"
+	"vibepn/netgraph"
+	"vibepn/shared"
+)
+
+type fakeTracker struct{}
+
+func (fakeTracker) ListPeers() []shared.PeerState {
+	return []shared.PeerState{{ID: "peer-a", Connected: true}}
+}
+func (fakeTracker) UpdatePeer(string)               {}
+func (fakeTracker) RecordRTT(string, time.Duration) {}
+
+func TestHTTPRequiresBearerToken(t *testing.T) {
+	Register(netgraph.NewRouteTable(), fakeTracker{}, nil)
+	h := newHTTPHandler("secret", log.New("control/http-test"))
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/status", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Authorization %q: status = %d, want %d", auth, rec.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestHTTPStatusAndPeerToggle(t *testing.T) {
+	Register(netgraph.NewRouteTable(), fakeTracker{}, nil)
+	var toggled string
+	var toggledEnabled bool
+	RegisterPeerToggle(func(peerID string, enabled bool) error {
+		toggled, toggledEnabled = peerID, enabled
+		return nil
+	})
+	defer RegisterPeerToggle(nil)
+
+	h := newHTTPHandler("secret", log.New("control/http-test"))
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/status", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var resp CommandResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode status response: %v", err)
+	}
+	out, _ := resp.Output.(map[string]interface{})
+	if resp.Status != "ok" || out["peers"] != float64(1) {
+		t.Fatalf("unexpected status response: %+v", resp)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/peers/peer-a/disable", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("disable code = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	if toggled != "peer-a" || toggledEnabled {
+		t.Fatalf("toggle callback got (%q, %v), want (%q, false)", toggled, toggledEnabled, "peer-a")
+	}
+}
+
+func TestHTTPListensOnLoopbackOnly(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:9100", "[::1]:9100", "localhost:9100"} {
+		if err := loopbackAddr(addr); err != nil {
+			t.Errorf("loopbackAddr(%q) = %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"0.0.0.0:9100", ":9100", "[::]:9100", "192.0.2.10:9100", "example.com:9100", "127.0.0.1"} {
+		if err := loopbackAddr(addr); err == nil {
+			t.Errorf("loopbackAddr(%q) accepted", addr)
+		}
+	}
+	if err := StartHTTP("0.0.0.0:0", "secret"); err == nil {
+		t.Fatal("StartHTTP served on a wildcard address")
+	}
+}
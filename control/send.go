@@ -3,6 +3,8 @@ package control
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
+	"sync"
 	"time"
 
 	"vibepn/log"
@@ -10,23 +12,66 @@ import (
 	"github.com/quic-go/quic-go"
 )
 
+// streamLocks serializes writes per stream so that messages sent
+// concurrently (keepalives, echoes, announcements) never interleave, while
+// a peer that stops reading only blocks writes to its own stream.
+var streamLocks struct {
+	sync.Mutex
+	m map[quic.Stream]*sync.Mutex
+}
+
+func init() {
+	streamLocks.m = make(map[quic.Stream]*sync.Mutex)
+}
+
+// streamLock returns the write lock of stream, dropped once its write side
+// is closed.
+func streamLock(stream quic.Stream) *sync.Mutex {
+	streamLocks.Lock()
+	defer streamLocks.Unlock()
+	mu := streamLocks.m[stream]
+	if mu == nil {
+		mu = &sync.Mutex{}
+		streamLocks.m[stream] = mu
+		go func() {
+			<-stream.Context().Done()
+			streamLocks.Lock()
+			delete(streamLocks.m, stream)
+			streamLocks.Unlock()
+		}()
+	}
+	return mu
+}
+
+// writeMessage frames buf with its 2-byte big-endian length and writes it
+// in a single call.
+func writeMessage(stream quic.Stream, buf []byte) error {
+	if len(buf) > 0xFFFF {
+		return fmt.Errorf("control message too large: %d bytes", len(buf))
+	}
+
+	frame := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(frame, uint16(len(buf)))
+	copy(frame[2:], buf)
+
+	mu := streamLock(stream)
+	mu.Lock()
+	defer mu.Unlock()
+	_, err := stream.Write(frame)
+	return err
+}
+
+// SendHello sends the tie-breaker nonce followed by our capability bits.
 func SendHello(stream quic.Stream, tieBreakerNonce uint64) error {
 	logger := log.New("control/hello")
 
-	buf := make([]byte, 9)
+	buf := make([]byte, 13)
 	buf[0] = 'H'
-	binary.BigEndian.PutUint64(buf[1:], tieBreakerNonce)
+	binary.BigEndian.PutUint64(buf[1:9], tieBreakerNonce)
+	binary.BigEndian.PutUint32(buf[9:], LocalCapabilities())
 
-	length := make([]byte, 2)
-	binary.BigEndian.PutUint16(length, uint16(len(buf)))
-
-	_, err := stream.Write(length)
-	if err != nil {
-		return fmt.Errorf("send hello length: %w", err)
-	}
-	_, err = stream.Write(buf)
-	if err != nil {
-		return fmt.Errorf("send hello payload: %w", err)
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send hello: %w", err)
 	}
 
 	logger.Infof("Sent Hello with nonce %d", tieBreakerNonce)
@@ -58,16 +103,8 @@ func SendRouteAnnounce(stream quic.Stream, network string, prefixes []string) er
 		buf = append(buf, metricBuf...)
 	}
 
-	length := make([]byte, 2)
-	binary.BigEndian.PutUint16(length, uint16(len(buf)))
-
-	_, err := stream.Write(length)
-	if err != nil {
-		return fmt.Errorf("send route-announce length: %w", err)
-	}
-	_, err = stream.Write(buf)
-	if err != nil {
-		return fmt.Errorf("send route-announce payload: %w", err)
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send route-announce: %w", err)
 	}
 
 	logger.Infof("Sent Route-Announce for network %s (%d prefixes)", network, len(prefixes))
@@ -94,47 +131,38 @@ func SendRouteWithdraw(stream quic.Stream, network string, prefix string) error
 	buf = append(buf, byte(len(prefix)))
 	buf = append(buf, []byte(prefix)...)
 
-	length := make([]byte, 2)
-	binary.BigEndian.PutUint16(length, uint16(len(buf)))
-
-	_, err := stream.Write(length)
-	if err != nil {
-		return fmt.Errorf("send route-withdraw length: %w", err)
-	}
-	_, err = stream.Write(buf)
-	if err != nil {
-		return fmt.Errorf("send route-withdraw payload: %w", err)
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send route-withdraw: %w", err)
 	}
 
 	logger.Infof("Sent Route-Withdraw for network %s prefix %s", network, prefix)
 	return nil
 }
 
-// 🚀 Send a Keepalive
+// 🚀 Send a Keepalive. The body carries the send time in nanoseconds, which
+// the peer echoes back in a Keepalive-Ack so we can measure RTT.
 func SendKeepalive(stream quic.Stream) error {
 	logger := log.New("control/keepalive")
 
-	buf := []byte{'K'} // control type 'K'
+	buf := make([]byte, 9)
+	buf[0] = 'K' // control type 'K'
+	binary.BigEndian.PutUint64(buf[1:], uint64(time.Now().UnixNano()))
 
-	timestamp := uint64(time.Now().Unix())
-	timestampBuf := make([]byte, 8)
-	binary.BigEndian.PutUint64(timestampBuf, timestamp)
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send keepalive: %w", err)
+	}
 
-	buf = append(buf, timestampBuf...)
+	logger.Debugf("Sent Keepalive")
+	return nil
+}
 
-	length := make([]byte, 2)
-	binary.BigEndian.PutUint16(length, uint16(len(buf)))
+// 🚀 Send a Keepalive-Ack echoing the timestamp of a received Keepalive
+func SendKeepaliveAck(stream quic.Stream, timestamp []byte) error {
+	buf := append([]byte{'k'}, timestamp...) // control type 'k'
 
-	_, err := stream.Write(length)
-	if err != nil {
-		return fmt.Errorf("send keepalive length: %w", err)
-	}
-	_, err = stream.Write(buf)
-	if err != nil {
-		return fmt.Errorf("send keepalive payload: %w", err)
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send keepalive-ack: %w", err)
 	}
-
-	logger.Debugf("Sent Keepalive")
 	return nil
 }
 
@@ -144,18 +172,286 @@ func SendGoodbye(stream quic.Stream) error {
 
 	buf := []byte{'G'} // control type 'G'
 
-	length := make([]byte, 2)
-	binary.BigEndian.PutUint16(length, uint16(len(buf)))
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send goodbye: %w", err)
+	}
 
-	_, err := stream.Write(length)
+	logger.Infof("Sent Goodbye")
+	return nil
+}
+
+// 🚀 Send an Observed-Address telling the peer the address (ip:port) its
+// packets arrive from, i.e. its reflexive address.
+func SendObservedAddr(stream quic.Stream, addr string) error {
+	buf, err := appendString([]byte{'O'}, addr) // control type 'O'
 	if err != nil {
-		return fmt.Errorf("send goodbye length: %w", err)
+		return fmt.Errorf("send observed address: %w", err)
+	}
+
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send observed address: %w", err)
+	}
+	return nil
+}
+
+// 🚀 Send a Punch. With an empty addr it asks the receiver to broker a hole
+// punch towards peer; with an addr it tells the receiver to dial peer there.
+func SendPunch(stream quic.Stream, peer, addr string) error {
+	buf, err := appendString([]byte{'P'}, peer) // control type 'P'
+	if err == nil {
+		buf, err = appendString(buf, addr)
 	}
-	_, err = stream.Write(buf)
 	if err != nil {
-		return fmt.Errorf("send goodbye payload: %w", err)
+		return fmt.Errorf("send punch: %w", err)
 	}
 
-	logger.Infof("Sent Goodbye")
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send punch: %w", err)
+	}
+	return nil
+}
+
+// 🚀 Send a Gossip message carrying one signed member record. The record is
+// opaque here; peers forward it verbatim.
+func SendGossip(stream quic.Stream, record []byte) error {
+	buf := make([]byte, 0, 1+len(record))
+	buf = append(buf, 'X') // control type 'X'
+	buf = append(buf, record...)
+
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send gossip: %w", err)
+	}
+	return nil
+}
+
+// 🚀 Send a Revocations message carrying the signed revocation list in
+// force. Like gossip records, it is forwarded verbatim.
+func SendRevocations(stream quic.Stream, list []byte) error {
+	buf := make([]byte, 0, 1+len(list))
+	buf = append(buf, 'V') // control type 'V'
+	buf = append(buf, list...)
+
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send revocations: %w", err)
+	}
+	return nil
+}
+
+// 🚀 Send a Succession message announcing the key that replaces ours. It is
+// signed by both keys and checked by the receiver.
+func SendSuccession(stream quic.Stream, announcement []byte) error {
+	buf := make([]byte, 0, 1+len(announcement))
+	buf = append(buf, 'S') // control type 'S'
+	buf = append(buf, announcement...)
+
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send succession: %w", err)
+	}
+	return nil
+}
+
+// 🚀 Send a Join request redeeming an invite token. name is the joiner's
+// node name; advertise, if set, is where the inviter can dial it back.
+func SendJoin(stream quic.Stream, token []byte, name, advertise string) error {
+	if len(token) > 0xFFFF {
+		return fmt.Errorf("invite token too large: %d bytes", len(token))
+	}
+	buf := make([]byte, 3, 3+len(token)+2+len(name)+len(advertise))
+	buf[0] = 'J' // control type 'J'
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(token)))
+	buf = append(buf, token...)
+
+	var err error
+	if buf, err = appendString(buf, name); err != nil {
+		return fmt.Errorf("send join name: %w", err)
+	}
+	if buf, err = appendString(buf, advertise); err != nil {
+		return fmt.Errorf("send join advertise: %w", err)
+	}
+
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send join: %w", err)
+	}
+	return nil
+}
+
+// 🚀 Send a Join reply telling the joiner whether it was admitted
+func SendJoinReply(stream quic.Stream, ok bool, message string) error {
+	buf := []byte{'j', 0} // control type 'j'
+	if ok {
+		buf[1] = 1
+	}
+
+	var err error
+	if buf, err = appendString(buf, message); err != nil {
+		return fmt.Errorf("send join-reply message: %w", err)
+	}
+
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send join-reply: %w", err)
+	}
+	return nil
+}
+
+// 🚀 Send a Network-Proof showing we hold the pre-shared secret of network
+func SendNetworkProof(stream quic.Stream, network string, proof []byte) error {
+	buf, err := appendString([]byte{'N'}, network) // control type 'N'
+	if err != nil {
+		return fmt.Errorf("send network-proof network: %w", err)
+	}
+	buf = append(buf, proof...)
+
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send network-proof: %w", err)
+	}
+	return nil
+}
+
+// 🚀 Send an Address announcing the IPv4 address we hold on network
+func SendAddress(stream quic.Stream, network string, ip net.IP) error {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return fmt.Errorf("send address: %s is not IPv4", ip)
+	}
+	buf, err := appendString([]byte{'I'}, network) // control type 'I'
+	if err != nil {
+		return fmt.Errorf("send address network: %w", err)
+	}
+	buf = append(buf, ip4...)
+
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send address: %w", err)
+	}
+	return nil
+}
+
+// 🚀 Send a Lease-Request asking the coordinator for an address on
+// network; ip is the address we hold or want, nil for none
+func SendLeaseRequest(stream quic.Stream, network string, ip net.IP) error {
+	buf, err := appendString([]byte{'L'}, network) // control type 'L'
+	if err != nil {
+		return fmt.Errorf("send lease request network: %w", err)
+	}
+	buf = append(buf, leaseAddr(ip)...)
+
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send lease request: %w", err)
+	}
+	return nil
+}
+
+// 🚀 Send a Lease granting ip on network for d; a nil ip refuses the
+// request
+func SendLease(stream quic.Stream, network string, ip net.IP, d time.Duration) error {
+	buf, err := appendString([]byte{'l'}, network) // control type 'l'
+	if err != nil {
+		return fmt.Errorf("send lease network: %w", err)
+	}
+	buf = append(buf, leaseAddr(ip)...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(d/time.Second))
+
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send lease: %w", err)
+	}
+	return nil
+}
+
+// 🚀 Send a Multicast-Groups message listing the groups hosts behind us
+// joined on network; an empty list still tells the peer we filter by group
+func SendGroups(stream quic.Stream, network string, groups []net.IP) error {
+	buf, err := appendString([]byte{'M'}, network) // control type 'M'
+	if err != nil {
+		return fmt.Errorf("send groups network: %w", err)
+	}
+	if len(groups) > 0xFFFF {
+		return fmt.Errorf("send groups: too many groups: %d", len(groups))
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(groups)))
+	for _, g := range groups {
+		if ip4 := g.To4(); ip4 != nil {
+			g = ip4
+		}
+		buf = append(buf, byte(len(g)))
+		buf = append(buf, g...)
+	}
+
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send groups: %w", err)
+	}
+	return nil
+}
+
+// leaseAddr encodes ip for lease messages, 0.0.0.0 standing for none.
+func leaseAddr(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return net.IPv4zero.To4()
+}
+
+// appendString appends a 1-byte length-prefixed string.
+func appendString(buf []byte, s string) ([]byte, error) {
+	if len(s) > 255 {
+		return nil, fmt.Errorf("string too long: %d bytes", len(s))
+	}
+	buf = append(buf, byte(len(s)))
+	return append(buf, s...), nil
+}
+
+// 🚀 Send an Echo request. The receiving peer answers itself when ttl is 1,
+// target is empty, or it owns target; otherwise it forwards the request
+// one hop closer to target with ttl-1.
+func SendEcho(stream quic.Stream, id uint64, ttl uint8, network, target string) error {
+	logger := log.New("control/echo")
+
+	buf := make([]byte, 10, 10+2+len(network)+len(target))
+	buf[0] = 'E' // control type 'E'
+	binary.BigEndian.PutUint64(buf[1:9], id)
+	buf[9] = ttl
+
+	var err error
+	if buf, err = appendString(buf, network); err != nil {
+		return fmt.Errorf("send echo network: %w", err)
+	}
+	if buf, err = appendString(buf, target); err != nil {
+		return fmt.Errorf("send echo target: %w", err)
+	}
+
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send echo: %w", err)
+	}
+
+	logger.Debugf("Sent Echo id=%d ttl=%d target=%q", id, ttl, target)
+	return nil
+}
+
+// Echo reply flags.
+const (
+	EchoReached     = 1 << 0 // replying node owns the traced address
+	EchoUnreachable = 1 << 1 // replying node has no route further
+)
+
+// 🚀 Send an Echo reply identifying the replying node
+func SendEchoReply(stream quic.Stream, id uint64, flags uint8, name, fingerprint string) error {
+	logger := log.New("control/echo")
+
+	buf := make([]byte, 10, 10+2+len(name)+len(fingerprint))
+	buf[0] = 'R' // control type 'R'
+	binary.BigEndian.PutUint64(buf[1:9], id)
+	buf[9] = flags
+
+	var err error
+	if buf, err = appendString(buf, name); err != nil {
+		return fmt.Errorf("send echo-reply name: %w", err)
+	}
+	if buf, err = appendString(buf, fingerprint); err != nil {
+		return fmt.Errorf("send echo-reply fingerprint: %w", err)
+	}
+
+	if err := writeMessage(stream, buf); err != nil {
+		return fmt.Errorf("send echo-reply: %w", err)
+	}
+
+	logger.Debugf("Sent Echo-Reply id=%d flags=%d", id, flags)
 	return nil
 }
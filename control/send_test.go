@@ -0,0 +1,46 @@
+package control
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// stuckStream blocks every write until released, like a peer that stopped
+// reading.
+type stuckStream struct {
+	quic.Stream
+	release chan struct{}
+}
+
+func (s *stuckStream) Write(p []byte) (int, error) {
+	<-s.release
+	return len(p), nil
+}
+
+func (s *stuckStream) Context() context.Context { return context.Background() }
+
+type okStream struct{ quic.Stream }
+
+func (okStream) Write(p []byte) (int, error) { return len(p), nil }
+
+func (okStream) Context() context.Context { return context.Background() }
+
+func TestBlockedStreamDoesNotStallOthers(t *testing.T) {
+	stuck := &stuckStream{release: make(chan struct{})}
+	defer close(stuck.release)
+	go SendKeepalive(stuck)
+
+	done := make(chan error)
+	go func() { done <- SendKeepalive(&okStream{}) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("SendKeepalive failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write to one stream waited for another stream's blocked write")
+	}
+}
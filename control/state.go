@@ -1,6 +1,7 @@
 package control
 
 import (
+	"errors"
 	"sync"
 	"time"
 
@@ -12,16 +13,51 @@ import (
 type PeerLister interface {
 	ListPeers() []shared.PeerState
 	UpdatePeer(peerID string)
+	RecordRTT(peerID string, rtt time.Duration)
+}
+
+// TraceHop identifies the node that answered an echo probe.
+type TraceHop struct {
+	Peer        string
+	Name        string
+	Reached     bool
+	Unreachable bool
+}
+
+// Prober sends echo probes over peer control streams.
+type Prober interface {
+	Ping(peer string, timeout time.Duration) (TraceHop, time.Duration, error)
+	Trace(network, target string, ttl int, timeout time.Duration) (TraceHop, time.Duration, error)
+}
+
+// ExitNodes picks the exit node default traffic goes through.
+type ExitNodes interface {
+	UseExit(peer, network string) error
+	ExitStatus() map[string]interface{}
+}
+
+// LeaseServer lists the addresses this node leases as a coordinator.
+type LeaseServer interface {
+	LeaseStatus() ([]map[string]interface{}, error)
 }
 
 type PeerSendFunc func(peerID, network string, route netgraph.Route)
 type GoodbyeFunc func()
+type PeerToggleFunc func(peerID string, enabled bool) error
+type RevocationReloadFunc func() (uint64, error)
+type KeyRotationFunc func(certPath, keyPath string, grace time.Duration) (string, error)
 
 var (
 	routeTable  *netgraph.RouteTable
 	peerTracker PeerLister
 	sendRoute   PeerSendFunc
 	goodbyeFunc GoodbyeFunc
+	togglePeer  PeerToggleFunc
+	revocations RevocationReloadFunc
+	rotateKey   KeyRotationFunc
+	prober      Prober
+	exitNodes   ExitNodes
+	leaseServer LeaseServer
 	startupTime = time.Now()
 	configPath  = "/etc/vibepn/config.toml"
 )
@@ -71,6 +107,67 @@ func RegisterGoodbyeCallback(f GoodbyeFunc) {
 	goodbyeFunc = f
 }
 
+func RegisterPeerToggle(f PeerToggleFunc) {
+	togglePeer = f
+}
+
+func SetPeerEnabled(peerID string, enabled bool) error {
+	if togglePeer == nil {
+		return errors.New("peer toggling not available")
+	}
+	return togglePeer(peerID, enabled)
+}
+
+func RegisterRevocationReload(f RevocationReloadFunc) {
+	revocations = f
+}
+
+// ReloadRevocations makes the daemon re-read its revocation file and
+// returns the version in force.
+func ReloadRevocations() (uint64, error) {
+	if revocations == nil {
+		return 0, errors.New("revocation not available")
+	}
+	return revocations()
+}
+
+func RegisterKeyRotation(f KeyRotationFunc) {
+	rotateKey = f
+}
+
+// RotateKey switches the daemon to a new identity and returns its
+// fingerprint.
+func RotateKey(certPath, keyPath string, grace time.Duration) (string, error) {
+	if rotateKey == nil {
+		return "", errors.New("key rotation not available")
+	}
+	return rotateKey(certPath, keyPath, grace)
+}
+
+func RegisterProber(p Prober) {
+	prober = p
+}
+
+func GetProber() Prober {
+	return prober
+}
+
+func RegisterExitNodes(e ExitNodes) {
+	exitNodes = e
+}
+
+func GetExitNodes() ExitNodes {
+	return exitNodes
+}
+
+func RegisterLeaseServer(l LeaseServer) {
+	leaseServer = l
+}
+
+func GetLeaseServer() LeaseServer {
+	return leaseServer
+}
+
 func TriggerGoodbye() {
 	if goodbyeFunc != nil {
 		goodbyeFunc()
@@ -49,7 +49,7 @@ func handleConn(c net.Conn, logger *log.Logger) {
 	}
 
 	logger.Infof("Received command: %s", req.Cmd)
-	resp := Handle(req.Cmd, nil, logger)
+	resp := Handle(req.Cmd, req.Args, logger)
 
 	enc := json.NewEncoder(c)
 	if err := enc.Encode(resp); err != nil {
@@ -0,0 +1,221 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In CA mode peers are trusted because a mesh CA issued their certificate,
+// not because their fingerprint was pinned. Node certificates carry the
+// node name as common name and each network the node may join as a
+// vibepn://network/<name> URI SAN.
+var trustedCA struct {
+	sync.RWMutex
+	pool *x509.CertPool
+}
+
+// SetTrustedCA switches TLS verification to CA mode, trusting the PEM
+// certificates in path.
+func SetTrustedCA(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates in CA file %s", path)
+	}
+
+	trustedCA.Lock()
+	defer trustedCA.Unlock()
+	trustedCA.pool = pool
+	return nil
+}
+
+// CAEnabled reports whether peers are verified against a mesh CA.
+func CAEnabled() bool {
+	trustedCA.RLock()
+	defer trustedCA.RUnlock()
+	return trustedCA.pool != nil
+}
+
+// verifyCA checks that the presented chain leads to the mesh CA and
+// returns the leaf.
+func verifyCA(rawCerts [][]byte) (*x509.Certificate, error) {
+	trustedCA.RLock()
+	pool := trustedCA.pool
+	trustedCA.RUnlock()
+
+	if len(rawCerts) == 0 {
+		return nil, errors.New("no peer certificate presented")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse peer certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("peer certificate not issued by mesh CA: %w", err)
+	}
+	return certs[0], nil
+}
+
+func verifyCAFunc(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if err := checkNotRevoked(rawCerts); err != nil {
+		return err
+	}
+	_, err := verifyCA(rawCerts)
+	return err
+}
+
+// verifyCANamed is the CA-mode replacement for TOFU: instead of pinning a
+// fingerprint, the peer must hold a CA-issued certificate for the name we
+// dialed, so keys can rotate without touching anyone's config.
+func verifyCANamed(rawCerts [][]byte, peerName string) error {
+	leaf, err := verifyCA(rawCerts)
+	if err != nil {
+		return err
+	}
+	if peerName != "" && leaf.Subject.CommonName != peerName {
+		return fmt.Errorf("peer certificate is for %q, expected %q", leaf.Subject.CommonName, peerName)
+	}
+	return nil
+}
+
+// CertNetworks returns the networks a CA-issued certificate authorizes.
+// restricted is false when the certificate lists none, meaning any.
+func CertNetworks(cert *x509.Certificate) (networks []string, restricted bool) {
+	for _, u := range cert.URIs {
+		if u.Scheme == "vibepn" && u.Host == "network" {
+			if name := strings.TrimPrefix(u.Path, "/"); name != "" {
+				networks = append(networks, name)
+			}
+		}
+	}
+	return networks, len(networks) > 0
+}
+
+// NewCA creates a self-signed mesh CA certificate and its ECDSA key.
+func NewCA(name string, validity time.Duration) ([]byte, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate CA key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create CA certificate: %w", err)
+	}
+	return der, key, nil
+}
+
+// IssueNodeCert signs a node certificate for pub with the mesh CA.
+func IssueNodeCert(ca *x509.Certificate, caKey crypto.Signer, pub crypto.PublicKey, name string, networks []string, validity time.Duration) ([]byte, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, n := range networks {
+		tmpl.URIs = append(tmpl.URIs, &url.URL{Scheme: "vibepn", Host: "network", Path: "/" + n})
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, pub, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("sign node certificate: %w", err)
+	}
+	return der, nil
+}
+
+// LoadCA reads a CA certificate and private key written by vpnctl ca init.
+func LoadCA(certPath, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read CA certificate: %w", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, nil, fmt.Errorf("no certificate in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse CA certificate: %w", err)
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read CA key: %w", err)
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no private key in %s", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse CA key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("CA key cannot sign")
+	}
+	return cert, signer, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial number: %w", err)
+	}
+	return serial, nil
+}
@@ -0,0 +1,95 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"slices"
+	"testing"
+	"time"
+)
+
+func useTestCA(t *testing.T) ([]byte, *ecdsa.PrivateKey) {
+	t.Helper()
+	caDER, caKey, err := NewCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	trustedCA.Lock()
+	saved := trustedCA.pool
+	trustedCA.pool = pool
+	trustedCA.Unlock()
+	t.Cleanup(func() {
+		trustedCA.Lock()
+		trustedCA.pool = saved
+		trustedCA.Unlock()
+	})
+	return caDER, caKey
+}
+
+func issueTestCert(t *testing.T, caDER []byte, caKey *ecdsa.PrivateKey, name string, networks []string) []byte {
+	t.Helper()
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := IssueNodeCert(caCert, caKey, &key.PublicKey, name, networks, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestCAIssuedCertificateVerifies(t *testing.T) {
+	caDER, caKey := useTestCA(t)
+	der := issueTestCert(t, caDER, caKey, "node3", []string{"corp", "lab"})
+
+	if err := verifyCANamed([][]byte{der}, "node3"); err != nil {
+		t.Fatalf("CA-issued certificate rejected: %v", err)
+	}
+	if err := verifyCANamed([][]byte{der}, "node4"); err == nil {
+		t.Fatal("expected certificate for another node name to be rejected")
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	networks, restricted := CertNetworks(leaf)
+	if !restricted || !slices.Equal(networks, []string{"corp", "lab"}) {
+		t.Fatalf("CertNetworks = %v, %v; want [corp lab], true", networks, restricted)
+	}
+}
+
+func TestCARejectsForeignCertificate(t *testing.T) {
+	useTestCA(t)
+	otherDER, otherKey, err := NewCA("other CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := issueTestCert(t, otherDER, otherKey, "node3", nil)
+
+	if _, err := verifyCA([][]byte{der}); err == nil {
+		t.Fatal("expected certificate from another CA to be rejected")
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, restricted := CertNetworks(leaf); restricted {
+		t.Fatal("certificate without networks should not be restricted")
+	}
+}
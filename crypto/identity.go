@@ -10,7 +10,7 @@ import (
 )
 
 func LoadTLS(certPath, keyPath, expectedFP string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	cert, err := LoadKeyPair(certPath, keyPath)
 	if err != nil {
 		return nil, fmt.Errorf("load cert/key: %w", err)
 	}
@@ -20,15 +20,48 @@ func LoadTLS(certPath, keyPath, expectedFP string) (*tls.Config, error) {
 		return nil, fmt.Errorf("parse cert: %w", err)
 	}
 
-	hash := sha256.Sum256(x509cert.Raw)
-	fingerprint := hex.EncodeToString(hash[:])
+	fingerprint := Fingerprint(x509cert.Raw)
 	if expectedFP != "" && fingerprint != expectedFP {
 		return nil, fmt.Errorf("fingerprint mismatch: got %s, expected %s", fingerprint, expectedFP)
 	}
 
+	// Served through GetCertificate rather than Certificates so that
+	// RotateIdentity applies to new connections
+	setLocalIdentity(cert)
 	tlsConf := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{"vibepn/0.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return LocalCertificate(), nil
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return LocalCertificate(), nil
+		},
+		NextProtos: []string{"vibepn/0.1"},
+	}
+	if CAEnabled() {
+		// Clients still connect with RequireAnyClientCert; the chain is
+		// checked here instead of by crypto/tls
+		tlsConf.VerifyPeerCertificate = verifyCAFunc
 	}
 	return tlsConf, nil
 }
+
+// NodeName returns the common name of the local certificate, which is what
+// vpnctl init writes as the node name.
+func NodeName() string {
+	local := LocalCertificate()
+	if local == nil || len(local.Certificate) == 0 {
+		return ""
+	}
+	cert, err := x509.ParseCertificate(local.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// Fingerprint returns the hex SHA-256 of a DER certificate, which is how
+// peers are identified everywhere.
+func Fingerprint(der []byte) string {
+	hash := sha256.Sum256(der)
+	return hex.EncodeToString(hash[:])
+}
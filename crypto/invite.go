@@ -0,0 +1,260 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const inviteFormat = 1
+
+// inviteContext is prepended to the signed bytes so an invite signature
+// cannot be replayed as anything else.
+var inviteContext = []byte("vibepn-invite-v1\x00")
+
+// InviteToken lets one node join a network through the inviter. It is
+// signed by the inviter's identity key, expires, and is redeemed once.
+type InviteToken struct {
+	Network string
+	Prefix  string
+	Inviter string // inviter node name
+	Address string // where the joiner dials the inviter
+	Invitee string // if set, only a joiner with this name may redeem it
+	Nonce   []byte
+	Expires time.Time
+	// SignerFingerprint is what is signed; the certificate itself is
+	// optional on the wire, so compact invites can leave it out and the
+	// joiner takes it from the TLS handshake with the pinned inviter
+	SignerFingerprint string
+	Signer            []byte // inviter DER certificate, not signed
+	Signature         []byte
+}
+
+// SignInvite fills in a fresh nonce and signs tok with cert.
+func SignInvite(tok *InviteToken, cert tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("signing certificate is empty")
+	}
+	tok.Nonce = make([]byte, 16)
+	if _, err := rand.Read(tok.Nonce); err != nil {
+		return fmt.Errorf("generate invite nonce: %w", err)
+	}
+	tok.Signer = cert.Certificate[0]
+	tok.SignerFingerprint = Fingerprint(tok.Signer)
+
+	body, err := tok.encodeBody()
+	if err != nil {
+		return err
+	}
+	sig, err := SignWithCertificate(cert, append(append([]byte{}, inviteContext...), body...))
+	if err != nil {
+		return fmt.Errorf("sign invite: %w", err)
+	}
+	tok.Signature = sig
+	return nil
+}
+
+// Verify checks the signature against the certificate, which must be set
+// and match the signed fingerprint, and that the token has not expired.
+func (tok *InviteToken) Verify(now time.Time) error {
+	if len(tok.Signer) == 0 {
+		return errors.New("invite carries no inviter certificate")
+	}
+	if Fingerprint(tok.Signer) != tok.SignerFingerprint {
+		return errors.New("invite certificate does not match its signer")
+	}
+	body, err := tok.encodeBody()
+	if err != nil {
+		return err
+	}
+	if err := VerifyCertificateSignature(tok.Signer, append(append([]byte{}, inviteContext...), body...), tok.Signature); err != nil {
+		return fmt.Errorf("invalid invite signature: %w", err)
+	}
+	if now.After(tok.Expires) {
+		return fmt.Errorf("invite expired at %s", tok.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// encodeBody writes format(1) | expires(8) | network, prefix, inviter,
+// address, invitee as 1-byte length-prefixed strings | 2-byte
+// length-prefixed nonce | signer fingerprint(32).
+func (tok *InviteToken) encodeBody() ([]byte, error) {
+	fp, err := hex.DecodeString(tok.SignerFingerprint)
+	if err != nil || len(fp) != sha256.Size {
+		return nil, fmt.Errorf("invalid invite signer fingerprint %q", tok.SignerFingerprint)
+	}
+	buf := []byte{inviteFormat}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(tok.Expires.Unix()))
+	for _, s := range []string{tok.Network, tok.Prefix, tok.Inviter, tok.Address, tok.Invitee} {
+		if len(s) > 255 {
+			return nil, fmt.Errorf("invite field too long: %q", s)
+		}
+		buf = append(buf, byte(len(s)))
+		buf = append(buf, s...)
+	}
+	buf = appendBlob(buf, tok.Nonce)
+	return append(buf, fp...), nil
+}
+
+// Marshal returns the wire form of tok: the body, the signature and the
+// certificate if set.
+func (tok *InviteToken) Marshal() ([]byte, error) {
+	body, err := tok.encodeBody()
+	if err != nil {
+		return nil, err
+	}
+	return appendBlob(appendBlob(body, tok.Signature), tok.Signer), nil
+}
+
+// ParseInviteToken decodes the wire form. It does not verify it.
+func ParseInviteToken(data []byte) (*InviteToken, error) {
+	errShort := errors.New("invite token truncated")
+	if len(data) < 9 {
+		return nil, errShort
+	}
+	if data[0] != inviteFormat {
+		return nil, fmt.Errorf("unsupported invite format %d", data[0])
+	}
+	tok := &InviteToken{Expires: time.Unix(int64(binary.BigEndian.Uint64(data[1:9])), 0)}
+
+	rest := data[9:]
+	for _, field := range []*string{&tok.Network, &tok.Prefix, &tok.Inviter, &tok.Address, &tok.Invitee} {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, errShort
+		}
+		*field = string(rest[1 : 1+int(rest[0])])
+		rest = rest[1+int(rest[0]):]
+	}
+
+	var ok bool
+	if tok.Nonce, rest, ok = readBlob(rest); !ok || len(rest) < sha256.Size {
+		return nil, errShort
+	}
+	tok.SignerFingerprint, rest = hex.EncodeToString(rest[:sha256.Size]), rest[sha256.Size:]
+	if tok.Signature, rest, ok = readBlob(rest); !ok {
+		return nil, errShort
+	}
+	if tok.Signer, rest, ok = readBlob(rest); !ok || len(rest) != 0 {
+		return nil, errShort
+	}
+	if len(tok.Signer) == 0 {
+		tok.Signer = nil
+	}
+	return tok, nil
+}
+
+// redeemedInvite records who used an invite, so it cannot be used again.
+type redeemedInvite struct {
+	Fingerprint string    `json:"fingerprint"`
+	Name        string    `json:"name"`
+	RedeemedAt  time.Time `json:"redeemed_at"`
+	Expires     time.Time `json:"expires"` // the entry is dropped after this
+}
+
+var inviteMu sync.Mutex
+
+// inviteStorePath keeps redeemed invites next to the TOFU store.
+func inviteStorePath() string {
+	tofuMu.Lock()
+	defer tofuMu.Unlock()
+	return filepath.Join(filepath.Dir(tofuPath), "redeemed_invites.json")
+}
+
+// RedeemInvite accepts tok from the joiner joinerName/joinerFP once: it
+// must be signed by this node, unexpired, meant for joinerName if bound to
+// a name, and not redeemed before.
+func RedeemInvite(tok *InviteToken, joinerName, joinerFP string, now time.Time) error {
+	if signer := tok.SignerFingerprint; signer != LocalFingerprint() && !isSuccessor(signer, LocalFingerprint()) {
+		return errors.New("invite was not issued by this node")
+	}
+	if len(tok.Signer) == 0 && tok.SignerFingerprint == LocalFingerprint() {
+		tok.Signer = LocalCertificate().Certificate[0]
+	}
+	if err := tok.Verify(now); err != nil {
+		return err
+	}
+	if tok.Invitee != "" && tok.Invitee != joinerName {
+		return fmt.Errorf("invite is for %q, not %q", tok.Invitee, joinerName)
+	}
+
+	inviteMu.Lock()
+	defer inviteMu.Unlock()
+
+	path := inviteStorePath()
+	redeemed, err := loadRedeemed(path)
+	if err != nil {
+		return err // fail closed
+	}
+	nonce := hex.EncodeToString(tok.Nonce)
+	if prev, ok := redeemed[nonce]; ok {
+		return fmt.Errorf("invite already used by %s at %s", prev.Name, prev.RedeemedAt.Format(time.RFC3339))
+	}
+	for n, r := range redeemed {
+		if now.After(r.Expires) {
+			delete(redeemed, n)
+		}
+	}
+	redeemed[nonce] = redeemedInvite{Fingerprint: joinerFP, Name: joinerName, RedeemedAt: now, Expires: tok.Expires}
+	return saveRedeemed(path, redeemed)
+}
+
+// ReleaseInvite undoes RedeemInvite for tok, when admitting the joiner
+// failed after the token was redeemed, so the invite can be retried.
+func ReleaseInvite(tok *InviteToken) error {
+	inviteMu.Lock()
+	defer inviteMu.Unlock()
+
+	path := inviteStorePath()
+	redeemed, err := loadRedeemed(path)
+	if err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(tok.Nonce)
+	if _, ok := redeemed[nonce]; !ok {
+		return nil
+	}
+	delete(redeemed, nonce)
+	return saveRedeemed(path, redeemed)
+}
+
+// loadRedeemed reads the redeemed invites at path; a missing file is
+// empty. Caller must hold inviteMu.
+func loadRedeemed(path string) (map[string]redeemedInvite, error) {
+	redeemed := make(map[string]redeemedInvite)
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &redeemed); err != nil {
+			return nil, fmt.Errorf("parse redeemed invites %s: %w", path, err)
+		}
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("read redeemed invites: %w", err)
+	}
+	return redeemed, nil
+}
+
+// saveRedeemed replaces the redeemed invites at path. Caller must hold
+// inviteMu.
+func saveRedeemed(path string, redeemed map[string]redeemedInvite) error {
+	out, err := json.MarshalIndent(redeemed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode redeemed invites: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create invite store directory: %w", err)
+	}
+	if err := writeFileAtomic(path, out); err != nil {
+		return fmt.Errorf("write redeemed invites: %w", err)
+	}
+	return nil
+}
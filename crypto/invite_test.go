@@ -0,0 +1,98 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+)
+
+func signedInvite(t *testing.T, invitee string, expires time.Time) *InviteToken {
+	t.Helper()
+	tok := &InviteToken{
+		Network: "corp",
+		Prefix:  "10.42.0.0/24",
+		Inviter: "node1",
+		Address: "203.0.113.10:51820",
+		Invitee: invitee,
+		Expires: expires.Truncate(time.Second),
+	}
+	if err := SignInvite(tok, *LocalCertificate()); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := tok.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseInviteToken(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestInviteTokenRoundTripAndTamper(t *testing.T) {
+	fp := useTestIdentity(t, "node1")
+	now := time.Now()
+	tok := signedInvite(t, "", now.Add(time.Hour))
+
+	if err := tok.Verify(now); err != nil {
+		t.Fatal(err)
+	}
+	if tok.SignerFingerprint != fp || tok.Network != "corp" || tok.Address != "203.0.113.10:51820" {
+		t.Fatalf("unexpected token %+v", tok)
+	}
+	if err := tok.Verify(now.Add(2 * time.Hour)); err == nil {
+		t.Fatal("expected expired invite to be rejected")
+	}
+
+	tok.Network = "prod"
+	if err := tok.Verify(now); err == nil {
+		t.Fatal("expected tampered invite to be rejected")
+	}
+}
+
+func TestRedeemInviteOnlyOnce(t *testing.T) {
+	useTestIdentity(t, "node1")
+	useTempStore(t)
+	now := time.Now()
+
+	tok := signedInvite(t, "node2", now.Add(time.Hour))
+	if err := RedeemInvite(tok, "node3", fpB, now); err == nil {
+		t.Fatal("expected invite bound to node2 to be rejected for node3")
+	}
+	if err := RedeemInvite(tok, "node2", fpA, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := RedeemInvite(tok, "node2", fpA, now); err == nil {
+		t.Fatal("expected second redemption to be rejected")
+	}
+	if err := ReleaseInvite(tok); err != nil {
+		t.Fatal(err)
+	}
+	if err := RedeemInvite(tok, "node2", fpA, now); err != nil {
+		t.Fatalf("released invite not redeemable again: %v", err)
+	}
+
+	// Compact invites arrive without the certificate, the inviter has it
+	open := signedInvite(t, "", now.Add(time.Hour))
+	open.Signer = nil
+	raw, err := open.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open, err = ParseInviteToken(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := open.Verify(now); err == nil {
+		t.Fatal("expected an invite without certificate to fail verification")
+	}
+	if err := RedeemInvite(open, "node3", fpB, now); err != nil {
+		t.Fatalf("second invite rejected: %v", err)
+	}
+
+	useTestIdentity(t, "node9")
+	foreign := signedInvite(t, "", now.Add(time.Hour))
+	useTestIdentity(t, "node1")
+	if err := RedeemInvite(foreign, "node4", fpB, now); err == nil {
+		t.Fatal("expected invite signed by another node to be rejected")
+	}
+}
@@ -0,0 +1,231 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Private keys can be stored encrypted: the PEM body is the original key
+// DER sealed with AES-256-GCM under a key derived from a passphrase with
+// scrypt. The parameters travel in PEM headers.
+const encryptedKeyType = "VIBEPN ENCRYPTED PRIVATE KEY"
+
+// scrypt cost for new files; about 100ms and 32 MiB, paid once at startup.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Where the passphrase of an encrypted identity key is looked up, in order:
+// identity.passphrase_file, the systemd credential (LoadCredential=) and
+// the environment.
+const (
+	KeyPassphraseEnv        = "VIBEPN_KEY_PASSPHRASE"
+	KeyPassphraseCredential = "vibepn-key-passphrase"
+)
+
+var keyPassphrase struct {
+	sync.Mutex
+	file   string
+	cached []byte // kept so that keys loaded later, on rotation, unlock too
+}
+
+// SetKeyPassphraseFile sets the file holding the identity key passphrase.
+func SetKeyPassphraseFile(path string) {
+	keyPassphrase.Lock()
+	defer keyPassphrase.Unlock()
+	keyPassphrase.file = path
+	keyPassphrase.cached = nil
+}
+
+// KeyPassphrase returns the passphrase for encrypted identity keys from
+// the first source that has one. The environment variable is cleared once
+// read so child processes do not inherit it.
+func KeyPassphrase() ([]byte, error) {
+	keyPassphrase.Lock()
+	defer keyPassphrase.Unlock()
+	if keyPassphrase.cached != nil {
+		return keyPassphrase.cached, nil
+	}
+
+	var pass []byte
+	switch {
+	case keyPassphrase.file != "":
+		data, err := os.ReadFile(keyPassphrase.file)
+		if err != nil {
+			return nil, fmt.Errorf("read passphrase file: %w", err)
+		}
+		pass = data
+	case os.Getenv("CREDENTIALS_DIRECTORY") != "" && fileExists(filepath.Join(os.Getenv("CREDENTIALS_DIRECTORY"), KeyPassphraseCredential)):
+		data, err := os.ReadFile(filepath.Join(os.Getenv("CREDENTIALS_DIRECTORY"), KeyPassphraseCredential))
+		if err != nil {
+			return nil, fmt.Errorf("read passphrase credential: %w", err)
+		}
+		pass = data
+	case os.Getenv(KeyPassphraseEnv) != "":
+		pass = []byte(os.Getenv(KeyPassphraseEnv))
+		os.Unsetenv(KeyPassphraseEnv)
+	default:
+		return nil, fmt.Errorf("identity key is encrypted: set identity.passphrase_file, the %s credential or %s", KeyPassphraseCredential, KeyPassphraseEnv)
+	}
+
+	pass = bytes.TrimRight(pass, "\r\n")
+	if len(pass) == 0 {
+		return nil, errors.New("key passphrase is empty")
+	}
+	keyPassphrase.cached = pass
+	return pass, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// IsEncryptedKey reports whether data is an encrypted key PEM.
+func IsEncryptedKey(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == encryptedKeyType
+}
+
+// EncryptKeyPEM seals the first PEM block of keyPEM with passphrase.
+func EncryptKeyPEM(keyPEM, passphrase []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM key found")
+	}
+	if block.Type == encryptedKeyType {
+		return nil, errors.New("key is already encrypted")
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase is empty")
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generate salt: %w", err)
+	}
+	aead, err := keyAEAD(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+
+	headers := map[string]string{
+		"KDF":      "scrypt",
+		"N":        strconv.Itoa(scryptN),
+		"R":        strconv.Itoa(scryptR),
+		"P":        strconv.Itoa(scryptP),
+		"Salt":     hex.EncodeToString(salt),
+		"Nonce":    hex.EncodeToString(nonce),
+		"Key-Type": block.Type,
+	}
+	// The headers are authenticated too, so none can be swapped
+	sealed := aead.Seal(nil, nonce, block.Bytes, headerAAD(headers))
+	return pem.EncodeToMemory(&pem.Block{Type: encryptedKeyType, Headers: headers, Bytes: sealed}), nil
+}
+
+// DecryptKeyPEM opens an encrypted key PEM and returns the original one.
+func DecryptKeyPEM(data, passphrase []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedKeyType {
+		return nil, errors.New("not an encrypted key")
+	}
+	h := block.Headers
+	if h["KDF"] != "scrypt" {
+		return nil, fmt.Errorf("unsupported key derivation %q", h["KDF"])
+	}
+	var params [3]int
+	for i, name := range []string{"N", "R", "P"} {
+		v, err := strconv.Atoi(h[name])
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid scrypt parameter %s=%q", name, h[name])
+		}
+		params[i] = v
+	}
+	salt, err := hex.DecodeString(h["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	nonce, err := hex.DecodeString(h["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce: %w", err)
+	}
+
+	aead, err := keyAEAD(passphrase, salt, params[0], params[1], params[2])
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce length")
+	}
+	der, err := aead.Open(nil, nonce, block.Bytes, headerAAD(h))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: h["Key-Type"], Bytes: der}), nil
+}
+
+func keyAEAD(passphrase, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// headerAAD serializes the PEM headers in a fixed order.
+func headerAAD(h map[string]string) []byte {
+	var buf []byte
+	for _, name := range []string{"KDF", "N", "R", "P", "Salt", "Nonce", "Key-Type"} {
+		buf = append(buf, name...)
+		buf = append(buf, '=')
+		buf = append(buf, h[name]...)
+		buf = append(buf, '\n')
+	}
+	return buf
+}
+
+// LoadKeyPair is tls.LoadX509KeyPair for keys that may be encrypted; the
+// passphrase comes from KeyPassphrase.
+func LoadKeyPair(certPath, keyPath string) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if IsEncryptedKey(keyPEM) {
+		pass, err := KeyPassphrase()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if keyPEM, err = DecryptKeyPEM(keyPEM, pass); err != nil {
+			return tls.Certificate{}, fmt.Errorf("unlock %s: %w", keyPath, err)
+		}
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
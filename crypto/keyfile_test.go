@@ -0,0 +1,101 @@
+package crypto
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useKeyPassphraseFile(t *testing.T, path string) {
+	t.Helper()
+	keyPassphrase.Lock()
+	saved := keyPassphrase.file
+	keyPassphrase.Unlock()
+	SetKeyPassphraseFile(path)
+	t.Cleanup(func() { SetKeyPassphraseFile(saved) })
+}
+
+func TestEncryptedKeyRoundTrip(t *testing.T) {
+	_, keyPath := writeTestIdentity(t, "node1")
+	plain, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := EncryptKeyPEM(plain, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncryptedKey(sealed) || IsEncryptedKey(plain) {
+		t.Fatal("IsEncryptedKey does not tell the two apart")
+	}
+	if bytes.Contains(sealed, plain[40:80]) {
+		t.Fatal("encrypted key contains plaintext key material")
+	}
+
+	opened, err := DecryptKeyPEM(sealed, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plain) {
+		t.Fatal("decrypted key differs from the original")
+	}
+	if _, err := DecryptKeyPEM(sealed, []byte("wrong horse")); err == nil {
+		t.Fatal("expected wrong passphrase to fail")
+	}
+
+	// Parameters are authenticated: a weakened cost is noticed
+	weakened := bytes.Replace(sealed, []byte("N: 32768"), []byte("N: 16384"), 1)
+	if _, err := DecryptKeyPEM(weakened, []byte("correct horse")); err == nil {
+		t.Fatal("expected tampered headers to fail")
+	}
+}
+
+func TestLoadKeyPairUnlocksEncryptedKey(t *testing.T) {
+	certPath, keyPath := writeTestIdentity(t, "node1")
+	plain, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := EncryptKeyPEM(plain, []byte("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, sealed, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// systemd credential
+	credDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(credDir, KeyPassphraseCredential), []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", credDir)
+	useKeyPassphraseFile(t, "")
+	if _, err := LoadKeyPair(certPath, keyPath); err != nil {
+		t.Fatalf("credential passphrase: %v", err)
+	}
+
+	// An explicit file wins and a wrong one fails
+	wrong := filepath.Join(t.TempDir(), "pass")
+	if err := os.WriteFile(wrong, []byte("nope\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	useKeyPassphraseFile(t, wrong)
+	if _, err := LoadKeyPair(certPath, keyPath); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Fatalf("expected wrong passphrase error, got: %v", err)
+	}
+
+	// Environment, cleared once read
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	t.Setenv(KeyPassphraseEnv, "s3cret")
+	useKeyPassphraseFile(t, "")
+	if _, err := LoadKeyPair(certPath, keyPath); err != nil {
+		t.Fatalf("environment passphrase: %v", err)
+	}
+	if os.Getenv(KeyPassphraseEnv) != "" {
+		t.Fatal("passphrase left in the environment")
+	}
+}
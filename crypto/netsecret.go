@@ -0,0 +1,89 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Networks can require a pre-shared secret on top of a trusted key. Each
+// side proves it knows the secret with an HMAC over both Hello nonces and
+// both fingerprints, keyed to the connection through the TLS exporter so a
+// proof cannot be replayed on another connection or reflected back.
+const (
+	networkProofContext = "vibepn-network-proof-v1\x00"
+	networkProofLabel   = "EXPORTER-vibepn-network-proof"
+	NetworkProofSize    = sha256.Size
+)
+
+var networkSecrets struct {
+	sync.RWMutex
+	m map[string][]byte
+}
+
+// SetNetworkSecrets replaces the secrets of all networks. Networks missing
+// from secrets are open to every trusted peer.
+func SetNetworkSecrets(secrets map[string][]byte) {
+	networkSecrets.Lock()
+	defer networkSecrets.Unlock()
+	networkSecrets.m = secrets
+}
+
+// HasNetworkSecret reports whether network requires a proof.
+func HasNetworkSecret(network string) bool {
+	networkSecrets.RLock()
+	defer networkSecrets.RUnlock()
+	_, ok := networkSecrets.m[network]
+	return ok
+}
+
+// SecretNetworks lists the networks that require a proof, sorted.
+func SecretNetworks() []string {
+	networkSecrets.RLock()
+	defer networkSecrets.RUnlock()
+	names := make([]string, 0, len(networkSecrets.m))
+	for name := range networkSecrets.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NetworkProof computes the proof the node fromFP, which sent fromNonce in
+// its Hello, gives toFP for network on the connection described by state.
+func NetworkProof(state tls.ConnectionState, network string, fromNonce, toNonce uint64, fromFP, toFP string) ([]byte, error) {
+	networkSecrets.RLock()
+	secret, ok := networkSecrets.m[network]
+	networkSecrets.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no secret for network %s", network)
+	}
+
+	binding, err := state.ExportKeyingMaterial(networkProofLabel, nil, 32)
+	if err != nil {
+		return nil, fmt.Errorf("export keying material: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(networkProofContext))
+	for _, field := range []string{network, fromFP, toFP} {
+		mac.Write([]byte{byte(len(field))})
+		mac.Write([]byte(field))
+	}
+	var nonces [16]byte
+	binary.BigEndian.PutUint64(nonces[:8], fromNonce)
+	binary.BigEndian.PutUint64(nonces[8:], toNonce)
+	mac.Write(nonces[:])
+	mac.Write(binding)
+	return mac.Sum(nil), nil
+}
+
+// VerifyNetworkProof checks a proof received from fromFP.
+func VerifyNetworkProof(state tls.ConnectionState, network string, fromNonce, toNonce uint64, fromFP, toFP string, proof []byte) bool {
+	want, err := NetworkProof(state, network, fromNonce, toNonce, fromFP, toFP)
+	return err == nil && hmac.Equal(want, proof)
+}
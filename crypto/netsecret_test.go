@@ -0,0 +1,69 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// tlsPair completes a TLS 1.3 handshake over a pipe and returns both
+// sides' connection state.
+func tlsPair(t *testing.T) (tls.ConnectionState, tls.ConnectionState) {
+	t.Helper()
+	useTestIdentity(t, "node1")
+	cert := *LocalCertificate()
+
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	server := tls.Server(a, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13})
+	client := tls.Client(b, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return client.ConnectionState(), server.ConnectionState()
+}
+
+func useNetworkSecrets(t *testing.T, secrets map[string][]byte) {
+	t.Helper()
+	networkSecrets.RLock()
+	saved := networkSecrets.m
+	networkSecrets.RUnlock()
+	SetNetworkSecrets(secrets)
+	t.Cleanup(func() { SetNetworkSecrets(saved) })
+}
+
+func TestNetworkProofBindsConnectionAndDirection(t *testing.T) {
+	clientState, serverState := tlsPair(t)
+	useNetworkSecrets(t, map[string][]byte{"corp": []byte("0123456789abcdef")})
+
+	proof, err := NetworkProof(clientState, "corp", 1, 2, fpA, fpB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyNetworkProof(serverState, "corp", 1, 2, fpA, fpB, proof) {
+		t.Fatal("valid proof rejected")
+	}
+
+	// Reflected back to its sender, or replayed on another connection
+	if VerifyNetworkProof(serverState, "corp", 2, 1, fpB, fpA, proof) {
+		t.Fatal("reflected proof accepted")
+	}
+	_, otherState := tlsPair(t)
+	if VerifyNetworkProof(otherState, "corp", 1, 2, fpA, fpB, proof) {
+		t.Fatal("proof replayed on another connection accepted")
+	}
+
+	useNetworkSecrets(t, map[string][]byte{"corp": []byte("fedcba9876543210")})
+	if VerifyNetworkProof(serverState, "corp", 1, 2, fpA, fpB, proof) {
+		t.Fatal("proof made with another secret accepted")
+	}
+	if _, err := NetworkProof(clientState, "lab", 1, 2, fpA, fpB); err == nil {
+		t.Fatal("expected proof for a network without secret to fail")
+	}
+}
@@ -0,0 +1,23 @@
+package crypto
+
+import (
+	"os"
+	"syscall"
+)
+
+// keepOwner gives tmp the owner and group of fi, so replacing a file the
+// daemon owns from a root shell leaves it readable by the daemon.
+func keepOwner(tmp *os.File, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	cur, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if cst, ok := cur.Sys().(*syscall.Stat_t); ok && cst.Uid == st.Uid && cst.Gid == st.Gid {
+		return nil
+	}
+	return tmp.Chown(int(st.Uid), int(st.Gid))
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package crypto
+
+import "os"
+
+func keepOwner(tmp *os.File, fi os.FileInfo) error {
+	return nil
+}
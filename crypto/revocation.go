@@ -0,0 +1,362 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	revocationFormat     = 1
+	maxRevocationEntries = 900 // keeps a signed list inside one control message
+	revocationPEMType    = "VIBEPN REVOCATION LIST"
+)
+
+// revocationContext is prepended to the signed bytes so a revocation list
+// signature cannot be replayed as anything else.
+var revocationContext = []byte("vibepn-revocations-v1\x00")
+
+// RevocationList names peer keys that must no longer be accepted, by
+// certificate fingerprint or by mesh CA serial number. A list always
+// replaces the previous one as a whole, and only a higher Version does.
+type RevocationList struct {
+	Version      uint64
+	Issued       time.Time
+	Fingerprints []string
+	Serials      []string // lower-case hex
+	Signer       []byte   // DER certificate of the signer
+	Signature    []byte
+}
+
+// The list in force and the policy for accepting newer ones.
+var revocations struct {
+	sync.RWMutex
+	list         *RevocationList
+	path         string
+	signers      map[string]bool
+	fingerprints map[string]bool
+	serials      map[string]bool
+}
+
+// ConfigureRevocation sets where the list is persisted and which keys may
+// sign it, then loads the list from path if there is one. The mesh CA may
+// always sign.
+func ConfigureRevocation(path string, signers []string) error {
+	revocations.Lock()
+	revocations.path = path
+	revocations.signers = make(map[string]bool, len(signers))
+	for _, fp := range signers {
+		revocations.signers[strings.ToLower(fp)] = true
+	}
+	revocations.Unlock()
+
+	if path == "" {
+		return nil
+	}
+	_, err := ReloadRevocationList()
+	return err
+}
+
+// ReloadRevocationList re-reads the configured file and applies it if it
+// is newer than the list in force.
+func ReloadRevocationList() (bool, error) {
+	revocations.RLock()
+	path := revocations.path
+	revocations.RUnlock()
+	if path == "" {
+		return false, errors.New("no revocation file configured")
+	}
+
+	rl, err := ReadRevocationFile(path)
+	if err != nil {
+		return false, err
+	}
+	if rl == nil {
+		return false, nil
+	}
+	return ApplyRevocationList(rl)
+}
+
+// ApplyRevocationList verifies rl and puts it in force if its version is
+// newer than the current one, saving it to the configured file. The list
+// is enforced even if saving fails.
+func ApplyRevocationList(rl *RevocationList) (bool, error) {
+	if err := verifyRevocationList(rl); err != nil {
+		return false, err
+	}
+
+	fingerprints := make(map[string]bool, len(rl.Fingerprints))
+	for _, fp := range rl.Fingerprints {
+		fingerprints[fp] = true
+	}
+	serials := make(map[string]bool, len(rl.Serials))
+	for _, s := range rl.Serials {
+		serials[s] = true
+	}
+
+	revocations.Lock()
+	if revocations.list != nil && rl.Version <= revocations.list.Version {
+		revocations.Unlock()
+		return false, nil
+	}
+	revocations.list = rl
+	revocations.fingerprints = fingerprints
+	revocations.serials = serials
+	path := revocations.path
+	revocations.Unlock()
+
+	if path != "" {
+		if err := WriteRevocationFile(path, rl); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// CurrentRevocationList returns the list in force, or nil. Callers must
+// not modify it.
+func CurrentRevocationList() *RevocationList {
+	revocations.RLock()
+	defer revocations.RUnlock()
+	return revocations.list
+}
+
+// RevokedFingerprint reports whether the key with fingerprint fp is revoked.
+func RevokedFingerprint(fp string) bool {
+	revocations.RLock()
+	defer revocations.RUnlock()
+	return revocations.fingerprints[fp]
+}
+
+// IsRevoked reports whether cert is revoked by fingerprint or serial.
+func IsRevoked(cert *x509.Certificate) bool {
+	revocations.RLock()
+	defer revocations.RUnlock()
+	if len(revocations.fingerprints) == 0 && len(revocations.serials) == 0 {
+		return false
+	}
+	return revocations.fingerprints[Fingerprint(cert.Raw)] ||
+		revocations.serials[cert.SerialNumber.Text(16)]
+}
+
+// checkNotRevoked is the revocation part of every peer verification.
+func checkNotRevoked(rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no peer certificate presented")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse peer certificate: %w", err)
+	}
+	if IsRevoked(cert) {
+		return fmt.Errorf("peer certificate %s is revoked", Fingerprint(cert.Raw))
+	}
+	return nil
+}
+
+// verifyRevocationList checks the signature and that the signer may issue
+// revocations: a configured signer, or the mesh CA itself.
+func verifyRevocationList(rl *RevocationList) error {
+	signed, err := rl.signedBytes()
+	if err != nil {
+		return err
+	}
+	if err := VerifyCertificateSignature(rl.Signer, signed, rl.Signature); err != nil {
+		return fmt.Errorf("invalid revocation list signature: %w", err)
+	}
+
+	fp := Fingerprint(rl.Signer)
+	revocations.RLock()
+	allowed := revocations.signers[fp]
+	revocations.RUnlock()
+	if allowed {
+		return nil
+	}
+
+	signer, err := x509.ParseCertificate(rl.Signer)
+	if err != nil {
+		return fmt.Errorf("parse revocation signer: %w", err)
+	}
+	if CAEnabled() && signer.IsCA {
+		if _, err := verifyCA([][]byte{rl.Signer}); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("revocation list signed by untrusted key %s", fp)
+}
+
+// SignRevocationList signs rl with cert, replacing any earlier signature.
+func SignRevocationList(rl *RevocationList, cert tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("signing certificate is empty")
+	}
+	rl.Signer = cert.Certificate[0]
+	signed, err := rl.signedBytes()
+	if err != nil {
+		return err
+	}
+	sig, err := SignWithCertificate(cert, signed)
+	if err != nil {
+		return fmt.Errorf("sign revocation list: %w", err)
+	}
+	rl.Signature = sig
+	return nil
+}
+
+// signedBytes is the signature input: context, then the list up to and
+// including the signer certificate.
+func (rl *RevocationList) signedBytes() ([]byte, error) {
+	body, err := rl.encodeBody()
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, revocationContext...), body...), nil
+}
+
+// encodeBody writes format(1) | version(8) | issued(8) |
+// count(2) + entries | signerLen(2) + signer. Each entry is a kind byte
+// ('f' fingerprint, 's' serial) and a 1-byte length-prefixed string.
+func (rl *RevocationList) encodeBody() ([]byte, error) {
+	if len(rl.Fingerprints)+len(rl.Serials) > maxRevocationEntries {
+		return nil, fmt.Errorf("revocation list has more than %d entries", maxRevocationEntries)
+	}
+	if len(rl.Signer) > 0xFFFF {
+		return nil, errors.New("revocation signer certificate too large")
+	}
+
+	buf := []byte{revocationFormat}
+	buf = binary.BigEndian.AppendUint64(buf, rl.Version)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(rl.Issued.Unix()))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(rl.Fingerprints)+len(rl.Serials)))
+	for _, e := range rl.Fingerprints {
+		if len(e) > 255 {
+			return nil, fmt.Errorf("fingerprint too long: %q", e)
+		}
+		buf = append(buf, 'f', byte(len(e)))
+		buf = append(buf, e...)
+	}
+	for _, e := range rl.Serials {
+		if len(e) > 255 {
+			return nil, fmt.Errorf("serial too long: %q", e)
+		}
+		buf = append(buf, 's', byte(len(e)))
+		buf = append(buf, e...)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(rl.Signer)))
+	buf = append(buf, rl.Signer...)
+	return buf, nil
+}
+
+// MarshalRevocationList returns the signed wire form of rl.
+func MarshalRevocationList(rl *RevocationList) ([]byte, error) {
+	body, err := rl.encodeBody()
+	if err != nil {
+		return nil, err
+	}
+	if len(rl.Signature) > 0xFFFF {
+		return nil, errors.New("revocation list signature too large")
+	}
+	buf := binary.BigEndian.AppendUint16(body, uint16(len(rl.Signature)))
+	return append(buf, rl.Signature...), nil
+}
+
+// ParseRevocationList decodes the wire form. It does not verify it.
+func ParseRevocationList(data []byte) (*RevocationList, error) {
+	errShort := errors.New("revocation list truncated")
+	if len(data) < 19 {
+		return nil, errShort
+	}
+	if data[0] != revocationFormat {
+		return nil, fmt.Errorf("unsupported revocation list format %d", data[0])
+	}
+
+	rl := &RevocationList{
+		Version: binary.BigEndian.Uint64(data[1:9]),
+		Issued:  time.Unix(int64(binary.BigEndian.Uint64(data[9:17])), 0),
+	}
+	count := int(binary.BigEndian.Uint16(data[17:19]))
+	rest := data[19:]
+	for i := 0; i < count; i++ {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, errShort
+		}
+		kind, entry := rest[0], string(rest[2:2+int(rest[1])])
+		rest = rest[2+int(rest[1]):]
+		switch kind {
+		case 'f':
+			rl.Fingerprints = append(rl.Fingerprints, entry)
+		case 's':
+			rl.Serials = append(rl.Serials, entry)
+		default:
+			return nil, fmt.Errorf("unknown revocation entry kind %q", kind)
+		}
+	}
+
+	var ok bool
+	if rl.Signer, rest, ok = readBlob(rest); !ok {
+		return nil, errShort
+	}
+	if rl.Signature, rest, ok = readBlob(rest); !ok {
+		return nil, errShort
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing bytes after revocation list")
+	}
+	return rl, nil
+}
+
+// readBlob reads a 2-byte length-prefixed byte string.
+func readBlob(buf []byte) ([]byte, []byte, bool) {
+	if len(buf) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+n {
+		return nil, nil, false
+	}
+	return append([]byte{}, buf[2:2+n]...), buf[2+n:], true
+}
+
+// ReadRevocationFile reads a PEM revocation list. A missing file yields a
+// nil list and no error.
+func ReadRevocationFile(path string) (*RevocationList, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read revocation list: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != revocationPEMType {
+		return nil, fmt.Errorf("no revocation list in %s", path)
+	}
+	rl, err := ParseRevocationList(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse revocation list %s: %w", path, err)
+	}
+	return rl, nil
+}
+
+// WriteRevocationFile stores rl as PEM at path.
+func WriteRevocationFile(path string, rl *RevocationList) error {
+	der, err := MarshalRevocationList(rl)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create revocation list directory: %w", err)
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: revocationPEMType, Bytes: der})); err != nil {
+		return fmt.Errorf("write revocation list: %w", err)
+	}
+	return nil
+}
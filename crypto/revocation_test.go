@@ -0,0 +1,136 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func useTempRevocations(t *testing.T, signers ...string) string {
+	t.Helper()
+	revocations.Lock()
+	list, savedPath, signersSaved := revocations.list, revocations.path, revocations.signers
+	fingerprints, serials := revocations.fingerprints, revocations.serials
+	revocations.list, revocations.fingerprints, revocations.serials = nil, nil, nil
+	revocations.Unlock()
+	t.Cleanup(func() {
+		revocations.Lock()
+		revocations.list, revocations.path, revocations.signers = list, savedPath, signersSaved
+		revocations.fingerprints, revocations.serials = fingerprints, serials
+		revocations.Unlock()
+	})
+
+	path := filepath.Join(t.TempDir(), "revoked.pem")
+	if err := ConfigureRevocation(path, signers); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testSigner(t *testing.T) tls.Certificate {
+	t.Helper()
+	der, key, err := NewCA("revocation signer", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func signedList(t *testing.T, signer tls.Certificate, version uint64, fingerprints ...string) *RevocationList {
+	t.Helper()
+	rl := &RevocationList{Version: version, Issued: time.Now(), Fingerprints: fingerprints}
+	if err := SignRevocationList(rl, signer); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := MarshalRevocationList(rl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseRevocationList(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestRevocationListAppliesNewerVersionsOnly(t *testing.T) {
+	signer := testSigner(t)
+	path := useTempRevocations(t, Fingerprint(signer.Certificate[0]))
+
+	if ok, err := ApplyRevocationList(signedList(t, signer, 2, fpA)); !ok || err != nil {
+		t.Fatalf("apply v2: ok=%v err=%v", ok, err)
+	}
+	if !RevokedFingerprint(fpA) || RevokedFingerprint(fpB) {
+		t.Fatal("v2 not in force")
+	}
+	if ok, _ := ApplyRevocationList(signedList(t, signer, 1, fpB)); ok {
+		t.Fatal("older list replaced a newer one")
+	}
+	if ok, _ := ApplyRevocationList(signedList(t, signer, 2, fpB)); ok {
+		t.Fatal("list with the same version replaced the one in force")
+	}
+
+	saved, err := ReadRevocationFile(path)
+	if err != nil || saved == nil || saved.Version != 2 {
+		t.Fatalf("saved list = %+v, err %v", saved, err)
+	}
+
+	if ok, err := ApplyRevocationList(signedList(t, signer, 3, fpB)); !ok || err != nil {
+		t.Fatalf("apply v3: ok=%v err=%v", ok, err)
+	}
+	if RevokedFingerprint(fpA) || !RevokedFingerprint(fpB) {
+		t.Fatal("v3 should replace v2 as a whole")
+	}
+}
+
+func TestRevocationListRejectsBadSignatures(t *testing.T) {
+	signer := testSigner(t)
+	useTempRevocations(t, Fingerprint(signer.Certificate[0]))
+
+	tampered := signedList(t, signer, 1, fpA)
+	tampered.Fingerprints = []string{fpB}
+	if _, err := ApplyRevocationList(tampered); err == nil {
+		t.Fatal("expected tampered list to be rejected")
+	}
+
+	if _, err := ApplyRevocationList(signedList(t, testSigner(t), 1, fpA)); err == nil {
+		t.Fatal("expected list from an untrusted signer to be rejected")
+	}
+	if CurrentRevocationList() != nil {
+		t.Fatal("rejected lists must not be put in force")
+	}
+}
+
+func TestRevokedSerialFailsVerification(t *testing.T) {
+	caDER, caKey := useTestCA(t)
+	useTempRevocations(t)
+	der := issueTestCert(t, caDER, caKey, "node3", nil)
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCAFunc([][]byte{der}, nil); err != nil {
+		t.Fatalf("before revocation: %v", err)
+	}
+
+	// The mesh CA may sign revocations without being a configured signer
+	rl := &RevocationList{Version: 1, Issued: time.Now(), Serials: []string{leaf.SerialNumber.Text(16)}}
+	if err := SignRevocationList(rl, tls.Certificate{Certificate: [][]byte{caDER}, PrivateKey: caKey}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplyRevocationList(rl); err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsRevoked(leaf) {
+		t.Fatal("certificate with revoked serial not reported as revoked")
+	}
+	if err := verifyCAFunc([][]byte{der}, nil); err == nil {
+		t.Fatal("expected revoked certificate to fail verification")
+	}
+	if err := verifyTOFU("node3", "")([][]byte{der}, nil); err == nil {
+		t.Fatal("expected revoked certificate to fail the dial-side check")
+	}
+}
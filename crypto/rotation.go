@@ -0,0 +1,236 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const successionFormat = 1
+
+// successionContext is prepended to the signed bytes so a succession
+// signature cannot be replayed as anything else.
+var successionContext = []byte("vibepn-rotation-v1\x00")
+
+// The certificate this node presents. The tls.Configs built here fetch it
+// on every handshake, so a rotation applies to new connections without
+// rebuilding them.
+var localIdentity struct {
+	sync.RWMutex
+	cert *tls.Certificate
+}
+
+// Keys that handed over to a successor: old fingerprint → new fingerprint.
+var successors struct {
+	sync.RWMutex
+	next map[string]string
+}
+
+func init() {
+	successors.next = make(map[string]string)
+}
+
+func setLocalIdentity(cert tls.Certificate) {
+	localIdentity.Lock()
+	defer localIdentity.Unlock()
+	localIdentity.cert = &cert
+}
+
+// LocalCertificate returns the identity this node currently presents, or
+// nil before LoadTLS.
+func LocalCertificate() *tls.Certificate {
+	localIdentity.RLock()
+	defer localIdentity.RUnlock()
+	return localIdentity.cert
+}
+
+// LocalFingerprint returns the fingerprint of the current identity.
+func LocalFingerprint() string {
+	cert := LocalCertificate()
+	if cert == nil || len(cert.Certificate) == 0 {
+		return ""
+	}
+	return Fingerprint(cert.Certificate[0])
+}
+
+// useLocalIdentity makes an outbound tls.Config present the current
+// identity, falling back to the key pair on disk when LoadTLS has not run.
+func useLocalIdentity(conf *tls.Config, certPath, keyPath string) error {
+	if LocalCertificate() != nil {
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return LocalCertificate(), nil
+		}
+		return nil
+	}
+	cert, err := LoadKeyPair(certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("load cert/key: %w", err)
+	}
+	conf.Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+// LatestFingerprint follows announced successors from fp to the key the
+// peer uses now.
+func LatestFingerprint(fp string) string {
+	successors.RLock()
+	defer successors.RUnlock()
+	for seen := 0; seen < 16; seen++ {
+		next, ok := successors.next[fp]
+		if !ok {
+			break
+		}
+		fp = next
+	}
+	return fp
+}
+
+// isSuccessor reports whether newFP took over from oldFP, directly or
+// through several rotations.
+func isSuccessor(oldFP, newFP string) bool {
+	return oldFP != newFP && LatestFingerprint(oldFP) == newFP
+}
+
+// Succession is a key rotation announcement: the old key names its
+// successor and both keys sign it. Peers keep accepting the old key until
+// Until.
+type Succession struct {
+	OldFingerprint string
+	NewFingerprint string
+	Until          time.Time
+	Raw            []byte // signed wire form
+}
+
+// RotateIdentity switches this node to the key pair at certPath/keyPath
+// and returns the announcement for peers. The new certificate must carry
+// the same node name.
+func RotateIdentity(certPath, keyPath string, grace time.Duration) (*Succession, error) {
+	if CAEnabled() {
+		return nil, errors.New("in CA mode, issue a new certificate with vpnctl ca sign instead")
+	}
+	old := LocalCertificate()
+	if old == nil {
+		return nil, errors.New("no identity loaded")
+	}
+	next, err := LoadKeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("load new cert/key: %w", err)
+	}
+
+	oldCert, err := x509.ParseCertificate(old.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse current cert: %w", err)
+	}
+	newCert, err := x509.ParseCertificate(next.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse new cert: %w", err)
+	}
+	if newCert.Subject.CommonName != oldCert.Subject.CommonName {
+		return nil, fmt.Errorf("new certificate is for %q, expected %q", newCert.Subject.CommonName, oldCert.Subject.CommonName)
+	}
+	s := &Succession{
+		OldFingerprint: Fingerprint(oldCert.Raw),
+		NewFingerprint: Fingerprint(newCert.Raw),
+		Until:          time.Now().Add(grace).Truncate(time.Second),
+	}
+	if s.OldFingerprint == s.NewFingerprint {
+		return nil, errors.New("new identity is the current one")
+	}
+
+	buf := []byte{successionFormat}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(s.Until.Unix()))
+	buf = appendBlob(buf, oldCert.Raw)
+	buf = appendBlob(buf, newCert.Raw)
+	signed := append(append([]byte{}, successionContext...), buf...)
+	oldSig, err := SignWithCertificate(*old, signed)
+	if err != nil {
+		return nil, fmt.Errorf("sign with current key: %w", err)
+	}
+	newSig, err := SignWithCertificate(next, signed)
+	if err != nil {
+		return nil, fmt.Errorf("sign with new key: %w", err)
+	}
+	buf = appendBlob(buf, oldSig)
+	s.Raw = appendBlob(buf, newSig)
+
+	setLocalIdentity(next)
+	noteSuccessor(s.OldFingerprint, s.NewFingerprint)
+
+	// Keep trusting revocation lists we sign ourselves
+	revocations.Lock()
+	if revocations.signers[s.OldFingerprint] {
+		revocations.signers[s.NewFingerprint] = true
+	}
+	revocations.Unlock()
+	return s, nil
+}
+
+// ParseSuccession decodes an announcement and checks both signatures.
+func ParseSuccession(data []byte) (*Succession, error) {
+	errShort := errors.New("succession truncated")
+	if len(data) < 9 {
+		return nil, errShort
+	}
+	if data[0] != successionFormat {
+		return nil, fmt.Errorf("unsupported succession format %d", data[0])
+	}
+	until := time.Unix(int64(binary.BigEndian.Uint64(data[1:9])), 0)
+
+	oldDER, rest, ok := readBlob(data[9:])
+	if !ok {
+		return nil, errShort
+	}
+	newDER, rest, ok := readBlob(rest)
+	if !ok {
+		return nil, errShort
+	}
+	signed := append(append([]byte{}, successionContext...), data[:len(data)-len(rest)]...)
+	oldSig, rest, ok := readBlob(rest)
+	if !ok {
+		return nil, errShort
+	}
+	newSig, rest, ok := readBlob(rest)
+	if !ok || len(rest) != 0 {
+		return nil, errShort
+	}
+
+	if err := VerifyCertificateSignature(oldDER, signed, oldSig); err != nil {
+		return nil, fmt.Errorf("invalid signature by current key: %w", err)
+	}
+	if err := VerifyCertificateSignature(newDER, signed, newSig); err != nil {
+		return nil, fmt.Errorf("invalid signature by new key: %w", err)
+	}
+	return &Succession{
+		OldFingerprint: Fingerprint(oldDER),
+		NewFingerprint: Fingerprint(newDER),
+		Until:          until,
+		Raw:            append([]byte{}, data...),
+	}, nil
+}
+
+// AcceptSuccession trusts the successor wherever the old key was trusted:
+// a TOFU pin gains a second pin for the new key and keeps the old one
+// until s.Until.
+func AcceptSuccession(s *Succession) error {
+	if RevokedFingerprint(s.NewFingerprint) {
+		return fmt.Errorf("successor %s is revoked", s.NewFingerprint)
+	}
+	noteSuccessor(s.OldFingerprint, s.NewFingerprint)
+	return pinSuccessor(s.OldFingerprint, s.NewFingerprint, s.Until)
+}
+
+func noteSuccessor(oldFP, newFP string) {
+	successors.Lock()
+	defer successors.Unlock()
+	successors.next[oldFP] = newFP
+}
+
+// appendBlob appends a 2-byte length-prefixed byte string.
+func appendBlob(buf, b []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(b)))
+	return append(buf, b...)
+}
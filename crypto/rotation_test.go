@@ -0,0 +1,113 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestIdentity writes a fresh self-signed key pair for name and
+// returns its paths.
+func writeTestIdentity(t *testing.T, name string) (string, string) {
+	t.Helper()
+	der, key, err := NewCA(name, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func useTestIdentity(t *testing.T, name string) string {
+	t.Helper()
+	certPath, keyPath := writeTestIdentity(t, name)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := LocalCertificate()
+	setLocalIdentity(cert)
+	t.Cleanup(func() {
+		localIdentity.Lock()
+		localIdentity.cert = saved
+		localIdentity.Unlock()
+	})
+	return Fingerprint(cert.Certificate[0])
+}
+
+func TestRotateIdentityAnnouncesSuccessor(t *testing.T) {
+	oldFP := useTestIdentity(t, "node1")
+
+	certPath, keyPath := writeTestIdentity(t, "node1")
+	s, err := RotateIdentity(certPath, keyPath, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.OldFingerprint != oldFP || LocalFingerprint() != s.NewFingerprint {
+		t.Fatalf("identity not switched: old %s new %s local %s", s.OldFingerprint, s.NewFingerprint, LocalFingerprint())
+	}
+	if !isSuccessor(oldFP, s.NewFingerprint) {
+		t.Fatal("rotating node should trust its own successor")
+	}
+
+	parsed, err := ParseSuccession(s.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.OldFingerprint != oldFP || parsed.NewFingerprint != s.NewFingerprint || !parsed.Until.Equal(s.Until) {
+		t.Fatalf("parsed %+v, want %+v", parsed, s)
+	}
+
+	tampered := append([]byte{}, s.Raw...)
+	tampered[3] ^= 0xff // inside the grace deadline
+	if _, err := ParseSuccession(tampered); err == nil {
+		t.Fatal("expected tampered succession to be rejected")
+	}
+
+	otherCert, otherKey := writeTestIdentity(t, "node9")
+	if _, err := RotateIdentity(otherCert, otherKey, time.Hour); err == nil {
+		t.Fatal("expected rotation to a certificate for another name to fail")
+	}
+}
+
+func TestTOFUAcceptsBothKeysDuringGrace(t *testing.T) {
+	useTempStore(t)
+	now := time.Now()
+
+	if err := checkTOFU("node2", "", fpA, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := pinSuccessor(fpA, fpB, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTOFU("node2", "", fpB, now); err != nil {
+		t.Fatalf("successor rejected: %v", err)
+	}
+	if err := checkTOFU("node2", "", fpA, now); err != nil {
+		t.Fatalf("old key rejected during grace: %v", err)
+	}
+
+	later := now.Add(2 * time.Hour)
+	if err := checkTOFU("node2", "", fpA, later); err == nil {
+		t.Fatal("expected old key to be rejected after the grace period")
+	}
+	if err := checkTOFU("node2", "", fpB, later); err != nil {
+		t.Fatalf("successor rejected after the grace period: %v", err)
+	}
+}
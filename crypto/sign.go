@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// SignWithCertificate signs msg with the private key behind cert, so that
+// anyone holding the certificate can check it with VerifyCertificateSignature.
+func SignWithCertificate(cert tls.Certificate, msg []byte) ([]byte, error) {
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot sign")
+	}
+
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		return signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		digest := sha256.Sum256(msg)
+		return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", signer.Public())
+	}
+}
+
+// VerifyCertificateSignature checks that sig over msg was made by the key
+// of the DER certificate certDER.
+func VerifyCertificateSignature(certDER, msg, sig []byte) error {
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return fmt.Errorf("parse cert: %w", err)
+	}
+
+	var algo x509.SignatureAlgorithm
+	switch cert.PublicKey.(type) {
+	case ed25519.PublicKey:
+		algo = x509.PureEd25519
+	case *ecdsa.PublicKey:
+		algo = x509.ECDSAWithSHA256
+	case *rsa.PublicKey:
+		algo = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("unsupported key type %T", cert.PublicKey)
+	}
+	return cert.CheckSignature(algo, msg, sig)
+}
@@ -1,14 +1,13 @@
 package crypto
 
 import (
-	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -16,67 +15,342 @@ import (
 )
 
 var (
-	tofuPath  = filepath.Join(os.Getenv("HOME"), ".vibepn", "known_peers.json")
-	tofuStore = make(map[string]string) // peerName → fingerprint
-	tofuMu    sync.Mutex
+	tofuPath = DefaultTOFUPath()
+	tofuMu   sync.Mutex
 )
 
-func init() {
-	loadTOFU()
+// lastSeenInterval is how stale LastSeen may get before a handshake that
+// changes nothing else rewrites the store.
+const lastSeenInterval = time.Hour
+
+// KnownPeer is one pinned identity in the TOFU store.
+type KnownPeer struct {
+	Fingerprint string    `json:"fingerprint"`
+	Name        string    `json:"name"`
+	Address     string    `json:"address,omitempty"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	AcceptNew   bool      `json:"accept_new,omitempty"` // replace the pin with the next key presented
+	// RetireAt is set on a key that announced a successor; it stays
+	// accepted next to the new pin until then
+	RetireAt *time.Time `json:"retire_at,omitempty"`
+}
+
+// tofuFile is the on-disk format. Version 1 was a bare name → fingerprint
+// object.
+type tofuFile struct {
+	Version int                   `json:"version"`
+	Peers   map[string]*KnownPeer `json:"peers"` // fingerprint → entry
 }
 
-func loadTOFU() {
+// DefaultTOFUPath is used when identity.known_peers is not configured.
+func DefaultTOFUPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".vibepn", "known_peers.json")
+}
+
+// SetTOFUPath changes where pinned peer identities are stored.
+func SetTOFUPath(path string) {
 	tofuMu.Lock()
 	defer tofuMu.Unlock()
+	tofuPath = path
+}
+
+// loadKnownPeers reads the store, converting the legacy format. The file is
+// read on every use so that edits made by vpnctl trust take effect without
+// restarting the daemon. Caller must hold tofuMu.
+func loadKnownPeers() (map[string]*KnownPeer, error) {
+	peers := make(map[string]*KnownPeer)
 
 	data, err := os.ReadFile(tofuPath)
+	if os.IsNotExist(err) {
+		return peers, nil
+	}
 	if err != nil {
-		if os.IsNotExist(err) {
-			return // no file yet
+		return nil, fmt.Errorf("read TOFU store: %w", err)
+	}
+
+	var f tofuFile
+	if err := json.Unmarshal(data, &f); err == nil && f.Version >= 2 {
+		for fp, p := range f.Peers {
+			p.Fingerprint = fp
+			peers[fp] = p
 		}
-		log.New("crypto/tofu").Warnf("Failed to load TOFU store: %v", err)
-		return
+		return peers, nil
 	}
-	err = json.Unmarshal(data, &tofuStore)
-	if err != nil {
-		log.New("crypto/tofu").Warnf("Failed to parse TOFU store: %v", err)
+
+	var legacy map[string]string // peerName → fingerprint
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, fmt.Errorf("parse TOFU store %s: %w", tofuPath, err)
+	}
+	for name, fp := range legacy {
+		peers[fp] = &KnownPeer{Fingerprint: fp, Name: name}
+	}
+	log.New("crypto/tofu").Infof("Migrating %d pinned peers in %s to the fingerprint-keyed format", len(peers), tofuPath)
+	if err := saveKnownPeers(peers); err != nil {
+		return nil, err
 	}
+	return peers, nil
 }
 
-func saveTOFU() {
+// saveKnownPeers replaces the store atomically: readers see either the
+// old or the new file, never a partial write. Caller must hold tofuMu.
+func saveKnownPeers(peers map[string]*KnownPeer) error {
 	dir := filepath.Dir(tofuPath)
-	_ = os.MkdirAll(dir, 0700)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create TOFU directory: %w", err)
+	}
 
-	data, err := json.MarshalIndent(tofuStore, "", "  ")
+	data, err := json.MarshalIndent(tofuFile{Version: 2, Peers: peers}, "", "  ")
 	if err != nil {
-		log.New("crypto/tofu").Errorf("Failed to encode TOFU store: %v", err)
-		return
+		return fmt.Errorf("encode TOFU store: %w", err)
+	}
+	if err := writeFileAtomic(tofuPath, data); err != nil {
+		return fmt.Errorf("write TOFU store: %w", err)
 	}
+	return nil
+}
 
-	err = os.WriteFile(tofuPath, data, 0600)
+// writeFileAtomic replaces path with data through a synced temp file in
+// the same directory, so readers never see a partial file. An existing
+// file keeps its mode and owner.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
 	if err != nil {
-		log.New("crypto/tofu").Errorf("Failed to save TOFU store: %v", err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if fi, err := os.Stat(path); err == nil {
+		if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := keepOwner(tmp, fi); err != nil {
+			tmp.Close()
+			return fmt.Errorf("keep owner of %s: %w", path, err)
+		}
 	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
-func LoadPeerTLSWithTOFU(peerName string, address string, certPath string, keyPath string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+// pinnedByName returns the current (not retiring) entry pinned for name,
+// if any.
+func pinnedByName(peers map[string]*KnownPeer, name string) *KnownPeer {
+	for _, p := range peers {
+		if p.Name == name && p.RetireAt == nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// KnownPeers lists the TOFU store sorted by name.
+func KnownPeers() ([]KnownPeer, error) {
+	tofuMu.Lock()
+	defer tofuMu.Unlock()
+
+	peers, err := loadKnownPeers()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]KnownPeer, 0, len(peers))
+	for _, p := range peers {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Fingerprint < out[j].Fingerprint
+	})
+	return out, nil
+}
+
+// ForgetPeer removes every pin matching a peer name or fingerprint and
+// returns how many were removed. The next connection trusts on first use
+// again.
+func ForgetPeer(nameOrFingerprint string) (int, error) {
+	tofuMu.Lock()
+	defer tofuMu.Unlock()
+
+	peers, err := loadKnownPeers()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for fp, p := range peers {
+		if fp == nameOrFingerprint || p.Name == nameOrFingerprint {
+			delete(peers, fp)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, saveKnownPeers(peers)
+}
+
+// PinPeer pins name to fingerprint, replacing any earlier pin for name.
+func PinPeer(name, fingerprint, address string) error {
+	tofuMu.Lock()
+	defer tofuMu.Unlock()
+
+	peers, err := loadKnownPeers()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	entry := &KnownPeer{Fingerprint: fingerprint, Name: name, Address: address, FirstSeen: now}
+	for fp, p := range peers {
+		if p.Name == name {
+			delete(peers, fp)
+		}
+	}
+	if old := peers[fingerprint]; old != nil {
+		entry.FirstSeen, entry.LastSeen = old.FirstSeen, old.LastSeen
+	}
+	peers[fingerprint] = entry
+	return saveKnownPeers(peers)
+}
+
+// AcceptNewKey lets the next connection to name replace its pinned
+// fingerprint, for legitimate key changes.
+func AcceptNewKey(name string) error {
+	tofuMu.Lock()
+	defer tofuMu.Unlock()
+
+	peers, err := loadKnownPeers()
+	if err != nil {
+		return err
+	}
+	p := pinnedByName(peers, name)
+	if p == nil {
+		return fmt.Errorf("no pinned key for %q (the next key will be trusted on first use)", name)
+	}
+	p.AcceptNew = true
+	return saveKnownPeers(peers)
+}
+
+// pinSuccessor pins newFP next to the pin for oldFP and lets the old key
+// retire at retireAt. Keys that were never pinned are left alone.
+func pinSuccessor(oldFP, newFP string, retireAt time.Time) error {
+	tofuMu.Lock()
+	defer tofuMu.Unlock()
+
+	peers, err := loadKnownPeers()
 	if err != nil {
-		return nil, fmt.Errorf("load cert/key: %w", err)
+		return err
+	}
+	old := peers[oldFP]
+	if old == nil {
+		return nil
+	}
+	if peers[newFP] == nil {
+		peers[newFP] = &KnownPeer{Fingerprint: newFP, Name: old.Name, Address: old.Address, FirstSeen: time.Now()}
+	}
+	old.RetireAt = &retireAt
+	old.AcceptNew = false
+	return saveKnownPeers(peers)
+}
+
+// checkTOFU pins peerFP for peerName on first use and rejects a different
+// fingerprint afterwards, unless the pin was marked to accept a new key.
+func checkTOFU(peerName, address, peerFP string, now time.Time) error {
+	logger := log.New("crypto/tofu")
+
+	tofuMu.Lock()
+	defer tofuMu.Unlock()
+
+	peers, err := loadKnownPeers()
+	if err != nil {
+		return fmt.Errorf("TOFU: %w", err) // fail closed rather than trust anything
+	}
+
+	changed := false
+	for fp, p := range peers {
+		if p.RetireAt != nil && now.After(*p.RetireAt) {
+			logger.Infof("TOFU: retiring old key %s of %s", fp, p.Name)
+			delete(peers, fp)
+			changed = true
+		}
 	}
 
-	return &tls.Config{
-		Certificates:          []tls.Certificate{cert}, // ← 🧠 Present your cert
+	pinned := pinnedByName(peers, peerName)
+	switch {
+	case peers[peerFP] != nil && peers[peerFP].Name == peerName && peers[peerFP].RetireAt != nil:
+		logger.Infof("TOFU: %s presented its retiring key, accepted until %s", peerName, peers[peerFP].RetireAt.Format(time.RFC3339))
+
+	case pinned == nil:
+		logger.Infof("TOFU: trusting first fingerprint for %s (%s)", peerName, address)
+		if other := peers[peerFP]; other != nil {
+			logger.Warnf("TOFU: %s presents the key pinned for %s, re-pinning it under the new name", peerName, other.Name)
+		}
+		peers[peerFP] = &KnownPeer{Fingerprint: peerFP, Name: peerName, FirstSeen: now}
+		changed = true
+
+	case pinned.Fingerprint == peerFP:
+		logger.Infof("TOFU: fingerprint matched for %s", peerName)
+		changed = pinned.AcceptNew
+		pinned.AcceptNew = false
+
+	case pinned.AcceptNew:
+		logger.Warnf("TOFU: accepting new fingerprint %s for %s (was %s)", peerFP, peerName, pinned.Fingerprint)
+		delete(peers, pinned.Fingerprint)
+		peers[peerFP] = &KnownPeer{Fingerprint: peerFP, Name: peerName, FirstSeen: now}
+		changed = true
+
+	default:
+		return fmt.Errorf("TOFU: fingerprint mismatch for %s: got %s, expected %s (if the key change is legitimate, run 'vpnctl trust accept-new %s')",
+			peerName, peerFP, pinned.Fingerprint, peerName)
+	}
+
+	entry := peers[peerFP]
+	if address != "" && entry.Address != address {
+		entry.Address = address
+		changed = true
+	}
+	if !changed && now.Sub(entry.LastSeen) < lastSeenInterval {
+		return nil
+	}
+	entry.LastSeen = now
+	if err := saveKnownPeers(peers); err != nil {
+		logger.Errorf("Failed to save TOFU store: %v", err)
+	}
+	return nil
+}
+
+func LoadPeerTLSWithTOFU(peerName string, address string, certPath string, keyPath string) (*tls.Config, error) {
+	tlsConf := &tls.Config{
 		InsecureSkipVerify:    true,
 		VerifyPeerCertificate: verifyTOFU(peerName, address),
 		NextProtos:            []string{"vibepn/0.1"}, // ← 🧠 Needed for QUIC
-	}, nil
+	}
+	// ← 🧠 Present your cert
+	if err := useLocalIdentity(tlsConf, certPath, keyPath); err != nil {
+		return nil, err
+	}
+	return tlsConf, nil
 }
 
 func verifyTOFU(peerName, address string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
-		if len(rawCerts) == 0 {
-			return fmt.Errorf("no peer certificate presented")
+		if err := checkNotRevoked(rawCerts); err != nil {
+			return err
+		}
+		if CAEnabled() {
+			return verifyCANamed(rawCerts, peerName)
 		}
 
 		cert, err := x509.ParseCertificate(rawCerts[0])
@@ -91,27 +365,37 @@ func verifyTOFU(peerName, address string) func(rawCerts [][]byte, verifiedChains
 			return fmt.Errorf("peer certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
 		}
 
-		fp := sha256.Sum256(cert.Raw)
-		peerFP := hex.EncodeToString(fp[:])
-		logger := log.New("crypto/tofu")
-
-		tofuMu.Lock()
-		defer tofuMu.Unlock()
+		return checkTOFU(peerName, address, Fingerprint(cert.Raw), now)
+	}
+}
 
-		pinned, ok := tofuStore[peerName]
-		if !ok {
-			// First-time trust
-			logger.Infof("TOFU: trusting first fingerprint for %s (%s)", peerName, address)
-			tofuStore[peerName] = peerFP
-			saveTOFU()
+// LoadPeerTLSPinned builds a client TLS config that only accepts a peer
+// presenting the certificate with the given fingerprint. It is used when a
+// peer is known by fingerprint alone, e.g. when dialing back during a hole
+// punch.
+func LoadPeerTLSPinned(fingerprint string, certPath string, keyPath string) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("no peer certificate presented")
+			}
+			// A key the pinned one announced as its successor is as good
+			if got := Fingerprint(rawCerts[0]); got != fingerprint && !isSuccessor(fingerprint, got) {
+				return fmt.Errorf("fingerprint mismatch: got %s, expected %s", got, fingerprint)
+			}
+			if err := checkNotRevoked(rawCerts); err != nil {
+				return err
+			}
+			if CAEnabled() {
+				return verifyCAFunc(rawCerts, nil)
+			}
 			return nil
-		}
-
-		if pinned != peerFP {
-			return fmt.Errorf("TOFU: fingerprint mismatch for %s: got %s, expected %s", peerName, peerFP, pinned)
-		}
-
-		logger.Infof("TOFU: fingerprint matched for %s", peerName)
-		return nil
+		},
+		NextProtos: []string{"vibepn/0.1"},
+	}
+	if err := useLocalIdentity(tlsConf, certPath, keyPath); err != nil {
+		return nil, err
 	}
+	return tlsConf, nil
 }
@@ -0,0 +1,153 @@
+package crypto
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	fpA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	fpB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+func useTempStore(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_peers.json")
+	saved := tofuPath
+	SetTOFUPath(path)
+	t.Cleanup(func() { SetTOFUPath(saved) })
+	return path
+}
+
+func TestTOFUPinsOnFirstUseAndRejectsChanges(t *testing.T) {
+	useTempStore(t)
+	now := time.Now()
+
+	if err := checkTOFU("node2", "203.0.113.9:51820", fpA, now); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := checkTOFU("node2", "203.0.113.9:51820", fpA, now.Add(lastSeenInterval)); err != nil {
+		t.Fatalf("same key: %v", err)
+	}
+	err := checkTOFU("node2", "203.0.113.9:51820", fpB, now)
+	if err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Fatalf("changed key: got %v, want mismatch", err)
+	}
+
+	peers, err := KnownPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].Fingerprint != fpA || peers[0].Name != "node2" ||
+		peers[0].Address != "203.0.113.9:51820" || !peers[0].LastSeen.After(peers[0].FirstSeen) {
+		t.Fatalf("unexpected store %+v", peers)
+	}
+}
+
+func TestTOFUAcceptNewAndForget(t *testing.T) {
+	useTempStore(t)
+	now := time.Now()
+
+	if err := checkTOFU("node2", "", fpA, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := AcceptNewKey("node2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTOFU("node2", "", fpB, now); err != nil {
+		t.Fatalf("accept-new: %v", err)
+	}
+	// The new key is pinned again, so a third one is refused.
+	if err := checkTOFU("node2", "", fpA, now); err == nil {
+		t.Fatal("expected old key to be rejected after re-keying")
+	}
+
+	if n, err := ForgetPeer("node2"); err != nil || n != 1 {
+		t.Fatalf("forget: n=%d err=%v", n, err)
+	}
+	if err := checkTOFU("node2", "", fpA, now); err != nil {
+		t.Fatalf("after forget: %v", err)
+	}
+}
+
+func TestTOFUPinReplacesExisting(t *testing.T) {
+	useTempStore(t)
+
+	if err := checkTOFU("node2", "", fpA, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := PinPeer("node2", fpB, "198.51.100.1:51820"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTOFU("node2", "", fpA, time.Now()); err == nil {
+		t.Fatal("expected previously pinned key to be rejected")
+	}
+	if err := checkTOFU("node2", "", fpB, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTOFUMigratesLegacyStore(t *testing.T) {
+	path := useTempStore(t)
+	if err := os.WriteFile(path, []byte(`{"node2": "`+fpA+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkTOFU("node2", "", fpA, time.Now()); err != nil {
+		t.Fatalf("legacy pin not honoured: %v", err)
+	}
+	if err := checkTOFU("node2", "", fpB, time.Now()); err == nil {
+		t.Fatal("expected legacy pin to reject a different key")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"version": 2`) {
+		t.Fatalf("store not rewritten in the new format:\n%s", data)
+	}
+}
+
+func TestTOFUFailsClosedOnCorruptStore(t *testing.T) {
+	path := useTempStore(t)
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTOFU("node2", "", fpA, time.Now()); err == nil {
+		t.Fatal("expected corrupt store to refuse the connection")
+	}
+}
+
+func TestTOFUSkipsLastSeenOnlyWrites(t *testing.T) {
+	path := useTempStore(t)
+	now := time.Now()
+	if err := checkTOFU("node2", "203.0.113.9:51820", fpA, now); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	before, _ := os.Stat(path)
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkTOFU("node2", "203.0.113.9:51820", fpA, now.Add(time.Minute)); err != nil {
+		t.Fatalf("same key: %v", err)
+	}
+	if after, _ := os.Stat(path); !after.ModTime().Equal(before.ModTime()) {
+		t.Error("store rewritten for a LastSeen update alone")
+	}
+
+	if err := checkTOFU("node2", "203.0.113.9:51820", fpA, now.Add(2*lastSeenInterval)); err != nil {
+		t.Fatalf("same key later: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.ModTime().Equal(before.ModTime()) {
+		t.Error("stale LastSeen never written")
+	}
+	if after.Mode().Perm() != 0640 {
+		t.Errorf("rewritten store has mode %v, want the original 0640", after.Mode().Perm())
+	}
+}
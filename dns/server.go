@@ -0,0 +1,194 @@
+package dns
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"vibepn/log"
+	"vibepn/metrics"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Domain is the zone the resolver answers itself: <peer>.<network>.vibepn.
+const Domain = "vibepn"
+
+const (
+	recordTTL       = 60
+	upstreamTimeout = 2 * time.Second
+	maxMessageSize  = 4096
+)
+
+// Directory resolves node names to overlay addresses.
+type Directory interface {
+	ResolveName(network, name string) net.IP
+}
+
+// Server answers names under Domain from the directory and forwards
+// every other query to the upstream servers, in order.
+type Server struct {
+	dir      Directory
+	upstream []string
+	logger   *log.Logger
+}
+
+func NewServer(dir Directory, upstream []string) *Server {
+	normalized := make([]string, 0, len(upstream))
+	for _, u := range upstream {
+		if _, _, err := net.SplitHostPort(u); err != nil {
+			u = net.JoinHostPort(u, "53")
+		}
+		normalized = append(normalized, u)
+	}
+	return &Server{
+		dir:      dir,
+		upstream: normalized,
+		logger:   log.New("dns/server"),
+	}
+}
+
+// ListenAndServe answers UDP queries on addr. It only returns on error.
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve answers UDP queries on conn until it fails or is closed, and
+// closes it.
+func (s *Server) Serve(conn net.PacketConn) error {
+	defer conn.Close()
+	s.logger.Infof("Resolving *.%s on %s", Domain, conn.LocalAddr())
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := slices.Clone(buf[:n])
+		go func() {
+			resp, result := s.handle(query)
+			metrics.DNSQueries.WithLabelValues(result).Inc()
+			if resp == nil {
+				return
+			}
+			if _, err := conn.WriteTo(resp, from); err != nil {
+				s.logger.Debugf("Failed to answer %s: %v", from, err)
+			}
+		}()
+	}
+}
+
+// handle returns the response to query and how it was resolved.
+func (s *Server) handle(query []byte) ([]byte, string) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, "malformed"
+	}
+	q, err := p.Question()
+	if err != nil || header.Response {
+		return nil, "malformed"
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	if name != Domain && !strings.HasSuffix(name, "."+Domain) {
+		return s.forward(header, q, query)
+	}
+
+	// 📇 <peer>.<network>.vibepn, answered from the peer table
+	var ip net.IP
+	if labels := strings.Split(strings.TrimSuffix(name, "."+Domain), "."); len(labels) == 2 {
+		ip = s.dir.ResolveName(labels[1], labels[0])
+	}
+	if ip == nil {
+		return reply(header, q, dnsmessage.RCodeNameError, nil), "nxdomain"
+	}
+	return reply(header, q, dnsmessage.RCodeSuccess, ip), "answered"
+}
+
+// forward relays query to the first upstream server that answers.
+func (s *Server) forward(header dnsmessage.Header, q dnsmessage.Question, query []byte) ([]byte, string) {
+	buf := make([]byte, maxMessageSize)
+	for _, upstream := range s.upstream {
+		conn, err := net.DialTimeout("udp", upstream, upstreamTimeout)
+		if err != nil {
+			continue
+		}
+		_ = conn.SetDeadline(time.Now().Add(upstreamTimeout))
+		_, err = conn.Write(query)
+		var n int
+		if err == nil {
+			n, err = conn.Read(buf)
+		}
+		conn.Close()
+		if err != nil {
+			s.logger.Debugf("Upstream %s failed for %s: %v", upstream, q.Name, err)
+			continue
+		}
+		return buf[:n], "forwarded"
+	}
+	return reply(header, q, dnsmessage.RCodeServerFailure, nil), "failed"
+}
+
+// reply builds a response to q, with an A or AAAA answer if ip matches
+// the question's type; a name without one gets no answer records.
+func reply(query dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode, ip net.IP) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		Authoritative:      rcode != dnsmessage.RCodeServerFailure,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	_ = b.StartQuestions()
+	_ = b.Question(q)
+	_ = b.StartAnswers()
+
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: recordTTL}
+	if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+		_ = b.AResource(rh, dnsmessage.AResource{A: [4]byte(ip4)})
+	} else if ip != nil && ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+		_ = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())})
+	}
+
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// SystemUpstreams returns the nameservers in /etc/resolv.conf, skipping
+// the addresses in exclude so the resolver never forwards to itself.
+func SystemUpstreams(exclude []net.IP) []string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var out []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		ip := net.ParseIP(fields[1])
+		if ip == nil || slices.ContainsFunc(exclude, ip.Equal) {
+			continue
+		}
+		out = append(out, net.JoinHostPort(ip.String(), "53"))
+	}
+	return out
+}
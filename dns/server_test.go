@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type staticDirectory map[string]net.IP // "network/name" → address
+
+func (d staticDirectory) ResolveName(network, name string) net.IP {
+	return d[network+"/"+name]
+}
+
+func query(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, RecursionDesired: true})
+	_ = b.StartQuestions()
+	if err := b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func parse(t *testing.T, resp []byte) dnsmessage.Message {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		t.Fatalf("unpack response: %v", err)
+	}
+	return m
+}
+
+func TestHandleOverlayNames(t *testing.T) {
+	s := NewServer(staticDirectory{"corp/node2": net.ParseIP("10.42.0.7")}, nil)
+
+	resp, result := s.handle(query(t, "Node2.corp.vibepn.", dnsmessage.TypeA))
+	m := parse(t, resp)
+	if result != "answered" || m.Header.ID != 7 || len(m.Answers) != 1 {
+		t.Fatalf("A query: result %s, %+v", result, m)
+	}
+	if a, ok := m.Answers[0].Body.(*dnsmessage.AResource); !ok || net.IP(a.A[:]).String() != "10.42.0.7" {
+		t.Fatalf("A answer = %v", m.Answers[0].Body)
+	}
+
+	// The name exists, but has no IPv6 address
+	resp, _ = s.handle(query(t, "node2.corp.vibepn.", dnsmessage.TypeAAAA))
+	if m := parse(t, resp); m.Header.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 0 {
+		t.Fatalf("AAAA query: %+v", m)
+	}
+
+	for _, name := range []string{"node3.corp.vibepn.", "node2.lab.vibepn.", "corp.vibepn."} {
+		resp, result := s.handle(query(t, name, dnsmessage.TypeA))
+		if m := parse(t, resp); result != "nxdomain" || m.Header.RCode != dnsmessage.RCodeNameError {
+			t.Errorf("%s: result %s, rcode %v", name, result, m.Header.RCode)
+		}
+	}
+}
+
+func TestHandleForwardsUpstream(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		n, from, err := upstream.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var p dnsmessage.Parser
+		h, _ := p.Start(buf[:n])
+		q, _ := p.Question()
+		upstream.WriteTo(reply(h, q, dnsmessage.RCodeSuccess, net.ParseIP("192.0.2.1")), from)
+	}()
+
+	// The first upstream is down, the second answers
+	s := NewServer(staticDirectory{}, []string{"127.0.0.1:1", upstream.LocalAddr().String()})
+	resp, result := s.handle(query(t, "example.com.", dnsmessage.TypeA))
+	m := parse(t, resp)
+	if result != "forwarded" || len(m.Answers) != 1 {
+		t.Fatalf("forwarded query: result %s, %+v", result, m)
+	}
+
+	s = NewServer(staticDirectory{}, nil)
+	resp, result = s.handle(query(t, "example.com.", dnsmessage.TypeA))
+	if m := parse(t, resp); result != "failed" || m.Header.RCode != dnsmessage.RCodeServerFailure {
+		t.Fatalf("query without upstream: result %s, rcode %v", result, m.Header.RCode)
+	}
+}
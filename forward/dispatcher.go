@@ -6,7 +6,9 @@ import (
 	"net"
 	"time"
 
+	"vibepn/config"
 	"vibepn/log"
+	"vibepn/metrics"
 	"vibepn/netgraph"
 	"vibepn/peer"
 	"vibepn/tun"
@@ -29,8 +31,13 @@ func NewDispatcher(routes *netgraph.RouteTable, ifaces map[string]*tun.Device, r
 }
 
 func (d *Dispatcher) Start(network string, dev *tun.Device) {
+	netCfg := d.Registry.NetConfig()[network]
 	go func() {
-		buf := make([]byte, 1500)
+		size := 1500
+		if dev.TAP() {
+			size += ethHeaderLen + 4 // room for a VLAN tag
+		}
+		buf := make([]byte, size)
 		for {
 			n, err := dev.Read(buf)
 			if err != nil {
@@ -39,67 +46,152 @@ func (d *Dispatcher) Start(network string, dev *tun.Device) {
 			}
 
 			pkt := buf[:n]
+			if dev.TAP() {
+				d.switchFrame(network, pkt)
+				continue
+			}
+
+			if _, dst := packetAddrs(pkt); dst != nil && groupDst(dst, netCfg.Prefix) {
+				d.multicast(network, netCfg, pkt, dst)
+				continue
+			}
+
 			dst := parseDstIP(pkt)
 			if dst == nil {
 				d.Logger.Warnf("[%s] Invalid IP packet: first 8 bytes = % x", network, pkt[:min(8, len(pkt))])
 				continue
 			}
 
-			route := d.lookupRoute(network, dst.String())
+			route := d.Routes.Lookup(network, dst, "")
 			if route == nil {
 				d.Logger.Warnf("[%s] No route for %s", network, dst)
 				continue
 			}
 
-			conn := d.Registry.Get(route.PeerID)
-			if conn == nil {
-				d.Logger.Warnf("[%s] No active connection for peer %s", network, route.PeerID)
-				continue
-			}
+			d.send(network, route.PeerID, pkt)
+		}
+	}()
+}
 
-			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-			stream, err := conn.OpenStreamSync(ctx)
-			cancel()
-			if err != nil {
-				d.Logger.Warnf("[%s] Failed to open stream to peer %s: %v", network, route.PeerID, err)
-				continue
-			}
+// switchFrame sends an Ethernet frame read from a tap device to the peer
+// its destination was learned from, or floods it to every member.
+func (d *Dispatcher) switchFrame(network string, frame []byte) {
+	if len(frame) < ethHeaderLen {
+		d.Logger.Warnf("[%s] Runt frame of %d bytes", network, len(frame))
+		return
+	}
+	if peerID := lookupMAC(network, frame, time.Now()); peerID != "" && d.Registry.Get(peerID) != nil {
+		d.send(network, peerID, frame)
+		return
+	}
+	for peerID := range d.Registry.All() {
+		if d.Registry.Authorized(peerID, network) {
+			d.send(network, peerID, frame)
+		}
+	}
+}
 
-			if len(network) > 255 {
-				d.Logger.Warnf("[%s] Network name too long: %d", network, len(network))
-				stream.Close()
-				continue
+// multicast sends a multicast or broadcast packet read from the TUN to
+// the members of network that listen to its group.
+func (d *Dispatcher) multicast(network string, netCfg config.NetworkConfig, pkt []byte, dst net.IP) {
+	if !netCfg.ForwardsMulticast() {
+		d.Logger.Debugf("[%s] Not forwarding packet for %s: multicast is off", network, dst)
+		metrics.MulticastPackets.WithLabelValues(network, "disabled").Inc()
+		return
+	}
+	mc := netCfg.Multicast
+	now := time.Now()
+
+	if mc.Snooping {
+		if joined, left, ok := membership(pkt); ok {
+			for _, group := range joined {
+				if !floodedGroup(group) {
+					d.Registry.JoinGroup(network, group)
+				}
 			}
-
-			if len(pkt) > 0xFFFF {
-				d.Logger.Warnf("[%s] Packet too large: %d bytes", network, len(pkt))
-				stream.Close()
-				continue
+			for _, group := range left {
+				d.Registry.LeaveGroup(network, group)
 			}
+			metrics.MulticastPackets.WithLabelValues(network, "membership").Inc()
+			return
+		}
+	}
+	if reflected(network, pkt, now) {
+		metrics.MulticastPackets.WithLabelValues(network, "reflected").Inc()
+		return
+	}
+	rate, burst := mc.Limits()
+	if !allowMulticast(network, "", rate, burst, now) {
+		d.Logger.Debugf("[%s] Multicast rate exceeded, dropping packet for %s", network, dst)
+		metrics.MulticastPackets.WithLabelValues(network, "rate_limited").Inc()
+		return
+	}
 
-			header := make([]byte, 1+len(network)+2)
-			header[0] = byte(len(network))
-			copy(header[1:], network)
-			binary.BigEndian.PutUint16(header[1+len(network):], uint16(len(pkt)))
+	var group net.IP
+	if mc.Snooping && !floodedGroup(dst) {
+		group = dst
+	}
+	peers := d.Registry.MulticastPeers(network, group)
+	if len(peers) == 0 {
+		metrics.MulticastPackets.WithLabelValues(network, "no_members").Inc()
+		return
+	}
+	for _, peerID := range peers {
+		d.send(network, peerID, pkt)
+	}
+	metrics.MulticastPackets.WithLabelValues(network, "sent").Inc()
+}
 
-			_, err = stream.Write(header)
-			if err != nil {
-				d.Logger.Warnf("[%s] Failed to write packet header: %v", network, err)
-				stream.Close()
-				continue
-			}
+// send writes pkt to peerID on a new stream, framed with its network.
+func (d *Dispatcher) send(network, peerID string, pkt []byte) {
+	conn := d.Registry.Get(peerID)
+	if conn == nil {
+		d.Logger.Warnf("[%s] No active connection for peer %s", network, peerID)
+		return
+	}
 
-			_, err = stream.Write(pkt)
-			if err != nil {
-				d.Logger.Warnf("[%s] Failed to write to stream: %v", network, err)
-				stream.Close()
-				continue
-			}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	stream, err := conn.OpenStreamSync(ctx)
+	cancel()
+	if err != nil {
+		d.Logger.Warnf("[%s] Failed to open stream to peer %s: %v", network, peerID, err)
+		return
+	}
 
-			stream.Close()
-			d.Logger.Debugf("[%s] Sent %d bytes to %s", network, n, route.PeerID)
-		}
-	}()
+	if len(network) > 255 {
+		d.Logger.Warnf("[%s] Network name too long: %d", network, len(network))
+		stream.Close()
+		return
+	}
+
+	if len(pkt) > 0xFFFF {
+		d.Logger.Warnf("[%s] Packet too large: %d bytes", network, len(pkt))
+		stream.Close()
+		return
+	}
+
+	header := make([]byte, 1+len(network)+2)
+	header[0] = byte(len(network))
+	copy(header[1:], network)
+	binary.BigEndian.PutUint16(header[1+len(network):], uint16(len(pkt)))
+
+	_, err = stream.Write(header)
+	if err != nil {
+		d.Logger.Warnf("[%s] Failed to write packet header: %v", network, err)
+		stream.Close()
+		return
+	}
+
+	_, err = stream.Write(pkt)
+	if err != nil {
+		d.Logger.Warnf("[%s] Failed to write to stream: %v", network, err)
+		stream.Close()
+		return
+	}
+
+	stream.Close()
+	d.Registry.AddTraffic(peerID, len(pkt), 0)
+	d.Logger.Debugf("[%s] Sent %d bytes to %s", network, len(pkt), peerID)
 }
 
 func parseDstIP(pkt []byte) net.IP {
@@ -109,25 +201,6 @@ func parseDstIP(pkt []byte) net.IP {
 	return net.IPv4(pkt[16], pkt[17], pkt[18], pkt[19])
 }
 
-func (d *Dispatcher) lookupRoute(network, ip string) *netgraph.Route {
-	routes := d.Routes.RoutesForNetwork(network, "")
-	dst := net.ParseIP(ip)
-	if dst == nil {
-		return nil
-	}
-
-	for _, r := range routes {
-		_, subnet, err := net.ParseCIDR(r.Prefix)
-		if err != nil {
-			continue
-		}
-		if subnet.Contains(dst) {
-			return &r
-		}
-	}
-	return nil
-}
-
 func min(a, b int) int {
 	if a < b {
 		return a
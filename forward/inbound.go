@@ -3,25 +3,35 @@ package forward
 import (
 	"encoding/binary"
 	"io"
+	"net"
+	"time"
+	"vibepn/config"
 	"vibepn/log"
+	"vibepn/metrics"
+	"vibepn/netgraph"
+	"vibepn/peer"
 	"vibepn/tun"
 
 	"github.com/quic-go/quic-go"
 )
 
 type Inbound struct {
-	devices map[string]*tun.Device
-	logger  *log.Logger
+	devices  map[string]*tun.Device
+	registry *peer.Registry
+	routes   *netgraph.RouteTable // subnet and exit routes peers sent, for source checks
+	logger   *log.Logger
 }
 
-func NewInbound(devices map[string]*tun.Device) *Inbound {
+func NewInbound(devices map[string]*tun.Device, registry *peer.Registry, routes *netgraph.RouteTable) *Inbound {
 	return &Inbound{
-		devices: devices,
-		logger:  log.New("forward/inbound"),
+		devices:  devices,
+		registry: registry,
+		routes:   routes,
+		logger:   log.New("forward/inbound"),
 	}
 }
 
-func (i *Inbound) HandleRawStream(stream quic.Stream) {
+func (i *Inbound) HandleRawStream(stream quic.Stream, peerID string) {
 	i.logger.Infof("Handling raw stream %d", stream.StreamID())
 
 	for {
@@ -38,7 +48,12 @@ func (i *Inbound) HandleRawStream(stream quic.Stream) {
 
 		networkLen := int(netLenBuf[0])
 		if networkLen == 0 {
-			i.logger.Warnf("Invalid network name length: %d", networkLen)
+			// 🔀 Length 0 escapes to a relay stream, which owns the rest of it
+			if i.registry == nil {
+				i.logger.Warnf("Relay stream from %s but no registry configured", peerID)
+				return
+			}
+			i.registry.HandleRelayStream(stream, peerID)
 			return
 		}
 
@@ -76,6 +91,16 @@ func (i *Inbound) HandleRawStream(stream quic.Stream) {
 		dev, ok := i.devices[network]
 		if !ok || dev == nil {
 			i.logger.Warnf("No local interface for network %s", network)
+			metrics.InboundDrops.WithLabelValues("", "no_interface").Inc()
+			continue
+		}
+		check := i.check
+		if dev.TAP() {
+			check = i.checkFrame
+		}
+		if reason := check(peerID, network, packet); reason != "" {
+			i.logger.Debugf("Dropping packet for %s from %s: %s", network, peerID, reason)
+			metrics.InboundDrops.WithLabelValues(network, reason).Inc()
 			continue
 		}
 
@@ -84,5 +109,133 @@ func (i *Inbound) HandleRawStream(stream quic.Stream) {
 			i.logger.Warnf("Failed to write packet to TUN for network %s: %v", network, err)
 			return
 		}
+		if dev.TAP() {
+			learnMAC(network, packet, peerID, time.Now())
+		}
+		if i.registry != nil {
+			i.registry.AddTraffic(peerID, 0, len(packet))
+			if !dev.TAP() {
+				src, _ := packetAddrs(packet)
+				i.registry.NoteAddress(peerID, network, src)
+			}
+		}
+	}
+}
+
+// check returns why packet from peerID may not enter network, or "" if it
+// may: the peer must be a member of the network, the source one the peer
+// may send from and the destination on the network, unless we are the
+// peer's exit, or a group or broadcast address when multicast is on.
+func (i *Inbound) check(peerID, network string, packet []byte) string {
+	if i.registry != nil && !i.registry.Authorized(peerID, network) {
+		return "not_member"
+	}
+	src, dst := packetAddrs(packet)
+	if src == nil {
+		return "malformed"
+	}
+	var netCfg config.NetworkConfig
+	if i.registry != nil {
+		netCfg = i.registry.NetConfig()[network]
+	}
+	group := groupDst(dst, netCfg.Prefix)
+	// IPv6 multicast comes from the sender's link-local address, which
+	// has no meaning beyond the network and is never announced
+	linkLocal := group && src.To4() == nil && src.IsLinkLocalUnicast()
+	if !linkLocal && !i.sourceAllowed(peerID, network, netCfg.Prefix, src) {
+		return "spoofed_source"
+	}
+	if group {
+		return checkMulticast(peerID, network, netCfg, packet)
+	}
+	if i.registry != nil && !i.registry.Deliverable(peerID, network, dst) {
+		return "exit_denied"
+	}
+	return ""
+}
+
+// sourceAllowed reports whether peerID may send from src on network: its
+// own address there, a subnet it routes for us or, while it is our exit,
+// any address. Routes inside the network's prefix do not count, since
+// every member announces the prefix itself.
+func (i *Inbound) sourceAllowed(peerID, network, prefix string, src net.IP) bool {
+	if i.registry == nil && i.routes == nil {
+		return true
+	}
+	if i.registry != nil && i.registry.OwnsAddress(peerID, network, src) {
+		return true
+	}
+	if i.routes == nil {
+		return false
+	}
+	_, own, _ := net.ParseCIDR(prefix)
+	for _, r := range i.routes.RoutesForNetwork(network, "") {
+		if r.PeerID != peerID {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(r.Prefix)
+		if err != nil || !subnet.Contains(src) || within(subnet, own) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// within reports whether subnet lies inside prefix.
+func within(subnet, prefix *net.IPNet) bool {
+	if prefix == nil {
+		return false
+	}
+	ones, _ := subnet.Mask.Size()
+	prefixOnes, _ := prefix.Mask.Size()
+	return prefixOnes <= ones && prefix.Contains(subnet.IP)
+}
+
+// checkMulticast is the rest of check for multicast and broadcast
+// packets: multicast must be on for the network, the peer within its rate
+// and the packet not one we already delivered.
+func checkMulticast(peerID, network string, netCfg config.NetworkConfig, packet []byte) string {
+	if !netCfg.ForwardsMulticast() {
+		return "multicast_disabled"
+	}
+	now := time.Now()
+	rate, burst := netCfg.Multicast.Limits()
+	if !allowMulticast(network, peerID, rate, burst, now) {
+		return "rate_limited"
+	}
+	if duplicate(network, packet, now) {
+		return "duplicate"
+	}
+	return ""
+}
+
+// checkFrame is check for tap networks: Ethernet frames carry no address
+// the peer has to announce, so only membership is enforced.
+func (i *Inbound) checkFrame(peerID, network string, frame []byte) string {
+	if i.registry != nil && !i.registry.Authorized(peerID, network) {
+		return "not_member"
+	}
+	if len(frame) < ethHeaderLen {
+		return "malformed"
+	}
+	return ""
+}
+
+// packetAddrs returns the source and destination of an IPv4 or IPv6 packet.
+func packetAddrs(pkt []byte) (net.IP, net.IP) {
+	if len(pkt) < 1 {
+		return nil, nil
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) >= 20 {
+			return net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		}
+	case 6:
+		if len(pkt) >= 40 {
+			return net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		}
 	}
+	return nil, nil
 }
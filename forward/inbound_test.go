@@ -0,0 +1,61 @@
+package forward
+
+import (
+	"testing"
+
+	"vibepn/config"
+	"vibepn/netgraph"
+	"vibepn/peer"
+)
+
+func TestInboundSourceCheck(t *testing.T) {
+	netcfg := map[string]config.NetworkConfig{"corp": {Prefix: "10.42.0.0/24", Export: true}}
+	peers := []config.Peer{{Name: "node2", Fingerprint: "fp-b"}, {Name: "node3", Fingerprint: "fp-c"}}
+	registry := peer.NewRegistry(config.Identity{}, peers, netcfg)
+	routes := netgraph.NewRouteTable()
+	in := NewInbound(nil, registry, routes)
+
+	own, _ := config.AutoAddress("corp", "fp-b", "10.42.0.0/24")
+	spoofed := "10.42.0.1"
+	if own == spoofed {
+		spoofed = "10.42.0.2"
+	}
+	// Every member announces the network's prefix, which proves nothing
+	routes.AddRoute(netgraph.Route{Network: "corp", Prefix: "10.42.0.0/24", PeerID: "fp-b"})
+	routes.AddRoute(netgraph.Route{Network: "corp", Prefix: "10.42.0.0/25", PeerID: "fp-b"})
+
+	cases := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"own address", own, ""},
+		{"another member's address", spoofed, "spoofed_source"},
+		{"unannounced subnet", "192.168.10.5", "spoofed_source"},
+	}
+	for _, c := range cases {
+		if got := in.check("fp-b", "corp", udp4(c.src, "10.42.0.9", 64)); got != c.want {
+			t.Errorf("%s: check = %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	routes.AddRoute(netgraph.Route{Network: "corp", Prefix: "192.168.10.0/24", PeerID: "fp-b"})
+	if got := in.check("fp-b", "corp", udp4("192.168.10.5", "10.42.0.9", 64)); got != "" {
+		t.Errorf("subnet the peer routes: check = %q", got)
+	}
+	if got := in.check("fp-c", "corp", udp4("192.168.10.5", "10.42.0.9", 64)); got != "spoofed_source" {
+		t.Errorf("subnet another peer routes: check = %q, want spoofed_source", got)
+	}
+
+	// Replies from the internet come through the exit we use
+	if got := in.check("fp-b", "corp", udp4("1.1.1.1", "10.42.0.9", 64)); got != "spoofed_source" {
+		t.Errorf("internet source without exit: check = %q, want spoofed_source", got)
+	}
+	routes.AddRoute(netgraph.Route{Network: "corp", Prefix: "0.0.0.0/0", PeerID: "fp-b", Metric: 1})
+	if got := in.check("fp-b", "corp", udp4("1.1.1.1", "10.42.0.9", 64)); got != "" {
+		t.Errorf("internet source through our exit: check = %q", got)
+	}
+	if got := in.check("fp-c", "corp", udp4("1.1.1.1", "10.42.0.9", 64)); got != "spoofed_source" {
+		t.Errorf("internet source from a peer that is not our exit: check = %q, want spoofed_source", got)
+	}
+}
@@ -0,0 +1,90 @@
+package forward
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"vibepn/log"
+)
+
+// On tap networks the node acts as a switch port towards its peers:
+// source MACs of frames from a peer are learned, frames for a learned MAC
+// go to that peer only, everything else (broadcast, multicast, unknown
+// unicast) is flooded to every connected member. Flooded frames are not
+// passed on by the receivers, so they reach members we are directly or
+// relay connected to.
+
+const (
+	ethHeaderLen = 14
+	// macAge is how long a MAC stays mapped to a peer without frames from
+	// it, as in a Linux bridge.
+	macAge = 5 * time.Minute
+)
+
+type macKey struct {
+	network string
+	mac     [6]byte
+}
+
+type macEntry struct {
+	peerID string
+	seen   time.Time
+}
+
+var macTable struct {
+	sync.Mutex
+	entries map[macKey]macEntry
+	swept   time.Time
+}
+
+func init() {
+	macTable.entries = make(map[macKey]macEntry)
+}
+
+// learnMAC maps the source MAC of frame, received from peerID on network,
+// to that peer.
+func learnMAC(network string, frame []byte, peerID string, now time.Time) {
+	var key macKey
+	key.network = network
+	copy(key.mac[:], frame[6:12])
+	if key.mac[0]&1 != 0 {
+		return // group addresses are never a source
+	}
+
+	macTable.Lock()
+	defer macTable.Unlock()
+	if old, ok := macTable.entries[key]; ok && old.peerID != peerID {
+		log.New("forward/l2").Debugf("[%s] %s moved from %s to %s", network, net.HardwareAddr(key.mac[:]), old.peerID, peerID)
+	}
+	macTable.entries[key] = macEntry{peerID: peerID, seen: now}
+
+	if now.Sub(macTable.swept) < macAge {
+		return
+	}
+	for k, e := range macTable.entries {
+		if now.Sub(e.seen) > macAge {
+			delete(macTable.entries, k)
+		}
+	}
+	macTable.swept = now
+}
+
+// lookupMAC returns the peer that the destination of frame on network was
+// learned from, or "" if the frame has to be flooded.
+func lookupMAC(network string, frame []byte, now time.Time) string {
+	var key macKey
+	key.network = network
+	copy(key.mac[:], frame[0:6])
+	if key.mac[0]&1 != 0 {
+		return "" // broadcast or multicast
+	}
+
+	macTable.Lock()
+	defer macTable.Unlock()
+	e, ok := macTable.entries[key]
+	if !ok || now.Sub(e.seen) > macAge {
+		return ""
+	}
+	return e.peerID
+}
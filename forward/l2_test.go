@@ -0,0 +1,59 @@
+package forward
+
+import (
+	"testing"
+	"time"
+)
+
+func frame(dst, src [6]byte) []byte {
+	f := make([]byte, ethHeaderLen)
+	copy(f[0:6], dst[:])
+	copy(f[6:12], src[:])
+	return f
+}
+
+func TestMACLearningAndAging(t *testing.T) {
+	t.Cleanup(func() {
+		macTable.Lock()
+		macTable.entries = make(map[macKey]macEntry)
+		macTable.Unlock()
+	})
+
+	local := [6]byte{0x02, 0, 0, 0, 0, 0x01}
+	remote := [6]byte{0x02, 0, 0, 0, 0, 0x02}
+	broadcast := [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	now := time.Now()
+
+	if got := lookupMAC("lan", frame(remote, local), now); got != "" {
+		t.Fatalf("unknown unicast went to %q, want a flood", got)
+	}
+
+	learnMAC("lan", frame(broadcast, remote), "fp-a", now)
+	if got := lookupMAC("lan", frame(remote, local), now); got != "fp-a" {
+		t.Fatalf("learned MAC went to %q, want fp-a", got)
+	}
+	if got := lookupMAC("other", frame(remote, local), now); got != "" {
+		t.Fatalf("MAC learned on another network went to %q", got)
+	}
+	if got := lookupMAC("lan", frame(broadcast, local), now); got != "" {
+		t.Fatalf("broadcast went to %q, want a flood", got)
+	}
+
+	// The station moved behind another peer
+	learnMAC("lan", frame(broadcast, remote), "fp-b", now.Add(time.Second))
+	if got := lookupMAC("lan", frame(remote, local), now.Add(time.Second)); got != "fp-b" {
+		t.Fatalf("moved MAC went to %q, want fp-b", got)
+	}
+
+	later := now.Add(macAge + 2*time.Second)
+	if got := lookupMAC("lan", frame(remote, local), later); got != "" {
+		t.Fatalf("aged MAC went to %q, want a flood", got)
+	}
+	learnMAC("lan", frame(broadcast, local), "fp-c", later)
+	macTable.Lock()
+	_, kept := macTable.entries[macKey{"lan", remote}]
+	macTable.Unlock()
+	if kept {
+		t.Fatal("aged MAC still in the table after a sweep")
+	}
+}
@@ -0,0 +1,154 @@
+package forward
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// On tun networks with multicast enabled, packets for a multicast group or
+// a broadcast address are sent to every member, or with snooping to those
+// that listen to the group. As with tap floods, receivers do not pass them
+// on. Each node limits how many it sends per network and accepts per peer,
+// and drops copies of a packet it has just seen, so a loop between
+// networks or a chatty host cannot flood the mesh.
+
+// dedupWindow is how long a packet is remembered. It only has to outlast
+// a trip through the mesh: identical packets sent on purpose, such as
+// retransmitted queries, are further apart.
+const dedupWindow = 500 * time.Millisecond
+
+// groupDst reports whether dst is a multicast group or a broadcast address
+// of a network with prefix.
+func groupDst(dst net.IP, prefix string) bool {
+	if dst.IsMulticast() || dst.Equal(net.IPv4bcast) {
+		return true
+	}
+	bcast := broadcastAddr(prefix)
+	return bcast != nil && dst.Equal(bcast)
+}
+
+// floodedGroup reports whether packets for dst go to every member even
+// with snooping: broadcasts and link-local groups, which hosts join
+// without always reporting it.
+func floodedGroup(dst net.IP) bool {
+	return !dst.IsMulticast() || dst.IsLinkLocalMulticast()
+}
+
+// broadcastAddr returns the directed broadcast address of an IPv4 prefix,
+// or nil if it has none.
+func broadcastAddr(prefix string) net.IP {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil || !p.Addr().Is4() || p.Bits() >= 31 {
+		return nil
+	}
+	a := p.Masked().Addr().As4()
+	host := uint32(1)<<(32-p.Bits()) - 1
+	binary.BigEndian.PutUint32(a[:], binary.BigEndian.Uint32(a[:])|host)
+	return net.IP(a[:])
+}
+
+type bucketKey struct {
+	network string
+	peerID  string // "" for what we send
+}
+
+// packetBucket admits rate packets per second, burst at once.
+type packetBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var limits struct {
+	sync.Mutex
+	buckets map[bucketKey]*packetBucket
+}
+
+var seen struct {
+	sync.Mutex
+	packets map[uint64]time.Time // packet hash → when it was seen
+	swept   time.Time
+}
+
+func init() {
+	limits.buckets = make(map[bucketKey]*packetBucket)
+	seen.packets = make(map[uint64]time.Time)
+}
+
+// allowMulticast takes a token for a packet sent on network (peerID "") or
+// received from peerID on it.
+func allowMulticast(network, peerID string, rate float64, burst int, now time.Time) bool {
+	limits.Lock()
+	defer limits.Unlock()
+	key := bucketKey{network, peerID}
+	b := limits.buckets[key]
+	if b == nil {
+		b = &packetBucket{tokens: float64(burst), last: now}
+		limits.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// duplicate reports whether pkt was seen on network within dedupWindow,
+// remembering it otherwise.
+func duplicate(network string, pkt []byte, now time.Time) bool {
+	h := packetHash(network, pkt)
+	seen.Lock()
+	defer seen.Unlock()
+	if at, ok := seen.packets[h]; ok && now.Sub(at) < dedupWindow {
+		return true
+	}
+	seen.packets[h] = now
+
+	if now.Sub(seen.swept) >= dedupWindow {
+		for k, at := range seen.packets {
+			if now.Sub(at) >= dedupWindow {
+				delete(seen.packets, k)
+			}
+		}
+		seen.swept = now
+	}
+	return false
+}
+
+// reflected reports whether pkt, read from the TUN, is one we just
+// received from the mesh and wrote there.
+func reflected(network string, pkt []byte, now time.Time) bool {
+	h := packetHash(network, pkt)
+	seen.Lock()
+	defer seen.Unlock()
+	at, ok := seen.packets[h]
+	return ok && now.Sub(at) < dedupWindow
+}
+
+// packetHash hashes pkt on network, leaving out the fields a router
+// rewrites: the IPv4 TTL and header checksum, the IPv6 hop limit.
+func packetHash(network string, pkt []byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(network))
+	h.Write([]byte{0})
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		h.Write(pkt[:8])
+		h.Write(pkt[9:10])
+		h.Write(pkt[12:])
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		h.Write(pkt[:7])
+		h.Write(pkt[8:])
+	default:
+		h.Write(pkt)
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,87 @@
+package forward
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// udp4 builds an IPv4 header from src to dst with the given TTL.
+func udp4(src, dst string, ttl byte) []byte {
+	pkt := make([]byte, 28)
+	pkt[0] = 0x45
+	pkt[8] = ttl
+	pkt[9] = 17
+	copy(pkt[12:16], net.ParseIP(src).To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+	return pkt
+}
+
+func TestGroupDst(t *testing.T) {
+	for _, dst := range []string{"224.0.0.251", "239.1.1.1", "255.255.255.255", "10.42.0.255", "ff02::fb", "ff15::1"} {
+		if !groupDst(net.ParseIP(dst), "10.42.0.0/24") {
+			t.Errorf("%s not taken for a group", dst)
+		}
+	}
+	for _, dst := range []string{"10.42.0.7", "10.42.1.255", "fe80::1"} {
+		if groupDst(net.ParseIP(dst), "10.42.0.0/24") {
+			t.Errorf("unicast %s taken for a group", dst)
+		}
+	}
+	if !floodedGroup(net.ParseIP("224.0.0.251")) || !floodedGroup(net.ParseIP("ff02::1")) || !floodedGroup(net.ParseIP("10.42.0.255")) {
+		t.Error("link-local group or broadcast not flooded")
+	}
+	if floodedGroup(net.ParseIP("239.1.1.1")) {
+		t.Error("routable group flooded")
+	}
+}
+
+func TestMulticastRateLimit(t *testing.T) {
+	t.Cleanup(func() {
+		limits.Lock()
+		limits.buckets = make(map[bucketKey]*packetBucket)
+		limits.Unlock()
+	})
+	now := time.Now()
+
+	for n := range 5 {
+		if !allowMulticast("corp", "fp-a", 10, 5, now) {
+			t.Fatalf("packet %d of the burst refused", n+1)
+		}
+	}
+	if allowMulticast("corp", "fp-a", 10, 5, now) {
+		t.Fatal("packet past the burst allowed")
+	}
+	if !allowMulticast("corp", "fp-b", 10, 5, now) {
+		t.Fatal("one peer's burst limited another")
+	}
+	if !allowMulticast("corp", "fp-a", 10, 5, now.Add(100*time.Millisecond)) {
+		t.Fatal("token not refilled at the rate")
+	}
+}
+
+func TestDuplicateSuppression(t *testing.T) {
+	t.Cleanup(func() {
+		seen.Lock()
+		seen.packets = make(map[uint64]time.Time)
+		seen.Unlock()
+	})
+	now := time.Now()
+	pkt := udp4("10.42.0.2", "239.1.1.1", 64)
+
+	if duplicate("corp", pkt, now) {
+		t.Fatal("first copy taken for a duplicate")
+	}
+	if !duplicate("corp", pkt, now.Add(10*time.Millisecond)) {
+		t.Fatal("second copy delivered")
+	}
+	if duplicate("lab", pkt, now) {
+		t.Fatal("copy on another network taken for a duplicate")
+	}
+	if !reflected("corp", udp4("10.42.0.2", "239.1.1.1", 63), now) {
+		t.Fatal("packet routed back with a lower TTL not recognized")
+	}
+	if reflected("corp", pkt, now.Add(dedupWindow)) || duplicate("corp", pkt, now.Add(dedupWindow)) {
+		t.Fatal("packet remembered past the window")
+	}
+}
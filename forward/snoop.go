@@ -0,0 +1,137 @@
+package forward
+
+import (
+	"encoding/binary"
+	"net"
+	"slices"
+)
+
+// IGMP and MLD snooping: the kernel reports the groups its sockets join on
+// the TUN, which tells us which groups to ask peers for. The device only
+// exists while we run, so every join on it is reported to us. Reports are
+// consumed rather than sent on, as there is no multicast router behind the
+// other members to hear them.
+
+const (
+	protoIGMP   = 2
+	protoICMPv6 = 58
+
+	igmpV1Report = 0x12
+	igmpV2Report = 0x16
+	igmpV2Leave  = 0x17
+	igmpV3Report = 0x22
+
+	mldV1Report = 131
+	mldV1Done   = 132
+	mldV2Report = 143
+)
+
+// membership returns the groups an IGMP or MLD report in pkt joins and
+// leaves. ok is false for any other packet.
+func membership(pkt []byte) (joined, left []net.IP, ok bool) {
+	if len(pkt) < 1 {
+		return nil, nil, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if len(pkt) < 20 || ihl < 20 || len(pkt) < ihl+8 || pkt[9] != protoIGMP {
+			return nil, nil, false
+		}
+		return igmpMembership(pkt[ihl:])
+	case 6:
+		msg := icmpv6Payload(pkt)
+		if len(msg) < 4 {
+			return nil, nil, false
+		}
+		return mldMembership(msg)
+	}
+	return nil, nil, false
+}
+
+func igmpMembership(msg []byte) (joined, left []net.IP, ok bool) {
+	switch msg[0] {
+	case igmpV1Report, igmpV2Report:
+		return []net.IP{slices.Clone(msg[4:8])}, nil, true
+	case igmpV2Leave:
+		return nil, []net.IP{slices.Clone(msg[4:8])}, true
+	case igmpV3Report:
+		joined, left = groupRecords(msg[8:], int(binary.BigEndian.Uint16(msg[6:8])), net.IPv4len)
+		return joined, left, true
+	}
+	return nil, nil, false
+}
+
+func mldMembership(msg []byte) (joined, left []net.IP, ok bool) {
+	switch msg[0] {
+	case mldV1Report, mldV1Done:
+		if len(msg) < 8+net.IPv6len {
+			return nil, nil, false
+		}
+		group := []net.IP{slices.Clone(msg[8 : 8+net.IPv6len])}
+		if msg[0] == mldV1Done {
+			return nil, group, true
+		}
+		return group, nil, true
+	case mldV2Report:
+		if len(msg) < 8 {
+			return nil, nil, false
+		}
+		joined, left = groupRecords(msg[8:], int(binary.BigEndian.Uint16(msg[6:8])), net.IPv6len)
+		return joined, left, true
+	}
+	return nil, nil, false
+}
+
+// groupRecords reads the group records of an IGMPv3 or MLDv2 report. A
+// host listens to a group unless it includes no source, which is how it
+// leaves one.
+func groupRecords(b []byte, count, addrLen int) (joined, left []net.IP) {
+	for range count {
+		if len(b) < 4+addrLen {
+			return joined, left
+		}
+		recordType, auxLen := b[0], int(b[1])*4
+		sources := int(binary.BigEndian.Uint16(b[2:4]))
+		group := net.IP(slices.Clone(b[4 : 4+addrLen]))
+		switch recordType {
+		case 1, 3: // MODE_IS_INCLUDE, CHANGE_TO_INCLUDE
+			if sources == 0 {
+				left = append(left, group)
+			} else {
+				joined = append(joined, group)
+			}
+		case 2, 4: // MODE_IS_EXCLUDE, CHANGE_TO_EXCLUDE
+			joined = append(joined, group)
+		case 5: // ALLOW_NEW_SOURCES
+			if sources > 0 {
+				joined = append(joined, group)
+			}
+		}
+		n := 4 + addrLen + sources*addrLen + auxLen
+		if len(b) < n {
+			return joined, left
+		}
+		b = b[n:]
+	}
+	return joined, left
+}
+
+// icmpv6Payload returns the ICMPv6 message of an IPv6 packet, skipping the
+// Hop-by-Hop Options header MLD reports carry, or nil.
+func icmpv6Payload(pkt []byte) []byte {
+	if len(pkt) < 40 {
+		return nil
+	}
+	next, off := pkt[6], 40
+	for next == 0 || next == 60 { // Hop-by-Hop and Destination Options
+		if len(pkt) < off+2 {
+			return nil
+		}
+		next, off = pkt[off], off+(int(pkt[off+1])+1)*8
+	}
+	if next != protoICMPv6 || len(pkt) < off {
+		return nil
+	}
+	return pkt[off:]
+}
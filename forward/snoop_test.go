@@ -0,0 +1,54 @@
+package forward
+
+import (
+	"net"
+	"testing"
+)
+
+func igmp(msg []byte) []byte {
+	pkt := make([]byte, 24, 24+len(msg))
+	pkt[0] = 0x46 // Router Alert option
+	pkt[9] = protoIGMP
+	return append(pkt, msg...)
+}
+
+func TestIGMPMembership(t *testing.T) {
+	group := net.ParseIP("239.1.1.1").To4()
+
+	joined, _, ok := membership(igmp(append([]byte{igmpV2Report, 0, 0, 0}, group...)))
+	if !ok || len(joined) != 1 || !joined[0].Equal(group) {
+		t.Fatalf("v2 report: joined %v, ok %v", joined, ok)
+	}
+	_, left, ok := membership(igmp(append([]byte{igmpV2Leave, 0, 0, 0}, group...)))
+	if !ok || len(left) != 1 || !left[0].Equal(group) {
+		t.Fatalf("v2 leave: left %v, ok %v", left, ok)
+	}
+
+	// v3: exclude {} joins 239.1.1.1, include {} leaves 239.2.2.2
+	v3 := []byte{igmpV3Report, 0, 0, 0, 0, 0, 0, 2}
+	v3 = append(append(v3, 4, 0, 0, 0), group...)
+	v3 = append(append(v3, 3, 0, 0, 0), net.ParseIP("239.2.2.2").To4()...)
+	joined, left, ok = membership(igmp(v3))
+	if !ok || len(joined) != 1 || !joined[0].Equal(group) || len(left) != 1 || !left[0].Equal(net.ParseIP("239.2.2.2")) {
+		t.Fatalf("v3 report: joined %v, left %v, ok %v", joined, left, ok)
+	}
+
+	if _, _, ok := membership(udp4("10.42.0.2", "239.1.1.1", 1)); ok {
+		t.Fatal("UDP packet taken for a report")
+	}
+}
+
+func TestMLDMembership(t *testing.T) {
+	group := net.ParseIP("ff15::1")
+	pkt := make([]byte, 48)
+	pkt[0] = 0x60
+	pkt[6] = 0                        // Hop-by-Hop Options
+	pkt[40], pkt[41] = protoICMPv6, 0 // one 8-byte extension header
+	report := []byte{mldV2Report, 0, 0, 0, 0, 0, 0, 1, 4, 0, 0, 0}
+	pkt = append(append(pkt, report...), group...)
+
+	joined, _, ok := membership(pkt)
+	if !ok || len(joined) != 1 || !joined[0].Equal(group) {
+		t.Fatalf("MLDv2 report: joined %v, ok %v", joined, ok)
+	}
+}
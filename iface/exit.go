@@ -0,0 +1,10 @@
+package iface
+
+// Routing through an exit node follows wg-quick: default routes go to the
+// exit's TUN in their own table, picked by a rule for every packet that
+// does not carry FirewallMark. The daemon marks its own QUIC socket, so
+// tunnel traffic keeps using the main table.
+const (
+	FirewallMark = 51820
+	exitTable    = "51820"
+)
@@ -0,0 +1,127 @@
+package iface
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"vibepn/log"
+)
+
+// run executes an ip/iptables command, with its output in the error.
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// EnableExitRouting sends all traffic not marked with FirewallMark through
+// dev. The overlay only carries IPv4, so IPv6 default traffic is made
+// unreachable rather than leaked around the exit.
+func EnableExitRouting(dev string) error {
+	logger := log.New("iface/exit")
+	mark := strconv.Itoa(FirewallMark)
+
+	DisableExitRouting(dev) // no duplicate rules on re-enable
+	if err := run("ip", "-4", "route", "replace", "default", "dev", dev, "table", exitTable); err != nil {
+		return err
+	}
+	if err := run("ip", "-6", "route", "replace", "unreachable", "default", "table", exitTable); err != nil {
+		logger.Warnf("Failed to block IPv6 default traffic: %v", err)
+	}
+	for _, family := range []string{"-4", "-6"} {
+		if err := run("ip", family, "rule", "add", "not", "fwmark", mark, "table", exitTable, "priority", "31001"); err != nil {
+			return err
+		}
+		if err := run("ip", family, "rule", "add", "table", "main", "suppress_prefixlength", "0", "priority", "31000"); err != nil {
+			return err
+		}
+	}
+	logger.Infof("Default traffic now routed through %s", dev)
+	return nil
+}
+
+// DisableExitRouting removes what EnableExitRouting set up. It only
+// touches the rules and table VibePN owns, and ignores missing entries.
+func DisableExitRouting(dev string) error {
+	for _, family := range []string{"-4", "-6"} {
+		_ = run("ip", family, "rule", "del", "priority", "31001")
+		_ = run("ip", family, "rule", "del", "priority", "31000")
+		_ = run("ip", family, "route", "flush", "table", exitTable)
+	}
+	return nil
+}
+
+// EnableMasquerade lets peers on prefix reach beyond this node: it turns on
+// IPv4 forwarding, accepts their forwarded traffic and NATs it as it leaves
+// on egress (any interface other than dev if empty).
+func EnableMasquerade(prefix, dev, egress string) error {
+	if err := enableForwarding(); err != nil {
+		return err
+	}
+	if err := addRules(exitRules(prefix, dev, egress)); err != nil {
+		return err
+	}
+	log.New("iface/exit").Infof("Masquerading %s from %s", prefix, dev)
+	return nil
+}
+
+// DisableMasquerade removes the rules EnableMasquerade added. Forwarding
+// stays on, other services may rely on it.
+func DisableMasquerade(prefix, dev, egress string) error {
+	return deleteRules(exitRules(prefix, dev, egress))
+}
+
+func enableForwarding() error {
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return fmt.Errorf("enable IPv4 forwarding: %w", err)
+	}
+	return nil
+}
+
+// addRules adds the iptables rules (table first) that are not there yet.
+func addRules(rules [][]string) error {
+	for _, rule := range rules {
+		if run("iptables", append([]string{"-t", rule[0], "-C"}, rule[1:]...)...) == nil {
+			continue
+		}
+		// Ahead of any existing FORWARD drop, NAT just needs to be there
+		op := "-I"
+		if rule[0] == "nat" {
+			op = "-A"
+		}
+		if err := run("iptables", append([]string{"-t", rule[0], op}, rule[1:]...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRules removes rules added by addRules, returning the first error.
+func deleteRules(rules [][]string) error {
+	var firstErr error
+	for _, rule := range rules {
+		if err := run("iptables", append([]string{"-t", rule[0], "-D"}, rule[1:]...)...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// exitRules returns the iptables rules of an exit, table first.
+func exitRules(prefix, dev, egress string) [][]string {
+	out := []string{"!", "-o", dev}
+	if egress != "" {
+		out = []string{"-o", egress}
+	}
+	nat := append([]string{"nat", "POSTROUTING", "-s", prefix}, out...)
+	return [][]string{
+		append(nat, "-j", "MASQUERADE"),
+		{"filter", "FORWARD", "-i", dev, "-s", prefix, "-j", "ACCEPT"},
+		{"filter", "FORWARD", "-o", dev, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+}
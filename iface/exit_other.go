@@ -0,0 +1,15 @@
+//go:build !linux
+
+package iface
+
+import "errors"
+
+var errExitUnsupported = errors.New("exit nodes are only supported on Linux")
+
+func EnableExitRouting(dev string) error { return errExitUnsupported }
+
+func DisableExitRouting(dev string) error { return nil }
+
+func EnableMasquerade(prefix, dev, egress string) error { return errExitUnsupported }
+
+func DisableMasquerade(prefix, dev, egress string) error { return nil }
@@ -9,38 +9,88 @@ import (
 )
 
 type Manager struct {
-	Devices map[string]*tun.Device // network → device
-	logger  *log.Logger
+	Devices   map[string]*tun.Device // network → device
+	Addresses map[string]string      // network → local overlay address
+	prefixes  map[string]string      // network → prefix
+	logger    *log.Logger
 }
 
-func Init(cfg map[string]config.NetworkConfig, nodeID string) (*Manager, error) {
+// Init opens a TUN, or a TAP with mode "tap", per network. attempts holds
+// how often each network's auto address was rehashed after conflicts.
+// Leased networks get their device without an address until the
+// coordinator grants one.
+func Init(cfg map[string]config.NetworkConfig, nodeID string, attempts config.AddressState) (*Manager, error) {
 	logger := log.New("iface/init")
 	devs := make(map[string]*tun.Device)
+	addrs := make(map[string]string)
+	prefixes := make(map[string]string)
 
 	for name, netcfg := range cfg {
-		addr, err := config.ResolveAddressForNetwork(name, nodeID, cfg)
-		if err != nil {
-			logger.Errorf("Skipping network %s: %v", name, err)
-			continue
+		var addr, cidr string
+		if netcfg.Address != "lease" {
+			var err error
+			addr, err = config.ResolveAddressAttempt(name, nodeID, cfg, attempts[name])
+			if err != nil {
+				logger.Errorf("Skipping network %s: %v", name, err)
+				continue
+			}
+			cidr = fmt.Sprintf("%s/%d", addr, maskSize(netcfg.Prefix))
 		}
 
-		cidr := fmt.Sprintf("%s/%d", addr, maskSize(netcfg.Prefix))
-		dev, err := tun.Open(cidr, nodeID)
+		open := tun.Open
+		if netcfg.TAP() {
+			open = tun.OpenTAP
+		}
+		dev, err := open(cidr, nodeID)
 		if err != nil {
-			logger.Errorf("Failed to open TUN for %s: %v", name, err)
+			logger.Errorf("Failed to open device for %s: %v", name, err)
 			continue
 		}
 
-		logger.Infof("Network %s attached to %s (%s)", name, dev.Name(), cidr)
 		devs[name] = dev
+		prefixes[name] = netcfg.Prefix
+		if addr == "" {
+			logger.Infof("Network %s attached to %s, waiting for a lease from %s", name, dev.Name(), netcfg.Coordinator)
+			continue
+		}
+		logger.Infof("Network %s attached to %s (%s)", name, dev.Name(), cidr)
+		addrs[name] = addr
 	}
 
 	return &Manager{
-		Devices: devs,
-		logger:  logger,
+		Devices:   devs,
+		Addresses: addrs,
+		prefixes:  prefixes,
+		logger:    logger,
 	}, nil
 }
 
+// Readdress moves network's interface to addr. An empty addr removes the
+// current address, as when a lease expires.
+func (m *Manager) Readdress(network, addr string) error {
+	dev := m.Devices[network]
+	if dev == nil {
+		return fmt.Errorf("no interface for network %s", network)
+	}
+	bits := maskSize(m.prefixes[network])
+	var oldCIDR, newCIDR string
+	if old := m.Addresses[network]; old != "" {
+		oldCIDR = fmt.Sprintf("%s/%d", old, bits)
+	}
+	if addr != "" {
+		newCIDR = fmt.Sprintf("%s/%d", addr, bits)
+	}
+	if err := dev.Readdress(oldCIDR, newCIDR); err != nil {
+		return err
+	}
+	if addr == "" {
+		delete(m.Addresses, network)
+		return nil
+	}
+	m.Addresses[network] = addr
+	return nil
+}
+
 func maskSize(cidr string) int {
 	_, ipnet, err := net.ParseCIDR(cidr)
 	if err != nil {
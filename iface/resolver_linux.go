@@ -0,0 +1,79 @@
+package iface
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const resolve1 = "org.freedesktop.resolve1"
+
+// ConfigureResolver points the host resolver at the overlay resolver on
+// addr:port for domain, through systemd-resolved's D-Bus API ("resolved",
+// a routing-only domain on dev) or a resolvconf entry for dev
+// ("resolvconf", which cannot carry a port).
+func ConfigureResolver(mode, dev string, addr net.IP, port int, domain string) error {
+	ip4 := addr.To4()
+	if ip4 == nil {
+		return fmt.Errorf("resolver address %s is not IPv4", addr)
+	}
+	switch mode {
+	case "resolved":
+		idx, err := linkIndex(dev)
+		if err != nil {
+			return err
+		}
+		bytes := []string{"4", strconv.Itoa(int(ip4[0])), strconv.Itoa(int(ip4[1])), strconv.Itoa(int(ip4[2])), strconv.Itoa(int(ip4[3]))}
+		if port == 53 {
+			err = busctl("SetLinkDNS", append([]string{"ia(iay)", idx, "1", "2"}, bytes...)...)
+		} else {
+			err = busctl("SetLinkDNSEx", append(append([]string{"ia(iayqs)", idx, "1", "2"}, bytes...), strconv.Itoa(port), "")...)
+		}
+		if err != nil {
+			return err
+		}
+		return busctl("SetLinkDomains", "ia(sb)", idx, "1", domain, "true")
+	case "resolvconf":
+		if port != 53 {
+			return fmt.Errorf("resolvconf cannot use port %d", port)
+		}
+		cmd := exec.Command("resolvconf", "-a", dev+".vibepn")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("nameserver %s\nsearch %s\n", ip4, domain))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("resolvconf -a %s.vibepn: %w: %s", dev, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown resolver mode %q (want resolved or resolvconf)", mode)
+	}
+}
+
+// RevertResolver undoes ConfigureResolver for dev.
+func RevertResolver(mode, dev string) error {
+	switch mode {
+	case "resolved":
+		idx, err := linkIndex(dev)
+		if err != nil {
+			return err
+		}
+		return busctl("RevertLink", "i", idx)
+	case "resolvconf":
+		return run("resolvconf", "-d", dev+".vibepn")
+	}
+	return nil
+}
+
+func linkIndex(dev string) (string, error) {
+	ifi, err := net.InterfaceByName(dev)
+	if err != nil {
+		return "", fmt.Errorf("look up %s: %w", dev, err)
+	}
+	return strconv.Itoa(ifi.Index), nil
+}
+
+// busctl calls a method of systemd-resolved's Manager object.
+func busctl(method string, args ...string) error {
+	return run("busctl", append([]string{"call", resolve1, "/org/freedesktop/resolve1", resolve1 + ".Manager", method}, args...)...)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package iface
+
+import (
+	"errors"
+	"net"
+)
+
+func ConfigureResolver(mode, dev string, addr net.IP, port int, domain string) error {
+	return errors.New("configuring the host resolver is only supported on Linux")
+}
+
+func RevertResolver(mode, dev string) error { return nil }
@@ -0,0 +1,47 @@
+package iface
+
+import "vibepn/log"
+
+// AddRoute sends traffic for prefix into dev, for subnets peers route.
+func AddRoute(prefix, dev string) error {
+	return run("ip", "route", "replace", prefix, "dev", dev)
+}
+
+// DelRoute removes a route added by AddRoute.
+func DelRoute(prefix, dev string) error {
+	return run("ip", "route", "del", prefix, "dev", dev)
+}
+
+// EnableSubnetRouter forwards traffic between the overlay prefix on dev
+// and the local subnets in routes, masquerading it towards them if snat
+// is set. Without SNAT, hosts on the subnets need a route back to the
+// overlay prefix through this node.
+func EnableSubnetRouter(prefix, dev string, routes []string, snat bool) error {
+	if err := enableForwarding(); err != nil {
+		return err
+	}
+	if err := addRules(subnetRules(prefix, dev, routes, snat)); err != nil {
+		return err
+	}
+	log.New("iface/subnet").Infof("Routing %s to %v (snat %v)", prefix, routes, snat)
+	return nil
+}
+
+// DisableSubnetRouter removes the rules EnableSubnetRouter added.
+func DisableSubnetRouter(prefix, dev string, routes []string, snat bool) error {
+	return deleteRules(subnetRules(prefix, dev, routes, snat))
+}
+
+func subnetRules(prefix, dev string, routes []string, snat bool) [][]string {
+	var rules [][]string
+	for _, route := range routes {
+		if snat {
+			rules = append(rules, []string{"nat", "POSTROUTING", "-s", prefix, "-d", route, "-j", "MASQUERADE"})
+		}
+		rules = append(rules,
+			[]string{"filter", "FORWARD", "-i", dev, "-s", prefix, "-d", route, "-j", "ACCEPT"},
+			[]string{"filter", "FORWARD", "-o", dev, "-s", route, "-d", prefix, "-j", "ACCEPT"},
+		)
+	}
+	return rules
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package iface
+
+import "errors"
+
+var errSubnetUnsupported = errors.New("subnet routes are only supported on Linux")
+
+func AddRoute(prefix, dev string) error { return errSubnetUnsupported }
+
+func DelRoute(prefix, dev string) error { return nil }
+
+func EnableSubnetRouter(prefix, dev string, routes []string, snat bool) error {
+	return errSubnetUnsupported
+}
+
+func DisableSubnetRouter(prefix, dev string, routes []string, snat bool) error { return nil }
@@ -0,0 +1,250 @@
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrExhausted is returned when every address in the pool is leased.
+var ErrExhausted = errors.New("no free address")
+
+// Lease binds an address to a node's fingerprint until Expires. Expired
+// leases are kept so a returning node gets its old address back, and are
+// only handed to someone else once the pool has no never-leased address.
+type Lease struct {
+	Fingerprint string     `json:"fingerprint"`
+	Name        string     `json:"name,omitempty"`
+	Address     netip.Addr `json:"address"`
+	Expires     time.Time  `json:"expires"`
+}
+
+// Active reports whether the lease is still valid at now.
+func (l Lease) Active(now time.Time) bool {
+	return now.Before(l.Expires)
+}
+
+// Pool leases the host addresses of an IPv4 prefix, persisting every
+// change to a JSON file.
+type Pool struct {
+	mu       sync.Mutex
+	prefix   netip.Prefix
+	reserved []netip.Prefix
+	duration time.Duration
+	path     string
+	leases   map[string]*Lease // fingerprint → lease
+	swept    time.Time
+}
+
+// NewPool loads the leases at path, a missing file being empty. Reserved
+// entries are addresses or prefixes that are never leased.
+func NewPool(prefix string, reserved []string, duration time.Duration, path string) (*Pool, error) {
+	pfx, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix %q: %w", prefix, err)
+	}
+	if !pfx.Addr().Is4() || pfx.Bits() >= 31 {
+		return nil, fmt.Errorf("prefix %s: only IPv4 prefixes < /31 are supported", pfx)
+	}
+
+	p := &Pool{
+		prefix:   pfx.Masked(),
+		duration: duration,
+		path:     path,
+		leases:   make(map[string]*Lease),
+		swept:    time.Now(),
+	}
+	for _, r := range reserved {
+		if rp, err := netip.ParsePrefix(r); err == nil {
+			p.reserved = append(p.reserved, rp.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reserved address %q", r)
+		}
+		p.reserved = append(p.reserved, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read leases: %w", err)
+	}
+	var saved []Lease
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("parse leases %q: %w", path, err)
+	}
+	for i := range saved {
+		if p.prefix.Contains(saved[i].Address) {
+			p.leases[saved[i].Fingerprint] = &saved[i]
+		}
+	}
+	return p, nil
+}
+
+// Acquire grants or renews the lease of fingerprint. The node keeps the
+// address it holds; otherwise want is granted if free, then the lowest
+// never-leased address, then the address of the longest-expired lease.
+// inUse reports addresses held outside the pool, such as the
+// coordinator's own. A lease that could not be saved is still granted,
+// along with the error.
+func (p *Pool) Acquire(fingerprint, name string, want netip.Addr, inUse func(netip.Addr) bool, now time.Time) (Lease, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var addr netip.Addr
+	if l := p.leases[fingerprint]; l != nil && !inUse(l.Address) {
+		addr = l.Address
+	} else if want.IsValid() && p.usable(want) && !inUse(want) && p.holder(want) == "" {
+		addr = want
+	} else if a, ok := p.next(inUse); ok {
+		addr = a
+	} else if a, ok := p.reclaim(fingerprint, inUse, now); ok {
+		addr = a
+	} else {
+		return Lease{}, ErrExhausted
+	}
+
+	if holder := p.holder(addr); holder != "" && holder != fingerprint {
+		delete(p.leases, holder)
+	}
+	l := &Lease{Fingerprint: fingerprint, Name: name, Address: addr, Expires: now.Add(p.duration)}
+	p.leases[fingerprint] = l
+	return *l, p.save()
+}
+
+// Duration is how long a lease is granted for.
+func (p *Pool) Duration() time.Duration {
+	return p.duration
+}
+
+// Leases returns every lease, active or expired, ordered by address.
+func (p *Pool) Leases() []Lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]Lease, 0, len(p.leases))
+	for _, l := range p.leases {
+		out = append(out, *l)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address.Less(out[j].Address) })
+	return out
+}
+
+// Expired returns the leases that ran out since the previous call.
+func (p *Pool) Expired(now time.Time) []Lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []Lease
+	for _, l := range p.leases {
+		if !l.Expires.Before(p.swept) && !l.Active(now) {
+			out = append(out, *l)
+		}
+	}
+	p.swept = now
+	return out
+}
+
+// usable reports whether addr is a host address of the pool.
+func (p *Pool) usable(addr netip.Addr) bool {
+	if !p.prefix.Contains(addr) || addr == p.prefix.Addr() || addr == lastAddr(p.prefix) {
+		return false
+	}
+	for _, r := range p.reserved {
+		if r.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// holder returns the fingerprint with a lease, active or not, on addr.
+func (p *Pool) holder(addr netip.Addr) string {
+	for fp, l := range p.leases {
+		if l.Address == addr {
+			return fp
+		}
+	}
+	return ""
+}
+
+// next returns the lowest address never leased.
+func (p *Pool) next(inUse func(netip.Addr) bool) (netip.Addr, bool) {
+	held := make(map[netip.Addr]bool, len(p.leases))
+	for _, l := range p.leases {
+		held[l.Address] = true
+	}
+	for a := p.prefix.Addr().Next(); p.prefix.Contains(a); a = a.Next() {
+		if p.usable(a) && !inUse(a) && !held[a] {
+			return a, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// reclaim returns the address of the lease that expired first.
+func (p *Pool) reclaim(fingerprint string, inUse func(netip.Addr) bool, now time.Time) (netip.Addr, bool) {
+	var oldest *Lease
+	for fp, l := range p.leases {
+		if fp == fingerprint || l.Active(now) || !p.usable(l.Address) || inUse(l.Address) {
+			continue
+		}
+		if oldest == nil || l.Expires.Before(oldest.Expires) {
+			oldest = l
+		}
+	}
+	if oldest == nil {
+		return netip.Addr{}, false
+	}
+	return oldest.Address, true
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	a := p.Addr().As4()
+	host := uint32(1)<<(32-p.Bits()) - 1
+	v := uint32(a[0])<<24 | uint32(a[1])<<16 | uint32(a[2])<<8 | uint32(a[3]) | host
+	return netip.AddrFrom4([4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+// save writes the leases to the pool's file, replacing it atomically.
+func (p *Pool) save() error {
+	out := make([]Lease, 0, len(p.leases))
+	for _, l := range p.leases {
+		out = append(out, *l)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address.Less(out[j].Address) })
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode leases: %w", err)
+	}
+
+	dir := filepath.Dir(p.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create lease directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(p.path)+"-*")
+	if err != nil {
+		return fmt.Errorf("create temp leases: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write leases: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write leases: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), p.path); err != nil {
+		return fmt.Errorf("replace leases %q: %w", p.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package ipam
+
+import (
+	"errors"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func noneInUse(netip.Addr) bool { return false }
+
+func TestAcquireRenewAndPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	p, err := NewPool("10.42.0.0/24", []string{"10.42.0.1", "10.42.0.2/31"}, time.Hour, path)
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	now := time.Now()
+
+	a, err := p.Acquire("fp-a", "a", netip.Addr{}, noneInUse, now)
+	if err != nil || a.Address != netip.MustParseAddr("10.42.0.4") {
+		t.Fatalf("first lease = %v, %v; want the lowest unreserved address", a.Address, err)
+	}
+	b, _ := p.Acquire("fp-b", "b", netip.MustParseAddr("10.42.0.4"), noneInUse, now)
+	if b.Address == a.Address {
+		t.Fatalf("granted %s twice", a.Address)
+	}
+	c, _ := p.Acquire("fp-c", "c", netip.MustParseAddr("10.42.0.77"), noneInUse, now)
+	if c.Address != netip.MustParseAddr("10.42.0.77") {
+		t.Fatalf("free wanted address not granted: %v", c.Address)
+	}
+
+	renewed, _ := p.Acquire("fp-a", "a", netip.Addr{}, noneInUse, now.Add(30*time.Minute))
+	if renewed.Address != a.Address || !renewed.Expires.After(a.Expires) {
+		t.Fatalf("renewal = %+v, want %s with a later expiry", renewed, a.Address)
+	}
+
+	loaded, err := NewPool("10.42.0.0/24", nil, time.Hour, path)
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if got := loaded.Leases(); len(got) != 3 || got[0].Fingerprint != "fp-a" {
+		t.Fatalf("reloaded leases = %+v", got)
+	}
+}
+
+func TestAcquireReclaimsExpired(t *testing.T) {
+	// /29 has six hosts; five are reserved, leaving one
+	p, err := NewPool("10.42.0.0/29", []string{"10.42.0.1", "10.42.0.2", "10.42.0.3", "10.42.0.4", "10.42.0.5"}, time.Minute, filepath.Join(t.TempDir(), "leases.json"))
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	now := time.Now()
+
+	if _, err := p.Acquire("fp-a", "a", netip.Addr{}, noneInUse, now); err != nil {
+		t.Fatalf("first lease failed: %v", err)
+	}
+	if _, err := p.Acquire("fp-b", "b", netip.Addr{}, noneInUse, now); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("full pool: err = %v, want ErrExhausted", err)
+	}
+
+	later := now.Add(2 * time.Minute)
+	if expired := p.Expired(later); len(expired) != 1 || expired[0].Fingerprint != "fp-a" {
+		t.Fatalf("Expired = %+v", expired)
+	}
+	if expired := p.Expired(later); len(expired) != 0 {
+		t.Fatalf("expiry reported twice: %+v", expired)
+	}
+
+	b, err := p.Acquire("fp-b", "b", netip.Addr{}, noneInUse, later)
+	if err != nil || b.Address != netip.MustParseAddr("10.42.0.6") {
+		t.Fatalf("reclaim = %v, %v", b.Address, err)
+	}
+	if got := p.Leases(); len(got) != 1 || got[0].Fingerprint != "fp-b" {
+		t.Fatalf("expired lease kept after its address was reclaimed: %+v", got)
+	}
+}
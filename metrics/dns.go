@@ -0,0 +1,15 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// DNSQueries counts queries to the overlay resolver by result: "answered"
+// (a name under vibepn we know), "nxdomain", "forwarded" (answered by an
+// upstream server), "failed" (no upstream answered) and "malformed".
+var DNSQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "vibepn_dns_queries_total",
+	Help: "DNS queries handled by the overlay resolver.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(DNSQueries)
+}
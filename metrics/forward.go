@@ -0,0 +1,19 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Inbound packets dropped before reaching a local interface, by network
+// and reason: "not_member" (the sending peer may not use the network),
+// "spoofed_source" (source outside every prefix the peer announced there),
+// "exit_denied" (destination off the network and we are not the peer's
+// exit), "malformed" (no IP header), "no_interface" and, for multicast
+// and broadcast packets, "multicast_disabled", "rate_limited" (the peer
+// sent more than the network's multicast rate) and "duplicate".
+var InboundDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "vibepn_inbound_dropped_packets_total",
+	Help: "Inbound packets dropped instead of written to a local interface.",
+}, []string{"network", "reason"})
+
+func init() {
+	prometheus.MustRegister(InboundDrops)
+}
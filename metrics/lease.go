@@ -0,0 +1,12 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var LeasesActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "vibepn_leases_active",
+	Help: "Unexpired address leases granted by this coordinator, by network.",
+}, []string{"network"})
+
+func init() {
+	prometheus.MustRegister(LeasesActive)
+}
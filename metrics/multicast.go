@@ -0,0 +1,17 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Multicast and broadcast packets read from a local interface, by network
+// and result: "sent" (to at least one member), "no_members", "disabled"
+// (multicast is off on the network), "rate_limited", "reflected" (a packet
+// we just received from the mesh) and "membership" (an IGMP or MLD report
+// taken in by snooping).
+var MulticastPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "vibepn_multicast_packets_total",
+	Help: "Multicast and broadcast packets read from a local interface.",
+}, []string{"network", "result"})
+
+func init() {
+	prometheus.MustRegister(MulticastPackets)
+}
@@ -0,0 +1,21 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Hole punching outcomes, labelled by role: "initiator" for the side that
+// asked a rendezvous peer for help, "responder" for the side it contacted.
+// The success rate is successes / attempts.
+var (
+	NATPunchAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vibepn_nat_punch_attempts_total",
+		Help: "UDP hole punching attempts.",
+	}, []string{"role"})
+	NATPunchSuccesses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vibepn_nat_punch_successes_total",
+		Help: "UDP hole punching attempts that ended with a connection to the peer.",
+	}, []string{"role"})
+)
+
+func init() {
+	prometheus.MustRegister(NATPunchAttempts, NATPunchSuccesses)
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"vibepn/shared"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	peerRTTDesc = prometheus.NewDesc("vibepn_peer_rtt_seconds",
+		"Smoothed control-plane round-trip time measured with keepalives.", []string{"peer"}, nil)
+	peerJitterDesc = prometheus.NewDesc("vibepn_peer_jitter_seconds",
+		"Keepalive round-trip time variation.", []string{"peer"}, nil)
+	peerQUICRTTDesc = prometheus.NewDesc("vibepn_peer_quic_rtt_seconds",
+		"Smoothed RTT reported by the QUIC connection.", []string{"peer"}, nil)
+	peerCwndDesc = prometheus.NewDesc("vibepn_peer_congestion_window_bytes",
+		"QUIC congestion window.", []string{"peer"}, nil)
+	peerPacketsSentDesc = prometheus.NewDesc("vibepn_peer_quic_packets_sent_total",
+		"QUIC packets sent on the current connection.", []string{"peer"}, nil)
+	peerPacketsLostDesc = prometheus.NewDesc("vibepn_peer_quic_packets_lost_total",
+		"QUIC packets declared lost on the current connection.", []string{"peer"}, nil)
+	peerBytesDesc = prometheus.NewDesc("vibepn_peer_bytes_total",
+		"Data-plane bytes exchanged with the peer.", []string{"peer", "direction"}, nil)
+	peerRateDesc = prometheus.NewDesc("vibepn_peer_throughput_bytes_per_second",
+		"Data-plane throughput over the last sampling interval.", []string{"peer", "direction"}, nil)
+)
+
+// peerCollector exports per-peer statistics straight from the peer table
+// at scrape time.
+type peerCollector struct {
+	list func() []shared.PeerState
+}
+
+// RegisterPeerSource exposes the peers returned by list as Prometheus
+// metrics.
+func RegisterPeerSource(list func() []shared.PeerState) {
+	prometheus.MustRegister(peerCollector{list: list})
+}
+
+func (c peerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- peerRTTDesc
+	ch <- peerJitterDesc
+	ch <- peerQUICRTTDesc
+	ch <- peerCwndDesc
+	ch <- peerPacketsSentDesc
+	ch <- peerPacketsLostDesc
+	ch <- peerBytesDesc
+	ch <- peerRateDesc
+}
+
+func (c peerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range c.list() {
+		ch <- prometheus.MustNewConstMetric(peerRTTDesc, prometheus.GaugeValue, p.RTT.Seconds(), p.ID)
+		ch <- prometheus.MustNewConstMetric(peerJitterDesc, prometheus.GaugeValue, p.Jitter.Seconds(), p.ID)
+		ch <- prometheus.MustNewConstMetric(peerQUICRTTDesc, prometheus.GaugeValue, p.QUICRTT.Seconds(), p.ID)
+		ch <- prometheus.MustNewConstMetric(peerCwndDesc, prometheus.GaugeValue, float64(p.CongestionWindow), p.ID)
+		ch <- prometheus.MustNewConstMetric(peerPacketsSentDesc, prometheus.CounterValue, float64(p.PacketsSent), p.ID)
+		ch <- prometheus.MustNewConstMetric(peerPacketsLostDesc, prometheus.CounterValue, float64(p.PacketsLost), p.ID)
+		ch <- prometheus.MustNewConstMetric(peerBytesDesc, prometheus.CounterValue, float64(p.BytesSent), p.ID, "tx")
+		ch <- prometheus.MustNewConstMetric(peerBytesDesc, prometheus.CounterValue, float64(p.BytesReceived), p.ID, "rx")
+		ch <- prometheus.MustNewConstMetric(peerRateDesc, prometheus.GaugeValue, p.TxRate, p.ID, "tx")
+		ch <- prometheus.MustNewConstMetric(peerRateDesc, prometheus.GaugeValue, p.RxRate, p.ID, "rx")
+	}
+}
@@ -0,0 +1,18 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	RelaySessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "vibepn_relay_sessions",
+		Help: "Streams currently relayed between two other peers.",
+	})
+	RelayBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vibepn_relay_bytes_total",
+		Help: "Bytes forwarded on behalf of other peers.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(RelaySessions, RelayBytes)
+}
@@ -0,0 +1,14 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// PeerMigrations counts connections whose remote address changed while the
+// connection stayed up, i.e. a peer roamed or its NAT rebinded.
+var PeerMigrations = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "vibepn_peer_migrations_total",
+	Help: "Peer connections that moved to a new remote address without reconnecting.",
+})
+
+func init() {
+	prometheus.MustRegister(PeerMigrations)
+}
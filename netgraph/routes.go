@@ -1,6 +1,8 @@
 package netgraph
 
 import (
+	"net"
+	"slices"
 	"sync"
 	"time"
 )
@@ -75,6 +77,16 @@ func (rt *RouteTable) RemoveRoute(network, prefix string) {
 	rt.routes[network] = updated
 }
 
+// RemovePeerRoute removes prefix in network as announced by peerID only.
+func (rt *RouteTable) RemovePeerRoute(network, prefix, peerID string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.routes[network] = slices.DeleteFunc(rt.routes[network], func(r Route) bool {
+		return r.Prefix == prefix && r.PeerID == peerID
+	})
+}
+
 func (rt *RouteTable) RoutesForNetwork(network, excludePeer string) []Route {
 	rt.mu.Lock()
 	defer rt.mu.Unlock()
@@ -89,6 +101,50 @@ func (rt *RouteTable) RoutesForNetwork(network, excludePeer string) []Route {
 	return out
 }
 
+// Lookup returns the most specific route in network that contains ip,
+// ignoring routes via excludePeer. Ties go to the lower metric.
+func (rt *RouteTable) Lookup(network string, ip net.IP, excludePeer string) *Route {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var best *Route
+	bestOnes := -1
+	for _, r := range rt.routes[network] {
+		if excludePeer != "" && r.PeerID == excludePeer {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(r.Prefix)
+		if err != nil || !subnet.Contains(ip) {
+			continue
+		}
+		ones, _ := subnet.Mask.Size()
+		if ones > bestOnes || (ones == bestOnes && r.Metric < best.Metric) {
+			route := r
+			best = &route
+			bestOnes = ones
+		}
+	}
+	return best
+}
+
+// Announced reports whether peerID announced a prefix in network that
+// contains ip.
+func (rt *RouteTable) Announced(network, peerID string, ip net.IP) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for _, r := range rt.routes[network] {
+		if r.PeerID != peerID {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(r.Prefix)
+		if err == nil && subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func (rt *RouteTable) AllRoutes() []Route {
 	rt.mu.Lock()
 	defer rt.mu.Unlock()
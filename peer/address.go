@@ -0,0 +1,326 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"time"
+
+	"vibepn/config"
+	"vibepn/control"
+	"vibepn/ipam"
+	"vibepn/log"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Auto addresses are hashed from network and fingerprint, so two nodes can
+// draw the same one. Nodes announce their address on each network to their
+// peers; when a peer announces ours, the lower fingerprint keeps it and the
+// other rehashes with the next attempt, saves the attempt and moves its
+// TUN to the new address.
+
+// maxAddressAttempts bounds the search for a free address.
+const maxAddressAttempts = 64
+
+// SetAddressing enables conflict resolution and leased addresses: state
+// holds the current attempt per network and is saved to path, onReaddress
+// moves a network's interface to a new address, or drops it for "".
+func (r *Registry) SetAddressing(state config.AddressState, path string, onReaddress func(network, addr string) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if state == nil {
+		state = config.AddressState{}
+	}
+	r.addrState = state
+	r.addrStatePath = path
+	r.onReaddress = onReaddress
+}
+
+func localFingerprint() string {
+	localNode.RLock()
+	defer localNode.RUnlock()
+	return localNode.fingerprint
+}
+
+func localAddress(network string) net.IP {
+	localNode.RLock()
+	defer localNode.RUnlock()
+	return localNode.addrs[network]
+}
+
+// sendAddresses announces our address on every network the peer may use.
+func (r *Registry) sendAddresses(peerID string, stream quic.Stream) {
+	localNode.RLock()
+	addrs := make(map[string]net.IP, len(localNode.addrs))
+	for network, ip := range localNode.addrs {
+		addrs[network] = ip
+	}
+	localNode.RUnlock()
+
+	for network, ip := range addrs {
+		r.sendAddress(peerID, stream, network, ip)
+	}
+}
+
+func (r *Registry) sendAddress(peerID string, stream quic.Stream, network string, ip net.IP) {
+	if !r.authorizedFor(peerID, network) {
+		return
+	}
+	if err := control.SendAddress(stream, network, ip); err != nil {
+		log.New("peer/address").Warnf("Failed to announce address on %s to %s: %v", network, peerID, err)
+	}
+}
+
+// floodAddress announces our new address on network to every peer.
+func (r *Registry) floodAddress(network string, ip net.IP) {
+	r.mu.RLock()
+	streams := make(map[string]quic.Stream)
+	for id, e := range r.peers {
+		if e.control != nil && e.caps&control.CapAddress != 0 {
+			streams[id] = e.control
+		}
+	}
+	r.mu.RUnlock()
+
+	for id, stream := range streams {
+		r.sendAddress(id, stream, network, ip)
+	}
+}
+
+func (r *Registry) handleAddress(body []byte, peerID string) {
+	logger := log.New("peer/address")
+
+	network, rest, ok := readString(body)
+	if !ok || len(rest) != net.IPv4len {
+		logger.Warnf("Invalid address announcement from %s", peerID)
+		return
+	}
+	if !r.authorizedFor(peerID, network) {
+		logger.Warnf("Ignoring address on %s from %s: not a member", network, peerID)
+		return
+	}
+	ip := net.IP(slices.Clone(rest))
+	if !r.validAddress(peerID, network, ip) {
+		logger.Warnf("Ignoring address %s on %s from %s: not an address it can hold", ip, network, peerID)
+		return
+	}
+	if ip.Equal(localAddress(network)) {
+		r.resolveConflict(peerID, network, ip)
+		return
+	}
+
+	r.mu.Lock()
+	e := r.peers[peerID]
+	if e == nil {
+		r.mu.Unlock()
+		return
+	}
+	clash := ""
+	for id, other := range r.peers {
+		if id != peerID && other.conn != nil && other.announced[network].Equal(ip) {
+			clash = id
+			break
+		}
+	}
+	if clash == "" {
+		if e.announced == nil {
+			e.announced = make(map[string]net.IP)
+		}
+		e.announced[network] = ip
+	}
+	r.mu.Unlock()
+
+	// Two peers we reach on one address: they resolve it once they
+	// connect, until then the first one keeps it
+	if clash != "" {
+		logger.Warnf("Peers %s and %s both use %s on %s", peerID, clash, ip, network)
+		control.PublishEvent("address_conflict", map[string]interface{}{
+			"network": network,
+			"address": ip.String(),
+			"peers":   []string{clash, peerID},
+		})
+		return
+	}
+	logger.Debugf("Peer %s holds %s on %s", peerID, ip, network)
+}
+
+// resolveConflict settles a peer announcing our address on network. The
+// address is not recorded for the peer: one of us moves.
+func (r *Registry) resolveConflict(peerID, network string, ip net.IP) {
+	logger := log.New("peer/address")
+
+	logger.Warnf("Peer %s uses our address %s on %s", peerID, ip, network)
+	control.PublishEvent("address_conflict", map[string]interface{}{
+		"network": network,
+		"address": ip.String(),
+		"peers":   []string{localFingerprint(), peerID},
+	})
+	if localFingerprint() < peerID {
+		// 🥇 We keep it; make sure the peer knows it has to move
+		if stream := r.controlStream(peerID); stream != nil {
+			r.sendAddress(peerID, stream, network, ip)
+		}
+		return
+	}
+	r.readdress(network)
+}
+
+// validAddress reports whether peerID may hold ip on network: its active
+// lease where we hand out leases, one of its first maxAddressAttempts
+// hashed addresses on auto networks, else an address on the prefix.
+func (r *Registry) validAddress(peerID, network string, ip net.IP) bool {
+	if pool := leasePool(network); pool != nil {
+		return activeLease(pool, peerID).Equal(ip)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	netCfg := r.netcfg[network]
+	if netCfg.Address == "auto" {
+		for attempt := 0; attempt < maxAddressAttempts; attempt++ {
+			addr, err := config.ResolveAddressAttempt(network, peerID, r.netcfg, attempt)
+			if err != nil {
+				return false
+			}
+			if net.ParseIP(addr).Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	_, subnet, err := net.ParseCIDR(netCfg.Prefix)
+	return err == nil && subnet.Contains(ip)
+}
+
+// activeLease returns the address pool leases to peerID right now, or nil.
+func activeLease(pool *ipam.Pool, peerID string) net.IP {
+	now := time.Now()
+	for _, l := range pool.Leases() {
+		if l.Fingerprint == peerID && l.Active(now) {
+			return net.IP(l.Address.AsSlice())
+		}
+	}
+	return nil
+}
+
+// readdress moves us off a conflicting auto address on network to the
+// next attempt's address that no connected peer holds.
+func (r *Registry) readdress(network string) {
+	logger := log.New("peer/address")
+
+	r.addrMu.Lock()
+	defer r.addrMu.Unlock()
+
+	r.mu.RLock()
+	netCfg := r.netcfg[network]
+	state, path, hook := r.addrState, r.addrStatePath, r.onReaddress
+	taken := make([]net.IP, 0, len(r.peers))
+	for _, e := range r.peers {
+		if ip := e.announced[network]; ip != nil && e.conn != nil {
+			taken = append(taken, ip)
+		}
+	}
+	r.mu.RUnlock()
+
+	old := localAddress(network)
+	if netCfg.Address != "auto" || hook == nil {
+		logger.Errorf("Address %s on %s is in use by a peer, but it is not an auto address; change it in the config", old, network)
+		return
+	}
+
+	attempt := state[network]
+	var next net.IP
+	for tries := 0; tries < maxAddressAttempts && next == nil; tries++ {
+		attempt++
+		addr, err := config.ResolveAddressAttempt(network, localFingerprint(), r.netcfg, attempt)
+		if err != nil {
+			logger.Errorf("Cannot derive a new address on %s: %v", network, err)
+			return
+		}
+		if ip := net.ParseIP(addr); !ip.Equal(old) && !slices.ContainsFunc(taken, ip.Equal) {
+			next = ip
+		}
+	}
+	if next == nil {
+		logger.Errorf("No free address on %s after %d attempts", network, maxAddressAttempts)
+		return
+	}
+
+	if err := r.moveAddress(network, old, next); err != nil {
+		logger.Errorf("Failed to move to %s on %s: %v", next, network, err)
+		return
+	}
+	logger.Infof("Moved from %s to %s on %s (attempt %d)", old, next, network, attempt)
+
+	r.mu.Lock()
+	state[network] = attempt
+	r.mu.Unlock()
+	if err := state.Save(path); err != nil {
+		logger.Warnf("Moved to %s on %s, but could not save it: %v", next, network, err)
+	}
+}
+
+// moveAddress switches our address on network from old to ip through the
+// readdress hook and announces the new one to every peer. Either may be
+// nil, when a lease is first granted or runs out. Callers hold r.addrMu,
+// as the hook rewrites the interface manager's addresses.
+func (r *Registry) moveAddress(network string, old, ip net.IP) error {
+	r.mu.RLock()
+	hook := r.onReaddress
+	r.mu.RUnlock()
+	if hook == nil {
+		return errors.New("readdressing not available")
+	}
+
+	addr := ""
+	if ip != nil {
+		addr = ip.String()
+	}
+	if err := hook(network, addr); err != nil {
+		return err
+	}
+	localNode.Lock()
+	if ip == nil {
+		delete(localNode.addrs, network)
+	} else {
+		localNode.addrs[network] = ip
+	}
+	localNode.Unlock()
+
+	event := map[string]interface{}{"network": network}
+	if old != nil {
+		event["old"] = old.String()
+	}
+	if ip != nil {
+		event["new"] = ip.String()
+	}
+	control.PublishEvent("address_changed", event)
+	if ip != nil {
+		r.floodAddress(network, ip)
+	}
+	return nil
+}
+
+// OwnsAddress reports whether ip is peerID's own address on network: its
+// active lease if we hand out leases on network, else the one it announced
+// or, if it told us none, its auto address.
+func (r *Registry) OwnsAddress(peerID, network string, ip net.IP) bool {
+	if pool := leasePool(network); pool != nil {
+		return activeLease(pool, peerID).Equal(ip)
+	}
+
+	r.mu.RLock()
+	var announced net.IP
+	if e := r.peers[peerID]; e != nil {
+		announced = e.announced[network]
+	}
+	prefix := r.netcfg[network].Prefix
+	r.mu.RUnlock()
+	if announced != nil {
+		return announced.Equal(ip)
+	}
+
+	auto, err := config.AutoAddress(network, peerID, prefix)
+	return err == nil && net.ParseIP(auto).Equal(ip)
+}
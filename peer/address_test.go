@@ -0,0 +1,130 @@
+package peer
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"vibepn/config"
+)
+
+func addressBody(network string, ip net.IP) []byte {
+	body := append([]byte{byte(len(network))}, network...)
+	return append(body, ip.To4()...)
+}
+
+func TestAddressConflictLowerFingerprintKeeps(t *testing.T) {
+	// A /29 is small enough that both peers hash onto our address
+	netcfg := map[string]config.NetworkConfig{"corp": {Prefix: "10.42.0.0/29", Address: "auto", Export: true}}
+	peers := []config.Peer{{Name: "low", Fingerprint: "fp-a"}, {Name: "high", Fingerprint: "fp-z"}}
+	r := NewRegistry(config.Identity{}, peers, netcfg)
+
+	mine, _ := config.ResolveAddressForNetwork("corp", "fp-z", netcfg)
+	if low, _ := config.ResolveAddressAttempt("corp", "fp-a", netcfg, 1); low != mine {
+		t.Fatalf("fp-a's first rehash is %s, not %s", low, mine)
+	}
+	SetLocalNode("me", "fp-m", map[string]string{"corp": mine})
+	t.Cleanup(func() { SetLocalNode("", "", nil) })
+
+	path := filepath.Join(t.TempDir(), "addresses.json")
+	var moved []string
+	r.SetAddressing(config.AddressState{}, path, func(network, addr string) error {
+		moved = append(moved, addr)
+		return nil
+	})
+
+	// A higher fingerprint on our address has to move, so we stay
+	r.handleAddress(addressBody("corp", net.ParseIP(mine)), "fp-z")
+	if len(moved) != 0 || localAddress("corp").String() != mine {
+		t.Fatalf("moved off %s for a higher fingerprint: %v", mine, moved)
+	}
+	if got := r.peers["fp-z"].announced["corp"]; got != nil {
+		t.Fatalf("our address recorded for the peer: %v", got)
+	}
+
+	// A lower one keeps it and we rehash
+	r.handleAddress(addressBody("corp", net.ParseIP(mine)), "fp-a")
+	want, _ := config.ResolveAddressAttempt("corp", "fp-m", netcfg, 1)
+	if len(moved) != 1 || moved[0] != want {
+		t.Fatalf("hook calls = %v, want [%s]", moved, want)
+	}
+	if got := localAddress("corp").String(); got != want {
+		t.Fatalf("local address = %s, want %s", got, want)
+	}
+	state, err := config.LoadAddressState(path)
+	if err != nil || state["corp"] != 1 {
+		t.Fatalf("saved state = %v, %v; want attempt 1", state, err)
+	}
+}
+
+func TestOwnsAddress(t *testing.T) {
+	netcfg := map[string]config.NetworkConfig{"corp": {Prefix: "10.42.0.0/24", Export: true}}
+	r := NewRegistry(config.Identity{}, []config.Peer{{Name: "node2", Fingerprint: "fp-b"}}, netcfg)
+
+	auto, _ := config.AutoAddress("corp", "fp-b", "10.42.0.0/24")
+	if !r.OwnsAddress("fp-b", "corp", net.ParseIP(auto)) {
+		t.Fatalf("auto address %s of a peer that announced none not owned", auto)
+	}
+	if r.OwnsAddress("fp-b", "corp", net.ParseIP("10.42.0.250")) && auto != "10.42.0.250" {
+		t.Fatal("another address in the prefix owned")
+	}
+
+	announced := net.ParseIP("10.42.0.77")
+	r.handleAddress(addressBody("corp", announced), "fp-b")
+	if !r.OwnsAddress("fp-b", "corp", announced) {
+		t.Fatal("announced address not owned")
+	}
+	if auto != announced.String() && r.OwnsAddress("fp-b", "corp", net.ParseIP(auto)) {
+		t.Fatal("auto address still owned after the peer announced another")
+	}
+}
+
+func TestAddressAnnouncementsValidated(t *testing.T) {
+	netcfg := map[string]config.NetworkConfig{
+		"corp": {Prefix: "10.42.0.0/24", Address: "auto", Export: true},
+		"lab":  {Prefix: "10.77.0.0/24", Address: "10.77.0.1", Export: true},
+	}
+	peers := []config.Peer{{Name: "b", Fingerprint: "fp-b"}, {Name: "c", Fingerprint: "fp-c"}}
+	r := NewRegistry(config.Identity{}, peers, netcfg)
+	r.peers["fp-b"].conn = fakeConn{}
+	r.peers["fp-c"].conn = fakeConn{}
+	SetLocalNode("me", "fp-m", map[string]string{"corp": "10.42.0.1", "lab": "10.77.0.1"})
+	t.Cleanup(func() { SetLocalNode("", "", nil) })
+
+	// Auto networks: only addresses the peer's fingerprint hashes to
+	hashed := map[string]bool{}
+	for attempt := range maxAddressAttempts {
+		addr, _ := config.ResolveAddressAttempt("corp", "fp-b", netcfg, attempt)
+		hashed[addr] = true
+	}
+	var foreign net.IP
+	for host := 2; foreign == nil; host++ {
+		if ip := net.IPv4(10, 42, 0, byte(host)); !hashed[ip.String()] {
+			foreign = ip
+		}
+	}
+	r.handleAddress(addressBody("corp", foreign), "fp-b")
+	if r.OwnsAddress("fp-b", "corp", foreign) {
+		t.Fatalf("%s owned, but fp-b does not hash to it", foreign)
+	}
+	second, _ := config.ResolveAddressAttempt("corp", "fp-b", netcfg, 1)
+	r.handleAddress(addressBody("corp", net.ParseIP(second)), "fp-b")
+	if !r.OwnsAddress("fp-b", "corp", net.ParseIP(second)) {
+		t.Fatalf("rehashed address %s not owned", second)
+	}
+
+	// Static networks: never ours or a connected peer's
+	r.handleAddress(addressBody("lab", net.ParseIP("10.77.0.1")), "fp-b")
+	if r.OwnsAddress("fp-b", "lab", net.ParseIP("10.77.0.1")) {
+		t.Fatal("our address owned by a peer")
+	}
+	r.handleAddress(addressBody("lab", net.ParseIP("10.77.0.5")), "fp-b")
+	r.handleAddress(addressBody("lab", net.ParseIP("10.77.0.5")), "fp-c")
+	if !r.OwnsAddress("fp-b", "lab", net.ParseIP("10.77.0.5")) || r.OwnsAddress("fp-c", "lab", net.ParseIP("10.77.0.5")) {
+		t.Fatal("a connected peer's address went to another peer")
+	}
+	r.handleAddress(addressBody("lab", net.ParseIP("192.168.1.5")), "fp-c")
+	if r.OwnsAddress("fp-c", "lab", net.ParseIP("192.168.1.5")) {
+		t.Fatal("address outside the prefix owned")
+	}
+}
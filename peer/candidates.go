@@ -0,0 +1,211 @@
+package peer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"vibepn/config"
+	"vibepn/log"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	dialStagger = 250 * time.Millisecond // head start each endpoint gets before the next is tried
+	dialTimeout = 5 * time.Second
+)
+
+// endpoint is one concrete address a configured candidate resolved to.
+type endpoint struct {
+	candidate string // as configured, e.g. "vpn.example.com:51820"
+	addr      string // resolved ip:port
+}
+
+// dialPeer races every configured address of p, re-resolving DNS names on
+// each attempt, and returns the connection with the candidate it came from.
+func (r *Registry) dialPeer(p config.Peer, tlsConf *tls.Config) (quic.Connection, string, error) {
+	candidates := p.Candidates()
+	if len(candidates) == 0 {
+		return nil, "", errors.New("no address configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	endpoints, err := resolveCandidates(ctx, candidates)
+	cancel()
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := peerKey(p)
+	endpoints = orderEndpoints(endpoints, r.lastEndpoint(key))
+
+	conn, ep, err := raceDial(endpoints, tlsConf)
+	if err != nil {
+		return nil, "", err
+	}
+	r.rememberEndpoint(key, ep.addr)
+	return conn, ep.candidate, nil
+}
+
+// peerKey identifies a configured peer before its fingerprint is known.
+func peerKey(p config.Peer) string {
+	if p.Fingerprint != "" {
+		return p.Fingerprint
+	}
+	return "name:" + p.Name
+}
+
+func (r *Registry) lastEndpoint(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lastEndpoints[key]
+}
+
+func (r *Registry) rememberEndpoint(key, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastEndpoints[key] = addr
+}
+
+// resolveCandidates expands host:port candidates into endpoints, looking
+// up both A and AAAA records for names. Candidates that fail to resolve
+// are skipped as long as at least one endpoint remains.
+func resolveCandidates(ctx context.Context, candidates []string) ([]endpoint, error) {
+	logger := log.New("peer/dial")
+
+	var out []endpoint
+	var errs []error
+	for _, c := range candidates {
+		host, port, err := net.SplitHostPort(c)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c, err))
+			continue
+		}
+		if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+			out = append(out, endpoint{candidate: c, addr: net.JoinHostPort(ip.String(), port)})
+			continue
+		}
+
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			logger.Debugf("Failed to resolve %s: %v", c, err)
+			errs = append(errs, fmt.Errorf("resolve %s: %w", c, err))
+			continue
+		}
+		for _, ip := range ips {
+			out = append(out, endpoint{candidate: c, addr: net.JoinHostPort(ip.IP.String(), port)})
+		}
+	}
+
+	if len(out) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return out, nil
+}
+
+// orderEndpoints drops duplicates, interleaves IPv6 and IPv4 while keeping
+// configured order within each family (RFC 8305), and moves last to the
+// front if it is still among them.
+func orderEndpoints(endpoints []endpoint, last string) []endpoint {
+	seen := make(map[string]bool, len(endpoints))
+	var v6, v4 []endpoint
+	for _, ep := range endpoints {
+		if seen[ep.addr] {
+			continue
+		}
+		seen[ep.addr] = true
+		if strings.HasPrefix(ep.addr, "[") {
+			v6 = append(v6, ep)
+		} else {
+			v4 = append(v4, ep)
+		}
+	}
+
+	out := make([]endpoint, 0, len(v6)+len(v4))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+
+	for i, ep := range out {
+		if ep.addr == last {
+			copy(out[1:i+1], out[:i])
+			out[0] = ep
+			break
+		}
+	}
+	return out
+}
+
+// raceDial dials endpoints in order, giving each dialStagger before
+// starting the next one (or starting it immediately when the previous
+// fails). The first handshake to complete wins; late winners are closed.
+func raceDial(endpoints []endpoint, tlsConf *tls.Config) (quic.Connection, endpoint, error) {
+	logger := log.New("peer/dial")
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	type result struct {
+		conn quic.Connection
+		ep   endpoint
+		err  error
+	}
+	results := make(chan result, len(endpoints))
+
+	next, pending := 0, 0
+	start := func() {
+		ep := endpoints[next]
+		next++
+		pending++
+		logger.Infof("Dialing QUIC to %s (%s)...", ep.candidate, ep.addr)
+		go func() {
+			conn, err := dial(ctx, ep.addr, tlsConf)
+			results <- result{conn, ep, err}
+		}()
+	}
+
+	stagger := time.NewTimer(dialStagger)
+	defer stagger.Stop()
+
+	var errs []error
+	start()
+	for pending > 0 {
+		select {
+		case <-stagger.C:
+			if next < len(endpoints) {
+				start()
+				stagger.Reset(dialStagger)
+			}
+
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				cancel()
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.err == nil {
+							late.conn.CloseWithError(0, "lost dial race")
+						}
+					}
+				}(pending)
+				return res.conn, res.ep, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", res.ep.addr, res.err))
+			if next < len(endpoints) {
+				start()
+				stagger.Reset(dialStagger)
+			}
+		}
+	}
+	return nil, endpoint{}, errors.Join(errs...)
+}
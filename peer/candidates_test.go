@@ -0,0 +1,58 @@
+package peer
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func endpointAddrs(eps []endpoint) []string {
+	out := make([]string, len(eps))
+	for i, ep := range eps {
+		out[i] = ep.addr
+	}
+	return out
+}
+
+func TestOrderEndpoints(t *testing.T) {
+	eps := []endpoint{
+		{candidate: "a", addr: "192.0.2.1:51820"},
+		{candidate: "a", addr: "192.0.2.2:51820"},
+		{candidate: "a", addr: "[2001:db8::1]:51820"},
+		{candidate: "b", addr: "192.0.2.1:51820"}, // same address through another name
+		{candidate: "b", addr: "[2001:db8::2]:51820"},
+	}
+
+	got := endpointAddrs(orderEndpoints(eps, ""))
+	want := []string{"[2001:db8::1]:51820", "192.0.2.1:51820", "[2001:db8::2]:51820", "192.0.2.2:51820"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("interleaved order = %v, want %v", got, want)
+	}
+
+	got = endpointAddrs(orderEndpoints(eps, "192.0.2.2:51820"))
+	want = []string{"192.0.2.2:51820", "[2001:db8::1]:51820", "192.0.2.1:51820", "[2001:db8::2]:51820"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("last working endpoint first = %v, want %v", got, want)
+	}
+
+	got = endpointAddrs(orderEndpoints(eps, "198.51.100.1:51820"))
+	if got[0] != "[2001:db8::1]:51820" {
+		t.Fatalf("stale last endpoint should be ignored, got %v", got)
+	}
+}
+
+func TestResolveCandidatesLiterals(t *testing.T) {
+	eps, err := resolveCandidates(context.Background(), []string{"192.0.2.1:51820", "[2001:db8::1]:51820", "bogus"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := endpointAddrs(eps)
+	want := []string{"192.0.2.1:51820", "[2001:db8::1]:51820"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("resolved %v, want %v", got, want)
+	}
+
+	if _, err := resolveCandidates(context.Background(), []string{"bogus"}); err == nil {
+		t.Fatal("expected error when no candidate resolves")
+	}
+}
@@ -0,0 +1,286 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"vibepn/control"
+	"vibepn/log"
+)
+
+const echoRelayTimeout = 5 * time.Second
+
+var localNode struct {
+	sync.RWMutex
+	name        string
+	fingerprint string
+	addrs       map[string]net.IP // network → local overlay address
+}
+
+// SetLocalNode records how this node identifies itself in echo replies and
+// which overlay addresses it owns.
+func SetLocalNode(name, fingerprint string, addrs map[string]string) {
+	parsed := make(map[string]net.IP, len(addrs))
+	for network, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			parsed[network] = ip
+		}
+	}
+
+	localNode.Lock()
+	defer localNode.Unlock()
+	localNode.name = name
+	localNode.fingerprint = fingerprint
+	localNode.addrs = parsed
+}
+
+func ownsAddress(network string, ip net.IP) bool {
+	localNode.RLock()
+	defer localNode.RUnlock()
+	local, ok := localNode.addrs[network]
+	return ok && local.Equal(ip)
+}
+
+type echoResult struct {
+	flags       uint8
+	name        string
+	fingerprint string
+}
+
+type echoRelay struct {
+	origin  string
+	id      uint64
+	expires time.Time
+}
+
+var echoes struct {
+	sync.Mutex
+	waiters map[uint64]chan echoResult // probes we originated
+	relays  map[uint64]echoRelay       // probes we forwarded for a peer
+}
+
+func init() {
+	echoes.waiters = make(map[uint64]chan echoResult)
+	echoes.relays = make(map[uint64]echoRelay)
+}
+
+func (r *Registry) handleEcho(body []byte, peerID string) {
+	logger := log.New("peer/echo")
+
+	if len(body) < 9 {
+		logger.Warnf("Invalid echo payload")
+		return
+	}
+	id := binary.BigEndian.Uint64(body[:8])
+	ttl := body[8]
+
+	network, rest, ok := readString(body[9:])
+	if !ok {
+		logger.Warnf("Invalid echo network")
+		return
+	}
+	target, _, ok := readString(rest)
+	if !ok {
+		logger.Warnf("Invalid echo target")
+		return
+	}
+
+	stream := r.controlStream(peerID)
+	if stream == nil {
+		logger.Warnf("No control stream to answer echo from %s", peerID)
+		return
+	}
+
+	localNode.RLock()
+	name, fp := localNode.name, localNode.fingerprint
+	localNode.RUnlock()
+
+	reply := func(flags uint8) {
+		if err := control.SendEchoReply(stream, id, flags, name, fp); err != nil {
+			logger.Warnf("Failed to send echo reply to %s: %v", peerID, err)
+		}
+	}
+
+	if target == "" {
+		reply(control.EchoReached)
+		return
+	}
+	ip := net.ParseIP(target)
+	if ip == nil {
+		reply(control.EchoUnreachable)
+		return
+	}
+	if ownsAddress(network, ip) {
+		reply(control.EchoReached)
+		return
+	}
+	if ttl <= 1 {
+		reply(0)
+		return
+	}
+
+	route := control.GetRouteTable().Lookup(network, ip, peerID)
+	if route == nil {
+		reply(control.EchoUnreachable)
+		return
+	}
+	next := r.controlStream(route.PeerID)
+	if next == nil || !r.hasCapability(route.PeerID, control.CapEcho) {
+		reply(control.EchoUnreachable)
+		return
+	}
+
+	relayID := rand.Uint64()
+	echoes.Lock()
+	pruneEchoRelays()
+	echoes.relays[relayID] = echoRelay{origin: peerID, id: id, expires: time.Now().Add(echoRelayTimeout)}
+	echoes.Unlock()
+
+	if err := control.SendEcho(next, relayID, ttl-1, network, target); err != nil {
+		logger.Warnf("Failed to forward echo to %s: %v", route.PeerID, err)
+		reply(control.EchoUnreachable)
+	}
+}
+
+// pruneEchoRelays drops forwarded probes whose reply never came back.
+// Caller must hold echoes.
+func pruneEchoRelays() {
+	now := time.Now()
+	for id, r := range echoes.relays {
+		if now.After(r.expires) {
+			delete(echoes.relays, id)
+		}
+	}
+}
+
+func (r *Registry) handleEchoReply(body []byte, peerID string) {
+	logger := log.New("peer/echo")
+
+	if len(body) < 9 {
+		logger.Warnf("Invalid echo-reply payload")
+		return
+	}
+	id := binary.BigEndian.Uint64(body[:8])
+	flags := body[8]
+
+	name, rest, ok := readString(body[9:])
+	if !ok {
+		logger.Warnf("Invalid echo-reply name")
+		return
+	}
+	fp, _, _ := readString(rest)
+
+	echoes.Lock()
+	relay, relayed := echoes.relays[id]
+	delete(echoes.relays, id)
+	waiter := echoes.waiters[id]
+	echoes.Unlock()
+
+	if relayed {
+		stream := r.controlStream(relay.origin)
+		if stream == nil {
+			logger.Warnf("Origin %s of relayed echo is gone", relay.origin)
+			return
+		}
+		if err := control.SendEchoReply(stream, relay.id, flags, name, fp); err != nil {
+			logger.Warnf("Failed to relay echo reply to %s: %v", relay.origin, err)
+		}
+		return
+	}
+
+	if waiter == nil {
+		logger.Debugf("Unsolicited echo reply %d from %s", id, peerID)
+		return
+	}
+	select {
+	case waiter <- echoResult{flags: flags, name: name, fingerprint: fp}:
+	default:
+	}
+}
+
+// readString decodes a 1-byte length-prefixed string.
+func readString(b []byte) (string, []byte, bool) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil, false
+	}
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:], true
+}
+
+// Prober implements control.Prober on top of the peer control streams.
+type Prober struct {
+	registry *Registry
+}
+
+func NewProber(registry *Registry) *Prober {
+	return &Prober{registry: registry}
+}
+
+func (p *Prober) Ping(peer string, timeout time.Duration) (control.TraceHop, time.Duration, error) {
+	return p.registry.probe(p.registry.resolve(peer), 1, "", "", timeout)
+}
+
+func (p *Prober) Trace(network, target string, ttl int, timeout time.Duration) (control.TraceHop, time.Duration, error) {
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return control.TraceHop{}, 0, fmt.Errorf("invalid target address %q", target)
+	}
+
+	networks := []string{network}
+	if network == "" {
+		networks = networks[:0]
+		for name := range control.GetNetConfig() {
+			networks = append(networks, name)
+		}
+	}
+
+	for _, name := range networks {
+		if route := control.GetRouteTable().Lookup(name, ip, ""); route != nil {
+			return p.registry.probe(route.PeerID, uint8(ttl), name, target, timeout)
+		}
+	}
+	return control.TraceHop{}, 0, fmt.Errorf("no route to %s", target)
+}
+
+func (r *Registry) probe(peerID string, ttl uint8, network, target string, timeout time.Duration) (control.TraceHop, time.Duration, error) {
+	stream := r.controlStream(peerID)
+	if stream == nil {
+		return control.TraceHop{}, 0, fmt.Errorf("peer %s is not connected", peerID)
+	}
+	if !r.hasCapability(peerID, control.CapEcho) {
+		return control.TraceHop{}, 0, fmt.Errorf("peer %s does not support echo", peerID)
+	}
+
+	id := rand.Uint64()
+	ch := make(chan echoResult, 1)
+	echoes.Lock()
+	echoes.waiters[id] = ch
+	echoes.Unlock()
+	defer func() {
+		echoes.Lock()
+		delete(echoes.waiters, id)
+		echoes.Unlock()
+	}()
+
+	start := time.Now()
+	if err := control.SendEcho(stream, id, ttl, network, target); err != nil {
+		return control.TraceHop{}, 0, err
+	}
+
+	select {
+	case res := <-ch:
+		return control.TraceHop{
+			Peer:        res.fingerprint,
+			Name:        res.name,
+			Reached:     res.flags&control.EchoReached != 0,
+			Unreachable: res.flags&control.EchoUnreachable != 0,
+		}, time.Since(start), nil
+	case <-time.After(timeout):
+		return control.TraceHop{}, 0, errors.New("timeout")
+	}
+}
@@ -0,0 +1,284 @@
+package peer
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+
+	"vibepn/config"
+	"vibepn/control"
+	"vibepn/log"
+	"vibepn/netgraph"
+)
+
+// Exit nodes: a node that offers itself as exit announces the default
+// routes on its exit networks, to allowed peers only. Receivers remember
+// the offer but only put the default routes of the exit they chose into
+// the route table; the host's policy routing follows through onExit.
+
+// defaultRoutes are what an exit node announces.
+var defaultRoutes = []string{"0.0.0.0/0", "::/0"}
+
+func isDefaultRoute(prefix string) bool {
+	return slices.Contains(defaultRoutes, prefix)
+}
+
+// exitChoice names an exit by peer (name or fingerprint) and network.
+type exitChoice struct {
+	peer    string
+	network string
+}
+
+// OfferExit makes this node an exit for the peers cfg allows.
+func (r *Registry) OfferExit(cfg config.ExitNode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exitOffer = &cfg
+}
+
+// SetOnExit sets the hook that turns host routing through the exit on or
+// off for the network whose default routes are in use.
+func (r *Registry) SetOnExit(cb func(network string, enable bool) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onExit = cb
+}
+
+// ExitNetworks returns the networks we offer an exit on. Exits route IP,
+// so tap networks are left out.
+func (r *Registry) ExitNetworks() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.exitOffer == nil {
+		return nil
+	}
+	var out []string
+	for name, n := range r.netcfg {
+		if n.Export && !n.TAP() && (len(r.exitOffer.Networks) == 0 || slices.Contains(r.exitOffer.Networks, name)) {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// offersExitTo reports whether peerID may use us as exit on network.
+func (r *Registry) offersExitTo(peerID, network string) bool {
+	if !slices.Contains(r.ExitNetworks(), network) {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e := r.peers[peerID]
+	for _, a := range r.exitOffer.Allow {
+		if a == "*" || a == peerID || (e != nil && e.hasName(a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// exportPrefixes returns what we announce to peerID on network: the
+// network's prefix, the subnets we route and, if the peer may use us as
+// exit, the default routes.
+func (r *Registry) exportPrefixes(peerID, network string, netCfg config.NetworkConfig) []string {
+	prefixes := append([]string{netCfg.Prefix}, netCfg.Routes...)
+	if r.offersExitTo(peerID, network) {
+		prefixes = append(prefixes, defaultRoutes...)
+	}
+	return prefixes
+}
+
+// Deliverable reports whether a packet from peerID for dst may enter
+// network here: dst must be on the network or a subnet we route for it,
+// unless we are the peer's exit.
+func (r *Registry) Deliverable(peerID, network string, dst net.IP) bool {
+	r.mu.RLock()
+	netCfg, ok := r.netcfg[network]
+	r.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if routesTo(append([]string{netCfg.Prefix}, netCfg.Routes...), dst) {
+		return true
+	}
+	return r.offersExitTo(peerID, network)
+}
+
+// noteExitOffer records that peerID offers prefix as exit on network.
+func (r *Registry) noteExitOffer(peerID, network, prefix string) {
+	r.mu.Lock()
+	if e := r.peers[peerID]; e != nil {
+		if e.exits == nil {
+			e.exits = make(map[string][]string)
+		}
+		if !slices.Contains(e.exits[network], prefix) {
+			e.exits[network] = append(e.exits[network], prefix)
+		}
+	}
+	r.mu.Unlock()
+	r.applyExit()
+}
+
+// dropExitOffer forgets a default route peerID withdrew.
+func (r *Registry) dropExitOffer(peerID, network, prefix string) {
+	r.mu.Lock()
+	if e := r.peers[peerID]; e != nil && e.exits != nil {
+		e.exits[network] = slices.DeleteFunc(e.exits[network], func(p string) bool { return p == prefix })
+		if len(e.exits[network]) == 0 {
+			delete(e.exits, network)
+		}
+	}
+	r.mu.Unlock()
+
+	// Taken out here since applyExit only ever adds the offered routes
+	if rt := control.GetRouteTable(); rt != nil {
+		rt.RemovePeerRoute(network, prefix, peerID)
+	}
+	r.applyExit()
+}
+
+// UseExit routes our default traffic through peer's exit on network (empty
+// to take the only network it offers). An empty peer turns it off. The
+// choice holds while the exit is away and applies once it offers again.
+func (r *Registry) UseExit(peer, network string) error {
+	r.mu.Lock()
+	if peer != "" {
+		if network != "" {
+			if _, ok := r.netcfg[network]; !ok {
+				r.mu.Unlock()
+				return fmt.Errorf("unknown network %q", network)
+			}
+		}
+		if id := r.resolveLocked(peer); id == r.identity.Fingerprint && id != "" {
+			r.mu.Unlock()
+			return fmt.Errorf("cannot use this node as its own exit")
+		}
+	}
+	r.exitUse = exitChoice{peer: peer, network: network}
+	r.mu.Unlock()
+
+	r.applyExit()
+	return nil
+}
+
+// exitTarget returns the exit peer and network to route through now: the
+// chosen exit if it is connected and offering, else none.
+func (r *Registry) exitTarget() (string, string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	use := r.exitUse
+	if use.peer == "" {
+		return "", ""
+	}
+	for id, e := range r.peers {
+		if (id != use.peer && !e.hasName(use.peer)) || e.conn == nil || len(e.exits) == 0 {
+			continue
+		}
+		if use.network != "" {
+			if _, ok := e.exits[use.network]; ok {
+				return id, use.network
+			}
+			continue
+		}
+		return id, exitNetworks(e.exits)[0]
+	}
+	return "", ""
+}
+
+// applyExit brings the route table and host routing in line with
+// exitTarget. It reads the latest state each time, so callers may run it
+// in any order.
+func (r *Registry) applyExit() {
+	logger := log.New("peer/exit")
+
+	r.exitMu.Lock()
+	defer r.exitMu.Unlock()
+
+	peerID, network := r.exitTarget()
+	r.mu.RLock()
+	applied, hook := r.exitApplied, r.onExit
+	var prefixes []string
+	if e := r.peers[peerID]; e != nil {
+		prefixes = slices.Clone(e.exits[network])
+	}
+	r.mu.RUnlock()
+
+	rt := control.GetRouteTable()
+	if applied.peer != "" && (applied.peer != peerID || applied.network != network) {
+		if rt != nil {
+			for _, prefix := range defaultRoutes {
+				rt.RemovePeerRoute(applied.network, prefix, applied.peer)
+			}
+		}
+		if applied.network != network && hook != nil {
+			if err := hook(applied.network, false); err != nil {
+				logger.Warnf("Failed to stop routing through the exit on %s: %v", applied.network, err)
+			}
+		}
+		logger.Infof("No longer routing default traffic through %s", applied.peer)
+		control.PublishEvent("exit_node_inactive", map[string]interface{}{"peer": applied.peer, "network": applied.network})
+	}
+
+	// Routes are added every time: a reconnect removes them with the peer
+	if peerID != "" && rt != nil {
+		for _, prefix := range prefixes {
+			rt.AddRoute(netgraph.Route{Network: network, Prefix: prefix, PeerID: peerID, Metric: 1})
+		}
+	}
+	if peerID != "" && (applied.peer != peerID || applied.network != network) {
+		if applied.network != network && hook != nil {
+			if err := hook(network, true); err != nil {
+				logger.Warnf("Failed to route through the exit on %s: %v", network, err)
+			}
+		}
+		logger.Infof("Routing default traffic through exit %s on %s", peerID, network)
+		control.PublishEvent("exit_node_active", map[string]interface{}{"peer": peerID, "network": network})
+	}
+
+	r.mu.Lock()
+	r.exitApplied = exitChoice{peer: peerID, network: network}
+	r.mu.Unlock()
+}
+
+// exitNetworks lists the networks of an exits map, sorted.
+func exitNetworks(exits map[string][]string) []string {
+	if len(exits) == 0 {
+		return nil
+	}
+	networks := make([]string, 0, len(exits))
+	for n := range exits {
+		networks = append(networks, n)
+	}
+	sort.Strings(networks)
+	return networks
+}
+
+// ExitStatus describes the exit we offer, the one we use and the exits
+// peers offer us.
+func (r *Registry) ExitStatus() map[string]interface{} {
+	offering := r.ExitNetworks()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	offers := make([]map[string]interface{}, 0)
+	for id, e := range r.peers {
+		if e.conn == nil || len(e.exits) == 0 {
+			continue
+		}
+		offers = append(offers, map[string]interface{}{"peer": id, "name": e.name, "networks": exitNetworks(e.exits)})
+	}
+	sort.Slice(offers, func(i, j int) bool { return offers[i]["peer"].(string) < offers[j]["peer"].(string) })
+
+	return map[string]interface{}{
+		"offering": offering,
+		"use":      r.exitUse.peer,
+		"network":  r.exitUse.network,
+		"active":   r.exitApplied.peer != "",
+		"via":      r.exitApplied.peer,
+		"via_net":  r.exitApplied.network,
+		"offers":   offers,
+	}
+}
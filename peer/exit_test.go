@@ -0,0 +1,126 @@
+package peer
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"vibepn/config"
+	"vibepn/control"
+	"vibepn/netgraph"
+
+	"github.com/quic-go/quic-go"
+)
+
+// fakeConn stands in for a live connection; only its presence matters.
+type fakeConn struct{ quic.Connection }
+
+func TestExitOfferAndDelivery(t *testing.T) {
+	netcfg := map[string]config.NetworkConfig{
+		"corp": {Prefix: "10.42.0.0/24", Export: true},
+		"lab":  {Prefix: "10.77.0.0/24", Export: true},
+	}
+	peers := []config.Peer{{Name: "laptop", Fingerprint: "fp-laptop"}, {Name: "server", Fingerprint: "fp-server"}}
+	r := NewRegistry(config.Identity{}, peers, netcfg)
+	r.OfferExit(config.ExitNode{Advertise: true, Networks: []string{"corp"}, Allow: []string{"laptop"}})
+
+	if got := r.exportPrefixes("fp-laptop", "corp", netcfg["corp"]); !slices.Equal(got, []string{"10.42.0.0/24", "0.0.0.0/0", "::/0"}) {
+		t.Errorf("exportPrefixes to allowed peer = %v", got)
+	}
+	if got := r.exportPrefixes("fp-server", "corp", netcfg["corp"]); len(got) != 1 {
+		t.Errorf("exportPrefixes to other peer = %v, want only the network prefix", got)
+	}
+	if got := r.exportPrefixes("fp-laptop", "lab", netcfg["lab"]); len(got) != 1 {
+		t.Errorf("exportPrefixes on a network without exit = %v", got)
+	}
+
+	internet := net.ParseIP("1.1.1.1")
+	if !r.Deliverable("fp-server", "corp", net.ParseIP("10.42.0.9")) {
+		t.Error("packet for the network not deliverable")
+	}
+	if !r.Deliverable("fp-laptop", "corp", internet) {
+		t.Error("exit traffic from allowed peer not deliverable")
+	}
+	if r.Deliverable("fp-server", "corp", internet) || r.Deliverable("fp-laptop", "lab", internet) {
+		t.Error("exit traffic delivered without an exit offer")
+	}
+}
+
+func TestUseExitFollowsOffer(t *testing.T) {
+	rt := netgraph.NewRouteTable()
+	control.Register(rt, nil, nil)
+	t.Cleanup(func() { control.Register(nil, nil, nil) })
+
+	netcfg := map[string]config.NetworkConfig{"corp": {Prefix: "10.42.0.0/24", Export: true}}
+	r := NewRegistry(config.Identity{}, []config.Peer{{Name: "gw", Fingerprint: "fp-gw"}}, netcfg)
+	r.peers["fp-gw"].conn = fakeConn{}
+	var hooked []bool
+	r.SetOnExit(func(network string, enable bool) error {
+		hooked = append(hooked, enable)
+		return nil
+	})
+
+	// An offer alone does not route anything
+	r.noteExitOffer("fp-gw", "corp", "0.0.0.0/0")
+	if route := rt.Lookup("corp", net.ParseIP("1.1.1.1"), ""); route != nil {
+		t.Fatalf("default route installed without choosing the exit: %+v", route)
+	}
+
+	if err := r.UseExit("gw", ""); err != nil {
+		t.Fatal(err)
+	}
+	if route := rt.Lookup("corp", net.ParseIP("1.1.1.1"), ""); route == nil || route.PeerID != "fp-gw" {
+		t.Fatalf("default traffic not routed through the exit: %+v", route)
+	}
+
+	r.dropExitOffer("fp-gw", "corp", "0.0.0.0/0")
+	if route := rt.Lookup("corp", net.ParseIP("1.1.1.1"), ""); route != nil {
+		t.Fatalf("default route kept after the exit withdrew it: %+v", route)
+	}
+	if !slices.Equal(hooked, []bool{true, false}) {
+		t.Errorf("host routing hook calls = %v, want [true false]", hooked)
+	}
+	if err := r.UseExit("", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExitNamesOnlyMatchConfiguredPeers(t *testing.T) {
+	rt := netgraph.NewRouteTable()
+	control.Register(rt, nil, nil)
+	t.Cleanup(func() { control.Register(nil, nil, nil) })
+
+	netcfg := map[string]config.NetworkConfig{"corp": {Prefix: "10.42.0.0/24", Export: true}}
+	peers := []config.Peer{{Name: "gw", Fingerprint: "fp-gw"}, {Name: "laptop", Fingerprint: "fp-laptop"}}
+	r := NewRegistry(config.Identity{}, peers, netcfg)
+	r.SetOnExit(func(string, bool) error { return nil })
+	// 🎭 Unconfigured keys whose certificates claim the same names
+	r.peers["fp-fake-gw"] = &peerEntry{id: "fp-fake-gw", name: "gw", conn: fakeConn{}}
+	r.peers["fp-fake-laptop"] = &peerEntry{id: "fp-fake-laptop", name: "laptop", conn: fakeConn{}}
+
+	r.OfferExit(config.ExitNode{Advertise: true, Networks: []string{"corp"}, Allow: []string{"laptop"}})
+	if !r.offersExitTo("fp-laptop", "corp") {
+		t.Error("exit not offered to the configured laptop")
+	}
+	if r.offersExitTo("fp-fake-laptop", "corp") {
+		t.Error("exit offered to a key that only claims the name laptop")
+	}
+
+	r.noteExitOffer("fp-fake-gw", "corp", "0.0.0.0/0")
+	if err := r.UseExit("gw", ""); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := r.exitTarget(); id != "" {
+		t.Fatalf("exit gw resolved to %s while the configured gw is away", id)
+	}
+	r.peers["fp-gw"].conn = fakeConn{}
+	r.noteExitOffer("fp-gw", "corp", "0.0.0.0/0")
+	for range 10 {
+		if id, _ := r.exitTarget(); id != "fp-gw" {
+			t.Fatalf("exit gw resolved to %s, want fp-gw", id)
+		}
+	}
+	if route := rt.Lookup("corp", net.ParseIP("1.1.1.1"), ""); route == nil || route.PeerID != "fp-gw" {
+		t.Fatalf("default traffic routed through %+v, want fp-gw", route)
+	}
+}
@@ -0,0 +1,541 @@
+package peer
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"vibepn/config"
+	"vibepn/control"
+	"vibepn/crypto"
+	"vibepn/log"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	gossipVersion   = 1
+	gossipInterval  = 5 * time.Minute  // how often we re-sign and re-share our own record
+	gossipRecordTTL = 30 * time.Minute // members not heard of for this long are forgotten
+	gossipMaxSkew   = 5 * time.Minute  // tolerated clock skew for records from the future
+	gossipMaxRecord = 4000             // must fit a control message
+
+	// Records are signed by their own, freely made keys, so what one peer
+	// can make us keep and flood is bounded.
+	gossipMaxMembers   = 1024 // records kept in total
+	gossipMaxPerSource = 256  // records first heard from one peer
+)
+
+// gossipContext is prepended to the signed bytes so a member record
+// signature cannot be replayed as anything else.
+var gossipContext = []byte("vibepn-gossip-v1\x00")
+
+// memberRecord is what a node says about itself in gossip. It is signed by
+// the node's own identity key and carries its certificate, so it can be
+// checked no matter how many peers forwarded it.
+type memberRecord struct {
+	fingerprint string
+	name        string
+	networks    []string
+	addresses   []string
+	issued      time.Time
+	raw         []byte // signed wire form, forwarded verbatim
+	via         string // peer we first heard of the member from
+}
+
+// Peer exchange: every node floods its own signed record and forwards the
+// newest record it has seen for every other member of a network it
+// discovers. Records only ever cause a dial when the member is on the
+// allow list.
+var gossip struct {
+	sync.Mutex
+	cert      tls.Certificate
+	self      string
+	advertise []string
+	discover  map[string]bool // networks whose members we dial
+	allow     map[string]bool
+	allowAny  bool
+	members   map[string]*memberRecord // fingerprint → newest record
+	dialing   map[string]bool
+}
+
+func init() {
+	gossip.members = make(map[string]*memberRecord)
+	gossip.dialing = make(map[string]bool)
+}
+
+// EnableGossip turns on peer exchange with the given policy.
+func (r *Registry) EnableGossip(d config.Discovery) error {
+	cert, err := crypto.LoadKeyPair(r.identity.Cert, r.identity.Key)
+	if err != nil {
+		return fmt.Errorf("load identity for gossip: %w", err)
+	}
+
+	networks := d.Networks
+	if len(networks) == 0 {
+		for name := range r.netcfg {
+			networks = append(networks, name)
+		}
+	}
+
+	gossip.Lock()
+	gossip.cert = cert
+	gossip.self = crypto.Fingerprint(cert.Certificate[0])
+	gossip.advertise = d.Advertise
+	gossip.discover = make(map[string]bool, len(networks))
+	for _, n := range networks {
+		gossip.discover[n] = true
+	}
+	gossip.allow = make(map[string]bool, len(d.Allow))
+	for _, fp := range d.Allow {
+		if fp == "*" {
+			gossip.allowAny = true
+			continue
+		}
+		gossip.allow[fp] = true
+	}
+	gossip.Unlock()
+
+	control.EnableCapability(control.CapGossip)
+	go r.gossipLoop()
+	return nil
+}
+
+func (r *Registry) gossipLoop() {
+	ticker := time.NewTicker(gossipInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		r.expireMembers(time.Now())
+
+		record, err := r.localRecord()
+		if err != nil {
+			log.New("peer/gossip").Warnf("Failed to build own member record: %v", err)
+			continue
+		}
+		r.floodGossip(record)
+	}
+}
+
+// localRecord signs a fresh record describing this node.
+func (r *Registry) localRecord() ([]byte, error) {
+	localNode.RLock()
+	name := localNode.name
+	localNode.RUnlock()
+
+	networks := make([]string, 0, len(r.netcfg))
+	for n := range r.netcfg {
+		networks = append(networks, n)
+	}
+	sort.Strings(networks)
+
+	gossip.Lock()
+	cert := gossip.cert
+	addrs := slices.Clone(gossip.advertise)
+	gossip.Unlock()
+
+	// Reflexive addresses reported by directly connected peers are often
+	// dialable too, and give the rendezvous something to start from
+	r.mu.RLock()
+	for _, e := range r.peers {
+		if e.observedAs != "" && !slices.Contains(addrs, e.observedAs) {
+			addrs = append(addrs, e.observedAs)
+		}
+	}
+	r.mu.RUnlock()
+
+	return encodeMemberRecord(cert, name, networks, addrs, time.Now())
+}
+
+// sendGossip tells a newly connected peer about ourselves and every member
+// we know.
+func (r *Registry) sendGossip(peerID string, stream quic.Stream) {
+	logger := log.New("peer/gossip")
+
+	record, err := r.localRecord()
+	if err != nil {
+		logger.Warnf("Failed to build own member record: %v", err)
+		return
+	}
+	records := [][]byte{record}
+
+	gossip.Lock()
+	for fp, m := range gossip.members {
+		if fp != peerID {
+			records = append(records, m.raw)
+		}
+	}
+	gossip.Unlock()
+
+	for _, rec := range records {
+		if err := control.SendGossip(stream, rec); err != nil {
+			logger.Warnf("Failed to send gossip to %s: %v", peerID, err)
+			return
+		}
+	}
+}
+
+// floodGossip sends record to every gossip-capable peer except those in skip.
+func (r *Registry) floodGossip(record []byte, skip ...string) {
+	r.mu.RLock()
+	streams := make(map[string]quic.Stream)
+	for id, e := range r.peers {
+		if e.control != nil && e.caps&control.CapGossip != 0 && !slices.Contains(skip, id) {
+			streams[id] = e.control
+		}
+	}
+	r.mu.RUnlock()
+
+	for id, stream := range streams {
+		if err := control.SendGossip(stream, record); err != nil {
+			log.New("peer/gossip").Warnf("Failed to send gossip to %s: %v", id, err)
+		}
+	}
+}
+
+func (r *Registry) handleGossip(body []byte, peerID string) {
+	logger := log.New("peer/gossip")
+
+	if !r.hasCapability(peerID, control.CapGossip) {
+		return
+	}
+	m, err := decodeMemberRecord(body)
+	if err != nil {
+		logger.Warnf("Invalid gossip record from %s: %v", peerID, err)
+		return
+	}
+
+	now := time.Now()
+	if m.issued.After(now.Add(gossipMaxSkew)) || now.Sub(m.issued) > gossipRecordTTL {
+		logger.Debugf("Ignoring stale gossip record for %s from %s", m.fingerprint, peerID)
+		return
+	}
+	if crypto.RevokedFingerprint(m.fingerprint) {
+		logger.Debugf("Ignoring gossip record for revoked member %s from %s", m.fingerprint, peerID)
+		return
+	}
+
+	gossip.Lock()
+	if m.fingerprint == gossip.self {
+		gossip.Unlock()
+		return
+	}
+	old := gossip.members[m.fingerprint]
+	if old != nil && !m.issued.After(old.issued) {
+		gossip.Unlock()
+		return
+	}
+	if !discoversAny(m) {
+		delete(gossip.members, m.fingerprint)
+		gossip.Unlock()
+		logger.Debugf("Ignoring gossip record for %s from %s: no network we discover", m.fingerprint, peerID)
+		return
+	}
+	known := old != nil
+	if known {
+		m.via = old.via
+	} else if reason := recordLimit(peerID); reason != "" {
+		gossip.Unlock()
+		logger.Debugf("Ignoring gossip record for %s from %s: %s", m.fingerprint, peerID, reason)
+		return
+	} else {
+		m.via = peerID
+	}
+	gossip.members[m.fingerprint] = m
+	gossip.Unlock()
+
+	if !known {
+		logger.Infof("Discovered member %s (%s) via %s: networks %v, addresses %v",
+			m.name, m.fingerprint, peerID, m.networks, m.addresses)
+	}
+	r.noteMember(m)
+	r.floodGossip(m.raw, peerID, m.fingerprint)
+	r.maybeDialMember(m)
+}
+
+// noteMember makes a discovered member visible in the peer table. A record
+// is only signed by the member itself, so the networks it claims are
+// narrowed to those we export and discover, and only taken for members we
+// would dial; a connected peer keeps the membership it connected with.
+// Members we would not dial get no entry of their own.
+func (r *Registry) noteMember(m *memberRecord) {
+	gossip.Lock()
+	allowed := dialAllowed(m)
+	var members []string
+	if allowed {
+		for _, n := range m.networks {
+			if gossip.discover[n] && r.netcfg[n].Export {
+				members = append(members, n)
+			}
+		}
+	}
+	gossip.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e := r.peers[m.fingerprint]
+	if e == nil {
+		if !allowed {
+			return
+		}
+		e = &peerEntry{id: m.fingerprint}
+		r.peers[m.fingerprint] = e
+	}
+	if e.configured {
+		return
+	}
+	e.discovered = true
+	e.name = m.name
+	e.addresses = m.addresses
+	if e.conn == nil {
+		e.members = members
+	}
+}
+
+func (r *Registry) maybeDialMember(m *memberRecord) {
+	r.mu.RLock()
+	e := r.peers[m.fingerprint]
+	configured := e != nil && e.configured
+	r.mu.RUnlock()
+	if configured {
+		return // ConnectToPeers already maintains it
+	}
+
+	gossip.Lock()
+	if !dialAllowed(m) || gossip.dialing[m.fingerprint] {
+		gossip.Unlock()
+		return
+	}
+	gossip.dialing[m.fingerprint] = true
+	gossip.Unlock()
+
+	tlsConf, err := crypto.LoadPeerTLSPinned(m.fingerprint, r.identity.Cert, r.identity.Key)
+	if err != nil {
+		log.New("peer/gossip").Errorf("Failed to create TLS config for %s: %v", m.name, err)
+		gossip.Lock()
+		delete(gossip.dialing, m.fingerprint)
+		gossip.Unlock()
+		return
+	}
+
+	go func() {
+		defer func() {
+			gossip.Lock()
+			delete(gossip.dialing, m.fingerprint)
+			gossip.Unlock()
+		}()
+		r.maintainPeer(config.Peer{Name: m.name, Fingerprint: m.fingerprint}, tlsConf, true)
+	}()
+}
+
+// dialAllowed applies the discovery policy. Caller must hold the gossip lock.
+func dialAllowed(m *memberRecord) bool {
+	if !gossip.allowAny && !gossip.allow[m.fingerprint] {
+		return false
+	}
+	return discoversAny(m)
+}
+
+// discoversAny reports whether m names a network we discover. Caller must
+// hold the gossip lock.
+func discoversAny(m *memberRecord) bool {
+	return slices.ContainsFunc(m.networks, func(n string) bool { return gossip.discover[n] })
+}
+
+// recordLimit returns why a new record first heard from via cannot be
+// kept, or "". Caller must hold the gossip lock.
+func recordLimit(via string) string {
+	if len(gossip.members) >= gossipMaxMembers {
+		return fmt.Sprintf("already %d members", gossipMaxMembers)
+	}
+	n := 0
+	for _, m := range gossip.members {
+		if m.via == via {
+			n++
+		}
+	}
+	if n >= gossipMaxPerSource {
+		return fmt.Sprintf("already %d members from this peer", gossipMaxPerSource)
+	}
+	return ""
+}
+
+// discoveredPeer returns how to dial a discovered member right now, or
+// false once it should no longer be dialed.
+func (r *Registry) discoveredPeer(fingerprint string) (config.Peer, bool) {
+	gossip.Lock()
+	defer gossip.Unlock()
+
+	m := gossip.members[fingerprint]
+	if m == nil || !dialAllowed(m) {
+		return config.Peer{}, false
+	}
+	return config.Peer{Name: m.name, Addresses: m.addresses, Fingerprint: fingerprint, Networks: m.networks}, true
+}
+
+// expireMembers forgets members whose record was not refreshed in time.
+func (r *Registry) expireMembers(now time.Time) {
+	var expired []string
+	gossip.Lock()
+	for fp, m := range gossip.members {
+		if now.Sub(m.issued) > gossipRecordTTL {
+			delete(gossip.members, fp)
+			expired = append(expired, fp)
+		}
+	}
+	gossip.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, fp := range expired {
+		r.logger.Infof("Member %s expired from gossip", fp)
+		if e := r.peers[fp]; e != nil && e.discovered {
+			e.discovered = false
+			if e.conn == nil && !e.configured && !e.disabled {
+				delete(r.peers, fp)
+			}
+		}
+	}
+}
+
+// encodeMemberRecord builds the wire form of a member record:
+//
+//	version(1) issued(8, unix seconds) name networks addresses
+//	certLen(2) cert sigLen(2) sig
+//
+// where strings are 1-byte length-prefixed and lists are a 1-byte count of
+// strings. The signature covers everything before certLen.
+func encodeMemberRecord(cert tls.Certificate, name string, networks, addresses []string, issued time.Time) ([]byte, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("no certificate")
+	}
+
+	buf := []byte{gossipVersion}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(issued.Unix()))
+	var err error
+	if buf, err = appendString(buf, name); err != nil {
+		return nil, err
+	}
+	if buf, err = appendList(buf, networks); err != nil {
+		return nil, err
+	}
+	if buf, err = appendList(buf, addresses); err != nil {
+		return nil, err
+	}
+
+	sig, err := crypto.SignWithCertificate(cert, append(slices.Clone(gossipContext), buf...))
+	if err != nil {
+		return nil, fmt.Errorf("sign member record: %w", err)
+	}
+
+	der := cert.Certificate[0]
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(der)))
+	buf = append(buf, der...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(sig)))
+	buf = append(buf, sig...)
+	if len(buf) > gossipMaxRecord {
+		return nil, fmt.Errorf("member record too large: %d bytes", len(buf))
+	}
+	return buf, nil
+}
+
+// decodeMemberRecord parses and verifies a member record. The member's
+// fingerprint is taken from the embedded certificate that signed it.
+func decodeMemberRecord(b []byte) (*memberRecord, error) {
+	if len(b) < 9 {
+		return nil, errors.New("record too short")
+	}
+	if b[0] != gossipVersion {
+		return nil, fmt.Errorf("unsupported record version %d", b[0])
+	}
+	m := &memberRecord{issued: time.Unix(int64(binary.BigEndian.Uint64(b[1:9])), 0)}
+
+	var ok bool
+	rest := b[9:]
+	if m.name, rest, ok = readString(rest); !ok {
+		return nil, errors.New("invalid name")
+	}
+	if m.networks, rest, ok = readList(rest); !ok {
+		return nil, errors.New("invalid networks")
+	}
+	if m.addresses, rest, ok = readList(rest); !ok {
+		return nil, errors.New("invalid addresses")
+	}
+	signed := b[:len(b)-len(rest)]
+
+	der, rest, ok := readBlob(rest)
+	if !ok {
+		return nil, errors.New("invalid certificate")
+	}
+	sig, rest, ok := readBlob(rest)
+	if !ok || len(rest) != 0 {
+		return nil, errors.New("invalid signature")
+	}
+
+	if err := crypto.VerifyCertificateSignature(der, append(slices.Clone(gossipContext), signed...), sig); err != nil {
+		return nil, fmt.Errorf("bad signature: %w", err)
+	}
+	m.fingerprint = crypto.Fingerprint(der)
+	m.raw = slices.Clone(b)
+	return m, nil
+}
+
+// appendString appends a 1-byte length-prefixed string.
+func appendString(buf []byte, s string) ([]byte, error) {
+	if len(s) > 255 {
+		return nil, fmt.Errorf("string too long: %d bytes", len(s))
+	}
+	buf = append(buf, byte(len(s)))
+	return append(buf, s...), nil
+}
+
+func appendList(buf []byte, list []string) ([]byte, error) {
+	if len(list) > 255 {
+		return nil, fmt.Errorf("list too long: %d entries", len(list))
+	}
+	buf = append(buf, byte(len(list)))
+	var err error
+	for _, s := range list {
+		if buf, err = appendString(buf, s); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func readList(b []byte) ([]string, []byte, bool) {
+	if len(b) < 1 {
+		return nil, nil, false
+	}
+	n := int(b[0])
+	b = b[1:]
+	list := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		var s string
+		var ok bool
+		if s, b, ok = readString(b); !ok {
+			return nil, nil, false
+		}
+		list = append(list, s)
+	}
+	return list, b, true
+}
+
+// readBlob reads a 2-byte length-prefixed byte slice.
+func readBlob(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, false
+	}
+	return b[2 : 2+n], b[2+n:], true
+}
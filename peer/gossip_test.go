@@ -0,0 +1,250 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+
+	"vibepn/config"
+	"vibepn/control"
+	"vibepn/crypto"
+)
+
+func testCertificate(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestMemberRecordRoundTrip(t *testing.T) {
+	cert := testCertificate(t, "node-a")
+	issued := time.Unix(1700000000, 0)
+
+	raw, err := encodeMemberRecord(cert, "node-a", []string{"corp"}, []string{"198.51.100.7:51820"}, issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := decodeMemberRecord(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.fingerprint != crypto.Fingerprint(cert.Certificate[0]) {
+		t.Fatalf("fingerprint %s does not match signing certificate", m.fingerprint)
+	}
+	if m.name != "node-a" || !m.issued.Equal(issued) ||
+		!slices.Equal(m.networks, []string{"corp"}) ||
+		!slices.Equal(m.addresses, []string{"198.51.100.7:51820"}) {
+		t.Fatalf("unexpected record %+v", m)
+	}
+}
+
+func TestMemberRecordRejectsTampering(t *testing.T) {
+	cert := testCertificate(t, "node-a")
+	raw, err := encodeMemberRecord(cert, "node-a", []string{"corp"}, []string{"198.51.100.7:51820"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Redirect the advertised address to somewhere else.
+	tampered := slices.Clone(raw)
+	tampered[bytes.Index(tampered, []byte("198.51"))] = '2'
+	if _, err := decodeMemberRecord(tampered); err == nil {
+		t.Fatal("expected tampered address to be rejected")
+	}
+
+	// Claim the record with someone else's certificate.
+	other := testCertificate(t, "node-b")
+	otherRaw, err := encodeMemberRecord(other, "node-b", nil, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapped := append(slices.Clone(raw[:signedLen(t, raw)]), otherRaw[signedLen(t, otherRaw):]...)
+	if _, err := decodeMemberRecord(swapped); err == nil {
+		t.Fatal("expected record signed by another certificate to be rejected")
+	}
+}
+
+// signedLen returns the length of the signed prefix of a record.
+func signedLen(t *testing.T, raw []byte) int {
+	t.Helper()
+	rest := raw[9:]
+	var ok bool
+	if _, rest, ok = readString(rest); !ok {
+		t.Fatal("bad name")
+	}
+	if _, rest, ok = readList(rest); !ok {
+		t.Fatal("bad networks")
+	}
+	if _, rest, ok = readList(rest); !ok {
+		t.Fatal("bad addresses")
+	}
+	return len(raw) - len(rest)
+}
+
+func TestDialAllowed(t *testing.T) {
+	gossip.Lock()
+	defer gossip.Unlock()
+	saved := gossip.allow
+	savedAny, savedDiscover := gossip.allowAny, gossip.discover
+	defer func() { gossip.allow, gossip.allowAny, gossip.discover = saved, savedAny, savedDiscover }()
+
+	gossip.discover = map[string]bool{"corp": true}
+	gossip.allow = map[string]bool{"aa": true}
+	gossip.allowAny = false
+
+	cases := []struct {
+		m    memberRecord
+		want bool
+	}{
+		{memberRecord{fingerprint: "aa", networks: []string{"corp"}}, true},
+		{memberRecord{fingerprint: "bb", networks: []string{"corp"}}, false},
+		{memberRecord{fingerprint: "aa", networks: []string{"lab"}}, false},
+	}
+	for _, c := range cases {
+		if got := dialAllowed(&c.m); got != c.want {
+			t.Errorf("dialAllowed(%s, %v) = %v, want %v", c.m.fingerprint, c.m.networks, got, c.want)
+		}
+	}
+
+	gossip.allowAny = true
+	if !dialAllowed(&memberRecord{fingerprint: "bb", networks: []string{"corp"}}) {
+		t.Error("allow = [\"*\"] should admit any member of a discovered network")
+	}
+}
+
+func TestGossipCannotClaimNetworks(t *testing.T) {
+	gossip.Lock()
+	saved, savedAny, savedDiscover := gossip.allow, gossip.allowAny, gossip.discover
+	gossip.discover = map[string]bool{"corp": true, "local": true}
+	gossip.allow = map[string]bool{"fp-allowed": true}
+	gossip.allowAny = false
+	gossip.Unlock()
+	t.Cleanup(func() {
+		gossip.Lock()
+		gossip.allow, gossip.allowAny, gossip.discover = saved, savedAny, savedDiscover
+		gossip.Unlock()
+	})
+
+	netcfg := map[string]config.NetworkConfig{
+		"corp":  {Prefix: "10.42.0.0/24", Export: true},
+		"lab":   {Prefix: "10.43.0.0/24", Export: true},
+		"local": {Prefix: "10.99.0.0/24"},
+	}
+	r := NewRegistry(config.Identity{}, nil, netcfg)
+	claim := []string{"corp", "lab", "local"}
+
+	r.noteMember(&memberRecord{fingerprint: "fp-allowed", networks: claim})
+	if r.authorizedFor("fp-allowed", "local") {
+		t.Error("gossiped claim authorized a network we do not export")
+	}
+	if !r.authorizedFor("fp-allowed", "corp") || r.authorizedFor("fp-allowed", "lab") {
+		t.Error("allowed member not narrowed to the exported networks we discover")
+	}
+
+	r.noteMember(&memberRecord{fingerprint: "fp-stranger", networks: claim})
+	if r.authorizedFor("fp-stranger", "local") {
+		t.Error("member off the allow list authorized a network we do not export")
+	}
+
+	r.peers["fp-allowed"].conn = fakeConn{}
+	r.noteMember(&memberRecord{fingerprint: "fp-allowed", networks: []string{"lab"}})
+	if !r.authorizedFor("fp-allowed", "corp") {
+		t.Error("gossip changed the membership of a connected peer")
+	}
+}
+
+func TestGossipRecordLimits(t *testing.T) {
+	gossip.Lock()
+	saved, savedAny, savedDiscover := gossip.allow, gossip.allowAny, gossip.discover
+	gossip.discover = map[string]bool{"corp": true}
+	gossip.allow = map[string]bool{}
+	gossip.allowAny = false
+	gossip.Unlock()
+	t.Cleanup(func() {
+		gossip.Lock()
+		gossip.allow, gossip.allowAny, gossip.discover = saved, savedAny, savedDiscover
+		gossip.members = make(map[string]*memberRecord)
+		gossip.Unlock()
+	})
+
+	r := NewRegistry(config.Identity{}, nil, map[string]config.NetworkConfig{"corp": {Prefix: "10.42.0.0/24", Export: true}})
+	r.peers["fp-src"] = &peerEntry{id: "fp-src", caps: control.CapGossip}
+	r.peers["fp-other"] = &peerEntry{id: "fp-other", caps: control.CapGossip}
+	record := func(networks ...string) ([]byte, string) {
+		t.Helper()
+		cert := testCertificate(t, "member")
+		raw, err := encodeMemberRecord(cert, "member", networks, nil, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw, crypto.Fingerprint(cert.Certificate[0])
+	}
+	kept := func(fp string) bool {
+		gossip.Lock()
+		defer gossip.Unlock()
+		return gossip.members[fp] != nil
+	}
+
+	raw, fp := record("lab")
+	r.handleGossip(raw, "fp-src")
+	if kept(fp) {
+		t.Fatal("kept a record for a network we do not discover")
+	}
+
+	raw, fp = record("corp")
+	r.handleGossip(raw, "fp-src")
+	if !kept(fp) {
+		t.Fatal("record for a network we discover not kept")
+	}
+	if r.peers[fp] != nil {
+		t.Fatal("registry entry made for a member we will not dial")
+	}
+
+	for range gossipMaxPerSource - 1 {
+		raw, _ := record("corp")
+		r.handleGossip(raw, "fp-src")
+	}
+	raw, fp = record("corp")
+	r.handleGossip(raw, "fp-src")
+	if kept(fp) {
+		t.Fatalf("kept more than %d records from one peer", gossipMaxPerSource)
+	}
+	r.handleGossip(raw, "fp-other")
+	if !kept(fp) {
+		t.Fatal("one peer's records limited another's")
+	}
+
+	gossip.Lock()
+	for i := len(gossip.members); i < gossipMaxMembers; i++ {
+		gossip.members[fmt.Sprintf("fp-filler-%d", i)] = &memberRecord{via: "fp-filler"}
+	}
+	gossip.Unlock()
+	raw, fp = record("corp")
+	r.handleGossip(raw, "fp-other")
+	if kept(fp) {
+		t.Fatalf("kept more than %d records in total", gossipMaxMembers)
+	}
+}
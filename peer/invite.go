@@ -0,0 +1,250 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"vibepn/config"
+	"vibepn/control"
+	"vibepn/crypto"
+	"vibepn/log"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Invites: the joiner dials the inviter with the key pinned in the invite
+// and redeems the signed token with a Join message. The inviter checks the
+// token once, pins the joiner's key and adds it to its joined peers, so
+// nobody has to run add-peer by hand.
+
+// joinMu serializes joins, which rewrite the joined peers file.
+var joinMu sync.Mutex
+
+func (r *Registry) handleJoin(body []byte, peerID string, conn quic.Connection, stream quic.Stream) {
+	logger := log.New("peer/invite")
+
+	reply := func(err error) {
+		msg := "welcome"
+		if err != nil {
+			msg = err.Error()
+			logger.Warnf("Rejected join from %s (%s): %v", peerID, conn.RemoteAddr(), err)
+		}
+		if len(msg) > 255 {
+			msg = msg[:255]
+		}
+		if sendErr := control.SendJoinReply(stream, err == nil, msg); sendErr != nil {
+			logger.Warnf("Failed to send join reply to %s: %v", peerID, sendErr)
+		}
+	}
+
+	tokenRaw, name, advertise, ok := parseJoin(body)
+	if !ok {
+		reply(errors.New("malformed join request"))
+		return
+	}
+	tok, err := crypto.ParseInviteToken(tokenRaw)
+	if err != nil {
+		reply(err)
+		return
+	}
+
+	joinMu.Lock()
+	defer joinMu.Unlock()
+
+	p, err := r.admit(tok, name, advertise, peerID, conn)
+	reply(err)
+	if err != nil {
+		return
+	}
+
+	logger.Infof("Peer %s (%s) joined network %s with an invite", name, peerID, tok.Network)
+	control.PublishEvent("peer_joined", map[string]interface{}{
+		"peer":    peerID,
+		"name":    name,
+		"network": tok.Network,
+	})
+
+	// 📞 Keep the new peer connected once it hangs up, if it can be dialed
+	if advertise != "" {
+		tlsConf, err := crypto.LoadPeerTLSWithTOFU(name, advertise, r.identity.Cert, r.identity.Key)
+		if err != nil {
+			logger.Warnf("Failed to create TLS config for %s: %v", name, err)
+			return
+		}
+		go r.maintainPeer(p, tlsConf, false)
+	}
+}
+
+// admit redeems tok for the peer on conn and adds it as a configured peer.
+// Caller must hold joinMu.
+func (r *Registry) admit(tok *crypto.InviteToken, name, advertise, peerID string, conn quic.Connection) (config.Peer, error) {
+	p := config.Peer{Name: name, Address: advertise, Fingerprint: peerID, Networks: []string{tok.Network}}
+
+	netCfg, ok := control.GetNetConfig()[tok.Network]
+	if !ok || !netCfg.Export {
+		return p, fmt.Errorf("network %q is not exported here", tok.Network)
+	}
+	certs := conn.ConnectionState().TLS.PeerCertificates
+	if len(certs) == 0 || certs[0].Subject.CommonName != name {
+		return p, fmt.Errorf("certificate is not issued to %q", name)
+	}
+
+	cfg, err := config.Load(control.GetConfigPath())
+	if err != nil {
+		return p, fmt.Errorf("inviter cannot load its config: %w", err)
+	}
+	joinedPath := cfg.JoinedPeersPath()
+	joined, err := config.LoadJoinedPeers(joinedPath)
+	if err != nil {
+		return p, fmt.Errorf("inviter cannot load its joined peers: %w", err)
+	}
+	for _, existing := range slices.Concat(cfg.Peers, joined) {
+		if existing.Name == name && existing.Fingerprint != peerID {
+			return p, fmt.Errorf("a peer named %q already exists", name)
+		}
+	}
+
+	// ✅ Checks that do not burn the token are done, redeem it
+	if err := crypto.RedeemInvite(tok, name, peerID, time.Now()); err != nil {
+		return p, err
+	}
+	// ↩️ Give the token back if the joiner cannot be admitted after all
+	release := func(err error) (config.Peer, error) {
+		if relErr := crypto.ReleaseInvite(tok); relErr != nil {
+			log.New("peer/invite").Warnf("Failed to release invite of %s: %v", name, relErr)
+		}
+		return p, err
+	}
+
+	if err := crypto.PinPeer(name, peerID, advertise); err != nil {
+		return release(fmt.Errorf("pin peer: %w", err))
+	}
+	joined = slices.DeleteFunc(joined, func(j config.Peer) bool { return j.Fingerprint == peerID })
+	if err := config.SaveJoinedPeers(joinedPath, append(joined, p)); err != nil {
+		return release(fmt.Errorf("inviter cannot record the new peer: %w", err))
+	}
+
+	r.mu.Lock()
+	if e := r.peers[peerID]; e != nil {
+		e.name = name
+		e.addresses = p.Candidates()
+		e.members = p.Networks
+		e.configured = true
+	}
+	r.mu.Unlock()
+	return p, nil
+}
+
+// parseJoin decodes token (2-byte length) | name | advertise.
+func parseJoin(body []byte) ([]byte, string, string, bool) {
+	if len(body) < 2 {
+		return nil, "", "", false
+	}
+	n := int(binary.BigEndian.Uint16(body[:2]))
+	if len(body) < 2+n {
+		return nil, "", "", false
+	}
+	token, rest := body[2:2+n], body[2+n:]
+
+	name, rest, ok := readString(rest)
+	if !ok || name == "" {
+		return nil, "", "", false
+	}
+	advertise, _, ok := readString(rest)
+	if !ok {
+		return nil, "", "", false
+	}
+	return token, name, advertise, true
+}
+
+// Join redeems an invite at the inviter: it dials the inviter with the key
+// that signed the token pinned, presents the token and waits for the
+// verdict. certPath/keyPath is the joiner's identity.
+func Join(tok *crypto.InviteToken, name, advertise, certPath, keyPath string, timeout time.Duration) error {
+	tlsConf, err := crypto.LoadPeerTLSPinned(tok.SignerFingerprint, certPath, keyPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, tok.Address, tlsConf, QUICConfig())
+	if err != nil {
+		return fmt.Errorf("dial inviter %s: %w", tok.Address, err)
+	}
+	defer conn.CloseWithError(0, "join finished")
+
+	// 🔏 Compact invites leave out the inviter certificate; the pinned
+	// handshake just proved which one it is
+	if len(tok.Signer) == 0 {
+		tok.Signer = conn.ConnectionState().TLS.PeerCertificates[0].Raw
+	}
+	if err := tok.Verify(time.Now()); err != nil {
+		return err
+	}
+	raw, err := tok.Marshal()
+	if err != nil {
+		return err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("open control stream: %w", err)
+	}
+	nonce, err := generateNonce()
+	if err != nil {
+		return err
+	}
+	if err := control.SendHello(stream, nonce); err != nil {
+		return err
+	}
+	if err := control.SendJoin(stream, raw, name, advertise); err != nil {
+		return err
+	}
+
+	// ⏳ The inviter says Hello and announces routes first; wait for the verdict
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetReadDeadline(deadline)
+	}
+	for {
+		msgType, body, err := readMessage(stream)
+		if err != nil {
+			return fmt.Errorf("waiting for join reply: %w", err)
+		}
+		if msgType != 'j' {
+			continue
+		}
+		if len(body) < 1 {
+			return errors.New("malformed join reply")
+		}
+		msg, _, _ := readString(body[1:])
+		if body[0] != 1 {
+			return fmt.Errorf("inviter refused: %s", msg)
+		}
+		return nil
+	}
+}
+
+// readMessage reads one length-prefixed control message.
+func readMessage(stream io.Reader) (byte, []byte, error) {
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(stream, lenBuf); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint16(lenBuf)
+	if length == 0 {
+		return 0, nil, errors.New("invalid control message length")
+	}
+	msgBuf := make([]byte, length)
+	if _, err := io.ReadFull(stream, msgBuf); err != nil {
+		return 0, nil, err
+	}
+	return msgBuf[0], msgBuf[1:], nil
+}
@@ -0,0 +1,409 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"vibepn/control"
+	"vibepn/ipam"
+	"vibepn/log"
+	"vibepn/metrics"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Leased addresses: on networks with address = "lease", the node asks the
+// configured coordinator for an address once connected to it, renews
+// halfway through the lease and drops the address if the lease runs out.
+// The coordinator hands out host addresses of the network's prefix,
+// skipping its own and any announced by other peers, and keeps the leases
+// on disk.
+
+const (
+	leaseSweepInterval = time.Minute      // how often the coordinator looks for expired leases
+	leaseRetry         = 30 * time.Second // how often a member without a lease asks again
+)
+
+var leases struct {
+	sync.Mutex
+	pools map[string]*ipam.Pool // networks we coordinate
+	held  map[string]*heldLease // networks we lease our address on
+}
+
+type heldLease struct {
+	expires time.Time
+	timer   *time.Timer
+}
+
+func init() {
+	leases.pools = make(map[string]*ipam.Pool)
+	leases.held = make(map[string]*heldLease)
+}
+
+// ServeLeases makes this node the coordinator of every network with a
+// leases table.
+func (r *Registry) ServeLeases() error {
+	pools := make(map[string]*ipam.Pool)
+	for network, netCfg := range r.netcfg {
+		if netCfg.Leases == nil {
+			continue
+		}
+		d, err := netCfg.Leases.LeaseDuration()
+		if err != nil {
+			return fmt.Errorf("network %s: %w", network, err)
+		}
+		pool, err := ipam.NewPool(netCfg.Prefix, netCfg.Leases.Reserved, d, netCfg.Leases.Path(network))
+		if err != nil {
+			return fmt.Errorf("load leases for %s: %w", network, err)
+		}
+		pools[network] = pool
+		r.logger.Infof("Leasing addresses on %s from %s", network, netCfg.Prefix)
+	}
+	if len(pools) == 0 {
+		return nil
+	}
+
+	leases.Lock()
+	leases.pools = pools
+	leases.Unlock()
+	for network, pool := range pools {
+		countLeases(network, pool)
+	}
+
+	control.EnableCapability(control.CapLease)
+	go r.leaseLoop()
+	return nil
+}
+
+func (r *Registry) leaseLoop() {
+	ticker := time.NewTicker(leaseSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		r.expireLeases(time.Now())
+	}
+}
+
+// expireLeases reports the leases that ran out since the last sweep.
+func (r *Registry) expireLeases(now time.Time) {
+	leases.Lock()
+	pools := make(map[string]*ipam.Pool, len(leases.pools))
+	for network, pool := range leases.pools {
+		pools[network] = pool
+	}
+	leases.Unlock()
+
+	for network, pool := range pools {
+		for _, l := range pool.Expired(now) {
+			r.logger.Infof("Lease of %s on %s to %s expired", l.Address, network, l.Fingerprint)
+			control.PublishEvent("lease_expired", map[string]interface{}{
+				"network": network,
+				"address": l.Address.String(),
+				"peer":    l.Fingerprint,
+			})
+		}
+		countLeases(network, pool)
+	}
+}
+
+func countLeases(network string, pool *ipam.Pool) {
+	now := time.Now()
+	active := 0
+	for _, l := range pool.Leases() {
+		if l.Active(now) {
+			active++
+		}
+	}
+	metrics.LeasesActive.WithLabelValues(network).Set(float64(active))
+}
+
+func leasePool(network string) *ipam.Pool {
+	leases.Lock()
+	defer leases.Unlock()
+	return leases.pools[network]
+}
+
+// addressInUse reports, for the coordinator, the addresses on network it
+// must not lease to peerID: its own and those announced by other peers.
+func (r *Registry) addressInUse(network, peerID string) func(netip.Addr) bool {
+	var used []net.IP
+	if ip := localAddress(network); ip != nil {
+		used = append(used, ip)
+	}
+	r.mu.RLock()
+	for id, e := range r.peers {
+		if ip := e.announced[network]; ip != nil && id != peerID && e.conn != nil {
+			used = append(used, ip)
+		}
+	}
+	r.mu.RUnlock()
+
+	return func(a netip.Addr) bool {
+		return slices.ContainsFunc(used, net.IP(a.AsSlice()).Equal)
+	}
+}
+
+func (r *Registry) handleLeaseRequest(body []byte, peerID string, stream quic.Stream) {
+	logger := log.New("peer/lease")
+
+	network, rest, ok := readString(body)
+	if !ok || len(rest) != net.IPv4len {
+		logger.Warnf("Invalid lease request from %s", peerID)
+		return
+	}
+	pool := leasePool(network)
+	if pool == nil || !r.authorizedFor(peerID, network) {
+		logger.Warnf("Refusing lease on %s to %s: not coordinating it for this peer", network, peerID)
+		r.refuseLease(stream, network)
+		return
+	}
+
+	want, _ := netip.AddrFromSlice(rest)
+	if want.IsUnspecified() {
+		want = netip.Addr{}
+	}
+	r.mu.RLock()
+	name := ""
+	if e := r.peers[peerID]; e != nil {
+		name = e.name
+	}
+	r.mu.RUnlock()
+
+	lease, err := pool.Acquire(peerID, name, want, r.addressInUse(network, peerID), time.Now())
+	if errors.Is(err, ipam.ErrExhausted) {
+		logger.Warnf("No address left on %s for %s", network, peerID)
+		r.refuseLease(stream, network)
+		return
+	}
+	if err != nil {
+		logger.Warnf("Leased %s on %s to %s, but could not save it: %v", lease.Address, network, peerID, err)
+	}
+	countLeases(network, pool)
+
+	if lease.Address == want {
+		logger.Debugf("Renewed %s on %s for %s until %s", lease.Address, network, peerID, lease.Expires.Format(time.RFC3339))
+	} else {
+		logger.Infof("Leased %s on %s to %s until %s", lease.Address, network, peerID, lease.Expires.Format(time.RFC3339))
+		control.PublishEvent("lease_granted", map[string]interface{}{
+			"network": network,
+			"address": lease.Address.String(),
+			"peer":    peerID,
+		})
+	}
+	if err := control.SendLease(stream, network, net.IP(lease.Address.AsSlice()), pool.Duration()); err != nil {
+		logger.Warnf("Failed to send lease on %s to %s: %v", network, peerID, err)
+	}
+}
+
+func (r *Registry) refuseLease(stream quic.Stream, network string) {
+	if err := control.SendLease(stream, network, nil, 0); err != nil {
+		log.New("peer/lease").Warnf("Failed to refuse lease on %s: %v", network, err)
+	}
+}
+
+// leaseCoordinator reports whether peerID is the coordinator we lease our
+// address on network from.
+func (r *Registry) leaseCoordinator(peerID, network string) bool {
+	r.mu.RLock()
+	coordinator := r.coordinatorLocked(network)
+	r.mu.RUnlock()
+	return coordinator != "" && coordinator == peerID &&
+		r.hasCapability(peerID, control.CapLease) && r.authorizedFor(peerID, network)
+}
+
+// coordinatorLocked returns the fingerprint of the peer we lease our
+// address on network from, or "". Only configured and joined peers count:
+// a certificate name must not make a peer our coordinator.
+func (r *Registry) coordinatorLocked(network string) string {
+	netCfg := r.netcfg[network]
+	if netCfg.Address != "lease" || netCfg.Coordinator == "" {
+		return ""
+	}
+	if e := r.peers[netCfg.Coordinator]; e != nil && e.configured {
+		return netCfg.Coordinator
+	}
+	for id, e := range r.peers {
+		if e.hasName(netCfg.Coordinator) {
+			return id
+		}
+	}
+	return ""
+}
+
+// requestLeases asks peerID for our address on every network it
+// coordinates for us.
+func (r *Registry) requestLeases(peerID string, stream quic.Stream) {
+	r.mu.RLock()
+	networks := make([]string, 0, len(r.netcfg))
+	for network := range r.netcfg {
+		networks = append(networks, network)
+	}
+	r.mu.RUnlock()
+
+	for _, network := range networks {
+		if r.leaseCoordinator(peerID, network) {
+			r.requestLease(stream, network)
+		}
+	}
+}
+
+func (r *Registry) requestLease(stream quic.Stream, network string) {
+	if err := control.SendLeaseRequest(stream, network, localAddress(network)); err != nil {
+		log.New("peer/lease").Warnf("Failed to request a lease on %s: %v", network, err)
+	}
+}
+
+func (r *Registry) handleLease(body []byte, peerID string) {
+	logger := log.New("peer/lease")
+
+	network, rest, ok := readString(body)
+	if !ok || len(rest) != net.IPv4len+4 {
+		logger.Warnf("Invalid lease from %s", peerID)
+		return
+	}
+	if !r.leaseCoordinator(peerID, network) {
+		logger.Warnf("Ignoring lease on %s from %s: not our coordinator", network, peerID)
+		return
+	}
+	ip := net.IP(slices.Clone(rest[:net.IPv4len]))
+	d := time.Duration(binary.BigEndian.Uint32(rest[net.IPv4len:])) * time.Second
+	if ip.IsUnspecified() || d == 0 {
+		logger.Warnf("Coordinator %s has no address for us on %s, retrying in %s", peerID, network, leaseRetry)
+		r.scheduleLease(network, leaseRetry)
+		return
+	}
+	if _, prefix, err := net.ParseCIDR(r.netcfg[network].Prefix); err != nil || !prefix.Contains(ip) {
+		logger.Warnf("Ignoring lease of %s on %s from %s: outside the network", ip, network, peerID)
+		return
+	}
+
+	r.addrMu.Lock()
+	if old := localAddress(network); !ip.Equal(old) {
+		if err := r.moveAddress(network, old, ip); err != nil {
+			r.addrMu.Unlock()
+			logger.Errorf("Failed to take leased address %s on %s: %v", ip, network, err)
+			r.scheduleLease(network, leaseRetry)
+			return
+		}
+		logger.Infof("Leased %s on %s from %s for %s", ip, network, peerID, d)
+	} else {
+		logger.Debugf("Renewed %s on %s for %s", ip, network, d)
+	}
+	r.addrMu.Unlock()
+
+	leases.Lock()
+	held := leases.held[network]
+	if held == nil {
+		held = &heldLease{}
+		leases.held[network] = held
+	}
+	held.expires = time.Now().Add(d)
+	leases.Unlock()
+	r.scheduleLease(network, d/2)
+}
+
+// scheduleLease runs renewLease for network after d.
+func (r *Registry) scheduleLease(network string, d time.Duration) {
+	leases.Lock()
+	defer leases.Unlock()
+	held := leases.held[network]
+	if held == nil {
+		held = &heldLease{}
+		leases.held[network] = held
+	}
+	if held.timer == nil {
+		held.timer = time.AfterFunc(d, func() { r.renewLease(network) })
+		return
+	}
+	held.timer.Reset(d)
+}
+
+// renewLease drops our address on network if its lease ran out and asks
+// the coordinator for one, if connected.
+func (r *Registry) renewLease(network string) {
+	logger := log.New("peer/lease")
+	now := time.Now()
+
+	leases.Lock()
+	held := leases.held[network]
+	expires := held.expires
+	if !expires.IsZero() && !now.Before(expires) {
+		held.expires = time.Time{}
+	}
+	leases.Unlock()
+
+	if !expires.IsZero() && !now.Before(expires) {
+		r.addrMu.Lock()
+		ip := localAddress(network)
+		if ip != nil {
+			logger.Warnf("Lease of %s on %s ran out, dropping the address", ip, network)
+			if err := r.moveAddress(network, ip, nil); err != nil {
+				logger.Errorf("Failed to drop %s on %s: %v", ip, network, err)
+			}
+		}
+		r.addrMu.Unlock()
+		if ip != nil {
+			control.PublishEvent("lease_expired", map[string]interface{}{
+				"network": network,
+				"address": ip.String(),
+			})
+		}
+		expires = time.Time{}
+	}
+
+	r.mu.RLock()
+	coordinator := r.coordinatorLocked(network)
+	r.mu.RUnlock()
+	if stream := r.controlStream(coordinator); stream != nil && r.leaseCoordinator(coordinator, network) {
+		r.requestLease(stream, network)
+	}
+
+	next := leaseRetry
+	if left := expires.Sub(now); left > 0 && left < next {
+		next = left
+	}
+	r.scheduleLease(network, next)
+}
+
+// LeaseStatus lists the leases of every network we coordinate.
+func (r *Registry) LeaseStatus() ([]map[string]interface{}, error) {
+	leases.Lock()
+	networks := make([]string, 0, len(leases.pools))
+	for network := range leases.pools {
+		networks = append(networks, network)
+	}
+	leases.Unlock()
+	if len(networks) == 0 {
+		return nil, errors.New("this node is not a lease coordinator")
+	}
+	sort.Strings(networks)
+
+	now := time.Now()
+	output := make([]map[string]interface{}, 0)
+	for _, network := range networks {
+		for _, l := range leasePool(network).Leases() {
+			state := "active"
+			if !l.Active(now) {
+				state = "expired"
+			}
+			output = append(output, map[string]interface{}{
+				"network":   network,
+				"address":   l.Address.String(),
+				"name":      l.Name,
+				"peer":      l.Fingerprint,
+				"expires":   l.Expires.Format(time.RFC3339),
+				"state":     state,
+				"connected": r.Get(l.Fingerprint) != nil,
+			})
+		}
+	}
+	return output, nil
+}
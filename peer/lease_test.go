@@ -0,0 +1,211 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"vibepn/config"
+	"vibepn/control"
+	"vibepn/ipam"
+
+	"github.com/quic-go/quic-go"
+)
+
+// recordStream keeps what is written to it.
+type recordStream struct {
+	quic.Stream
+	buf bytes.Buffer
+}
+
+func (s *recordStream) Write(p []byte) (int, error) { return s.buf.Write(p) }
+
+func (s *recordStream) Context() context.Context { return context.Background() }
+
+// body returns the body of the single control message written, after
+// checking its type.
+func (s *recordStream) body(t *testing.T, typ byte) []byte {
+	t.Helper()
+	frame := s.buf.Bytes()
+	if len(frame) < 3 || frame[2] != typ {
+		t.Fatalf("wrote %q, want one %q message", frame, typ)
+	}
+	s.buf.Reset()
+	return frame[3:]
+}
+
+func leaseRequest(network string, ip net.IP) []byte {
+	body := append([]byte{byte(len(network))}, network...)
+	return append(body, leaseIP(ip)...)
+}
+
+func leaseIP(ip net.IP) net.IP {
+	if ip == nil {
+		return net.IPv4zero.To4()
+	}
+	return ip.To4()
+}
+
+func TestLeaseGrantAndTake(t *testing.T) {
+	t.Cleanup(func() {
+		leases.Lock()
+		for _, held := range leases.held {
+			if held.timer != nil {
+				held.timer.Stop()
+			}
+		}
+		leases.pools = make(map[string]*ipam.Pool)
+		leases.held = make(map[string]*heldLease)
+		leases.Unlock()
+		SetLocalNode("", "", nil)
+	})
+
+	// 🏢 Coordinator: 10.42.0.1 is its own, so the first lease is .2
+	coordCfg := map[string]config.NetworkConfig{"corp": {
+		Address: "10.42.0.1", Prefix: "10.42.0.0/24", Export: true,
+		Leases: &config.Leases{File: filepath.Join(t.TempDir(), "leases.json")},
+	}}
+	coord := NewRegistry(config.Identity{}, []config.Peer{{Name: "client", Fingerprint: "fp-client"}}, coordCfg)
+	SetLocalNode("coord", "fp-coord", map[string]string{"corp": "10.42.0.1"})
+	if err := coord.ServeLeases(); err != nil {
+		t.Fatalf("ServeLeases failed: %v", err)
+	}
+
+	s := &recordStream{}
+	coord.handleLeaseRequest(leaseRequest("lab", nil), "fp-client", s)
+	if refusal := s.body(t, 'l'); !net.IP(refusal[4:8]).IsUnspecified() {
+		t.Fatalf("lease granted on a network without a pool: %v", refusal)
+	}
+	coord.handleLeaseRequest(leaseRequest("corp", nil), "fp-client", s)
+	grant := s.body(t, 'l')
+	if got := net.IP(grant[5:9]); !got.Equal(net.ParseIP("10.42.0.2")) {
+		t.Fatalf("leased %v, want 10.42.0.2", got)
+	}
+	out, err := coord.LeaseStatus()
+	if err != nil || len(out) != 1 || out[0]["peer"] != "fp-client" || out[0]["state"] != "active" {
+		t.Fatalf("LeaseStatus = %v, %v", out, err)
+	}
+	coord.handleAddress(addressBody("corp", net.ParseIP("10.42.0.9")), "fp-client")
+	if coord.OwnsAddress("fp-client", "corp", net.ParseIP("10.42.0.9")) || !coord.OwnsAddress("fp-client", "corp", net.ParseIP("10.42.0.2")) {
+		t.Fatal("an address other than the active lease owned")
+	}
+
+	// 💻 Member: takes the address only from its coordinator
+	clientCfg := map[string]config.NetworkConfig{"corp": {Address: "lease", Coordinator: "coord", Prefix: "10.42.0.0/24", Export: true}}
+	client := NewRegistry(config.Identity{}, []config.Peer{{Name: "coord", Fingerprint: "fp-coord"}, {Name: "other", Fingerprint: "fp-other"}}, clientCfg)
+	client.peers["fp-coord"].caps = control.CapLease
+	client.peers["fp-other"].caps = control.CapLease
+	SetLocalNode("client", "fp-client", nil)
+	var moved []string
+	client.SetAddressing(nil, filepath.Join(t.TempDir(), "addresses.json"), func(network, addr string) error {
+		moved = append(moved, addr)
+		return nil
+	})
+
+	client.handleLease(grant, "fp-other")
+	if len(moved) != 0 {
+		t.Fatalf("took a lease from a peer that is not the coordinator: %v", moved)
+	}
+	client.handleLease(grant, "fp-coord")
+	if len(moved) != 1 || moved[0] != "10.42.0.2" || !localAddress("corp").Equal(net.ParseIP("10.42.0.2")) {
+		t.Fatalf("leased address not taken: hook %v, local %v", moved, localAddress("corp"))
+	}
+	client.handleLease(grant, "fp-coord")
+	if len(moved) != 1 {
+		t.Fatalf("renewal moved the address again: %v", moved)
+	}
+}
+
+func TestLeaseMoveWaitsForReaddress(t *testing.T) {
+	t.Cleanup(func() {
+		leases.Lock()
+		for _, held := range leases.held {
+			if held.timer != nil {
+				held.timer.Stop()
+			}
+		}
+		leases.held = make(map[string]*heldLease)
+		leases.Unlock()
+		SetLocalNode("", "", nil)
+	})
+
+	netcfg := map[string]config.NetworkConfig{
+		"corp": {Address: "lease", Coordinator: "coord", Prefix: "10.42.0.0/24", Export: true},
+		"lab":  {Address: "auto", Prefix: "10.77.0.0/24", Export: true},
+	}
+	r := NewRegistry(config.Identity{}, []config.Peer{{Name: "coord", Fingerprint: "fp-coord"}}, netcfg)
+	r.peers["fp-coord"].caps = control.CapLease
+	lab, _ := config.ResolveAddressForNetwork("lab", "fp-client", netcfg)
+	SetLocalNode("client", "fp-client", map[string]string{"lab": lab})
+
+	var active atomic.Int32
+	var overlapped atomic.Bool
+	entered, release := make(chan struct{}), make(chan struct{})
+	r.SetAddressing(nil, filepath.Join(t.TempDir(), "addresses.json"), func(network, addr string) error {
+		if active.Add(1) > 1 {
+			overlapped.Store(true)
+		}
+		if network == "corp" {
+			close(entered)
+			<-release
+		}
+		active.Add(-1)
+		return nil
+	})
+
+	grant := append([]byte{byte(len("corp"))}, "corp"...)
+	grant = append(grant, net.ParseIP("10.42.0.2").To4()...)
+	grant = binary.BigEndian.AppendUint32(grant, 3600)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.handleLease(grant, "fp-coord")
+	}()
+	<-entered
+	go func() {
+		defer wg.Done()
+		r.readdress("lab")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if overlapped.Load() {
+		t.Fatal("readdress moved an address while a lease was being taken")
+	}
+	if localAddress("corp") == nil || localAddress("lab").String() == lab {
+		t.Fatalf("addresses not moved: corp %v, lab %v", localAddress("corp"), localAddress("lab"))
+	}
+}
+
+func TestLeaseCoordinatorOnlyConfigured(t *testing.T) {
+	netcfg := map[string]config.NetworkConfig{
+		"corp": {Address: "lease", Coordinator: "coord", Prefix: "10.42.0.0/24", Export: true},
+		"lab":  {Address: "lease", Coordinator: "fp-lab", Prefix: "10.77.0.0/24", Export: true},
+	}
+	r := NewRegistry(config.Identity{}, nil, netcfg)
+
+	// A certificate named like the coordinator is not the coordinator
+	r.peers["fp-evil"] = &peerEntry{name: "coord", caps: control.CapLease}
+	r.peers["fp-lab"] = &peerEntry{name: "lab", caps: control.CapLease}
+	if r.leaseCoordinator("fp-evil", "corp") || r.leaseCoordinator("fp-lab", "lab") {
+		t.Fatal("unconfigured peer taken as coordinator")
+	}
+
+	r.peers["fp-coord"] = &peerEntry{name: "coord", caps: control.CapLease, configured: true}
+	r.peers["fp-lab"].configured = true
+	if !r.leaseCoordinator("fp-coord", "corp") || !r.leaseCoordinator("fp-lab", "lab") {
+		t.Fatal("configured coordinator not recognized")
+	}
+	if r.leaseCoordinator("fp-evil", "corp") {
+		t.Fatal("impostor taken as coordinator next to the configured one")
+	}
+}
@@ -1,64 +1,57 @@
 package peer
 
 import (
-	"sync"
 	"time"
 
-	"vibepn/log"
-	"vibepn/netgraph"
-	"vibepn/shared"
+	gquic "github.com/quic-go/quic-go"
 )
 
-type LivenessTracker struct {
-	mu      sync.Mutex
-	peers   map[string]shared.PeerState // ✅ Always shared.PeerState
-	timeout time.Duration
-}
+const DefaultLivenessTimeout = 30 * time.Second
 
-func NewLivenessTracker(timeout time.Duration) *LivenessTracker {
-	if timeout <= 0 {
-		timeout = 30 * time.Second
-	}
+// UpdatePeer marks a connected peer as alive.
+func (r *Registry) UpdatePeer(peerID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	return &LivenessTracker{
-		peers:   make(map[string]shared.PeerState), // ✅ Always shared.PeerState
-		timeout: timeout,
+	if e := r.peers[peerID]; e != nil && e.conn != nil {
+		e.lastSeen = time.Now()
 	}
 }
 
-func (t *LivenessTracker) MarkAlive(id string) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+// RecordRTT folds a keepalive round-trip sample into the peer's smoothed
+// RTT and jitter.
+func (r *Registry) RecordRTT(peerID string, sample time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	t.peers[id] = shared.PeerState{
-		ID:       id,
-		LastSeen: time.Now(),
+	e := r.peers[peerID]
+	if e == nil {
+		return
 	}
+	e.rtt, e.jitter = smoothRTT(e.rtt, e.jitter, sample)
 }
 
-func (t *LivenessTracker) UpdatePeer(peerID string) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+// AddTraffic accounts data-plane bytes exchanged with a known peer.
+func (r *Registry) AddTraffic(peerID string, sent, received int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	t.peers[peerID] = shared.PeerState{
-		ID:       peerID,
-		LastSeen: time.Now(),
+	e := r.peers[peerID]
+	if e == nil {
+		return
 	}
+	e.bytesSent += uint64(sent)
+	e.bytesReceived += uint64(received)
 }
 
-func (t *LivenessTracker) ListPeers() []shared.PeerState {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-
-	var out []shared.PeerState
-	for _, p := range t.peers {
-		out = append(out, p)
+// StartWatcher closes connections that have not been heard from within
+// timeout. Closing goes through the normal disconnect path, so routes are
+// withdrawn and outbound peers are redialed. It also notices connections
+// that migrated to a new remote address.
+func (r *Registry) StartWatcher(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultLivenessTimeout
 	}
-	return out
-}
-
-func (t *LivenessTracker) StartWatcher(rt *netgraph.RouteTable) {
-	logger := log.New("peer/watcher")
 
 	go func() {
 		ticker := time.NewTicker(10 * time.Second)
@@ -67,22 +60,48 @@ func (t *LivenessTracker) StartWatcher(rt *netgraph.RouteTable) {
 		for {
 			<-ticker.C
 
-			t.mu.Lock()
 			now := time.Now()
-			expired := []string{}
+			expired := map[string]gquic.Connection{}
+			var migrated []migration
 
-			for id, peer := range t.peers {
-				if now.Sub(peer.LastSeen) > t.timeout {
-					expired = append(expired, id)
+			r.mu.Lock()
+			for id, e := range r.peers {
+				if e.conn == nil {
+					continue
 				}
+				if now.Sub(e.lastSeen) > timeout {
+					expired[id] = e.conn
+					continue
+				}
+				e.sampleRates(now)
+				if m, ok := e.checkMigration(); ok {
+					migrated = append(migrated, m)
+				}
+			}
+			r.mu.Unlock()
+
+			for _, m := range migrated {
+				handleMigration(m)
 			}
 
-			for _, id := range expired {
-				logger.Warnf("Peer %s considered dead (timeout)", id)
-				delete(t.peers, id)
-				rt.RemoveByPeer(id)
+			for id, conn := range expired {
+				r.logger.Warnf("Peer %s considered dead (no keepalive for %s), closing connection", id, timeout)
+				_ = conn.CloseWithError(0, "liveness timeout")
 			}
-			t.mu.Unlock()
 		}
 	}()
 }
+
+// sampleRates updates throughput from the byte counters since the last
+// sample. Caller must hold the registry lock.
+func (e *peerEntry) sampleRates(now time.Time) {
+	elapsed := now.Sub(e.sampledAt).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	e.txRate = float64(e.bytesSent-e.sampledSent) / elapsed
+	e.rxRate = float64(e.bytesReceived-e.sampledRecv) / elapsed
+	e.sampledAt = now
+	e.sampledSent = e.bytesSent
+	e.sampledRecv = e.bytesReceived
+}
@@ -3,9 +3,12 @@ package peer
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	"vibepn/config"
@@ -34,10 +37,6 @@ func ConnectToPeers(
 	registry *Registry,
 ) {
 	logger := log.New("peer/manager")
-	const (
-		initialReconnectBackoff = 2 * time.Second
-		maxReconnectBackoff     = 30 * time.Second
-	)
 
 	logger.Infof("identity.Fingerprint = %q", identity.Fingerprint)
 	logger.Infof("netcfg contents: %+v", netcfg)
@@ -47,98 +46,196 @@ func ConnectToPeers(
 		logger.Infof("Launching goroutine to connect to peer: %s", peer.Name)
 
 		go func() {
-			logger.Infof("Started goroutine for peer %s (%s)", peer.Name, peer.Address)
+			addrs := strings.Join(peer.Candidates(), ", ")
+			logger.Infof("Started goroutine for peer %s (%s)", peer.Name, addrs)
 
-			tlsConf, err := crypto.LoadPeerTLSWithTOFU(peer.Name, peer.Address, identity.Cert, identity.Key)
+			tlsConf, err := crypto.LoadPeerTLSWithTOFU(peer.Name, addrs, identity.Cert, identity.Key)
 			if err != nil {
 				logger.Errorf("Failed to create TLS config for %s: %v", peer.Name, err)
 				return
 			}
 			logger.Infof("TLS config created for peer %s", peer.Name)
 
-			reconnectBackoff := initialReconnectBackoff
-			waitBeforeRetry := func(reason string, err error) {
-				logger.Warnf("%s: %v (retrying in %s)", reason, err, reconnectBackoff)
-				time.Sleep(reconnectBackoff)
-				reconnectBackoff *= 2
-				if reconnectBackoff > maxReconnectBackoff {
-					reconnectBackoff = maxReconnectBackoff
-				}
-			}
+			registry.maintainPeer(peer, tlsConf, false)
+		}()
+	}
+}
 
-			for {
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// maintainPeer keeps a connection to peer up for as long as the process
+// runs. Discovered peers follow their latest gossip record and are given up
+// once it expires or stops being allowed.
+func (r *Registry) maintainPeer(peer config.Peer, tlsConf *tls.Config, discovered bool) {
+	logger := log.New("peer/manager")
+	const (
+		initialReconnectBackoff = 2 * time.Second
+		maxReconnectBackoff     = 30 * time.Second
+	)
 
-				logger.Infof("Dialing QUIC to %s...", peer.Address)
-				conn, err := quic.DialAddr(ctx, peer.Address, tlsConf, nil)
-				cancel()
-				if err != nil {
-					waitBeforeRetry(fmt.Sprintf("❌ QUIC dial to %s failed", peer.Address), err)
-					continue
-				}
-				logger.Infof("✅ QUIC connection established to %s", peer.Address)
+	reconnectBackoff := initialReconnectBackoff
+	waitBeforeRetry := func(reason string, err error) {
+		logger.Warnf("%s: %v (retrying in %s)", reason, err, reconnectBackoff)
+		time.Sleep(reconnectBackoff)
+		reconnectBackoff *= 2
+		if reconnectBackoff > maxReconnectBackoff {
+			reconnectBackoff = maxReconnectBackoff
+		}
+	}
 
-				streamCtx, streamCancel := context.WithTimeout(context.Background(), 2*time.Second)
-				stream, err := conn.OpenStreamSync(streamCtx)
-				streamCancel()
-				if err != nil {
-					conn.CloseWithError(0, "failed to open control stream")
-					waitBeforeRetry("Failed to open control stream", err)
+	var lastAttempt time.Time
+	for {
+		if discovered {
+			latest, ok := r.discoveredPeer(peer.Fingerprint)
+			if !ok {
+				logger.Infof("No longer dialing discovered peer %s", peer.Name)
+				return
+			}
+			peer = latest
+		} else {
+			// 🔑 Follow key rotations the peer announced
+			peer.Fingerprint = crypto.LatestFingerprint(peer.Fingerprint)
+		}
+		if !r.IsEnabled(peer.Fingerprint) {
+			time.Sleep(maxReconnectBackoff)
+			continue
+		}
+		// 🔁 Already connected inbound (e.g. the peer dialed us or a punch
+		// won); relayed connections still look for a direct path now and then
+		upgrading := false
+		if peer.Fingerprint != "" {
+			if c := r.Get(peer.Fingerprint); c != nil {
+				if relayedVia(c) == "" || time.Since(lastAttempt) < relayUpgradeInterval {
+					time.Sleep(initialReconnectBackoff)
 					continue
 				}
+				upgrading = true
+			}
+		}
+		lastAttempt = time.Now()
 
-				myNonce, err := generateNonce()
-				if err != nil {
-					conn.CloseWithError(0, "failed to generate nonce")
-					waitBeforeRetry("Failed to generate nonce", err)
-					continue
-				}
+		conn, endpoint, err := r.connect(peer, tlsConf, !upgrading)
+		if errors.Is(err, errPunchedInbound) {
+			logger.Infof("Hole punch to %s completed inbound", peer.Name)
+			continue
+		}
+		if err != nil {
+			if upgrading {
+				logger.Debugf("No direct path to %s yet, staying on relay: %v", peer.Name, err)
+				continue
+			}
+			waitBeforeRetry(fmt.Sprintf("❌ QUIC dial to %s failed", peer.Name), err)
+			continue
+		}
+		logger.Infof("✅ QUIC connection established to %s (%s)", peer.Name, conn.RemoteAddr())
 
-				// 📨 Send Hello
-				err = control.SendHello(stream, myNonce)
-				if err != nil {
-					conn.CloseWithError(0, "failed to send hello")
-					waitBeforeRetry("Failed to send hello", err)
-					continue
-				}
+		peerID, err := r.startOutboundSession(conn, peer, r.netcfg)
+		if err != nil {
+			waitBeforeRetry("Failed to start control session", err)
+			continue
+		}
+		r.setEndpoint(peerID, conn, endpoint)
 
-				storePeerNonce(peer.Fingerprint, myNonce)
+		reconnectBackoff = initialReconnectBackoff
 
-				logger.Infof("Sent TieBreakerNonce: %d", myNonce)
+		if relayedVia(conn) != "" {
+			select {
+			case <-conn.Context().Done():
+			case <-time.After(relayUpgradeInterval):
+				continue // 🔁 keep the relay while looking for a direct path
+			}
+		} else {
+			<-conn.Context().Done()
+		}
+		logger.Warnf("Connection to %s closed: %v", peer.Name, conn.Context().Err())
+		logger.Infof("Reconnecting to %s in %s", peer.Name, reconnectBackoff)
+		time.Sleep(reconnectBackoff)
+	}
+}
 
-				registry.Add(peer.Fingerprint, conn, myNonce)
+// connect reaches p directly, then by hole punching, then (if allowed)
+// through a relay. For direct connections it also returns the configured
+// address that answered.
+func (r *Registry) connect(p config.Peer, tlsConf *tls.Config, allowRelay bool) (quic.Connection, string, error) {
+	logger := log.New("peer/manager")
 
-				// 📢 Announce all exported routes
-				for netName, netCfg := range netcfg {
-					if !netCfg.Export {
-						continue
-					}
-					err = control.SendRouteAnnounce(stream, netName, []string{netCfg.Prefix})
-					if err != nil {
-						logger.Warnf("Failed to announce route for network %s: %v", netName, err)
-					}
-				}
+	conn, endpoint, err := r.dialPeer(p, tlsConf)
+	if err == nil || p.Fingerprint == "" {
+		return conn, endpoint, err
+	}
 
-				// 🫡 Start Keepalive loop
-				control.StartKeepaliveLoop(stream)
+	// 🕳️ Direct dial failed, try punching through via a rendezvous peer
+	logger.Infof("Direct dial to %s failed (%v), trying hole punch", p.Name, err)
+	conn, err = r.punch(p, tlsConf)
+	if err == nil || !allowRelay || errors.Is(err, errPunchedInbound) {
+		return conn, "", err
+	}
 
-				// 🚀 Start Control Loop
-				go HandleControlStream(conn, stream, peer.Fingerprint)
+	// 🔀 Last resort: let a relay peer carry the connection
+	logger.Infof("Hole punch to %s failed (%v), trying relays", p.Name, err)
+	conn, err = r.dialRelayed(p, tlsConf)
+	return conn, "", err
+}
 
-				reconnectBackoff = initialReconnectBackoff
+// startOutboundSession opens the control stream on a freshly dialed
+// connection, says Hello, registers it and starts the control loop.
+func (r *Registry) startOutboundSession(conn quic.Connection, p config.Peer, netcfg map[string]config.NetworkConfig) (string, error) {
+	logger := log.New("peer/manager")
 
-				<-conn.Context().Done()
-				logger.Warnf("Connection to %s closed: %v", peer.Address, conn.Context().Err())
-				logger.Infof("Reconnecting to %s in %s", peer.Address, reconnectBackoff)
-				time.Sleep(reconnectBackoff)
-			}
-		}()
+	streamCtx, streamCancel := context.WithTimeout(context.Background(), 2*time.Second)
+	stream, err := conn.OpenStreamSync(streamCtx)
+	streamCancel()
+	if err != nil {
+		conn.CloseWithError(0, "failed to open control stream")
+		return "", fmt.Errorf("open control stream: %w", err)
+	}
+
+	myNonce, err := generateNonce()
+	if err != nil {
+		conn.CloseWithError(0, "failed to generate nonce")
+		return "", err
+	}
+
+	// 📨 Send Hello
+	if err := control.SendHello(stream, myNonce); err != nil {
+		conn.CloseWithError(0, "failed to send hello")
+		return "", err
+	}
+
+	logger.Infof("Sent TieBreakerNonce: %d", myNonce)
+
+	peerID := r.AddOutbound(p, conn, myNonce)
+
+	// 📢 Announce all exported routes
+	for netName, netCfg := range netcfg {
+		if !netCfg.Export || !r.authorizedFor(peerID, netName) {
+			continue
+		}
+		err = control.SendRouteAnnounce(stream, netName, r.exportPrefixes(peerID, netName, netCfg))
+		if err != nil {
+			logger.Warnf("Failed to announce route for network %s: %v", netName, err)
+		}
 	}
+
+	// 🫡 Start Keepalive loop
+	control.StartKeepaliveLoop(stream)
+
+	// 🚀 Start Control Loop
+	go r.HandleControlStream(conn, stream, peerID)
+
+	return peerID, nil
 }
 
-func HandleControlStream(conn quic.Connection, stream quic.Stream, peerID string) {
+func (r *Registry) HandleControlStream(conn quic.Connection, stream quic.Stream, peerID string) {
 	logger := log.New("peer/control")
 
+	if !r.setControlStream(peerID, conn, stream) {
+		logger.Debugf("Connection to %s is not active, ignoring its control stream", peerID)
+	}
+	defer r.clearControlStream(peerID, stream)
+
+	// The peer's Hello nonce, which its network proofs are bound to
+	var peerNonce uint64
+	helloSeen := false
+
 	for {
 		lenBuf := make([]byte, 2)
 		_, err := io.ReadFull(stream, lenBuf)
@@ -148,8 +245,10 @@ func HandleControlStream(conn quic.Connection, stream quic.Stream, peerID string
 			return
 		}
 
+		// Any length the 2-byte prefix can express is allowed, since
+		// revocation lists can be large
 		length := binary.BigEndian.Uint16(lenBuf)
-		if length == 0 || length > 4096 {
+		if length == 0 {
 			logger.Warnf("Invalid control message length: %d", length)
 			conn.CloseWithError(0, "invalid control message length")
 			return
@@ -166,6 +265,9 @@ func HandleControlStream(conn quic.Connection, stream quic.Stream, peerID string
 		controlType := msgBuf[0]
 		body := msgBuf[1:]
 
+		// 🔥 Any control traffic proves the peer is alive
+		r.UpdatePeer(peerID)
+
 		switch controlType {
 		case 'H':
 			logger.Infof("Received Hello from %s", conn.RemoteAddr())
@@ -179,13 +281,51 @@ func HandleControlStream(conn quic.Connection, stream quic.Stream, peerID string
 			logger.Infof("Received TieBreakerNonce: %d", tieBreakerNonce)
 
 			storePeerNonce(peerID, tieBreakerNonce)
+			peerNonce, helloSeen = tieBreakerNonce, true
+
+			var peerCaps uint32
+			if len(body) >= 12 {
+				peerCaps = binary.BigEndian.Uint32(body[8:12])
+			}
+			r.setCapabilities(peerID, peerCaps)
+			logger.Infof("Peer %s capabilities: %v", peerID, control.CapabilityNames(control.NegotiateCapabilities(peerCaps)))
+
+			// 🪞 Tell the peer which address its packets come from
+			if r.hasCapability(peerID, control.CapNATPunch) && relayedVia(conn) == "" {
+				if err := control.SendObservedAddr(stream, conn.RemoteAddr().String()); err != nil {
+					logger.Warnf("Failed to send observed address to %s: %v", peerID, err)
+				}
+			}
+
+			// 🗣️ Share what we know about the mesh
+			if r.hasCapability(peerID, control.CapGossip) {
+				r.sendGossip(peerID, stream)
+			}
+			if r.hasCapability(peerID, control.CapRevocation) {
+				r.sendRevocations(peerID, stream)
+			}
+			if r.hasCapability(peerID, control.CapRotation) {
+				r.sendSuccession(peerID, stream)
+			}
+			if r.hasCapability(peerID, control.CapNetworkSecret) {
+				r.sendNetworkProofs(peerID, conn, stream, peerNonce)
+			}
+			if r.hasCapability(peerID, control.CapAddress) {
+				r.sendAddresses(peerID, stream)
+			}
+			if r.hasCapability(peerID, control.CapLease) {
+				r.requestLeases(peerID, stream)
+			}
+			if r.hasCapability(peerID, control.CapMulticast) {
+				r.sendGroups(peerID, stream)
+			}
 
 			// 🧠 Announce exported routes
 			for netName, netCfg := range control.GetNetConfig() {
-				if !netCfg.Export {
+				if !netCfg.Export || !r.authorizedFor(peerID, netName) {
 					continue
 				}
-				err := control.SendRouteAnnounce(stream, netName, []string{netCfg.Prefix})
+				err := control.SendRouteAnnounce(stream, netName, r.exportPrefixes(peerID, netName, netCfg))
 				if err != nil {
 					logger.Warnf("Failed to announce route for network %s: %v", netName, err)
 				}
@@ -195,15 +335,75 @@ func HandleControlStream(conn quic.Connection, stream quic.Stream, peerID string
 
 		case 'A':
 			logger.Infof("Received Route-Announce from %s", conn.RemoteAddr())
-			handleRouteAnnounce(body, peerID)
+			r.handleRouteAnnounce(body, peerID)
 
 		case 'W':
 			logger.Infof("Received Route-Withdraw from %s", conn.RemoteAddr())
-			handleRouteWithdraw(body)
+			r.handleRouteWithdraw(body, peerID)
 
 		case 'K':
 			logger.Debugf("Received Keepalive from %s", conn.RemoteAddr())
-			handleKeepalive(body, peerID)
+			r.handleKeepalive(body, peerID, stream)
+
+		case 'k':
+			logger.Debugf("Received Keepalive-Ack from %s", conn.RemoteAddr())
+			r.handleKeepaliveAck(body, peerID)
+
+		case 'E':
+			logger.Debugf("Received Echo from %s", conn.RemoteAddr())
+			r.handleEcho(body, peerID)
+
+		case 'R':
+			logger.Debugf("Received Echo-Reply from %s", conn.RemoteAddr())
+			r.handleEchoReply(body, peerID)
+
+		case 'O':
+			logger.Debugf("Received Observed-Address from %s", conn.RemoteAddr())
+			r.handleObservedAddr(body, peerID)
+
+		case 'P':
+			logger.Infof("Received Punch from %s", conn.RemoteAddr())
+			r.handlePunch(body, peerID)
+
+		case 'X':
+			logger.Debugf("Received Gossip from %s", conn.RemoteAddr())
+			r.handleGossip(body, peerID)
+
+		case 'V':
+			logger.Debugf("Received Revocations from %s", conn.RemoteAddr())
+			r.handleRevocations(body, peerID)
+
+		case 'S':
+			logger.Infof("Received Succession from %s", conn.RemoteAddr())
+			r.handleSuccession(body, peerID)
+
+		case 'N':
+			logger.Infof("Received Network-Proof from %s", conn.RemoteAddr())
+			if !helloSeen {
+				logger.Warnf("Network-Proof from %s before Hello, ignoring", peerID)
+				continue
+			}
+			r.handleNetworkProof(body, peerID, conn, stream, peerNonce)
+
+		case 'J':
+			logger.Infof("Received Join from %s", conn.RemoteAddr())
+			r.handleJoin(body, peerID, conn, stream)
+
+		case 'I':
+			logger.Infof("Received Address from %s", conn.RemoteAddr())
+			r.handleAddress(body, peerID)
+
+		case 'L':
+			logger.Infof("Received Lease-Request from %s", conn.RemoteAddr())
+			r.handleLeaseRequest(body, peerID, stream)
+
+		case 'l':
+			logger.Infof("Received Lease from %s", conn.RemoteAddr())
+			r.handleLease(body, peerID)
+
+		case 'M':
+			logger.Debugf("Received Multicast-Groups from %s", conn.RemoteAddr())
+			r.handleGroups(body, peerID)
 
 		case 'G':
 			logger.Infof("Received Goodbye from %s", conn.RemoteAddr())
@@ -217,7 +417,7 @@ func HandleControlStream(conn quic.Connection, stream quic.Stream, peerID string
 }
 
 // 👇 Properly decode a Route-Announce message
-func handleRouteAnnounce(body []byte, peerID string) {
+func (r *Registry) handleRouteAnnounce(body []byte, peerID string) {
 	logger := log.New("peer/route-announce")
 
 	if len(body) < 2 {
@@ -234,6 +434,11 @@ func handleRouteAnnounce(body []byte, peerID string) {
 	networkName := string(body[1 : 1+networkLen])
 	logger.Infof("Route-Announce for network: %s", networkName)
 
+	if !r.authorizedFor(peerID, networkName) {
+		logger.Warnf("Ignoring routes for %s from %s: its certificate does not authorize that network", networkName, peerID)
+		return
+	}
+
 	cursor := 1 + networkLen
 
 	for cursor < len(body) {
@@ -249,6 +454,24 @@ func handleRouteAnnounce(body []byte, peerID string) {
 		prefix := string(prefixBytes)
 		cursor += 1 + prefixLen + 2
 
+		// 🚪 Default routes are exit offers, only used once chosen
+		if isDefaultRoute(prefix) {
+			logger.Infof("Peer %s offers an exit on %s (%s)", peerID, networkName, prefix)
+			r.noteExitOffer(peerID, networkName, prefix)
+			continue
+		}
+
+		// 🛂 Beyond the network's own prefix, our route policy decides
+		if !r.acceptRoute(networkName, prefix) {
+			logger.Infof("Not accepting route %s on %s from %s: not allowed by accept_routes", prefix, networkName, peerID)
+			control.PublishEvent("route_rejected", map[string]interface{}{
+				"network": networkName,
+				"prefix":  prefix,
+				"peer":    peerID,
+			})
+			continue
+		}
+
 		route := netgraph.Route{
 			Network: networkName,
 			Prefix:  prefix,
@@ -258,11 +481,19 @@ func handleRouteAnnounce(body []byte, peerID string) {
 
 		logger.Infof("Learned route: %+v", route)
 		control.GetRouteTable().AddRoute(route)
+		control.PublishEvent("route_added", map[string]interface{}{
+			"network": networkName,
+			"prefix":  prefix,
+			"peer":    peerID,
+		})
+		if r.isSubnet(networkName, prefix) {
+			r.noteSubnet(peerID, networkName, prefix)
+		}
 	}
 }
 
 // 👇 Properly decode a Route-Withdraw message
-func handleRouteWithdraw(body []byte) {
+func (r *Registry) handleRouteWithdraw(body []byte, peerID string) {
 	logger := log.New("peer/route-withdraw")
 
 	if len(body) < 2 {
@@ -277,6 +508,10 @@ func handleRouteWithdraw(body []byte) {
 	}
 
 	networkName := string(body[1 : 1+networkLen])
+	if !r.authorizedFor(peerID, networkName) {
+		logger.Warnf("Ignoring withdraw for %s from %s: its certificate does not authorize that network", networkName, peerID)
+		return
+	}
 
 	cursor := 1 + networkLen
 
@@ -294,11 +529,24 @@ func handleRouteWithdraw(body []byte) {
 	prefix := string(body[cursor+1 : cursor+1+prefixLen])
 
 	logger.Infof("Withdraw route network=%s, prefix=%s", networkName, prefix)
+	if isDefaultRoute(prefix) {
+		r.dropExitOffer(peerID, networkName, prefix)
+		return
+	}
 
-	control.GetRouteTable().RemoveRoute(networkName, prefix)
+	// Only the sender's route goes: other peers announce the network's
+	// prefix too and may route the same subnet
+	control.GetRouteTable().RemovePeerRoute(networkName, prefix, peerID)
+	if r.isSubnet(networkName, prefix) {
+		r.dropSubnet(peerID, networkName, prefix)
+	}
+	control.PublishEvent("route_removed", map[string]interface{}{
+		"network": networkName,
+		"prefix":  prefix,
+	})
 }
 
-func handleKeepalive(body []byte, peerID string) {
+func (r *Registry) handleKeepalive(body []byte, peerID string, stream quic.Stream) {
 	logger := log.New("peer/keepalive")
 
 	if len(body) < 8 {
@@ -306,12 +554,30 @@ func handleKeepalive(body []byte, peerID string) {
 		return
 	}
 
-	timestamp := binary.BigEndian.Uint64(body)
-	t := time.Unix(int64(timestamp), 0)
+	// Peers that predate Keepalive-Ack would not understand it
+	if !r.hasCapability(peerID, control.CapKeepaliveAck) {
+		return
+	}
+	if err := control.SendKeepaliveAck(stream, body[:8]); err != nil {
+		logger.Warnf("Failed to ack keepalive from %s: %v", peerID, err)
+	}
+}
 
-	logger.Debugf("Keepalive received: timestamp = %s", t.Format(time.RFC3339))
+func (r *Registry) handleKeepaliveAck(body []byte, peerID string) {
+	logger := log.New("peer/keepalive")
+
+	if len(body) < 8 {
+		logger.Warnf("Invalid keepalive-ack payload")
+		return
+	}
+
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(body)))
+	rtt := time.Since(sent)
+	if rtt < 0 || rtt > time.Minute {
+		logger.Debugf("Ignoring implausible keepalive RTT %s from %s", rtt, peerID)
+		return
+	}
 
-	// 🔥 Mark the peer as alive
-	control.GetPeerTracker().UpdatePeer(peerID)
-	logger.Debugf("Updated liveness for peer %s", peerID)
+	r.RecordRTT(peerID, rtt)
+	logger.Debugf("Keepalive RTT to %s: %s", peerID, rtt)
 }
@@ -0,0 +1,187 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+
+	"vibepn/control"
+	"vibepn/log"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Multicast groups: on networks with snooping, the dispatcher reports the
+// groups hosts behind us join and leave, and we tell every member. A peer
+// that sent us its list for a network, even an empty one, only gets the
+// groups on it; peers that never did get every multicast packet.
+
+// maxGroups bounds the groups tracked per network, ours and each peer's.
+const maxGroups = 1024
+
+var groups struct {
+	sync.Mutex
+	joined map[string][]net.IP // network → groups hosts behind us joined
+}
+
+func init() {
+	groups.joined = make(map[string][]net.IP)
+}
+
+// JoinGroup records that a host behind us joined group on network.
+func (r *Registry) JoinGroup(network string, group net.IP) {
+	groups.Lock()
+	joined := groups.joined[network]
+	if slices.ContainsFunc(joined, group.Equal) {
+		groups.Unlock()
+		return
+	}
+	if len(joined) >= maxGroups {
+		groups.Unlock()
+		log.New("peer/multicast").Warnf("[%s] Not tracking group %s: already %d groups", network, group, maxGroups)
+		return
+	}
+	groups.joined[network] = append(joined, slices.Clone(group))
+	groups.Unlock()
+
+	log.New("peer/multicast").Infof("[%s] Joined group %s", network, group)
+	r.floodGroups(network)
+}
+
+// LeaveGroup records that hosts behind us left group on network.
+func (r *Registry) LeaveGroup(network string, group net.IP) {
+	groups.Lock()
+	joined := groups.joined[network]
+	i := slices.IndexFunc(joined, group.Equal)
+	if i < 0 {
+		groups.Unlock()
+		return
+	}
+	groups.joined[network] = slices.Delete(slices.Clone(joined), i, i+1)
+	groups.Unlock()
+
+	log.New("peer/multicast").Infof("[%s] Left group %s", network, group)
+	r.floodGroups(network)
+}
+
+func localGroups(network string) []net.IP {
+	groups.Lock()
+	out := slices.Clone(groups.joined[network])
+	groups.Unlock()
+	sort.Slice(out, func(i, j int) bool { return bytes.Compare(out[i].To16(), out[j].To16()) < 0 })
+	return out
+}
+
+// snooping reports whether we filter multicast on network by group.
+func (r *Registry) snooping(network string) bool {
+	netCfg := r.netcfg[network]
+	return netCfg.ForwardsMulticast() && netCfg.Multicast.Snooping
+}
+
+// sendGroups tells peerID our groups on every network we snoop on.
+func (r *Registry) sendGroups(peerID string, stream quic.Stream) {
+	for network := range r.netcfg {
+		if r.snooping(network) {
+			r.sendGroupsOn(peerID, stream, network)
+		}
+	}
+}
+
+func (r *Registry) sendGroupsOn(peerID string, stream quic.Stream, network string) {
+	if !r.authorizedFor(peerID, network) {
+		return
+	}
+	if err := control.SendGroups(stream, network, localGroups(network)); err != nil {
+		log.New("peer/multicast").Warnf("Failed to send groups on %s to %s: %v", network, peerID, err)
+	}
+}
+
+// floodGroups sends our groups on network to every peer.
+func (r *Registry) floodGroups(network string) {
+	r.mu.RLock()
+	streams := make(map[string]quic.Stream)
+	for id, e := range r.peers {
+		if e.control != nil && e.caps&control.CapMulticast != 0 {
+			streams[id] = e.control
+		}
+	}
+	r.mu.RUnlock()
+
+	for id, stream := range streams {
+		r.sendGroupsOn(id, stream, network)
+	}
+}
+
+func (r *Registry) handleGroups(body []byte, peerID string) {
+	logger := log.New("peer/multicast")
+
+	network, rest, ok := readString(body)
+	if !ok || len(rest) < 2 {
+		logger.Warnf("Invalid groups from %s", peerID)
+		return
+	}
+	if !r.authorizedFor(peerID, network) {
+		logger.Warnf("Ignoring groups on %s from %s: not a member", network, peerID)
+		return
+	}
+	count := int(binary.BigEndian.Uint16(rest))
+	if count > maxGroups {
+		logger.Warnf("Ignoring groups on %s from %s: %d groups, at most %d", network, peerID, count, maxGroups)
+		return
+	}
+	rest = rest[2:]
+	joined := make([]net.IP, 0, count)
+	for range count {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			logger.Warnf("Invalid groups from %s", peerID)
+			return
+		}
+		n := int(rest[0])
+		group := net.IP(slices.Clone(rest[1 : 1+n]))
+		rest = rest[1+n:]
+		if (n != net.IPv4len && n != net.IPv6len) || !group.IsMulticast() {
+			logger.Warnf("Ignoring group %v on %s from %s: not a multicast address", group, network, peerID)
+			continue
+		}
+		joined = append(joined, group)
+	}
+
+	r.mu.Lock()
+	if e := r.peers[peerID]; e != nil {
+		if e.groups == nil {
+			e.groups = make(map[string][]net.IP)
+		}
+		e.groups[network] = joined
+	}
+	r.mu.Unlock()
+	logger.Debugf("Peer %s listens to %d groups on %s", peerID, len(joined), network)
+}
+
+// MulticastPeers returns the connected members of network to send a
+// packet for group to. A nil group, as for broadcasts, goes to every
+// member.
+func (r *Registry) MulticastPeers(network string, group net.IP) []string {
+	r.mu.RLock()
+	var candidates []string
+	for id, e := range r.peers {
+		if e.conn == nil {
+			continue
+		}
+		if joined, filters := e.groups[network]; group != nil && filters && !slices.ContainsFunc(joined, group.Equal) {
+			continue
+		}
+		candidates = append(candidates, id)
+	}
+	r.mu.RUnlock()
+
+	out := candidates[:0]
+	for _, id := range candidates {
+		if r.authorizedFor(id, network) {
+			out = append(out, id)
+		}
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+package peer
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"vibepn/config"
+	"vibepn/control"
+)
+
+func TestMulticastGroups(t *testing.T) {
+	t.Cleanup(func() {
+		groups.Lock()
+		groups.joined = make(map[string][]net.IP)
+		groups.Unlock()
+	})
+
+	netcfg := map[string]config.NetworkConfig{"corp": {
+		Prefix: "10.42.0.0/24", Export: true,
+		Multicast: &config.Multicast{Enabled: true, Snooping: true},
+	}}
+	peers := []config.Peer{{Name: "a", Fingerprint: "fp-a"}, {Name: "b", Fingerprint: "fp-b"}, {Name: "c", Fingerprint: "fp-c"}}
+	r := NewRegistry(config.Identity{}, peers, netcfg)
+	for _, e := range r.peers {
+		e.conn = fakeConn{}
+	}
+	s := &recordStream{}
+	r.peers["fp-a"].control = s
+	r.peers["fp-a"].caps = control.CapMulticast
+
+	// 📢 A join is announced to peers that filter by group
+	group := net.ParseIP("239.1.1.1").To4()
+	r.JoinGroup("corp", group)
+	announced := s.body(t, 'M')
+	r.handleGroups(announced, "fp-a")
+	if err := control.SendGroups(s, "corp", nil); err != nil {
+		t.Fatalf("SendGroups failed: %v", err)
+	}
+	r.handleGroups(s.body(t, 'M'), "fp-b")
+
+	// a listens to the group, b to none, c never said and gets everything
+	got := r.MulticastPeers("corp", group)
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"fp-a", "fp-c"}) {
+		t.Errorf("peers for %s = %v, want fp-a and fp-c", group, got)
+	}
+	if got := r.MulticastPeers("corp", net.ParseIP("239.2.2.2")); !slices.Equal(got, []string{"fp-c"}) {
+		t.Errorf("peers for an unjoined group = %v, want fp-c", got)
+	}
+	if got := r.MulticastPeers("corp", nil); len(got) != 3 {
+		t.Errorf("broadcast peers = %v, want all three", got)
+	}
+	if got := r.MulticastPeers("lab", nil); len(got) != 0 {
+		t.Errorf("peers on a network they are not members of: %v", got)
+	}
+
+	r.LeaveGroup("corp", group)
+	if left := s.body(t, 'M'); len(left) != 1+len("corp")+2 || left[len(left)-1] != 0 {
+		t.Errorf("after leaving, announced %v, want an empty list", left)
+	}
+}
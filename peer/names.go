@@ -0,0 +1,96 @@
+package peer
+
+import (
+	"net"
+	"slices"
+	"strings"
+
+	"vibepn/config"
+	"vibepn/crypto"
+)
+
+// Peer names resolve to overlay addresses for the DNS resolver: the
+// address the peer announced, else on networks with automatic addressing
+// the one derived from its fingerprint, else the source address we last
+// saw in its packets on the network.
+
+// NoteAddress records src as peerID's address on network if it lies on
+// the network's prefix.
+func (r *Registry) NoteAddress(peerID, network string, src net.IP) {
+	r.mu.RLock()
+	e := r.peers[peerID]
+	known := e != nil && e.overlay[network].Equal(src)
+	netCfg := r.netcfg[network]
+	r.mu.RUnlock()
+	if e == nil || known {
+		return
+	}
+	if _, subnet, err := net.ParseCIDR(netCfg.Prefix); err != nil || !subnet.Contains(src) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e := r.peers[peerID]; e != nil {
+		if e.overlay == nil {
+			e.overlay = make(map[string]net.IP)
+		}
+		e.overlay[network] = slices.Clone(src)
+	}
+}
+
+// ResolveName returns the overlay address of the node called name on
+// network, this node included, or nil. Names match case-insensitively.
+// Names of configured and joined peers win over certificate and gossip
+// names, only peers authorized for network answer, and ties go to the
+// lowest fingerprint so the answer does not change between queries.
+func (r *Registry) ResolveName(network, name string) net.IP {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	netCfg, ok := r.netcfg[network]
+	if !ok {
+		return nil
+	}
+	if strings.EqualFold(name, crypto.NodeName()) {
+		localNode.RLock()
+		defer localNode.RUnlock()
+		return localNode.addrs[network]
+	}
+
+	var ids []string
+	configured := false
+	for id, e := range r.peers {
+		if e.name == "" || !strings.EqualFold(e.name, name) {
+			continue
+		}
+		if e.configured && !configured {
+			// A configured name can't be claimed by anyone else
+			configured = true
+			ids = ids[:0]
+		}
+		if e.configured == configured {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		if !r.authorizedForLocked(id, network) {
+			continue
+		}
+		e := r.peers[id]
+		if ip := e.announced[network]; ip != nil {
+			return ip
+		}
+		if netCfg.Address == "auto" {
+			if addr, err := config.ResolveAddressForNetwork(network, id, r.netcfg); err == nil {
+				return net.ParseIP(addr)
+			}
+		}
+		if ip := e.overlay[network]; ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package peer
+
+import (
+	"net"
+	"testing"
+
+	"vibepn/config"
+)
+
+func TestResolveName(t *testing.T) {
+	netcfg := map[string]config.NetworkConfig{
+		"corp": {Prefix: "10.42.0.0/24", Address: "auto", Export: true},
+		"lab":  {Prefix: "10.77.0.0/24", Address: "10.77.0.1", Export: true},
+	}
+	peers := []config.Peer{{Name: "node2", Fingerprint: "fp-node2"}}
+	r := NewRegistry(config.Identity{}, peers, netcfg)
+
+	want, _ := config.ResolveAddressForNetwork("corp", "fp-node2", netcfg)
+	if got := r.ResolveName("corp", "NODE2"); got.String() != want {
+		t.Fatalf("auto network: got %v, want derived %s", got, want)
+	}
+
+	// Static networks only know what the peer's packets showed
+	if got := r.ResolveName("lab", "node2"); got != nil {
+		t.Fatalf("static network before traffic: got %v", got)
+	}
+	r.NoteAddress("fp-node2", "lab", net.ParseIP("192.168.1.5"))
+	r.NoteAddress("fp-node2", "lab", net.ParseIP("10.77.0.9"))
+	if got := r.ResolveName("lab", "node2"); !got.Equal(net.ParseIP("10.77.0.9")) {
+		t.Fatalf("static network: got %v, want the address seen on the network", got)
+	}
+
+	if r.ResolveName("corp", "node3") != nil || r.ResolveName("ops", "node2") != nil {
+		t.Fatal("unknown peer or network resolved")
+	}
+}
+
+func TestResolveNamePrefersConfiguredPeers(t *testing.T) {
+	netcfg := map[string]config.NetworkConfig{"lab": {Prefix: "10.77.0.0/24", Address: "10.77.0.1", Export: true}}
+	peers := []config.Peer{{Name: "node2", Fingerprint: "fp-node2"}}
+	r := NewRegistry(config.Identity{}, peers, netcfg)
+	r.peers["fp-node2"].announced = map[string]net.IP{"lab": net.ParseIP("10.77.0.2")}
+
+	// A certificate or gossip name never shadows a configured one
+	r.peers["fp-aaaa"] = &peerEntry{name: "node2", announced: map[string]net.IP{"lab": net.ParseIP("10.77.0.66")}}
+	for range 10 {
+		if got := r.ResolveName("lab", "node2"); !got.Equal(net.ParseIP("10.77.0.2")) {
+			t.Fatalf("got %v, want the configured peer's address", got)
+		}
+	}
+
+	// Without a configured owner, the lowest fingerprint answers
+	r.peers["fp-bbbb"] = &peerEntry{name: "node3", announced: map[string]net.IP{"lab": net.ParseIP("10.77.0.4")}}
+	r.peers["fp-cccc"] = &peerEntry{name: "node3", announced: map[string]net.IP{"lab": net.ParseIP("10.77.0.3")}}
+	for range 10 {
+		if got := r.ResolveName("lab", "node3"); !got.Equal(net.ParseIP("10.77.0.4")) {
+			t.Fatalf("got %v, want the lowest fingerprint's address", got)
+		}
+	}
+
+	// Peers not authorized for the network don't answer on it
+	r.peers["fp-bbbb"].members = []string{"corp"}
+	r.peers["fp-cccc"].members = []string{"corp"}
+	if got := r.ResolveName("lab", "node3"); got != nil {
+		t.Fatalf("unauthorized peer answered: %v", got)
+	}
+}
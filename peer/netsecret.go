@@ -0,0 +1,111 @@
+package peer
+
+import (
+	"slices"
+
+	"vibepn/control"
+	"vibepn/crypto"
+	"vibepn/log"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Networks with a pre-shared secret are only opened to a peer once it sent
+// a valid Network-Proof on the current connection. Both sides send theirs
+// as soon as they have the other's Hello nonce; routes for the network are
+// announced when the peer's proof checks out.
+
+// localNonce returns the Hello nonce we sent on conn, if it is still the
+// peer's active connection.
+func (r *Registry) localNonce(peerID string, conn quic.Connection) (uint64, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e := r.peers[peerID]
+	if e == nil || e.conn != conn {
+		return 0, false
+	}
+	return e.nonce, true
+}
+
+// sendNetworkProofs proves to the peer that we hold the secret of every
+// network that has one.
+func (r *Registry) sendNetworkProofs(peerID string, conn quic.Connection, stream quic.Stream, peerNonce uint64) {
+	logger := log.New("peer/netsecret")
+
+	networks := crypto.SecretNetworks()
+	if len(networks) == 0 {
+		return
+	}
+	myNonce, ok := r.localNonce(peerID, conn)
+	if !ok {
+		return
+	}
+	state := conn.ConnectionState().TLS
+	for _, network := range networks {
+		proof, err := crypto.NetworkProof(state, network, myNonce, peerNonce, crypto.LocalFingerprint(), peerID)
+		if err != nil {
+			logger.Warnf("Failed to compute proof for %s: %v", network, err)
+			continue
+		}
+		if err := control.SendNetworkProof(stream, network, proof); err != nil {
+			logger.Warnf("Failed to send proof for %s to %s: %v", network, peerID, err)
+		}
+	}
+}
+
+func (r *Registry) handleNetworkProof(body []byte, peerID string, conn quic.Connection, stream quic.Stream, peerNonce uint64) {
+	logger := log.New("peer/netsecret")
+
+	network, proof, ok := readString(body)
+	if !ok || len(proof) != crypto.NetworkProofSize {
+		logger.Warnf("Invalid network-proof from %s", peerID)
+		return
+	}
+	if !crypto.HasNetworkSecret(network) {
+		logger.Debugf("Ignoring proof from %s for %s, which has no secret here", peerID, network)
+		return
+	}
+	myNonce, ok := r.localNonce(peerID, conn)
+	if !ok {
+		return
+	}
+
+	// 🔐 The peer signs as sender, we check as receiver
+	if !crypto.VerifyNetworkProof(conn.ConnectionState().TLS, network, peerNonce, myNonce, peerID, crypto.LocalFingerprint(), proof) {
+		logger.Warnf("Peer %s failed the secret check for network %s", peerID, network)
+		control.PublishEvent("network_proof_failed", map[string]interface{}{
+			"peer":    peerID,
+			"network": network,
+		})
+		return
+	}
+
+	r.mu.Lock()
+	e := r.peers[peerID]
+	if e == nil || e.conn != conn || slices.Contains(e.proven, network) {
+		r.mu.Unlock()
+		return
+	}
+	e.proven = append(e.proven, network)
+	r.mu.Unlock()
+	logger.Infof("Peer %s proved it holds the secret of network %s", peerID, network)
+
+	// 📢 Now the network is open to the peer, announce our address and
+	// prefix on it
+	if ip := localAddress(network); ip != nil && r.hasCapability(peerID, control.CapAddress) {
+		r.sendAddress(peerID, stream, network, ip)
+	}
+	if r.leaseCoordinator(peerID, network) {
+		r.requestLease(stream, network)
+	}
+	if r.snooping(network) && r.hasCapability(peerID, control.CapMulticast) {
+		r.sendGroupsOn(peerID, stream, network)
+	}
+	netCfg, ok := control.GetNetConfig()[network]
+	if !ok || !netCfg.Export || !r.authorizedFor(peerID, network) {
+		return
+	}
+	if err := control.SendRouteAnnounce(stream, network, r.exportPrefixes(peerID, network, netCfg)); err != nil {
+		logger.Warnf("Failed to announce route for network %s: %v", network, err)
+	}
+}
@@ -0,0 +1,300 @@
+package peer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"vibepn/config"
+	"vibepn/control"
+	"vibepn/crypto"
+	"vibepn/log"
+	"vibepn/metrics"
+
+	"github.com/quic-go/quic-go"
+)
+
+// errPunchedInbound is returned by punch when the peer's simultaneous dial
+// won: the connection arrived inbound and nothing is left to dial.
+var errPunchedInbound = errors.New("punch completed inbound")
+
+const (
+	punchWait    = 3 * time.Second // how long a rendezvous peer has to answer
+	punchTimeout = 5 * time.Second // dial timeout once the reflexive address is known
+
+	// A rendezvous can make us dial an address of its choosing, so
+	// responder dials are limited: one per target per punchCooldown and
+	// maxPunchBacks at a time.
+	punchCooldown = 30 * time.Second
+	maxPunchBacks = 4
+)
+
+// Hole punching works through a rendezvous: a peer connected to both
+// sides. The initiator sends it Punch(target, ""); the rendezvous answers
+// each side with Punch(other, other's observed address) and both dial each
+// other from their listener socket at the same time, so each NAT sees
+// outgoing traffic before the other side's packets arrive.
+var punches struct {
+	sync.Mutex
+	waiters   map[string]*punchWaiter // target fingerprint → our pending punch
+	responded map[string]time.Time    // target fingerprint → last responder dial
+	inFlight  int                     // responder dials running
+}
+
+// punchWaiter receives the reflexive address of a target from one of the
+// rendezvous peers we asked.
+type punchWaiter struct {
+	ch    chan string
+	asked map[string]bool
+}
+
+func init() {
+	punches.waiters = make(map[string]*punchWaiter)
+	punches.responded = make(map[string]time.Time)
+}
+
+// punch tries to reach p through any connected peer that can broker it.
+func (r *Registry) punch(p config.Peer, tlsConf *tls.Config) (quic.Connection, error) {
+	logger := log.New("peer/punch")
+
+	rendezvous := r.punchCapableStreams(p.Fingerprint)
+	if len(rendezvous) == 0 {
+		return nil, errors.New("no rendezvous peer available")
+	}
+
+	waiter := &punchWaiter{ch: make(chan string, 1), asked: make(map[string]bool)}
+	for id := range rendezvous {
+		waiter.asked[id] = true
+	}
+	punches.Lock()
+	punches.waiters[p.Fingerprint] = waiter
+	punches.Unlock()
+	defer func() {
+		punches.Lock()
+		delete(punches.waiters, p.Fingerprint)
+		punches.Unlock()
+	}()
+
+	for id, stream := range rendezvous {
+		if err := control.SendPunch(stream, p.Fingerprint, ""); err != nil {
+			logger.Warnf("Failed to ask %s to broker punch to %s: %v", id, p.Name, err)
+		}
+	}
+
+	var addr string
+	select {
+	case addr = <-waiter.ch:
+	case <-time.After(punchWait):
+		return nil, fmt.Errorf("no rendezvous peer is connected to %s", p.Name)
+	}
+
+	metrics.NATPunchAttempts.WithLabelValues("initiator").Inc()
+	logger.Infof("Punching to %s at %s", p.Name, addr)
+
+	conn, err := dialPunch(addr, tlsConf)
+	if err != nil {
+		// The peer's simultaneous dial may have won and arrived inbound
+		if !r.directlyConnected(p.Fingerprint) {
+			return nil, fmt.Errorf("punch to %s at %s: %w", p.Name, addr, err)
+		}
+		err = errPunchedInbound
+	}
+	metrics.NATPunchSuccesses.WithLabelValues("initiator").Inc()
+	return conn, err
+}
+
+func dialPunch(addr string, tlsConf *tls.Config) (quic.Connection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), punchTimeout)
+	defer cancel()
+	return dial(ctx, addr, tlsConf)
+}
+
+// punchCapableStreams returns the control streams of connected peers that
+// can act as rendezvous, excluding target itself.
+func (r *Registry) punchCapableStreams(target string) map[string]quic.Stream {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make(map[string]quic.Stream)
+	for id, e := range r.peers {
+		if id == target || e.control == nil || e.caps&control.CapNATPunch == 0 || relayedVia(e.conn) != "" {
+			continue
+		}
+		out[id] = e.control
+	}
+	return out
+}
+
+func (r *Registry) handleObservedAddr(body []byte, peerID string) {
+	addr, _, ok := readString(body)
+	if !ok {
+		log.New("peer/punch").Warnf("Invalid observed-address payload")
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e := r.peers[peerID]; e != nil {
+		e.observedAs = addr
+	}
+}
+
+func (r *Registry) handlePunch(body []byte, peerID string) {
+	logger := log.New("peer/punch")
+
+	target, rest, ok := readString(body)
+	if !ok {
+		logger.Warnf("Invalid punch payload")
+		return
+	}
+	addr, _, ok := readString(rest)
+	if !ok {
+		logger.Warnf("Invalid punch address")
+		return
+	}
+
+	if addr == "" {
+		r.brokerPunch(peerID, target)
+		return
+	}
+
+	punches.Lock()
+	waiter := punches.waiters[target]
+	punches.Unlock()
+	if waiter != nil {
+		if !waiter.asked[peerID] {
+			logger.Warnf("Ignoring punch to %s from %s: not a rendezvous we asked", target, peerID)
+			return
+		}
+		select {
+		case waiter.ch <- addr:
+		default:
+		}
+		return
+	}
+
+	if target == r.identity.Fingerprint || r.directlyConnected(target) || !r.IsEnabled(target) {
+		return
+	}
+	// 🛡️ Only a configured peer may have us dial someone unasked
+	if !r.isConfigured(peerID) || !r.hasCapability(peerID, control.CapNATPunch) {
+		logger.Warnf("Ignoring punch to %s from %s: not a configured rendezvous", target, peerID)
+		return
+	}
+	if !startPunchBack(target, time.Now()) {
+		logger.Debugf("Ignoring punch to %s from %s: responder dials limited", target, peerID)
+		return
+	}
+	go func() {
+		defer endPunchBack()
+		r.punchBack(target, addr)
+	}()
+}
+
+// startPunchBack reserves a responder dial to target, unless one was made
+// within punchCooldown or maxPunchBacks are running.
+func startPunchBack(target string, now time.Time) bool {
+	punches.Lock()
+	defer punches.Unlock()
+	if now.Sub(punches.responded[target]) < punchCooldown || punches.inFlight >= maxPunchBacks {
+		return false
+	}
+	for t, at := range punches.responded {
+		if now.Sub(at) >= punchCooldown {
+			delete(punches.responded, t)
+		}
+	}
+	punches.responded[target] = now
+	punches.inFlight++
+	return true
+}
+
+func endPunchBack() {
+	punches.Lock()
+	punches.inFlight--
+	punches.Unlock()
+}
+
+// brokerPunch acts as rendezvous between requester and target, handing
+// each the address the other's packets arrive from.
+func (r *Registry) brokerPunch(requester, target string) {
+	logger := log.New("peer/punch")
+
+	if requester == target {
+		return
+	}
+	if !r.hasCapability(target, control.CapNATPunch) {
+		logger.Debugf("Cannot broker punch from %s: %s is not connected or cannot punch", requester, target)
+		return
+	}
+	reqConn, reqStream := r.Get(requester), r.controlStream(requester)
+	targetConn, targetStream := r.Get(target), r.controlStream(target)
+	if reqConn == nil || reqStream == nil || targetConn == nil || targetStream == nil {
+		return
+	}
+	if relayedVia(reqConn) != "" || relayedVia(targetConn) != "" {
+		logger.Debugf("Cannot broker punch between %s and %s: no observed address for relayed peers", requester, target)
+		return
+	}
+
+	logger.Infof("Brokering hole punch between %s (%s) and %s (%s)",
+		requester, reqConn.RemoteAddr(), target, targetConn.RemoteAddr())
+
+	if err := control.SendPunch(targetStream, requester, reqConn.RemoteAddr().String()); err != nil {
+		logger.Warnf("Failed to send punch to %s: %v", target, err)
+		return
+	}
+	if err := control.SendPunch(reqStream, target, targetConn.RemoteAddr().String()); err != nil {
+		logger.Warnf("Failed to send punch to %s: %v", requester, err)
+	}
+}
+
+// punchBack is the responder side: dial the initiator so our NAT lets its
+// packets in. The initiator may not be in our config, so its certificate is
+// pinned to the fingerprint the rendezvous vouched for.
+func (r *Registry) punchBack(peerID, addr string) {
+	logger := log.New("peer/punch")
+	metrics.NATPunchAttempts.WithLabelValues("responder").Inc()
+
+	tlsConf, err := crypto.LoadPeerTLSPinned(peerID, r.identity.Cert, r.identity.Key)
+	if err != nil {
+		logger.Errorf("Failed to create TLS config for punch to %s: %v", peerID, err)
+		return
+	}
+
+	logger.Infof("Punching back to %s at %s", peerID, addr)
+	conn, err := dialPunch(addr, tlsConf)
+	if err != nil && !r.directlyConnected(peerID) {
+		logger.Warnf("Punch to %s at %s failed: %v", peerID, addr, err)
+		return
+	}
+	metrics.NATPunchSuccesses.WithLabelValues("responder").Inc()
+	if err != nil {
+		return // the initiator's dial won and arrived inbound
+	}
+
+	if _, err := r.startOutboundSession(conn, r.configuredPeer(peerID), r.netcfg); err != nil {
+		logger.Warnf("Failed to start session with %s after punch: %v", peerID, err)
+	}
+}
+
+func (r *Registry) isConfigured(peerID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e := r.peers[peerID]
+	return e != nil && e.configured
+}
+
+// configuredPeer returns what the config says about peerID, or a bare
+// fingerprint for peers we only know through a rendezvous.
+func (r *Registry) configuredPeer(peerID string) config.Peer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if e := r.peers[peerID]; e != nil && e.configured {
+		return config.Peer{Name: e.name, Addresses: e.addresses, Fingerprint: peerID}
+	}
+	return config.Peer{Fingerprint: peerID}
+}
@@ -0,0 +1,68 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"vibepn/config"
+)
+
+func punchBody(target, addr string) []byte {
+	body := append([]byte{byte(len(target))}, target...)
+	body = append(body, byte(len(addr)))
+	return append(body, addr...)
+}
+
+func TestPunchOnlyFromAskedRendezvous(t *testing.T) {
+	r := NewRegistry(config.Identity{}, []config.Peer{{Name: "rv", Fingerprint: "fp-rv"}}, nil)
+	waiter := &punchWaiter{ch: make(chan string, 1), asked: map[string]bool{"fp-rv": true}}
+	punches.Lock()
+	punches.waiters["fp-target"] = waiter
+	punches.Unlock()
+	t.Cleanup(func() {
+		punches.Lock()
+		delete(punches.waiters, "fp-target")
+		punches.Unlock()
+	})
+
+	r.handlePunch(punchBody("fp-target", "198.51.100.7:51820"), "fp-other")
+	select {
+	case addr := <-waiter.ch:
+		t.Fatalf("took address %s from a peer we did not ask", addr)
+	default:
+	}
+
+	r.handlePunch(punchBody("fp-target", "203.0.113.9:51820"), "fp-rv")
+	if addr := <-waiter.ch; addr != "203.0.113.9:51820" {
+		t.Fatalf("address from our rendezvous = %q", addr)
+	}
+}
+
+func TestPunchBackLimits(t *testing.T) {
+	t.Cleanup(func() {
+		punches.Lock()
+		punches.responded = make(map[string]time.Time)
+		punches.inFlight = 0
+		punches.Unlock()
+	})
+	now := time.Now()
+
+	if !startPunchBack("fp-a", now) {
+		t.Fatal("first responder dial refused")
+	}
+	if startPunchBack("fp-a", now.Add(time.Second)) {
+		t.Fatal("second dial to the same target within the cooldown allowed")
+	}
+	for i := range maxPunchBacks - 1 {
+		if !startPunchBack(string(rune('b'+i)), now) {
+			t.Fatalf("dial %d refused below the limit", i+2)
+		}
+	}
+	if startPunchBack("fp-z", now) {
+		t.Fatal("dial allowed past maxPunchBacks in flight")
+	}
+	endPunchBack()
+	if !startPunchBack("fp-z", now) {
+		t.Fatal("dial refused after one finished")
+	}
+}
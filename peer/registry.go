@@ -1,25 +1,109 @@
 package peer
 
 import (
-	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"vibepn/config"
 	"vibepn/control"
+	"vibepn/crypto"
 	"vibepn/log"
+	"vibepn/shared"
 
 	gquic "github.com/quic-go/quic-go" // alias to avoid conflict
 )
 
+type Direction string
+
+const (
+	Inbound  Direction = "inbound"
+	Outbound Direction = "outbound"
+)
+
+// peerEntry is the single authoritative record for a peer: what the config
+// says about it, its current connection, liveness, and counters.
+type peerEntry struct {
+	id         string
+	name       string
+	addresses  []string
+	configured bool
+	discovered bool // learned through gossip
+	disabled   bool
+
+	conn        gquic.Connection
+	control     gquic.Stream
+	direction   Direction
+	endpoint    string // configured address an outbound connection was dialed through
+	remote      string // last remote address seen on conn, to notice migrations
+	connectedAt time.Time
+	lastSeen    time.Time
+	caps        uint32
+	observedAs  string // our address as seen by the peer
+
+	// networks the peer's CA-issued certificate authorizes; only enforced
+	// when restricted
+	networks   []string
+	restricted bool
+
+	// networks the peer is configured or discovered in; without any, it
+	// is a member of our exported networks only
+	members []string
+
+	exits     map[string][]string // network → default routes the peer offers us as exit
+	subnets   map[string][]string // network → accepted subnets the peer routes for us
+	overlay   map[string]net.IP   // network → address last seen in the peer's packets
+	announced map[string]net.IP   // network → address the peer announced
+	groups    map[string][]net.IP // network → multicast groups the peer listens to
+
+	nonce  uint64   // our Hello nonce on conn
+	proven []string // secret networks the peer proved it may join on conn
+
+	rtt           time.Duration
+	jitter        time.Duration
+	bytesSent     uint64
+	bytesReceived uint64
+	txRate        float64
+	rxRate        float64
+
+	// byte counters at the previous rate sample
+	sampledAt   time.Time
+	sampledSent uint64
+	sampledRecv uint64
+}
+
 type Registry struct {
 	mu           sync.RWMutex
-	conns        map[string]gquic.Connection // peerID → connection
+	peers        map[string]*peerEntry // fingerprint → entry
 	logger       *log.Logger
 	identity     config.Identity
 	netcfg       map[string]config.NetworkConfig
 	onConnect    func(peerID string, conn gquic.Connection) // 🧠 callback on new connection
 	onDisconnect func(peerID string)                        // 🧠 NEW: callback on full disconnect
+
+	lastEndpoints map[string]string // peerKey → last endpoint that worked
+
+	relay        *relayConn
+	relayEnabled bool
+	relayLimiter *tokenBucket // nil: unlimited
+
+	exitOffer   *config.ExitNode // set when we offer ourselves as exit
+	exitUse     exitChoice       // exit chosen for our own default traffic
+	exitApplied exitChoice       // exit the route table and host routing follow
+	exitMu      sync.Mutex       // serializes applyExit
+	onExit      func(network string, enable bool) error
+
+	subnetsApplied map[subnetRoute]bool // host routes in place for peers' subnets
+	subnetMu       sync.Mutex           // serializes applySubnets
+	onSubnet       func(network, prefix string, add bool) error
+
+	addrState     config.AddressState // auto address attempt per network
+	addrStatePath string
+	addrMu        sync.Mutex // serializes moveAddress
+	onReaddress   func(network, addr string) error
 }
 
 var peerNonces struct {
@@ -44,40 +128,129 @@ func getPeerNonce(peerID string) (uint64, bool) {
 	return nonce, ok
 }
 
-func NewRegistry(identity config.Identity, netcfg map[string]config.NetworkConfig) *Registry {
-	return &Registry{
-		conns:    make(map[string]gquic.Connection),
-		logger:   log.New("peer/registry"),
-		identity: identity,
-		netcfg:   netcfg,
+func NewRegistry(identity config.Identity, peers []config.Peer, netcfg map[string]config.NetworkConfig) *Registry {
+	r := &Registry{
+		peers:         make(map[string]*peerEntry),
+		logger:        log.New("peer/registry"),
+		identity:      identity,
+		netcfg:        netcfg,
+		lastEndpoints: make(map[string]string),
+	}
+	r.relay = newRelayConn(r)
+
+	for _, p := range peers {
+		if p.Fingerprint == "" {
+			continue // TOFU peers are keyed once their certificate is seen
+		}
+		r.peers[p.Fingerprint] = &peerEntry{
+			id:         p.Fingerprint,
+			name:       p.Name,
+			addresses:  p.Candidates(),
+			members:    p.Networks,
+			configured: true,
+		}
 	}
+	return r
 }
 
+// Add registers an inbound connection.
 func (r *Registry) Add(peerID string, conn gquic.Connection, myNonce uint64) {
+	r.add(peerID, conn, myNonce, Inbound, nil)
+}
+
+// AddOutbound registers a connection dialed to a configured peer and
+// returns the peer's fingerprint as presented in the TLS handshake.
+func (r *Registry) AddOutbound(p config.Peer, conn gquic.Connection, myNonce uint64) string {
+	peerID := p.Fingerprint
+	if certs := conn.ConnectionState().TLS.PeerCertificates; len(certs) > 0 {
+		peerID = crypto.Fingerprint(certs[0].Raw)
+	}
+
+	// Peers reached through a hole punch may be known by fingerprint only
+	cfgPeer := &p
+	if p.Name == "" && len(p.Candidates()) == 0 {
+		cfgPeer = nil
+	}
+	r.add(peerID, conn, myNonce, Outbound, cfgPeer)
+	return peerID
+}
+
+func (r *Registry) add(peerID string, conn gquic.Connection, myNonce uint64, dir Direction, cfgPeer *config.Peer) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	existing := r.conns[peerID]
-	if existing != nil {
+	e := r.peers[peerID]
+	if e == nil {
+		e = &peerEntry{id: peerID}
+		r.peers[peerID] = e
+	}
+	if cfgPeer != nil && !e.discovered {
+		e.name = cfgPeer.Name
+		e.addresses = cfgPeer.Candidates()
+		e.members = cfgPeer.Networks
+		e.configured = true
+	}
+	certs := conn.ConnectionState().TLS.PeerCertificates
+	if e.name == "" && len(certs) > 0 {
+		e.name = certs[0].Subject.CommonName
+	}
+
+	if e.disabled {
+		r.logger.Warnf("Rejecting connection for disabled peer %s", peerID)
+		closeConn(conn, "peer disabled")
+		return
+	}
+
+	existing := e.conn
+	switch {
+	case existing == nil:
+	case relayedVia(existing) != "" && relayedVia(conn) == "":
+		// 🚀 A direct path always beats a relay
+		r.logger.Infof("Direct connection to %s replaces relay via %s", peerID, relayedVia(existing))
+		closeConn(existing, "upgraded to direct path")
+	case relayedVia(existing) == "" && relayedVia(conn) != "":
+		r.logger.Infof("Already directly connected to %s, dropping relayed connection", peerID)
+		closeConn(conn, "direct path exists")
+		return
+	default:
 		peerNonce, ok := getPeerNonce(peerID)
 		if !ok {
 			r.logger.Warnf("No peer nonce yet for %s, keeping existing connection", peerID)
-			conn.CloseWithError(0, "duplicate connection (no peer nonce)")
+			closeConn(conn, "duplicate connection (no peer nonce)")
 			return
 		}
 
 		if myNonce < peerNonce {
 			r.logger.Warnf("Duplicate connection for peer %s, keeping outgoing (I win tie-break)", peerID)
-			existing.CloseWithError(0, "duplicate connection (loser)")
+			closeConn(existing, "duplicate connection (loser)")
 		} else {
 			r.logger.Warnf("Duplicate connection for peer %s, keeping incoming (peer wins tie-break)", peerID)
-			conn.CloseWithError(0, "duplicate connection (loser)")
+			closeConn(conn, "duplicate connection (loser)")
 			return
 		}
 	}
 
-	r.conns[peerID] = conn
-	r.logger.Infof("Registered connection for peer %s", peerID)
+	now := time.Now()
+	e.conn = conn
+	e.control = nil
+	e.direction = dir
+	e.endpoint = ""
+	e.remote = conn.RemoteAddr().String()
+	e.connectedAt = now
+	e.lastSeen = now
+	e.caps = 0
+	e.observedAs = ""
+	e.networks, e.restricted = nil, false
+	e.nonce, e.proven = myNonce, nil
+	e.exits = nil
+	e.groups = nil
+	if crypto.CAEnabled() && len(certs) > 0 {
+		e.networks, e.restricted = crypto.CertNetworks(certs[0])
+	}
+	e.sampledAt = now
+	e.sampledSent, e.sampledRecv = e.bytesSent, e.bytesReceived
+	bindQUICStats(peerID, conn)
+	r.logger.Infof("Registered %s connection for peer %s", dir, peerID)
 
 	if r.onConnect != nil {
 		r.onConnect(peerID, conn)
@@ -95,17 +268,44 @@ func (r *Registry) removeConnection(peerID string, closedConn gquic.Connection)
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	existing := r.conns[peerID]
-	if existing == closedConn {
-		r.logger.Infof("Removing connection for peer %s", peerID)
-		delete(r.conns, peerID)
+	e := r.peers[peerID]
+	if e == nil || e.conn != closedConn {
+		r.logger.Infof("Closed connection was not active for peer %s, keeping current connection", peerID)
+		return
+	}
+
+	r.logger.Infof("Removing connection for peer %s", peerID)
+	e.conn = nil
+	e.control = nil
+	e.caps = 0
+	e.proven = nil
+	hadExit := len(e.exits) > 0
+	e.exits = nil
+	hadSubnets := len(e.subnets) > 0
+	e.subnets = nil
+	e.groups = nil
+	if !e.configured && !e.discovered && !e.disabled {
+		delete(r.peers, peerID)
+	}
+
+	// 🧠 Only if no connection left, trigger onDisconnect
+	if r.onDisconnect != nil {
+		r.onDisconnect(peerID)
+	}
 
-		// 🧠 Only if no connection left, trigger onDisconnect
-		if r.onDisconnect != nil {
-			r.onDisconnect(peerID)
+	// Connections this peer was relaying for us cannot survive it
+	for id, other := range r.peers {
+		if other.conn != nil && relayedVia(other.conn) == peerID {
+			r.logger.Infof("Relay %s gone, closing relayed connection to %s", peerID, id)
+			closeConn(other.conn, "relay disconnected")
 		}
-	} else {
-		r.logger.Infof("Closed connection was not active for peer %s, keeping current connection", peerID)
+	}
+
+	if hadExit {
+		go r.applyExit()
+	}
+	if hadSubnets {
+		go r.applySubnets()
 	}
 }
 
@@ -115,16 +315,21 @@ func (r *Registry) removeConnection(peerID string, closedConn gquic.Connection)
 func (r *Registry) Get(peerID string) gquic.Connection {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	return r.conns[peerID]
+	if e := r.peers[peerID]; e != nil {
+		return e.conn
+	}
+	return nil
 }
 
 func (r *Registry) All() map[string]gquic.Connection {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	out := make(map[string]gquic.Connection, len(r.conns))
-	for k, v := range r.conns {
-		out[k] = v
+	out := make(map[string]gquic.Connection, len(r.peers))
+	for id, e := range r.peers {
+		if e.conn != nil {
+			out[id] = e.conn
+		}
 	}
 	return out
 }
@@ -132,22 +337,223 @@ func (r *Registry) All() map[string]gquic.Connection {
 func (r *Registry) DisconnectAll() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	for peerID, conn := range r.conns {
+	for peerID, e := range r.peers {
+		if e.conn == nil {
+			continue
+		}
 		// 🔥 Try to say Goodbye before closing
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		stream, err := conn.OpenStreamSync(ctx)
-		cancel()
-		if err == nil {
-			_ = control.SendGoodbye(stream)
-			_ = stream.Close()
-		} else {
-			r.logger.Warnf("Failed to open stream to peer %s for goodbye: %v", peerID, err)
+		if e.control != nil {
+			_ = control.SendGoodbye(e.control)
 		}
 
-		_ = conn.CloseWithError(0, "shutdown")
+		closeConn(e.conn, "shutdown")
+		e.conn = nil
+		e.control = nil
 		r.logger.Infof("Disconnected from peer %s", peerID)
 	}
-	r.conns = map[string]gquic.Connection{}
+}
+
+// SetEnabled administratively enables or disables a peer. Disabling closes
+// any active connection and refuses new ones until re-enabled.
+func (r *Registry) SetEnabled(peerID string, enabled bool) {
+	r.mu.Lock()
+	e := r.peers[peerID]
+	if e == nil {
+		e = &peerEntry{id: peerID}
+		r.peers[peerID] = e
+	}
+	e.disabled = !enabled
+	conn := e.conn
+	r.mu.Unlock()
+
+	if enabled {
+		r.logger.Infof("Peer %s enabled", peerID)
+		return
+	}
+	r.logger.Infof("Peer %s disabled", peerID)
+	if conn != nil {
+		closeConn(conn, "peer disabled")
+	}
+}
+
+func (r *Registry) IsEnabled(peerID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e := r.peers[peerID]
+	return e == nil || !e.disabled
+}
+
+// setEndpoint records which configured address conn was dialed through.
+func (r *Registry) setEndpoint(peerID string, conn gquic.Connection, endpoint string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e := r.peers[peerID]; e != nil && e.conn == conn {
+		e.endpoint = endpoint
+	}
+}
+
+// setControlStream attaches stream to the peer if conn is still the
+// peer's active connection.
+func (r *Registry) setControlStream(peerID string, conn gquic.Connection, stream gquic.Stream) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.peers[peerID]
+	if e == nil || e.conn != conn {
+		return false
+	}
+	e.control = stream
+	return true
+}
+
+func (r *Registry) clearControlStream(peerID string, stream gquic.Stream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e := r.peers[peerID]; e != nil && e.control == stream {
+		e.control = nil
+	}
+}
+
+func (r *Registry) controlStream(peerID string) gquic.Stream {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if e := r.peers[peerID]; e != nil {
+		return e.control
+	}
+	return nil
+}
+
+// setCapabilities records the features both sides advertised in Hello.
+func (r *Registry) setCapabilities(peerID string, peerCaps uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e := r.peers[peerID]; e != nil {
+		e.caps = control.NegotiateCapabilities(peerCaps)
+	}
+}
+
+// authorizedFor reports whether the peer may take part in network: it must
+// be a member (see peerEntry.members), its certificate must allow it (only
+// checked in CA mode) and, if the network has a secret, the peer must have
+// proven it holds it.
+func (r *Registry) authorizedFor(peerID, network string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.authorizedForLocked(peerID, network)
+}
+
+func (r *Registry) authorizedForLocked(peerID, network string) bool {
+	e := r.peers[peerID]
+	if e == nil || (e.restricted && !slices.Contains(e.networks, network)) {
+		return false
+	}
+	if len(e.members) > 0 {
+		if !slices.Contains(e.members, network) {
+			return false
+		}
+	} else if !r.netcfg[network].Export {
+		return false
+	}
+	return !crypto.HasNetworkSecret(network) || slices.Contains(e.proven, network)
+}
+
+// Authorized is authorizedFor for the data plane.
+func (r *Registry) Authorized(peerID, network string) bool {
+	return r.authorizedFor(peerID, network)
+}
+
+func (r *Registry) hasCapability(peerID string, bit uint32) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e := r.peers[peerID]
+	return e != nil && e.caps&bit != 0
+}
+
+// resolve maps a peer name to its fingerprint; anything else is assumed to
+// already be a fingerprint.
+func (r *Registry) resolve(peer string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.resolveLocked(peer)
+}
+
+// resolveLocked is resolve for callers holding r.mu.
+func (r *Registry) resolveLocked(peer string) string {
+	if _, ok := r.peers[peer]; ok {
+		return peer
+	}
+	for id, e := range r.peers {
+		if e.name == peer {
+			return id
+		}
+	}
+	return peer
+}
+
+// hasName reports whether our config or an invite calls the peer name. A
+// name from its certificate or gossip record is its own claim and never
+// matches.
+func (e *peerEntry) hasName(name string) bool {
+	return name != "" && e.configured && e.name == name
+}
+
+// AnnounceRoute sends a Route-Announce on the peer's control stream. Peers
+// not authorized for network are skipped.
+func (r *Registry) AnnounceRoute(peerID, network string, prefixes []string) error {
+	if !r.authorizedFor(peerID, network) {
+		return nil
+	}
+	stream := r.controlStream(peerID)
+	if stream == nil {
+		return fmt.Errorf("no control stream for peer %s", peerID)
+	}
+	return control.SendRouteAnnounce(stream, network, prefixes)
+}
+
+func (r *Registry) ListPeers() []shared.PeerState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make([]shared.PeerState, 0, len(r.peers))
+	for id, e := range r.peers {
+		p := shared.PeerState{
+			ID:            id,
+			LastSeen:      e.lastSeen,
+			Name:          e.name,
+			Address:       strings.Join(e.addresses, ", "),
+			Direction:     string(e.direction),
+			Endpoint:      e.endpoint,
+			Networks:      e.networks,
+			ExitNetworks:  exitNetworks(e.exits),
+			Subnets:       subnetPrefixes(e.subnets),
+			Connected:     e.conn != nil,
+			ConnectedAt:   e.connectedAt,
+			Disabled:      e.disabled,
+			Discovered:    e.discovered,
+			Capabilities:  e.caps,
+			ObservedAddr:  e.observedAs,
+			RTT:           e.rtt,
+			Jitter:        e.jitter,
+			BytesSent:     e.bytesSent,
+			BytesReceived: e.bytesReceived,
+			TxRate:        e.txRate,
+			RxRate:        e.rxRate,
+		}
+		if e.conn != nil {
+			if via := relayedVia(e.conn); via != "" {
+				p.RelayVia = via
+			} else {
+				p.Remote = e.conn.RemoteAddr().String()
+			}
+			if s := peerQUICStats(id); s != nil {
+				p.QUICRTT = time.Duration(s.rtt.Load())
+				p.CongestionWindow = s.cwnd.Load()
+				p.PacketsSent = s.packetsSent.Load()
+				p.PacketsLost = s.packetsLost.Load()
+			}
+		}
+		out = append(out, p)
+	}
+	return out
 }
 
 func (r *Registry) Identity() config.Identity {
@@ -0,0 +1,116 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+
+	"vibepn/config"
+	"vibepn/control"
+	"vibepn/crypto"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestAuthorizedForMembership(t *testing.T) {
+	netcfg := map[string]config.NetworkConfig{
+		"corp":  {Prefix: "10.42.0.0/24", Export: true},
+		"local": {Prefix: "10.99.0.0/24"},
+		"lab":   {Prefix: "10.77.0.0/24", Export: true},
+	}
+	peers := []config.Peer{{Name: "node2", Fingerprint: "fp-node2", Networks: []string{"corp"}}}
+	r := NewRegistry(config.Identity{}, peers, netcfg)
+	r.peers["fp-stranger"] = &peerEntry{id: "fp-stranger"}
+
+	cases := []struct {
+		peer, network string
+		want          bool
+	}{
+		{"fp-node2", "corp", true},
+		{"fp-node2", "lab", false},        // not listed for the peer
+		{"fp-stranger", "lab", true},      // exported, open to unlisted peers
+		{"fp-stranger", "local", false},   // not exported
+		{"fp-stranger", "unknown", false}, // not a local network
+		{"fp-nobody", "corp", false},
+	}
+	for _, c := range cases {
+		if got := r.authorizedFor(c.peer, c.network); got != c.want {
+			t.Errorf("authorizedFor(%s, %s) = %v, want %v", c.peer, c.network, got, c.want)
+		}
+	}
+
+	// A network secret also requires a proof on the connection
+	crypto.SetNetworkSecrets(map[string][]byte{"corp": []byte("0123456789abcdef")})
+	t.Cleanup(func() { crypto.SetNetworkSecrets(nil) })
+	if r.authorizedFor("fp-node2", "corp") {
+		t.Fatal("member without proof authorized for a secret network")
+	}
+	r.peers["fp-node2"].proven = []string{"corp"}
+	if !r.authorizedFor("fp-node2", "corp") {
+		t.Fatal("member with proof not authorized")
+	}
+}
+
+// helloConn is an inbound connection whose peer only says Hello.
+type helloConn struct{ quic.Connection }
+
+func (helloConn) RemoteAddr() net.Addr                                   { return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820} }
+func (helloConn) CloseWithError(quic.ApplicationErrorCode, string) error { return nil }
+
+// scriptStream plays back in and keeps what is written to it.
+type scriptStream struct {
+	quic.Stream
+	in  *bytes.Reader
+	mu  sync.Mutex
+	out bytes.Buffer
+}
+
+func (s *scriptStream) Read(p []byte) (int, error) { return s.in.Read(p) }
+func (s *scriptStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.Write(p)
+}
+func (s *scriptStream) Context() context.Context { return context.Background() }
+
+func TestHelloAnnouncesOnlyProvenSecretNetworks(t *testing.T) {
+	crypto.SetNetworkSecrets(map[string][]byte{"vault": []byte("0123456789abcdef")})
+	t.Cleanup(func() { crypto.SetNetworkSecrets(nil) })
+	netcfg := map[string]config.NetworkConfig{
+		"corp":  {Prefix: "10.42.0.0/24", Export: true},
+		"vault": {Prefix: "10.66.0.0/24", Export: true},
+	}
+	control.RegisterNetConfig(netcfg)
+	t.Cleanup(func() { control.RegisterNetConfig(nil) })
+
+	r := NewRegistry(config.Identity{}, nil, netcfg)
+	conn := helloConn{}
+	r.peers["fp-stranger"] = &peerEntry{id: "fp-stranger", conn: conn}
+
+	hello := []byte{0, 13, 'H'}
+	hello = binary.BigEndian.AppendUint64(hello, 2)
+	hello = binary.BigEndian.AppendUint32(hello, 0)
+	stream := &scriptStream{in: bytes.NewReader(hello)}
+	r.HandleControlStream(conn, stream, "fp-stranger")
+
+	stream.mu.Lock()
+	out := stream.out.Bytes()
+	stream.mu.Unlock()
+	var announced []string
+	for len(out) >= 3 {
+		n := int(binary.BigEndian.Uint16(out))
+		msg := out[2 : 2+n]
+		out = out[2+n:]
+		if msg[0] == 'A' {
+			network, _, _ := readString(msg[1:])
+			announced = append(announced, network)
+		}
+	}
+	if !slices.Equal(announced, []string{"corp"}) {
+		t.Fatalf("announced %v to a peer without the vault secret, want only corp", announced)
+	}
+}
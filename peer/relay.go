@@ -0,0 +1,550 @@
+package peer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"vibepn/config"
+	"vibepn/control"
+	"vibepn/log"
+	"vibepn/metrics"
+
+	"github.com/quic-go/quic-go"
+)
+
+// A relayed peer is reached with an ordinary QUIC connection whose packets
+// travel over a raw stream to a relay instead of UDP. The relay only copies
+// opaque, end-to-end encrypted bytes between two streams; the connection
+// itself, including TLS and fingerprint checks, is between the two peers.
+//
+// Relay streams start with the raw-frame escape (network length 0), a kind
+// byte and a 32-byte fingerprint, then carry 2-byte length-prefixed packets
+// in both directions.
+const (
+	relayConnect   = 1 // to a relay: forward this stream to fingerprint
+	relayDelivered = 2 // from a relay: this stream comes from fingerprint
+
+	relayUpgradeInterval = time.Minute
+	relayQueueLen        = 256
+
+	// maxRelayStreams bounds the relay sessions one source may hold open,
+	// so no peer takes the whole relay budget.
+	maxRelayStreams = 8
+)
+
+var relayStreams struct {
+	sync.Mutex
+	bySource map[string]int // source fingerprint → sessions we relay for it
+}
+
+func init() {
+	relayStreams.bySource = make(map[string]int)
+}
+
+// RelayAddr is the remote address of a connection carried by a relay.
+type RelayAddr struct {
+	Via  string // relay fingerprint
+	Peer string // far end fingerprint
+}
+
+func (a *RelayAddr) Network() string { return "relay" }
+func (a *RelayAddr) String() string  { return "relay:" + a.Via + "/" + a.Peer }
+
+// relayedVia returns the relay carrying conn, or "" for a direct connection.
+func relayedVia(conn quic.Connection) string {
+	if a, ok := conn.RemoteAddr().(*RelayAddr); ok {
+		return a.Via
+	}
+	return ""
+}
+
+type relayPacket struct {
+	data []byte
+	addr *RelayAddr
+}
+
+type relaySession struct {
+	mu     sync.Mutex
+	stream quic.Stream
+}
+
+// relayConn is the net.PacketConn under the relay transport. Writes go to
+// the session stream for the destination, opening one through the relay on
+// first use; packets from all sessions are read from a single queue.
+type relayConn struct {
+	registry *Registry
+	incoming chan relayPacket
+	closed   chan struct{}
+	once     sync.Once
+
+	mu       sync.Mutex
+	sessions map[string]*relaySession // RelayAddr.String() → session
+	deadline time.Time
+	wake     chan struct{} // closed when the read deadline changes
+}
+
+func newRelayConn(r *Registry) *relayConn {
+	return &relayConn{
+		registry: r,
+		incoming: make(chan relayPacket, relayQueueLen),
+		closed:   make(chan struct{}),
+		sessions: make(map[string]*relaySession),
+		wake:     make(chan struct{}),
+	}
+}
+
+func (c *relayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, wake := c.deadline, c.wake
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case p := <-c.incoming:
+			stopTimer(timer)
+			return copy(b, p.data), p.addr, nil
+		case <-c.closed:
+			stopTimer(timer)
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-wake:
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+func (c *relayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a, ok := addr.(*RelayAddr)
+	if !ok {
+		return 0, fmt.Errorf("not a relay address: %s", addr)
+	}
+	if len(b) > 0xFFFF {
+		return 0, fmt.Errorf("packet too large for relay: %d bytes", len(b))
+	}
+
+	s, err := c.session(a)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+
+	s.mu.Lock()
+	_, err = s.stream.Write(buf)
+	s.mu.Unlock()
+	if err != nil {
+		c.dropSession(a, s)
+		return 0, fmt.Errorf("write to relay %s: %w", a.Via, err)
+	}
+	return len(b), nil
+}
+
+// session returns the stream towards a, opening one through the relay.
+func (c *relayConn) session(a *RelayAddr) (*relaySession, error) {
+	c.mu.Lock()
+	s := c.sessions[a.String()]
+	c.mu.Unlock()
+	if s != nil {
+		return s, nil
+	}
+
+	conn := c.registry.Get(a.Via)
+	if conn == nil || relayedVia(conn) != "" {
+		return nil, fmt.Errorf("relay %s is not directly connected", a.Via)
+	}
+	header, err := relayHeader(relayConnect, a.Peer)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	stream, err := conn.OpenStreamSync(ctx)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("open relay stream to %s: %w", a.Via, err)
+	}
+	if _, err := stream.Write(header); err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, fmt.Errorf("write relay header: %w", err)
+	}
+
+	s = c.addSession(a, stream)
+	go c.readSession(a, s)
+	return s, nil
+}
+
+func (c *relayConn) addSession(a *RelayAddr, stream quic.Stream) *relaySession {
+	s := &relaySession{stream: stream}
+	c.mu.Lock()
+	c.sessions[a.String()] = s
+	c.mu.Unlock()
+	return s
+}
+
+func (c *relayConn) dropSession(a *RelayAddr, s *relaySession) {
+	c.mu.Lock()
+	if c.sessions[a.String()] == s {
+		delete(c.sessions, a.String())
+	}
+	c.mu.Unlock()
+	s.stream.CancelRead(0)
+	s.stream.Close()
+}
+
+// readSession queues packets arriving on a session stream until it ends.
+func (c *relayConn) readSession(a *RelayAddr, s *relaySession) {
+	defer c.dropSession(a, s)
+
+	lenBuf := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(s.stream, lenBuf); err != nil {
+			return
+		}
+		pkt := make([]byte, binary.BigEndian.Uint16(lenBuf))
+		if _, err := io.ReadFull(s.stream, pkt); err != nil {
+			return
+		}
+
+		select {
+		case c.incoming <- relayPacket{data: pkt, addr: a}:
+		case <-c.closed:
+			return
+		default:
+			// queue full: drop like a UDP socket would
+		}
+	}
+}
+
+func (c *relayConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *relayConn) LocalAddr() net.Addr {
+	return &RelayAddr{}
+}
+
+func (c *relayConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *relayConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	return nil
+}
+
+func (c *relayConn) SetWriteDeadline(time.Time) error { return nil }
+
+// Buffer sizes are meaningless for relay streams; these keep quic-go from
+// warning about them.
+func (c *relayConn) SetReadBuffer(int) error  { return nil }
+func (c *relayConn) SetWriteBuffer(int) error { return nil }
+
+// closeConn closes conn without waiting for it when it is relayed: its
+// close packet goes out through the relay conn, which takes the registry
+// lock that callers may be holding.
+func closeConn(conn quic.Connection, reason string) {
+	if relayedVia(conn) != "" {
+		go conn.CloseWithError(0, reason)
+		return
+	}
+	_ = conn.CloseWithError(0, reason)
+}
+
+func relayHeader(kind byte, fingerprint string) ([]byte, error) {
+	fp, err := hex.DecodeString(fingerprint)
+	if err != nil || len(fp) != 32 {
+		return nil, fmt.Errorf("invalid fingerprint %q", fingerprint)
+	}
+	return append([]byte{0, kind}, fp...), nil
+}
+
+// RelayPacketConn returns the packet conn that carries relayed connections.
+// It is meant for a dedicated quic.Transport, see SetRelayTransport.
+func (r *Registry) RelayPacketConn() net.PacketConn {
+	return r.relay
+}
+
+// EnableRelay offers this node as a relay to its peers, forwarding at most
+// maxBytesPerSec across all relayed streams (0 means unlimited).
+func (r *Registry) EnableRelay(maxBytesPerSec int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.relayEnabled = true
+	if maxBytesPerSec > 0 {
+		r.relayLimiter = newTokenBucket(float64(maxBytesPerSec))
+	}
+	control.EnableCapability(control.CapRelay)
+}
+
+// HandleRelayStream takes over a raw stream from peerID that started with
+// the relay escape. The escape byte has already been consumed.
+func (r *Registry) HandleRelayStream(stream quic.Stream, peerID string) {
+	logger := log.New("peer/relay")
+
+	header := make([]byte, 33)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		logger.Warnf("Failed to read relay header from %s: %v", peerID, err)
+		return
+	}
+	other := hex.EncodeToString(header[1:])
+
+	switch header[0] {
+	case relayConnect:
+		r.forwardRelay(stream, peerID, other)
+
+	case relayDelivered:
+		if !r.IsEnabled(other) {
+			logger.Warnf("Refusing relayed stream from disabled peer %s", other)
+			stream.CancelRead(0)
+			stream.Close()
+			return
+		}
+		a := &RelayAddr{Via: peerID, Peer: other}
+		logger.Infof("Relayed stream from %s via %s", other, peerID)
+		r.relay.readSession(a, r.relay.addSession(a, stream))
+
+	default:
+		logger.Warnf("Unknown relay stream kind %d from %s", header[0], peerID)
+		stream.CancelRead(0)
+		stream.Close()
+	}
+}
+
+// forwardRelay is the relay side: splice src's stream onto a new stream to
+// dst, pacing both directions through the relay's bandwidth cap.
+func (r *Registry) forwardRelay(src quic.Stream, srcID, dstID string) {
+	logger := log.New("peer/relay")
+
+	reject := func(reason string) {
+		logger.Warnf("Not relaying %s → %s: %s", srcID, dstID, reason)
+		src.CancelRead(0)
+		src.Close()
+	}
+
+	r.mu.RLock()
+	enabled, limiter := r.relayEnabled, r.relayLimiter
+	r.mu.RUnlock()
+	if !enabled {
+		reject("relaying is disabled")
+		return
+	}
+	if srcID == dstID {
+		reject("source and destination are the same")
+		return
+	}
+	if !r.relaySource(srcID) {
+		reject("source is not a known peer")
+		return
+	}
+	dstConn := r.Get(dstID)
+	if dstConn == nil || relayedVia(dstConn) != "" {
+		reject("destination is not directly connected")
+		return
+	}
+
+	header, err := relayHeader(relayDelivered, srcID)
+	if err != nil {
+		reject(err.Error())
+		return
+	}
+	if !startRelayStream(srcID) {
+		reject(fmt.Sprintf("source already has %d relay sessions", maxRelayStreams))
+		return
+	}
+	defer endRelayStream(srcID)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	dst, err := dstConn.OpenStreamSync(ctx)
+	cancel()
+	if err != nil {
+		reject(err.Error())
+		return
+	}
+	if _, err := dst.Write(header); err != nil {
+		dst.CancelRead(0)
+		dst.Close()
+		reject(err.Error())
+		return
+	}
+
+	logger.Infof("Relaying %s ↔ %s", srcID, dstID)
+	metrics.RelaySessions.Inc()
+	defer metrics.RelaySessions.Dec()
+
+	done := make(chan struct{}, 2)
+	pipe := func(to, from quic.Stream) {
+		copyRelay(to, from, limiter)
+		to.Close()
+		from.CancelRead(0)
+		done <- struct{}{}
+	}
+	go pipe(dst, src)
+	go pipe(src, dst)
+	<-done
+	<-done
+	logger.Infof("Relay session %s ↔ %s ended", srcID, dstID)
+}
+
+// relaySource reports whether we relay for peerID: a peer from our config
+// or admitted with an invite, one discovery let us dial, or one whose
+// CA-issued certificate names its networks. Anyone else could be any key.
+func (r *Registry) relaySource(peerID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e := r.peers[peerID]
+	return e != nil && (e.configured || len(e.members) > 0 || (e.restricted && len(e.networks) > 0))
+}
+
+// startRelayStream takes one of srcID's relay sessions, if it has any left.
+func startRelayStream(srcID string) bool {
+	relayStreams.Lock()
+	defer relayStreams.Unlock()
+	if relayStreams.bySource[srcID] >= maxRelayStreams {
+		return false
+	}
+	relayStreams.bySource[srcID]++
+	return true
+}
+
+func endRelayStream(srcID string) {
+	relayStreams.Lock()
+	defer relayStreams.Unlock()
+	if relayStreams.bySource[srcID]--; relayStreams.bySource[srcID] <= 0 {
+		delete(relayStreams.bySource, srcID)
+	}
+}
+
+func copyRelay(to io.Writer, from io.Reader, limiter *tokenBucket) {
+	buf := make([]byte, 16*1024)
+	for {
+		n, err := from.Read(buf)
+		if n > 0 {
+			if limiter != nil {
+				limiter.wait(n)
+			}
+			if _, werr := to.Write(buf[:n]); werr != nil {
+				return
+			}
+			metrics.RelayBytes.Add(float64(n))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *Registry) directlyConnected(peerID string) bool {
+	conn := r.Get(peerID)
+	return conn != nil && relayedVia(conn) == ""
+}
+
+// relayCandidates returns directly connected peers offering to relay,
+// excluding target.
+func (r *Registry) relayCandidates(target string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var out []string
+	for id, e := range r.peers {
+		if id == target || e.conn == nil || relayedVia(e.conn) != "" || e.caps&control.CapRelay == 0 {
+			continue
+		}
+		out = append(out, id)
+	}
+	return out
+}
+
+// dialRelayed reaches p through the first relay that can forward to it.
+func (r *Registry) dialRelayed(p config.Peer, tlsConf *tls.Config) (quic.Connection, error) {
+	logger := log.New("peer/relay")
+
+	relays := r.relayCandidates(p.Fingerprint)
+	if len(relays) == 0 {
+		return nil, errors.New("no relay peer available")
+	}
+
+	var lastErr error
+	for _, via := range relays {
+		ctx, cancel := context.WithTimeout(context.Background(), punchTimeout)
+		conn, err := dialRelay(ctx, &RelayAddr{Via: via, Peer: p.Fingerprint}, tlsConf)
+		cancel()
+		if err == nil {
+			logger.Infof("Reached %s via relay %s", p.Name, via)
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("no relay could reach %s: %w", p.Name, lastErr)
+}
+
+// tokenBucket paces relayed bytes to rate per second with one second of
+// burst. Callers may overdraw; the debt is paid back by sleeping.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (b *tokenBucket) wait(n int) {
+	if d := b.reserve(n, time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// reserve takes n tokens at now and returns how long to wait before using
+// them.
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
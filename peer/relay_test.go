@@ -0,0 +1,95 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"vibepn/config"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	start := time.Now()
+	b := &tokenBucket{rate: 1000, tokens: 1000, last: start}
+
+	if d := b.reserve(600, start); d != 0 {
+		t.Fatalf("within burst: got wait %s, want 0", d)
+	}
+	if d := b.reserve(600, start); d != 200*time.Millisecond {
+		t.Fatalf("overdrawn by 200: got wait %s, want 200ms", d)
+	}
+	// Half a second refills 500 of the 200 owed.
+	if d := b.reserve(300, start.Add(500*time.Millisecond)); d != 0 {
+		t.Fatalf("after refill: got wait %s, want 0", d)
+	}
+	// Idle time never banks more than one second of burst.
+	if d := b.reserve(1500, start.Add(time.Hour)); d != 500*time.Millisecond {
+		t.Fatalf("after long idle: got wait %s, want 500ms", d)
+	}
+}
+
+func TestRelayHeader(t *testing.T) {
+	fp := "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	h, err := relayHeader(relayConnect, fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 34 || h[0] != 0 || h[1] != relayConnect || h[2] != 0x00 || h[33] != 0xff {
+		t.Fatalf("unexpected header % x", h)
+	}
+	if _, err := relayHeader(relayConnect, "not-a-fingerprint"); err == nil {
+		t.Fatal("expected error for invalid fingerprint")
+	}
+}
+
+// closedStream records how a rejected relay stream was shut.
+type closedStream struct {
+	quic.Stream
+	canceled, closed bool
+}
+
+func (s *closedStream) CancelRead(quic.StreamErrorCode) { s.canceled = true }
+func (s *closedStream) Close() error                    { s.closed = true; return nil }
+
+func TestRelayRejectsUnknownSource(t *testing.T) {
+	peers := []config.Peer{{Name: "node2", Fingerprint: "fp-b"}, {Name: "node3", Fingerprint: "fp-c"}}
+	r := NewRegistry(config.Identity{}, peers, nil)
+	r.relayEnabled = true
+	r.peers["fp-stranger"] = &peerEntry{id: "fp-stranger", conn: fakeConn{}}
+
+	if r.relaySource("fp-stranger") || !r.relaySource("fp-b") {
+		t.Fatal("relay source check does not follow the config")
+	}
+
+	s := &closedStream{}
+	r.forwardRelay(s, "fp-stranger", "fp-c")
+	if !s.canceled || !s.closed {
+		t.Fatal("relay stream from an unknown source not rejected")
+	}
+}
+
+func TestRelayStreamsPerSource(t *testing.T) {
+	for range maxRelayStreams {
+		if !startRelayStream("fp-b") {
+			t.Fatal("relay session refused below the cap")
+		}
+	}
+	if startRelayStream("fp-b") {
+		t.Fatal("relay session allowed past the cap")
+	}
+	if !startRelayStream("fp-c") {
+		t.Fatal("one source's sessions limited another")
+	}
+	endRelayStream("fp-b")
+	if !startRelayStream("fp-b") {
+		t.Fatal("ended relay session not given back")
+	}
+	for range maxRelayStreams {
+		endRelayStream("fp-b")
+	}
+	endRelayStream("fp-c")
+	if len(relayStreams.bySource) != 0 {
+		t.Fatalf("relay sessions left over: %v", relayStreams.bySource)
+	}
+}
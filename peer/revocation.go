@@ -0,0 +1,129 @@
+package peer
+
+import (
+	"slices"
+
+	"vibepn/control"
+	"vibepn/crypto"
+	"vibepn/log"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Revocation lists spread like gossip: whoever learns a newer list puts it
+// in force, passes it on to every other peer and drops connections to the
+// keys it revokes. A peer that sends an older list is sent ours instead.
+
+func (r *Registry) sendRevocations(peerID string, stream quic.Stream) {
+	rl := crypto.CurrentRevocationList()
+	if rl == nil {
+		return
+	}
+	raw, err := crypto.MarshalRevocationList(rl)
+	if err != nil {
+		log.New("peer/revocation").Warnf("Failed to encode revocation list: %v", err)
+		return
+	}
+	if err := control.SendRevocations(stream, raw); err != nil {
+		log.New("peer/revocation").Warnf("Failed to send revocation list to %s: %v", peerID, err)
+	}
+}
+
+func (r *Registry) floodRevocations(skip ...string) {
+	r.mu.RLock()
+	streams := make(map[string]quic.Stream)
+	for id, e := range r.peers {
+		if e.control != nil && e.caps&control.CapRevocation != 0 && !slices.Contains(skip, id) {
+			streams[id] = e.control
+		}
+	}
+	r.mu.RUnlock()
+
+	for id, stream := range streams {
+		r.sendRevocations(id, stream)
+	}
+}
+
+func (r *Registry) handleRevocations(body []byte, peerID string) {
+	logger := log.New("peer/revocation")
+
+	if !r.hasCapability(peerID, control.CapRevocation) {
+		return
+	}
+	rl, err := crypto.ParseRevocationList(body)
+	if err != nil {
+		logger.Warnf("Invalid revocation list from %s: %v", peerID, err)
+		return
+	}
+
+	if current := crypto.CurrentRevocationList(); current != nil && rl.Version < current.Version {
+		logger.Debugf("Peer %s has revocation list v%d, sending v%d", peerID, rl.Version, current.Version)
+		if stream := r.controlStream(peerID); stream != nil {
+			r.sendRevocations(peerID, stream)
+		}
+		return
+	}
+
+	updated, err := crypto.ApplyRevocationList(rl)
+	if !updated {
+		if err != nil {
+			logger.Warnf("Rejected revocation list v%d from %s: %v", rl.Version, peerID, err)
+		}
+		return
+	}
+	if err != nil {
+		logger.Warnf("Revocation list v%d in force but not saved: %v", rl.Version, err)
+	}
+	logger.Infof("Revocation list v%d from %s in force (%d keys, %d serials)", rl.Version, peerID, len(rl.Fingerprints), len(rl.Serials))
+	r.revocationsUpdated(rl, peerID)
+}
+
+// ReloadRevocations re-reads the revocation file, as after vpnctl revoke,
+// and distributes the list if it is newer than the one in force.
+func (r *Registry) ReloadRevocations() (uint64, error) {
+	updated, err := crypto.ReloadRevocationList()
+	rl := crypto.CurrentRevocationList()
+	if updated {
+		log.New("peer/revocation").Infof("Revocation list v%d loaded from file", rl.Version)
+		r.revocationsUpdated(rl, "")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if rl == nil {
+		return 0, nil
+	}
+	return rl.Version, nil
+}
+
+func (r *Registry) revocationsUpdated(rl *crypto.RevocationList, from string) {
+	control.PublishEvent("revocations_updated", map[string]interface{}{
+		"version": rl.Version,
+		"from":    from,
+	})
+	r.floodRevocations(from)
+	r.disconnectRevoked()
+}
+
+// disconnectRevoked closes every connection whose peer key is now revoked
+// and disables the peer so it is not redialed.
+func (r *Registry) disconnectRevoked() {
+	r.mu.Lock()
+	revoked := make(map[string]quic.Connection)
+	for id, e := range r.peers {
+		if e.conn == nil {
+			continue
+		}
+		certs := e.conn.ConnectionState().TLS.PeerCertificates
+		if len(certs) > 0 && crypto.IsRevoked(certs[0]) {
+			e.disabled = true
+			revoked[id] = e.conn
+		}
+	}
+	r.mu.Unlock()
+
+	for id, conn := range revoked {
+		r.logger.Warnf("Closing connection to revoked peer %s", id)
+		closeConn(conn, "peer key revoked")
+	}
+}
@@ -0,0 +1,118 @@
+package peer
+
+import (
+	"time"
+
+	"vibepn/control"
+	"vibepn/log"
+	"vibepn/metrics"
+
+	"github.com/quic-go/quic-go"
+)
+
+// roamSettle lets a burst of address events (DHCP, SLAAC, interface
+// flaps) finish before we move connections.
+const roamSettle = 500 * time.Millisecond
+
+// Roaming relies on QUIC connection migration as quic-go v0.50 implements
+// it: the dialing side cannot open a new path explicitly, but outbound
+// connections share the listener's wildcard-bound socket, so once the old
+// address is gone the kernel sends from the new one and the listening side
+// validates and switches to that path. The dialer's job is to send right
+// away so the switch happens before liveness or idle timeouts fire.
+// Connections we accepted cannot migrate (only clients may) and are
+// redialed as usual.
+
+// WatchLocalAddresses moves outbound connections onto a new path as soon
+// as a local address appears or disappears.
+func (r *Registry) WatchLocalAddresses() {
+	logger := log.New("peer/roaming")
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		if err := watchAddresses(changed); err != nil {
+			logger.Warnf("Not watching local addresses, roaming disabled: %v", err)
+		}
+	}()
+
+	go func() {
+		for range changed {
+			time.Sleep(roamSettle)
+			select {
+			case <-changed:
+			default:
+			}
+			r.nudgeConnections()
+		}
+	}()
+}
+
+// nudgeConnections sends a keepalive on every direct outbound connection
+// so the peer sees packets from our new address.
+func (r *Registry) nudgeConnections() {
+	logger := log.New("peer/roaming")
+
+	r.mu.RLock()
+	streams := make(map[string]quic.Stream)
+	for id, e := range r.peers {
+		if e.control != nil && e.direction == Outbound && relayedVia(e.conn) == "" {
+			streams[id] = e.control
+		}
+	}
+	r.mu.RUnlock()
+
+	if len(streams) == 0 {
+		return
+	}
+	logger.Infof("Local addresses changed, migrating %d outbound connection(s)", len(streams))
+	for id, stream := range streams {
+		if err := control.SendKeepalive(stream); err != nil {
+			logger.Warnf("Failed to send keepalive to %s after address change: %v", id, err)
+		}
+	}
+}
+
+type migration struct {
+	peerID   string
+	from, to string
+	stream   quic.Stream
+	punch    bool
+}
+
+// checkMigration notices when QUIC switched the connection to a new remote
+// address. Caller must hold the registry lock.
+func (e *peerEntry) checkMigration() (migration, bool) {
+	if e.conn == nil || relayedVia(e.conn) != "" {
+		return migration{}, false
+	}
+	current := e.conn.RemoteAddr().String()
+	if e.remote == current {
+		return migration{}, false
+	}
+	m := migration{
+		peerID: e.id,
+		from:   e.remote,
+		to:     current,
+		stream: e.control,
+		punch:  e.caps&control.CapNATPunch != 0,
+	}
+	e.remote = current
+	return m, true
+}
+
+// handleMigration keeps the peer as it is and tells it its new address.
+func handleMigration(m migration) {
+	log.New("peer/roaming").Infof("Peer %s moved from %s to %s, connection kept", m.peerID, m.from, m.to)
+	metrics.PeerMigrations.Inc()
+	control.PublishEvent("peer_migrated", map[string]interface{}{
+		"peer": m.peerID,
+		"from": m.from,
+		"to":   m.to,
+	})
+
+	if m.punch && m.stream != nil {
+		if err := control.SendObservedAddr(m.stream, m.to); err != nil {
+			log.New("peer/roaming").Warnf("Failed to send observed address to %s: %v", m.peerID, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package peer
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Netlink multicast groups for address changes (linux/rtnetlink.h); the
+// syscall package does not export them.
+const (
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+// watchAddresses signals changed whenever the kernel adds or removes a
+// local IPv4 or IPv6 address. It only returns on error.
+func watchAddresses(changed chan<- struct{}) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("open netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return fmt.Errorf("bind netlink socket: %w", err)
+	}
+
+	buf := make([]byte, 16384)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("read netlink socket: %w", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			if m.Header.Type == syscall.RTM_NEWADDR || m.Header.Type == syscall.RTM_DELADDR {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package peer
+
+import "errors"
+
+func watchAddresses(changed chan<- struct{}) error {
+	return errors.New("address change notifications are only supported on Linux")
+}
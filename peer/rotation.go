@@ -0,0 +1,161 @@
+package peer
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"vibepn/control"
+	"vibepn/crypto"
+	"vibepn/log"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Key rotation: the node switches to its new certificate at once for new
+// connections and announces the successor, signed by both keys, to every
+// peer. Peers trust the new key wherever they trusted the old one and keep
+// accepting the old one until the grace period ends, when the node closes
+// the connections still running on it.
+var rotation struct {
+	sync.Mutex
+	announcement []byte // repeated in Hello while the old key is retiring
+	until        time.Time
+}
+
+// RotateIdentity switches to the key pair at certPath/keyPath and returns
+// its fingerprint.
+func (r *Registry) RotateIdentity(certPath, keyPath string, grace time.Duration) (string, error) {
+	logger := log.New("peer/rotation")
+
+	rotatedAt := time.Now()
+	s, err := crypto.RotateIdentity(certPath, keyPath, grace)
+	if err != nil {
+		return "", err
+	}
+	logger.Infof("Identity rotated from %s to %s, old key retires at %s", s.OldFingerprint, s.NewFingerprint, s.Until.Format(time.RFC3339))
+
+	rotation.Lock()
+	rotation.announcement = s.Raw
+	rotation.until = s.Until
+	rotation.Unlock()
+
+	localNode.Lock()
+	localNode.fingerprint = s.NewFingerprint
+	localNode.Unlock()
+
+	gossip.Lock()
+	if gossip.self != "" {
+		gossip.cert = *crypto.LocalCertificate()
+		gossip.self = s.NewFingerprint
+	}
+	gossip.Unlock()
+
+	r.floodSuccession(s.Raw)
+	time.AfterFunc(grace, func() { r.retireConnections(rotatedAt) })
+	return s.NewFingerprint, nil
+}
+
+// sendSuccession repeats a pending announcement to a newly connected peer,
+// so peers that were offline during the rotation learn it too.
+func (r *Registry) sendSuccession(peerID string, stream quic.Stream) {
+	rotation.Lock()
+	announcement := rotation.announcement
+	pending := time.Now().Before(rotation.until)
+	rotation.Unlock()
+
+	if announcement == nil || !pending {
+		return
+	}
+	if err := control.SendSuccession(stream, announcement); err != nil {
+		log.New("peer/rotation").Warnf("Failed to send key succession to %s: %v", peerID, err)
+	}
+}
+
+func (r *Registry) floodSuccession(announcement []byte) {
+	r.mu.RLock()
+	streams := make(map[string]quic.Stream)
+	for id, e := range r.peers {
+		if e.control != nil && e.caps&control.CapRotation != 0 {
+			streams[id] = e.control
+		}
+	}
+	r.mu.RUnlock()
+
+	for id, stream := range streams {
+		if err := control.SendSuccession(stream, announcement); err != nil {
+			log.New("peer/rotation").Warnf("Failed to send key succession to %s: %v", id, err)
+		}
+	}
+}
+
+func (r *Registry) handleSuccession(body []byte, peerID string) {
+	logger := log.New("peer/rotation")
+
+	if !r.hasCapability(peerID, control.CapRotation) {
+		return
+	}
+	s, err := crypto.ParseSuccession(body)
+	if err != nil {
+		logger.Warnf("Invalid key succession from %s: %v", peerID, err)
+		return
+	}
+	// Either key may deliver it: the old one before reconnecting, the new
+	// one to peers that missed the rotation
+	if !slices.Contains([]string{s.OldFingerprint, s.NewFingerprint}, peerID) {
+		logger.Warnf("Ignoring key succession for %s received from %s", s.OldFingerprint, peerID)
+		return
+	}
+	if time.Now().After(s.Until) {
+		logger.Debugf("Ignoring expired key succession from %s", peerID)
+		return
+	}
+	if crypto.LatestFingerprint(s.OldFingerprint) == s.NewFingerprint {
+		return // already known
+	}
+	if err := crypto.AcceptSuccession(s); err != nil {
+		logger.Warnf("Failed to accept key succession from %s: %v", peerID, err)
+		return
+	}
+
+	r.mu.RLock()
+	name, configured := "", false
+	if e := r.peers[s.OldFingerprint]; e != nil {
+		name, configured = e.name, e.configured
+	}
+	r.mu.RUnlock()
+	if name == "" {
+		name = s.OldFingerprint
+	}
+
+	logger.Infof("Peer %s rotated its key to %s, old key accepted until %s", name, s.NewFingerprint, s.Until.Format(time.RFC3339))
+	if configured {
+		logger.Warnf("Update the fingerprint of peer %s in the config to %s before restarting", name, s.NewFingerprint)
+	}
+	control.PublishEvent("peer_rotated", map[string]interface{}{
+		"peer":        s.OldFingerprint,
+		"fingerprint": s.NewFingerprint,
+		"until":       s.Until.Format(time.RFC3339),
+	})
+}
+
+// retireConnections closes connections set up before the rotation, which
+// still run on the old key; peers redial and get the new one.
+func (r *Registry) retireConnections(before time.Time) {
+	r.mu.RLock()
+	old := make(map[string]quic.Connection)
+	for id, e := range r.peers {
+		if e.conn != nil && e.connectedAt.Before(before) {
+			old[id] = e.conn
+		}
+	}
+	r.mu.RUnlock()
+
+	if len(old) > 0 {
+		log.New("peer/rotation").Infof("Old identity key retired, closing %d connection(s) still using it", len(old))
+	}
+	for _, conn := range old {
+		closeConn(conn, fmt.Sprintf("identity key retired at %s", time.Now().Format(time.RFC3339)))
+	}
+}
@@ -0,0 +1,114 @@
+package peer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gquic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// quicStats holds the transport statistics reported by quic-go for one
+// connection.
+type quicStats struct {
+	rtt         atomic.Int64 // smoothed RTT, ns
+	cwnd        atomic.Uint64
+	packetsSent atomic.Uint64
+	packetsLost atomic.Uint64
+
+	peerID string // set once bound to a peer, guarded by connStats
+}
+
+var connStats struct {
+	sync.Mutex
+	byTracingID map[gquic.ConnectionTracingID]*quicStats
+	byPeer      map[string]*quicStats
+}
+
+func init() {
+	connStats.byTracingID = make(map[gquic.ConnectionTracingID]*quicStats)
+	connStats.byPeer = make(map[string]*quicStats)
+}
+
+// QUICConfig returns the quic-go configuration shared by the listener and
+// outbound dials, with statistics tracing enabled.
+func QUICConfig() *gquic.Config {
+	return &gquic.Config{
+		EnableDatagrams: true,
+		Tracer:          newStatsTracer,
+	}
+}
+
+func newStatsTracer(ctx context.Context, _ logging.Perspective, _ gquic.ConnectionID) *logging.ConnectionTracer {
+	id, ok := ctx.Value(gquic.ConnectionTracingKey).(gquic.ConnectionTracingID)
+	if !ok {
+		return nil
+	}
+
+	s := &quicStats{}
+	connStats.Lock()
+	connStats.byTracingID[id] = s
+	connStats.Unlock()
+
+	return &logging.ConnectionTracer{
+		UpdatedMetrics: func(rtt *logging.RTTStats, cwnd, _ logging.ByteCount, _ int) {
+			s.rtt.Store(int64(rtt.SmoothedRTT()))
+			s.cwnd.Store(uint64(cwnd))
+		},
+		SentLongHeaderPacket: func(*logging.ExtendedHeader, logging.ByteCount, logging.ECN, *logging.AckFrame, []logging.Frame) {
+			s.packetsSent.Add(1)
+		},
+		SentShortHeaderPacket: func(*logging.ShortHeader, logging.ByteCount, logging.ECN, *logging.AckFrame, []logging.Frame) {
+			s.packetsSent.Add(1)
+		},
+		LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+			s.packetsLost.Add(1)
+		},
+		Close: func() {
+			connStats.Lock()
+			delete(connStats.byTracingID, id)
+			if s.peerID != "" && connStats.byPeer[s.peerID] == s {
+				delete(connStats.byPeer, s.peerID)
+			}
+			connStats.Unlock()
+		},
+	}
+}
+
+// bindQUICStats associates the traced statistics of conn with peerID.
+func bindQUICStats(peerID string, conn gquic.Connection) {
+	id, ok := conn.Context().Value(gquic.ConnectionTracingKey).(gquic.ConnectionTracingID)
+	if !ok {
+		return
+	}
+
+	connStats.Lock()
+	defer connStats.Unlock()
+	if s := connStats.byTracingID[id]; s != nil {
+		s.peerID = peerID
+		connStats.byPeer[peerID] = s
+	}
+}
+
+func peerQUICStats(peerID string) *quicStats {
+	connStats.Lock()
+	defer connStats.Unlock()
+	return connStats.byPeer[peerID]
+}
+
+// smoothRTT folds a new sample into the smoothed RTT and its variation
+// using the RFC 6298 estimator.
+func smoothRTT(srtt, rttvar, sample time.Duration) (time.Duration, time.Duration) {
+	if srtt == 0 {
+		return sample, sample / 2
+	}
+	diff := srtt - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	rttvar = (3*rttvar + diff) / 4
+	srtt = (7*srtt + sample) / 8
+	return srtt, rttvar
+}
@@ -0,0 +1,47 @@
+package peer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gquic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+func TestSmoothRTT(t *testing.T) {
+	srtt, rttvar := smoothRTT(0, 0, 100*time.Millisecond)
+	if srtt != 100*time.Millisecond || rttvar != 50*time.Millisecond {
+		t.Fatalf("first sample: got srtt=%s rttvar=%s, want 100ms/50ms", srtt, rttvar)
+	}
+
+	srtt, rttvar = smoothRTT(srtt, rttvar, 180*time.Millisecond)
+	if srtt != 110*time.Millisecond {
+		t.Fatalf("srtt = %s, want 110ms", srtt)
+	}
+	if rttvar != 57500*time.Microsecond {
+		t.Fatalf("rttvar = %s, want 57.5ms", rttvar)
+	}
+}
+
+// tracedConn is a connection carrying a quic-go tracing ID.
+type tracedConn struct {
+	gquic.Connection
+	ctx context.Context
+}
+
+func (c tracedConn) Context() context.Context { return c.ctx }
+
+func TestQUICStatsDroppedOnClose(t *testing.T) {
+	ctx := context.WithValue(context.Background(), gquic.ConnectionTracingKey, gquic.ConnectionTracingID(4242))
+	tracer := newStatsTracer(ctx, logging.PerspectiveClient, gquic.ConnectionID{})
+	bindQUICStats("fp-a", tracedConn{ctx: ctx})
+	if peerQUICStats("fp-a") == nil {
+		t.Fatal("stats not bound to the peer")
+	}
+
+	tracer.Close()
+	if peerQUICStats("fp-a") != nil {
+		t.Fatal("stats of a closed connection still reported for the peer")
+	}
+}
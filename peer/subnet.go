@@ -0,0 +1,161 @@
+package peer
+
+import (
+	"net"
+	"slices"
+	"sort"
+
+	"vibepn/log"
+)
+
+// Subnet routes: a node announces the prefixes in its network's routes
+// next to the network prefix. Receivers install those their accept_routes
+// policy allows, and keep one host route into the network's TUN per
+// prefix for as long as any connected peer routes it.
+
+// subnetRoute is a prefix routed into a network's TUN on this host.
+type subnetRoute struct {
+	network string
+	prefix  string
+}
+
+// SetOnSubnetRoute sets the hook that adds or removes the host route for
+// a subnet peers route for us.
+func (r *Registry) SetOnSubnetRoute(cb func(network, prefix string, add bool) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onSubnet = cb
+}
+
+// isSubnet reports whether prefix lies outside network's own prefix, so
+// announcing it makes the peer a router for it.
+func (r *Registry) isSubnet(network, prefix string) bool {
+	r.mu.RLock()
+	netCfg := r.netcfg[network]
+	r.mu.RUnlock()
+	_, own, err := net.ParseCIDR(netCfg.Prefix)
+	if err != nil {
+		return true
+	}
+	ip, subnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return true
+	}
+	ownBits, _ := own.Mask.Size()
+	bits, _ := subnet.Mask.Size()
+	return !own.Contains(ip) || bits < ownBits
+}
+
+// acceptRoute applies our route policy to a prefix a peer announced.
+func (r *Registry) acceptRoute(network, prefix string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	netCfg, ok := r.netcfg[network]
+	return ok && netCfg.AcceptsRoute(prefix)
+}
+
+// routesTo reports whether dst is on one of the subnets we route for
+// network.
+func routesTo(routes []string, dst net.IP) bool {
+	for _, route := range routes {
+		if _, subnet, err := net.ParseCIDR(route); err == nil && subnet.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// noteSubnet records that peerID routes prefix on network for us.
+func (r *Registry) noteSubnet(peerID, network, prefix string) {
+	r.mu.Lock()
+	if e := r.peers[peerID]; e != nil {
+		if e.subnets == nil {
+			e.subnets = make(map[string][]string)
+		}
+		if !slices.Contains(e.subnets[network], prefix) {
+			e.subnets[network] = append(e.subnets[network], prefix)
+		}
+	}
+	r.mu.Unlock()
+	r.applySubnets()
+}
+
+// dropSubnet forgets a subnet peerID withdrew.
+func (r *Registry) dropSubnet(peerID, network, prefix string) {
+	r.mu.Lock()
+	if e := r.peers[peerID]; e != nil && e.subnets != nil {
+		e.subnets[network] = slices.DeleteFunc(e.subnets[network], func(p string) bool { return p == prefix })
+		if len(e.subnets[network]) == 0 {
+			delete(e.subnets, network)
+		}
+	}
+	r.mu.Unlock()
+	r.applySubnets()
+}
+
+// applySubnets adds host routes for subnets a connected peer routes and
+// removes those none does any longer. Our own routes are never taken.
+func (r *Registry) applySubnets() {
+	logger := log.New("peer/subnet")
+
+	r.subnetMu.Lock()
+	defer r.subnetMu.Unlock()
+
+	r.mu.RLock()
+	want := make(map[subnetRoute]bool)
+	for _, e := range r.peers {
+		if e.conn == nil {
+			continue
+		}
+		for network, prefixes := range e.subnets {
+			for _, prefix := range prefixes {
+				if !slices.Contains(r.netcfg[network].Routes, prefix) {
+					want[subnetRoute{network, prefix}] = true
+				}
+			}
+		}
+	}
+	applied, hook := r.subnetsApplied, r.onSubnet
+	r.mu.RUnlock()
+
+	next := make(map[subnetRoute]bool, len(want))
+	for route := range applied {
+		if want[route] {
+			next[route] = true
+			continue
+		}
+		if hook != nil {
+			if err := hook(route.network, route.prefix, false); err != nil {
+				logger.Warnf("Failed to remove route %s on %s: %v", route.prefix, route.network, err)
+			}
+		}
+		logger.Infof("No peer routes %s on %s any longer", route.prefix, route.network)
+	}
+	for route := range want {
+		if applied[route] {
+			continue
+		}
+		if hook != nil {
+			if err := hook(route.network, route.prefix, true); err != nil {
+				logger.Warnf("Failed to add route %s on %s: %v", route.prefix, route.network, err)
+				continue
+			}
+		}
+		logger.Infof("Routing %s through network %s", route.prefix, route.network)
+		next[route] = true
+	}
+
+	r.mu.Lock()
+	r.subnetsApplied = next
+	r.mu.Unlock()
+}
+
+// subnetPrefixes lists the subnets of a subnets map, sorted.
+func subnetPrefixes(subnets map[string][]string) []string {
+	var out []string
+	for _, prefixes := range subnets {
+		out = append(out, prefixes...)
+	}
+	sort.Strings(out)
+	return out
+}
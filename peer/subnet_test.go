@@ -0,0 +1,73 @@
+package peer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"vibepn/config"
+	"vibepn/control"
+	"vibepn/netgraph"
+)
+
+func TestSubnetRoutesFollowPeers(t *testing.T) {
+	netcfg := map[string]config.NetworkConfig{"corp": {Prefix: "10.42.0.0/24", Export: true, Routes: []string{"192.168.1.0/24"}}}
+	peers := []config.Peer{{Name: "a", Fingerprint: "fp-a"}, {Name: "b", Fingerprint: "fp-b"}}
+	r := NewRegistry(config.Identity{}, peers, netcfg)
+	r.peers["fp-a"].conn = fakeConn{}
+	r.peers["fp-b"].conn = fakeConn{}
+	installed := map[string]bool{}
+	r.SetOnSubnetRoute(func(network, prefix string, add bool) error {
+		installed[prefix] = add
+		return nil
+	})
+
+	if r.isSubnet("corp", "10.42.0.0/24") || !r.isSubnet("corp", "192.168.10.0/24") {
+		t.Fatal("isSubnet misclassified a prefix")
+	}
+	if !r.Deliverable("fp-a", "corp", net.ParseIP("192.168.1.7")) {
+		t.Error("packet for a subnet we route not deliverable")
+	}
+
+	// Two routers for one subnet: the host route stays until both are gone
+	r.noteSubnet("fp-a", "corp", "192.168.10.0/24")
+	r.noteSubnet("fp-b", "corp", "192.168.10.0/24")
+	r.dropSubnet("fp-a", "corp", "192.168.10.0/24")
+	if !installed["192.168.10.0/24"] {
+		t.Fatal("host route removed while a peer still routes the subnet")
+	}
+	r.dropSubnet("fp-b", "corp", "192.168.10.0/24")
+	if installed["192.168.10.0/24"] {
+		t.Fatal("host route kept after the last router withdrew")
+	}
+
+	// Never take over a subnet we route ourselves
+	r.noteSubnet("fp-a", "corp", "192.168.1.0/24")
+	if _, ok := installed["192.168.1.0/24"]; ok {
+		t.Fatal("host route installed for our own subnet")
+	}
+}
+
+func TestWithdrawRemovesOnlySendersRoute(t *testing.T) {
+	rt := netgraph.NewRouteTable()
+	control.Register(rt, nil, nil)
+	t.Cleanup(func() { control.Register(nil, nil, nil) })
+
+	netcfg := map[string]config.NetworkConfig{"corp": {Prefix: "10.42.0.0/24", Export: true}}
+	peers := []config.Peer{{Name: "a", Fingerprint: "fp-a"}, {Name: "b", Fingerprint: "fp-b"}}
+	r := NewRegistry(config.Identity{}, peers, netcfg)
+	expires := time.Now().Add(time.Minute)
+	rt.AddRoute(netgraph.Route{Network: "corp", Prefix: "10.42.0.0/24", PeerID: "fp-a", ExpiresAt: expires})
+	rt.AddRoute(netgraph.Route{Network: "corp", Prefix: "10.42.0.0/24", PeerID: "fp-b", ExpiresAt: expires})
+
+	body := []byte{4}
+	body = append(body, "corp"...)
+	body = append(body, byte(len("10.42.0.0/24")))
+	body = append(body, "10.42.0.0/24"...)
+	r.handleRouteWithdraw(body, "fp-a")
+
+	routes := rt.RoutesForNetwork("corp", "")
+	if len(routes) != 1 || routes[0].PeerID != "fp-b" {
+		t.Fatalf("routes after fp-a withdrew = %+v, want only fp-b's", routes)
+	}
+}
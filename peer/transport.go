@@ -0,0 +1,67 @@
+package peer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// sharedTransport is the listener's UDP socket. Dialing from it keeps the
+// source port stable, so the NAT mapping a peer observes for us is the
+// same one that hole punching opens.
+var sharedTransport struct {
+	sync.RWMutex
+	tr *quic.Transport
+}
+
+// SetTransport makes outbound dials use tr instead of an ephemeral socket.
+func SetTransport(tr *quic.Transport) {
+	sharedTransport.Lock()
+	defer sharedTransport.Unlock()
+	sharedTransport.tr = tr
+}
+
+// relayTransport runs over the relay packet conn; see RelayPacketConn.
+var relayTransport struct {
+	sync.RWMutex
+	tr *quic.Transport
+}
+
+// SetRelayTransport sets the transport used to dial peers through a relay.
+func SetRelayTransport(tr *quic.Transport) {
+	relayTransport.Lock()
+	defer relayTransport.Unlock()
+	relayTransport.tr = tr
+}
+
+func dialRelay(ctx context.Context, addr *RelayAddr, tlsConf *tls.Config) (quic.Connection, error) {
+	relayTransport.RLock()
+	tr := relayTransport.tr
+	relayTransport.RUnlock()
+
+	if tr == nil {
+		return nil, errors.New("relay transport not configured")
+	}
+	return tr.Dial(ctx, addr, tlsConf, QUICConfig())
+}
+
+func dial(ctx context.Context, address string, tlsConf *tls.Config) (quic.Connection, error) {
+	sharedTransport.RLock()
+	tr := sharedTransport.tr
+	sharedTransport.RUnlock()
+
+	if tr == nil {
+		return quic.DialAddr(ctx, address, tlsConf, QUICConfig())
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", address, err)
+	}
+	return tr.Dial(ctx, addr, tlsConf, QUICConfig())
+}
@@ -0,0 +1,173 @@
+package qr
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomonMatchesReference(t *testing.T) {
+	// "HELLO WORLD" at 1-M, as worked through in the usual QR tutorials
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(len(want))); !bytes.Equal(got, want) {
+		t.Fatalf("ecc = %v, want %v", got, want)
+	}
+}
+
+func TestFormatAndVersionInfo(t *testing.T) {
+	tests := []struct {
+		level Level
+		mask  int
+		want  int
+	}{
+		{M, 0, 0b101010000010010},
+		{L, 4, 0b110011000101111},
+		{H, 7, 0b000100000111011},
+	}
+	for _, tt := range tests {
+		if got := formatInfo(tt.level, tt.mask); got != tt.want {
+			t.Errorf("formatInfo(%d, %d) = %015b, want %015b", tt.level, tt.mask, got, tt.want)
+		}
+	}
+	if got, want := versionInfo(7), 0b000111110010010100; got != want {
+		t.Errorf("versionInfo(7) = %018b, want %018b", got, want)
+	}
+}
+
+func TestFunctionPatternsLeaveDataArea(t *testing.T) {
+	for v := 1; v <= 40; v++ {
+		c := newCode(v)
+		c.drawFunctionPatterns(M)
+		free := 0
+		for y := range c.reserved {
+			for _, r := range c.reserved[y] {
+				if !r {
+					free++
+				}
+			}
+		}
+		if free != rawDataModules(v) {
+			t.Fatalf("version %d: %d data modules, want %d", v, free, rawDataModules(v))
+		}
+	}
+}
+
+// readBack undoes the mask and reads the data codewords of c in placement
+// order, the way a scanner would.
+func readBack(t *testing.T, c *Code, level Level) []byte {
+	t.Helper()
+	var format int
+	for i := 0; i <= 5; i++ {
+		if c.Dark(8, i) {
+			format |= 1 << i
+		}
+	}
+	mask := -1
+	for m := 0; m < 8; m++ {
+		if formatInfo(level, m)&0x3F == format {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("no mask matches format bits %06b", format)
+	}
+
+	c.applyMask(mask)
+	defer c.applyMask(mask)
+
+	var bits bitBuffer
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if !c.reserved[y][x] {
+					bits = append(bits, c.Dark(x, y))
+				}
+			}
+		}
+	}
+	return bits.bytes()
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, n := range []int{1, 17, 150, 800} {
+		data := bytes.Repeat([]byte("vibepn://"), n/9+1)[:n]
+		c, err := Encode(data, L)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Size != 4*c.Version+17 {
+			t.Fatalf("size %d for version %d", c.Size, c.Version)
+		}
+
+		// De-interleave: codeword i belongs to block i mod blocks, long
+		// blocks carry one extra data codeword at the end
+		codewords := readBack(t, c, L)
+		numBlocks := eccBlocks[L][c.Version]
+		eccLen := eccPerBlock[L][c.Version]
+		raw := rawDataModules(c.Version) / 8
+		numShort := numBlocks - raw%numBlocks
+		shortData := raw/numBlocks - eccLen
+
+		blocks := make([][]byte, numBlocks)
+		k := 0
+		for i := 0; i < shortData+1; i++ {
+			for j := range blocks {
+				if i == shortData && j < numShort {
+					continue
+				}
+				blocks[j] = append(blocks[j], codewords[k])
+				k++
+			}
+		}
+		var stream []byte
+		for j, block := range blocks {
+			stream = append(stream, block...)
+			// Each block's ECC must match its data
+			var got []byte
+			for i := 0; i < eccLen; i++ {
+				got = append(got, codewords[k+i*numBlocks+j])
+			}
+			if want := rsRemainder(block, rsDivisor(eccLen)); !bytes.Equal(got, want) {
+				t.Fatalf("n=%d block %d: ecc mismatch", n, j)
+			}
+		}
+
+		var hdr bitBuffer
+		hdr.append(0x4, 4)
+		hdr.append(n, countBits(c.Version))
+		for _, b := range data {
+			hdr.append(int(b), 8)
+		}
+		want := hdr.bytes()
+		want = want[:len(want)-1] // last byte only partly ours
+		if !bytes.Equal(stream[:len(want)], want) {
+			t.Fatalf("n=%d: data stream does not start with mode, count and data", n)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	c, err := Encode([]byte("hello"), M)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(c.ASCII(), "\n"), "\n")
+	if len(lines) != c.Size+2*quietZone || len(lines[0]) != 2*(c.Size+2*quietZone) {
+		t.Fatalf("ascii is %d lines of %d chars for size %d", len(lines), len(lines[0]), c.Size)
+	}
+	// Top left finder corner is dark, the quiet zone light
+	if !strings.HasPrefix(lines[quietZone], strings.Repeat("##", quietZone)+"  ") {
+		t.Fatalf("unexpected finder row %q", lines[quietZone])
+	}
+	if got := strings.Count(c.UTF8(), "\n"); got != (c.Size+2*quietZone+1)/2 {
+		t.Fatalf("utf8 has %d lines", got)
+	}
+}
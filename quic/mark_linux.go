@@ -0,0 +1,22 @@
+package quic
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMark sets SO_MARK on conn, so its packets bypass exit node routing.
+func setMark(conn *net.UDPConn, mark int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package quic
+
+import (
+	"errors"
+	"net"
+)
+
+func setMark(conn *net.UDPConn, mark int) error {
+	return errors.New("socket marks are only supported on Linux")
+}
@@ -3,35 +3,67 @@ package quic
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"math/rand/v2"
+	"net"
 
 	"vibepn/control"
+	"vibepn/crypto"
 	"vibepn/forward"
+	"vibepn/iface"
 	"vibepn/log"
 	"vibepn/netgraph"
 	"vibepn/peer"
 
-	"crypto/sha256"
-	"encoding/hex"
-
 	"github.com/quic-go/quic-go"
 )
 
 func Listen(addr string, tlsConf *tls.Config) (*quic.Listener, error) {
 	logger := log.New("quic/listener")
-	ln, err := quic.ListenAddr(addr, tlsConf, &quic.Config{
-		EnableDatagrams: true,
-	})
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve listen address: %w", err)
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
 		return nil, err
 	}
+
+	// 🏷️ Marked so tunnel packets skip the exit node routing table
+	if err := setMark(udpConn, iface.FirewallMark); err != nil {
+		logger.Debugf("Could not mark the QUIC socket, exit nodes unavailable: %v", err)
+	}
+
+	tr := &quic.Transport{Conn: udpConn}
+	ln, err := tr.Listen(tlsConf, peer.QUICConfig())
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+
+	// 🕳️ Outbound dials share the listener socket, so the NAT mapping peers
+	// observe for us is the one hole punching opens
+	peer.SetTransport(tr)
+
 	logger.Infof("Listening for QUIC connections on %s", addr)
 	return ln, nil
 }
 
+// ListenRelay accepts connections that peers make to us through a relay,
+// and lets outbound dials use relays too.
+func ListenRelay(tlsConf *tls.Config, registry *peer.Registry) (*quic.Listener, error) {
+	tr := &quic.Transport{Conn: registry.RelayPacketConn()}
+	ln, err := tr.Listen(tlsConf, peer.QUICConfig())
+	if err != nil {
+		return nil, fmt.Errorf("listen on relay transport: %w", err)
+	}
+	peer.SetRelayTransport(tr)
+	return ln, nil
+}
+
 func AcceptLoop(
 	ln quic.Listener,
-	tracker *peer.LivenessTracker,
 	routes *netgraph.RouteTable,
 	registry *peer.Registry,
 	inbound *forward.Inbound,
@@ -59,6 +91,13 @@ func AcceptLoop(
 		// SHA256 fingerprint
 		fp := FingerprintCertificate(peerCert.Raw)
 
+		// 🚫 Refuse revoked keys even when the TLS config could not
+		if crypto.IsRevoked(peerCert) {
+			logger.Warnf("Rejecting revoked peer %s from %s", fp, sess.RemoteAddr())
+			_ = sess.CloseWithError(0, "peer key revoked")
+			continue
+		}
+
 		logger.Infof("Peer fingerprint: %s", fp)
 
 		// 🧠 NEW: Generate random TieBreakerNonce
@@ -67,16 +106,15 @@ func AcceptLoop(
 		// 🧠 Pass the nonce into registry.Add
 		registry.Add(fp, sess, myNonce)
 
-		go handleSession(sess, inbound, fp)
+		go handleSession(sess, registry, inbound, fp, myNonce)
 	}
 }
 
 func FingerprintCertificate(cert []byte) string {
-	sum := sha256.Sum256(cert)
-	return hex.EncodeToString(sum[:])
+	return crypto.Fingerprint(cert)
 }
 
-func handleSession(sess quic.Connection, inbound *forward.Inbound, fingerprint string) {
+func handleSession(sess quic.Connection, registry *peer.Registry, inbound *forward.Inbound, fingerprint string, myNonce uint64) {
 	logger := log.New("quic/session")
 
 	// Accept the first control stream
@@ -87,27 +125,16 @@ func handleSession(sess quic.Connection, inbound *forward.Inbound, fingerprint s
 	}
 	logger.Infof("Accepted control stream (id=%d)", controlStream.StreamID())
 
-	// 🧠 Immediately send Hello with my nonce (generate one)
-	myNonce := rand.Uint64()
+	// 🧠 Immediately send Hello with the nonce registered for this session
 	err = control.SendHello(controlStream, myNonce)
 	if err != nil {
 		logger.Errorf("Failed to send Hello on incoming control stream: %v", err)
 		return
 	}
 
-	// 🧠 Immediately announce exported routes
-	for netName, netCfg := range control.GetNetConfig() {
-		if !netCfg.Export {
-			continue
-		}
-		err := control.SendRouteAnnounce(controlStream, netName, []string{netCfg.Prefix})
-		if err != nil {
-			logger.Warnf("Failed to announce route for network %s: %v", netName, err)
-		}
-	}
-
-	// 🧠 VERY IMPORTANT: Start control logic
-	go peer.HandleControlStream(sess, controlStream, fingerprint)
+	// 🧠 VERY IMPORTANT: Start control logic, which announces routes once
+	// the peer's Hello (and, for secret networks, its proof) is in
+	go registry.HandleControlStream(sess, controlStream, fingerprint)
 
 	// Keep accepting further raw streams
 	for {
@@ -117,16 +144,16 @@ func handleSession(sess quic.Connection, inbound *forward.Inbound, fingerprint s
 			return
 		}
 
-		go handleRawStream(stream, inbound)
+		go handleRawStream(stream, inbound, fingerprint)
 	}
 }
 
-func handleRawStream(stream quic.Stream, inbound *forward.Inbound) {
+func handleRawStream(stream quic.Stream, inbound *forward.Inbound, fingerprint string) {
 	logger := log.New("quic/raw")
 	logger.Debugf("Raw stream accepted (id=%d)", stream.StreamID())
 
 	if inbound != nil {
-		go inbound.HandleRawStream(stream)
+		go inbound.HandleRawStream(stream, fingerprint)
 	} else {
 		logger.Warnf("Inbound handler not configured, dropping stream")
 		stream.CancelRead(0)
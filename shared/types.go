@@ -5,4 +5,45 @@ import "time"
 type PeerState struct {
 	ID       string
 	LastSeen time.Time
+
+	// Configuration and connection state.
+	Name         string
+	Address      string // configured dial addresses
+	Endpoint     string // configured address the current outbound connection was dialed through
+	Remote       string // current remote address of the connection
+	Direction    string // "inbound" or "outbound"
+	Connected    bool
+	ConnectedAt  time.Time
+	Disabled     bool
+	Discovered   bool     // learned through gossip rather than configured
+	Capabilities uint32   // negotiated with the peer in Hello
+	Networks     []string // networks its CA-issued certificate authorizes, empty = any
+	ObservedAddr string   // our reflexive address as reported by the peer
+	RelayVia     string   // fingerprint of the relay carrying the connection, if any
+	ExitNetworks []string // networks the peer offers us an exit on
+	Subnets      []string // subnets the peer routes for us
+
+	// Control-plane round trip measured with keepalive echoes.
+	RTT    time.Duration
+	Jitter time.Duration
+
+	// Transport statistics reported by QUIC, when available.
+	QUICRTT          time.Duration
+	CongestionWindow uint64
+	PacketsSent      uint64
+	PacketsLost      uint64
+
+	// Data-plane counters and rates (bytes per second).
+	BytesSent     uint64
+	BytesReceived uint64
+	TxRate        float64
+	RxRate        float64
+}
+
+// LossRatio returns the fraction of QUIC packets declared lost.
+func (p PeerState) LossRatio() float64 {
+	if p.PacketsSent == 0 {
+		return 0
+	}
+	return float64(p.PacketsLost) / float64(p.PacketsSent)
 }
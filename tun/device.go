@@ -14,17 +14,33 @@ import (
 type Device struct {
 	iface *water.Interface
 	name  string
+	tap   bool
 	log   *log.Logger
 }
 
 func Open(cidr string, nodeID string) (*Device, error) {
+	return open(water.TUN, "vibepn", cidr, nodeID)
+}
+
+// OpenTAP creates a layer-2 device: reads and writes carry Ethernet
+// frames instead of IP packets.
+func OpenTAP(cidr string, nodeID string) (*Device, error) {
+	return open(water.TAP, "vibetap", cidr, nodeID)
+}
+
+func open(kind water.DeviceType, prefix, cidr, nodeID string) (*Device, error) {
 	config := water.Config{
-		DeviceType: water.TUN,
+		DeviceType: kind,
+	}
+	tap := kind == water.TAP
+	label := "TUN"
+	if tap {
+		label = "TAP"
 	}
 
 	iface, err := water.New(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create TUN device: %w", err)
+		return nil, fmt.Errorf("failed to create %s device: %w", label, err)
 	}
 
 	base := iface.Name()
@@ -32,7 +48,7 @@ func Open(cidr string, nodeID string) (*Device, error) {
 	// Hash nodeID to create deterministic suffix
 	h := sha256.Sum256([]byte(nodeID))
 	suffix := hex.EncodeToString(h[:])[:6]
-	newName := fmt.Sprintf("vibepn-%s", suffix)
+	newName := fmt.Sprintf("%s-%s", prefix, suffix)
 
 	if err := renameInterface(base, newName); err != nil {
 		return nil, fmt.Errorf("failed to rename %s to %s: %w", base, newName, err)
@@ -41,10 +57,11 @@ func Open(cidr string, nodeID string) (*Device, error) {
 	dev := &Device{
 		iface: iface,
 		name:  newName,
+		tap:   tap,
 		log:   log.New("tun/" + newName),
 	}
 
-	dev.log.Infof("Created TUN device %s (from %s)", newName, base)
+	dev.log.Infof("Created %s device %s (from %s)", label, newName, base)
 
 	if err := dev.configureIP(cidr); err != nil {
 		return nil, fmt.Errorf("failed to configure IP: %w", err)
@@ -58,13 +75,17 @@ func renameInterface(oldName, newName string) error {
 	return cmd.Run()
 }
 
+// configureIP assigns cidr, if any, and brings the device up. Leased
+// networks start without an address.
 func (d *Device) configureIP(cidr string) error {
-	cmd := exec.Command("ip", "addr", "add", cidr, "dev", d.name)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to assign IP: %w", err)
+	if cidr != "" {
+		cmd := exec.Command("ip", "addr", "add", cidr, "dev", d.name)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to assign IP: %w", err)
+		}
 	}
 
-	cmd = exec.Command("ip", "link", "set", "up", "dev", d.name)
+	cmd := exec.Command("ip", "link", "set", "up", "dev", d.name)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to bring interface up: %w", err)
 	}
@@ -73,6 +94,24 @@ func (d *Device) configureIP(cidr string) error {
 	return nil
 }
 
+// Readdress moves the device from oldCIDR to newCIDR, adding the new
+// address before dropping the old one. Either may be empty, to only add
+// or only remove an address.
+func (d *Device) Readdress(oldCIDR, newCIDR string) error {
+	if newCIDR != "" {
+		if out, err := exec.Command("ip", "addr", "add", newCIDR, "dev", d.name).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to assign IP %s: %w: %s", newCIDR, err, out)
+		}
+	}
+	if oldCIDR != "" {
+		if out, err := exec.Command("ip", "addr", "del", oldCIDR, "dev", d.name).CombinedOutput(); err != nil {
+			d.log.Warnf("Failed to remove old IP %s: %v: %s", oldCIDR, err, out)
+		}
+	}
+	d.log.Infof("Moved %s from %s to %s", d.name, oldCIDR, newCIDR)
+	return nil
+}
+
 func (d *Device) Read(buf []byte) (int, error) {
 	return d.iface.Read(buf)
 }
@@ -88,3 +127,8 @@ func (d *Device) Close() error {
 func (d *Device) Name() string {
 	return d.name
 }
+
+// TAP reports whether the device carries Ethernet frames.
+func (d *Device) TAP() bool {
+	return d.tap
+}